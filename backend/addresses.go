@@ -5,6 +5,9 @@ type AddressesBackend interface {
 	GetAddress(user, id string) (*Address, error)
 	// List all addresses owned by a user.
 	ListAddresses(user string) ([]*Address, error)
+	// Get an address by its e-mail, regardless of its owner. Returns the ID of
+	// the user owning it.
+	GetAddressByEmail(email string) (string, *Address, error)
 	// Create a new address.
 	InsertAddress(user string, address *Address) (*Address, error)
 	// Update an existing address.
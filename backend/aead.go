@@ -0,0 +1,362 @@
+package backend
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// AEAD encrypted data packets are defined in draft-ietf-openpgp-rfc4880bis
+// section 5.16. Only EAX is supported, OCB is not implemented.
+
+// EAX AEAD algorithm, see draft-ietf-openpgp-rfc4880bis section 9.6.
+const aeadEAX = 1
+
+const (
+	aeadTagSize = 16
+	eaxNonceSize = 16
+	// Chunks are limited to 4 MiB, as they're buffered
+	aeadMaxChunkSizeByte = 16
+)
+
+// Read an OpenPGP new format packet length. Partial lengths are only returned
+// for packet bodies.
+func readNewLength(br *bufio.Reader) (length int64, partial bool, err error) {
+	b, err := br.ReadByte()
+	if err != nil {
+		return
+	}
+
+	switch {
+	case b < 192:
+		length = int64(b)
+	case b < 224:
+		var b2 byte
+		if b2, err = br.ReadByte(); err != nil {
+			return
+		}
+		length = (int64(b)-192)<<8 + int64(b2) + 192
+	case b < 255:
+		length = 1 << (b & 0x1f)
+		partial = true
+	default:
+		buf := make([]byte, 4)
+		if _, err = io.ReadFull(br, buf); err != nil {
+			return
+		}
+		length = int64(binary.BigEndian.Uint32(buf))
+	}
+	return
+}
+
+// Reads the body of a new format packet, which may have partial lengths.
+type packetBodyReader struct {
+	br *bufio.Reader
+	remaining int64
+	partial bool
+}
+
+func (r *packetBodyReader) Read(b []byte) (int, error) {
+	for r.remaining == 0 {
+		if !r.partial {
+			return 0, io.EOF
+		}
+
+		var err error
+		if r.remaining, r.partial, err = readNewLength(r.br); err != nil {
+			return 0, err
+		}
+	}
+
+	if int64(len(b)) > r.remaining {
+		b = b[:r.remaining]
+	}
+	n, err := r.br.Read(b)
+	r.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// An AEAD encrypted data packet.
+type aeadEncrypted struct {
+	// The packet header, version, cipher and AEAD algorithms and chunk size,
+	// which are part of the associated data of every chunk.
+	prefix []byte
+	chunkSize int
+	iv []byte
+	contents io.Reader
+}
+
+// Read an AEAD encrypted data packet, whose tag has already been read.
+func readAeadEncrypted(br *bufio.Reader) (*aeadEncrypted, error) {
+	length, partial, err := readNewLength(br)
+	if err != nil {
+		return nil, err
+	}
+	contents := &packetBodyReader{br: br, remaining: length, partial: partial}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(contents, header); err != nil {
+		return nil, err
+	}
+	if header[0] != 1 {
+		return nil, errors.New("Unsupported AEAD encrypted data packet version")
+	}
+	if header[2] != aeadEAX {
+		return nil, errors.New("Unsupported AEAD algorithm, only EAX is supported")
+	}
+	if header[3] > aeadMaxChunkSizeByte {
+		return nil, errors.New("AEAD chunk size is too large")
+	}
+
+	iv := make([]byte, eaxNonceSize)
+	if _, err := io.ReadFull(contents, iv); err != nil {
+		return nil, err
+	}
+
+	return &aeadEncrypted{
+		prefix: append([]byte{0xc0 | aeadEncryptedPacketTag}, header...),
+		chunkSize: 1 << (header[3] + 6),
+		iv: iv,
+		contents: contents,
+	}, nil
+}
+
+// Decrypt the packet. Chunks are authenticated before being returned, and
+// reading the whole data returns an error if it has been truncated.
+func (pkt *aeadEncrypted) Decrypt(cipherFunc packet.CipherFunction, key []byte) (io.ReadCloser, error) {
+	if packet.CipherFunction(pkt.prefix[2]) != cipherFunc {
+		return nil, errors.New("Attachment key cipher function doesn't match encrypted data")
+	}
+
+	// AEAD requires a 128-bit block cipher
+	var block cipher.Block
+	switch cipherFunc {
+	case packet.CipherAES128, packet.CipherAES192, packet.CipherAES256:
+		var err error
+		if block, err = aes.NewCipher(key); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("Unsupported cipher function for AEAD encrypted data")
+	}
+
+	r := &aeadReader{
+		pkt: pkt,
+		eax: newEax(block),
+		chunk: make([]byte, pkt.chunkSize+2*aeadTagSize),
+	}
+
+	// Authenticate the first chunk now, to detect incorrect keys early
+	if err := r.readChunk(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+type aeadReader struct {
+	pkt *aeadEncrypted
+	eax *eax
+	chunk []byte
+	// Bytes read ahead, which may be the final tag
+	pending int
+	index uint64
+	total uint64
+	plaintext []byte
+	done bool
+	err error
+}
+
+func (r *aeadReader) nonce() []byte {
+	nonce := make([]byte, len(r.pkt.iv))
+	copy(nonce, r.pkt.iv)
+
+	var index [8]byte
+	binary.BigEndian.PutUint64(index[:], r.index)
+	for i, b := range index {
+		nonce[len(nonce)-len(index)+i] ^= b
+	}
+	return nonce
+}
+
+func (r *aeadReader) associatedData(final bool) []byte {
+	ad := make([]byte, len(r.pkt.prefix)+16)
+	n := copy(ad, r.pkt.prefix)
+	binary.BigEndian.PutUint64(ad[n:], r.index)
+	if !final {
+		return ad[:n+8]
+	}
+	binary.BigEndian.PutUint64(ad[n+8:], r.total)
+	return ad
+}
+
+// Read and authenticate the next chunk. The final tag is checked after the
+// last chunk.
+func (r *aeadReader) readChunk() error {
+	// A chunk and its tag can be followed by the final tag
+	n, err := io.ReadFull(r.pkt.contents, r.chunk[r.pending:])
+	n += r.pending
+	last := err == io.EOF || err == io.ErrUnexpectedEOF
+	if err != nil && !last {
+		return err
+	}
+
+	end := n
+	if last {
+		if n < aeadTagSize {
+			return ErrAttachmentIntegrity
+		}
+		end -= aeadTagSize
+	} else {
+		end -= aeadTagSize
+		r.pending = aeadTagSize
+	}
+
+	r.plaintext = nil
+	if end > 0 {
+		plaintext, err := r.eax.open(r.nonce(), r.chunk[:end], r.associatedData(false))
+		if err == errEaxAuthentication && r.index == 0 {
+			return ErrAttachmentKeyIncorrect
+		} else if err != nil {
+			return ErrAttachmentIntegrity
+		}
+
+		r.plaintext = plaintext
+		r.total += uint64(len(plaintext))
+		r.index++
+	}
+
+	if last {
+		if _, err := r.eax.open(r.nonce(), r.chunk[end:n], r.associatedData(true)); err != nil {
+			return ErrAttachmentIntegrity
+		}
+		r.done = true
+	} else {
+		copy(r.chunk, r.chunk[end:n])
+	}
+	return nil
+}
+
+func (r *aeadReader) Read(b []byte) (int, error) {
+	for len(r.plaintext) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		r.err = r.readChunk()
+	}
+
+	n := copy(b, r.plaintext)
+	r.plaintext = r.plaintext[n:]
+	return n, nil
+}
+
+// Check the remaining chunks and the final tag.
+func (r *aeadReader) Close() error {
+	_, err := io.Copy(ioutil.Discard, r)
+	return err
+}
+
+var errEaxAuthentication = errors.New("EAX authentication failed")
+
+// EAX mode, see "The EAX Mode of Operation" by Bellare, Rogaway and Wagner.
+// Only decryption is implemented.
+type eax struct {
+	block cipher.Block
+	// CMAC subkeys
+	k1, k2 []byte
+}
+
+// Double a value in GF(2^128), as defined for CMAC.
+func gfDouble(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i := range b {
+		out[i] = b[i] << 1
+		if i+1 < len(b) {
+			out[i] |= b[i+1] >> 7
+		}
+	}
+	if b[0]&0x80 != 0 {
+		out[len(out)-1] ^= 0x87
+	}
+	return out
+}
+
+func newEax(block cipher.Block) *eax {
+	l := make([]byte, block.BlockSize())
+	block.Encrypt(l, l)
+
+	k1 := gfDouble(l)
+	return &eax{block: block, k1: k1, k2: gfDouble(k1)}
+}
+
+// XOR b into dst.
+func xorBytes(dst, b []byte) {
+	for i := range dst {
+		dst[i] ^= b[i]
+	}
+}
+
+// Compute the OMAC of data, tweaked with t.
+func (e *eax) omac(t byte, data []byte) []byte {
+	size := e.block.BlockSize()
+
+	mac := make([]byte, size)
+	mac[size-1] = t
+	if len(data) == 0 {
+		xorBytes(mac, e.k1)
+		e.block.Encrypt(mac, mac)
+		return mac
+	}
+	e.block.Encrypt(mac, mac)
+
+	for len(data) > size {
+		xorBytes(mac, data[:size])
+		e.block.Encrypt(mac, mac)
+		data = data[size:]
+	}
+
+	last := make([]byte, size)
+	n := copy(last, data)
+	k := e.k1
+	if n < size {
+		last[n] = 0x80
+		k = e.k2
+	}
+	xorBytes(mac, last)
+	xorBytes(mac, k)
+	e.block.Encrypt(mac, mac)
+	return mac
+}
+
+// Authenticate and decrypt ciphertext, followed by its tag.
+func (e *eax) open(nonce, ciphertext, ad []byte) ([]byte, error) {
+	if len(ciphertext) < aeadTagSize {
+		return nil, errEaxAuthentication
+	}
+	tag := ciphertext[len(ciphertext)-aeadTagSize:]
+	ciphertext = ciphertext[:len(ciphertext)-aeadTagSize]
+
+	n := e.omac(0, nonce)
+	expected := e.omac(2, ciphertext)
+	xorBytes(expected, n)
+	xorBytes(expected, e.omac(1, ad))
+	if subtle.ConstantTimeCompare(expected[:aeadTagSize], tag) != 1 {
+		return nil, errEaxAuthentication
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCTR(e.block, n).XORKeyStream(plaintext, ciphertext)
+	return plaintext, nil
+}
@@ -1,12 +1,17 @@
 package backend
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/base64"
 	"errors"
+	"io"
 	"io/ioutil"
 	"net/textproto"
+	"strings"
 
+	"golang.org/x/crypto/openpgp/armor"
+	pgperrors "golang.org/x/crypto/openpgp/errors"
 	"golang.org/x/crypto/openpgp/packet"
 )
 
@@ -16,8 +21,13 @@ type AttachmentsBackend interface {
 	ListAttachments(user, msg string) ([]*Attachment, error)
 	// Get an attachment content.
 	ReadAttachment(user, id string) (*Attachment, []byte, error)
+	// Open an attachment content for reading. The caller must close the
+	// returned reader.
+	OpenAttachment(user, id string) (*Attachment, io.ReadCloser, error)
 	// Insert a new attachment.
 	InsertAttachment(user string, attachment *Attachment, contents []byte) (*Attachment, error)
+	// Insert a new attachment, reading its content from r.
+	InsertAttachmentFrom(user string, attachment *Attachment, r io.Reader) (*Attachment, error)
 	// Delete an attachment.
 	DeleteAttachment(user, id string) error
 }
@@ -41,15 +51,129 @@ type AttachmentKey struct {
 }
 
 // Decrypt a symmetrically encrypted packet with this key.
-func (at *AttachmentKey) Decrypt(encrypted []byte) (decrypted []byte, err error) {
-	pkt, err := packet.Read(bytes.NewReader(encrypted))
+func (at *AttachmentKey) Decrypt(encrypted []byte) ([]byte, error) {
+	r, err := at.DecryptReader(bytes.NewReader(encrypted))
 	if err != nil {
-		return
+		return nil, err
 	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// Cipher functions supported to decrypt attachments, indexed by their name.
+// See https://godoc.org/golang.org/x/crypto/openpgp/packet#CipherFunction
+var attachmentCipherFunctions = map[string]packet.CipherFunction{
+	"3des": packet.Cipher3DES,
+	"tripledes": packet.Cipher3DES,
+	"cast5": packet.CipherCAST5,
+	"aes128": packet.CipherAES128,
+	"aes192": packet.CipherAES192,
+	"aes256": packet.CipherAES256,
+}
 
-	encPkt, ok := pkt.(*packet.SymmetricallyEncrypted)
+// Tag of AEAD encrypted data packets, not supported by the openpgp package.
+const aeadEncryptedPacketTag = 20
+
+var (
+	ErrAttachmentKeyIncorrect = errors.New("Attachment key doesn't match encrypted data")
+	ErrAttachmentIntegrity = errors.New("Attachment integrity check failed")
+)
+
+// A reader for decrypted data. The integrity of the data is checked when EOF
+// is reached, so that corrupted data is never considered complete.
+type decryptedReader struct {
+	io.Reader
+	closer io.Closer
+	closed bool
+}
+
+func (r *decryptedReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if err == io.EOF {
+		if closeErr := r.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return n, err
+}
+
+func (r *decryptedReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	if err := r.closer.Close(); err != nil {
+		return ErrAttachmentIntegrity
+	}
+	return nil
+}
+
+// An encrypted data packet, either SymmetricallyEncrypted or AEAD encrypted.
+type encryptedData interface {
+	Decrypt(cipherFunc packet.CipherFunction, key []byte) (io.ReadCloser, error)
+}
+
+// Get the tag of an OpenPGP packet from its first byte.
+func packetTag(first byte) byte {
+	if first&0x40 != 0 {
+		// New format
+		return first & 0x3f
+	}
+	return (first >> 2) & 0x0f
+}
+
+// Read the encrypted data packet. Key packets are skipped.
+func readEncryptedData(r io.Reader) (encryptedData, error) {
+	br := bufio.NewReader(r)
+	for {
+		first, err := br.Peek(1)
+		if err == io.EOF {
+			return nil, errors.New("Encrypted data doesn't contain any encrypted data packet")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if first[0]&0x80 != 0 && packetTag(first[0]) == aeadEncryptedPacketTag {
+			br.ReadByte()
+			return readAeadEncrypted(br)
+		}
+
+		pkt, err := packet.Read(br)
+		if err != nil {
+			return nil, err
+		}
+
+		switch pkt := pkt.(type) {
+		case *packet.SymmetricallyEncrypted:
+			// Data without a modification detection code could have been
+			// tampered with, it isn't decrypted
+			if !pkt.MDC {
+				return nil, errors.New("Attachment is not integrity protected")
+			}
+			return pkt, nil
+		case *packet.EncryptedKey, *packet.SymmetricKeyEncrypted:
+			// Session keys are already known
+		default:
+			return nil, errors.New("Packet is not encrypted data")
+		}
+	}
+}
+
+// Decrypt an encrypted data packet read from r with this key. The caller must
+// close the returned reader. Reading the whole data returns an error if its
+// integrity cannot be verified.
+//
+// Both SymmetricallyEncrypted packets with a modification detection code and
+// AEAD encrypted data packets using EAX are supported. SymmetricallyEncrypted
+// packets without a modification detection code are refused, so attachments
+// encrypted by legacy clients without integrity protection cannot be sent in
+// clear text.
+func (at *AttachmentKey) DecryptReader(encrypted io.Reader) (decrypted io.ReadCloser, err error) {
+	cipherFunc, ok := attachmentCipherFunctions[strings.ToLower(at.Algo)]
 	if !ok {
-		err = errors.New("Packet is not SymmetricallyEncrypted")
+		err = errors.New("Unsupported cipher function: "+at.Algo)
 		return
 	}
 
@@ -57,23 +181,24 @@ func (at *AttachmentKey) Decrypt(encrypted []byte) (decrypted []byte, err error)
 	if err != nil {
 		return
 	}
+	if len(key) != cipherFunc.KeySize() {
+		err = errors.New("Invalid key length for cipher function "+at.Algo)
+		return
+	}
 
-	// TODO: support more cipher functions
-	// See https://godoc.org/golang.org/x/crypto/openpgp/packet#CipherFunction
-	var cipherFunc packet.CipherFunction
-	switch at.Algo {
-	case "aes256":
-		cipherFunc = packet.CipherAES256
-	default:
-		err = errors.New("Unsupported cipher function: "+at.Algo)
+	encPkt, err := readEncryptedData(encrypted)
+	if err != nil {
 		return
 	}
 
 	r, err := encPkt.Decrypt(cipherFunc, key)
+	if err == pgperrors.ErrKeyIncorrect {
+		err = ErrAttachmentKeyIncorrect
+		return
+	}
 	if err != nil {
 		return
 	}
-	defer r.Close()
 
 	pr := packet.NewReader(r)
 	for {
@@ -82,14 +207,165 @@ func (at *AttachmentKey) Decrypt(encrypted []byte) (decrypted []byte, err error)
 			break
 		}
 
-		literal, ok := pkt.(*packet.LiteralData)
-		if !ok {
+		// Compressed packets contain other packets
+		if compressed, ok := pkt.(*packet.Compressed); ok {
+			if err := pr.Push(compressed.Body); err != nil {
+				break
+			}
 			continue
 		}
 
-		return ioutil.ReadAll(literal.Body)
+		if literal, ok := pkt.(*packet.LiteralData); ok {
+			return &decryptedReader{Reader: literal.Body, closer: r}, nil
+		}
 	}
 
+	r.Close()
 	err = errors.New("Encrypted data doesn't contain any LiteralData")
 	return
 }
+
+// OpenPGP packet tags of packets containing session keys, see RFC 4880 section
+// 4.3.
+const (
+	encryptedKeyPacketTag = 1
+	symmetricKeyPacketTag = 3
+)
+
+// Read a packet with a definite length. Returns the whole packet, including its
+// header.
+func readPacket(br *bufio.Reader, first byte) ([]byte, error) {
+	header := []byte{first}
+
+	var length int
+	if first&0x40 != 0 {
+		// New format
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		header = append(header, b)
+
+		switch {
+		case b < 192:
+			length = int(b)
+		case b < 224:
+			b2, err := br.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			header = append(header, b2)
+			length = (int(b)-192)<<8 + int(b2) + 192
+		case b == 255:
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(br, buf); err != nil {
+				return nil, err
+			}
+			header = append(header, buf...)
+			length = int(buf[0])<<24 | int(buf[1])<<16 | int(buf[2])<<8 | int(buf[3])
+		default:
+			return nil, errors.New("Partial length key packets are not allowed")
+		}
+	} else {
+		// Old format
+		var n int
+		switch first & 0x03 {
+		case 0:
+			n = 1
+		case 1:
+			n = 2
+		case 2:
+			n = 4
+		default:
+			return nil, errors.New("Indeterminate length key packets are not allowed")
+		}
+
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, err
+		}
+		header = append(header, buf...)
+		for _, b := range buf {
+			length = length<<8 | int(b)
+		}
+	}
+
+	packet := make([]byte, len(header)+length)
+	copy(packet, header)
+	if _, err := io.ReadFull(br, packet[len(header):]); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// Split an OpenPGP message into key packets and data packets. Armored messages
+// are decoded.
+func SplitPgpMessage(r io.Reader) (keyPackets []byte, data io.Reader, err error) {
+	br := bufio.NewReader(r)
+
+	if prefix, _ := br.Peek(len("-----BEGIN")); string(prefix) == "-----BEGIN" {
+		var block *armor.Block
+		if block, err = armor.Decode(br); err != nil {
+			return
+		}
+		br = bufio.NewReader(block.Body)
+	}
+
+	for {
+		var first byte
+		if first, err = br.ReadByte(); err != nil {
+			return
+		}
+		if first&0x80 == 0 {
+			err = errors.New("Invalid OpenPGP packet")
+			return
+		}
+
+		if tag := packetTag(first); tag != encryptedKeyPacketTag && tag != symmetricKeyPacketTag {
+			if err = br.UnreadByte(); err != nil {
+				return
+			}
+			data = br
+			return
+		}
+
+		var packet []byte
+		if packet, err = readPacket(br, first); err != nil {
+			return
+		}
+		keyPackets = append(keyPackets, packet...)
+	}
+}
+
+// Encrypt an attachment. Key packets are stored in the returned attachment,
+// data packets are returned.
+func EncryptAttachment(att *Attachment, data io.Reader, publicKey string) (*Attachment, []byte, error) {
+	var b bytes.Buffer
+	w, err := EncryptToPublicKey(&b, publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.Copy(w, data); err != nil {
+		return nil, nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	keyPackets, dataPackets, err := SplitPgpMessage(&b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encrypted := &Attachment{
+		Name: att.Name,
+		MIMEType: att.MIMEType,
+		KeyPackets: base64.StdEncoding.EncodeToString(keyPackets),
+	}
+
+	var out bytes.Buffer
+	if _, err := out.ReadFrom(dataPackets); err != nil {
+		return nil, nil, err
+	}
+	return encrypted, out.Bytes(), nil
+}
@@ -0,0 +1,206 @@
+package backend_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"testing"
+
+	"github.com/emersion/neutron/backend"
+)
+
+// Data packets and session keys of attachments encrypted with GnuPG.
+var attachmentKeyTests = []struct{
+	name string
+	key *backend.AttachmentKey
+	data string
+}{
+	{
+		name: "3DES",
+		key: &backend.AttachmentKey{Algo: "3des", Key: "BbrMrK4qzwEqr1u2u7LpAKsrtxtZfZL5"},
+		data: "0kkBWm5sNMBpT5G/Fe0C7bkh99RdyR73jpMPS2tbKemSJcDCn0EHIHsG3wb5tTUDba7UAKGyfYtKstE415VaiyeyQBxjgGGyqYBj",
+	},
+	{
+		name: "CAST5",
+		key: &backend.AttachmentKey{Algo: "cast5", Key: "2mLU7LHE3z/H/q4ja14upg=="},
+		data: "0kkBs63QWuJ2pjZZWN1JwwxsUNZK2T3HDaBiMVvVfWq5b7DDvcU+zdSrh1iacuVqtfHsSZFN91lx/L4QF6LGamTNlVEKFAOgNdm4",
+	},
+	{
+		name: "AES-128",
+		key: &backend.AttachmentKey{Algo: "aes128", Key: "WpKfu+9pwQeYuHxrFvj/8Q=="},
+		data: "0lEBkS0hsrok954ryOzembzBfuoGbyYMh0S5mXQZ8TJrkhvanAtAdI+NvfyQeRZOGtm5e4vWPTRu7OATTf1Nyi3IGPlSYReQ+Cb3iXfRun2eAc0=",
+	},
+	{
+		name: "AES-192",
+		key: &backend.AttachmentKey{Algo: "aes192", Key: "rPAOy13OJvoVv5SA9NpjNeAmR2Ou9/H1"},
+		data: "0lEBPggBc6ctr181+uHxDQ2vdeoefDaA3w74jwYBO+vYdWqT5pNf7htzrnx6aeVzvFbIS7Q1XfAKoMiJUOEh+8nPBI6lEinWHPGLVrIq3z/6IaE=",
+	},
+	{
+		name: "AES-256",
+		key: &backend.AttachmentKey{Algo: "aes256", Key: "K2IeR5RuoPaXFdUCQHsqZOwwlM3Zn7MLIbqblnqbyVI="},
+		data: "0lEBcLbIw72sBv34OgHUoSbqfkOoJbR0+XddUqKTbkGyQM5xV+epmX4gT0jzrLOc7JIz9zlk+j3mw3xsg9RQzxnIr/Vo1egGLrYqWz5nGon0cGk=",
+	},
+	{
+		name: "AES-256 uncompressed",
+		key: &backend.AttachmentKey{Algo: "AES256", Key: "Zvn8Wn1FtXptu2NCeLQTK7aE04tt6nO+wMnnbkaGWw4="},
+		data: "0k0B20bGH8cdg2pMoDz/98aabteVlSTaWRAIKh0XrQK8wj/EPvprlLqIx3yB6ItCkwZj+S8fyFcETjahTTfZyuZlKmUz7skdGySyVkZzOQ==",
+	},
+}
+
+const attachmentPlaintext = "Hello, attachment!\n"
+
+func decodeAttachmentData(t *testing.T, data string) []byte {
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestAttachmentKey_Decrypt(t *testing.T) {
+	for _, test := range attachmentKeyTests {
+		decrypted, err := test.key.Decrypt(decodeAttachmentData(t, test.data))
+		if err != nil {
+			t.Errorf("Cannot decrypt %v attachment: %v", test.name, err)
+			continue
+		}
+
+		if string(decrypted) != attachmentPlaintext {
+			t.Errorf("Got %q instead of %q when decrypting %v attachment", decrypted, attachmentPlaintext, test.name)
+		}
+	}
+}
+
+func TestAttachmentKey_Decrypt_wrongKey(t *testing.T) {
+	test := attachmentKeyTests[4]
+	key := &backend.AttachmentKey{Algo: "aes256", Key: attachmentKeyTests[5].key.Key}
+
+	if _, err := key.Decrypt(decodeAttachmentData(t, test.data)); err != backend.ErrAttachmentKeyIncorrect {
+		t.Errorf("Expected %v, got %v", backend.ErrAttachmentKeyIncorrect, err)
+	}
+}
+
+func TestAttachmentKey_Decrypt_tampered(t *testing.T) {
+	test := attachmentKeyTests[4]
+
+	// Modify the last byte, which is part of the modification detection code
+	data := decodeAttachmentData(t, test.data)
+	data[len(data)-1] ^= 0xff
+
+	r, err := test.key.DecryptReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if _, err := ioutil.ReadAll(r); err != backend.ErrAttachmentIntegrity {
+		t.Errorf("Expected %v, got %v", backend.ErrAttachmentIntegrity, err)
+	}
+}
+
+func TestAttachmentKey_Decrypt_invalid(t *testing.T) {
+	tests := []struct{
+		name string
+		key *backend.AttachmentKey
+		data string
+	}{
+		{
+			name: "unsupported cipher",
+			key: &backend.AttachmentKey{Algo: "twofish", Key: attachmentKeyTests[4].key.Key},
+			data: attachmentKeyTests[4].data,
+		},
+		{
+			name: "invalid key length",
+			key: &backend.AttachmentKey{Algo: "aes128", Key: attachmentKeyTests[4].key.Key},
+			data: attachmentKeyTests[4].data,
+		},
+		{
+			name: "no integrity protection",
+			key: &backend.AttachmentKey{Algo: "cast5", Key: "lN8HyoRiCvsIKmUFfTXZvA=="},
+			data: "yTKqmn+bnaOPDfZ9g0k8A/XeTOmHierkaBrwZVaVZpZePnecqeqM1ulL1pQD978bdId+kg==",
+		},
+		{
+			name: "truncated AEAD packet",
+			key: attachmentKeyTests[4].key,
+			data: base64.StdEncoding.EncodeToString([]byte{0xd4, 0x04, 0x01, 0x09, 0x01, 0x10}),
+		},
+		{
+			name: "AEAD packet using OCB",
+			key: aeadAttachmentKey,
+			data: base64.StdEncoding.EncodeToString(append([]byte{0xd4, 0x13, 0x01, 0x07, 0x02, 0x0e}, make([]byte, 15)...)),
+		},
+		{
+			name: "AEAD packet with another cipher",
+			key: &backend.AttachmentKey{Algo: "aes256", Key: attachmentKeyTests[4].key.Key},
+			data: aeadAttachmentData,
+		},
+	}
+
+	for _, test := range tests {
+		if _, err := test.key.Decrypt(decodeAttachmentData(t, test.data)); err == nil {
+			t.Errorf("Expected an error when decrypting an attachment with %v", test.name)
+		}
+	}
+}
+
+// AEAD encrypted data packet using EAX, from draft-ietf-openpgp-rfc4880bis
+// appendix A.4.
+var aeadAttachmentKey = &backend.AttachmentKey{Algo: "aes128", Key: "hvHvuGlSMp8krNO/0OU0bQ=="}
+
+const (
+	aeadAttachmentData = "1EoBBwEOtzI3n3PEko3iX6z+ZRfsEF3BGoHcDLii9vPZABY4Slb8ghrhGujby0mGJlXeqI0GqBSGgBsP84e9LqsBPeEllYaQbqskdg=="
+	aeadAttachmentPlaintext = "Hello, world!\n"
+)
+
+func TestAttachmentKey_Decrypt_aead(t *testing.T) {
+	data := decodeAttachmentData(t, aeadAttachmentData)
+
+	// Streamed packets have partial body lengths
+	body := data[2:]
+	partial := []byte{0xd4, 0xe5}
+	partial = append(partial, body[:32]...)
+	partial = append(partial, 0xe5)
+	partial = append(partial, body[32:64]...)
+	partial = append(partial, byte(len(body)-64))
+	partial = append(partial, body[64:]...)
+
+	for name, data := range map[string][]byte{"definite": data, "partial": partial} {
+		decrypted, err := aeadAttachmentKey.Decrypt(data)
+		if err != nil {
+			t.Errorf("Cannot decrypt AEAD attachment with %v length: %v", name, err)
+			continue
+		}
+		if string(decrypted) != aeadAttachmentPlaintext {
+			t.Errorf("Got %q instead of %q when decrypting AEAD attachment with %v length", decrypted, aeadAttachmentPlaintext, name)
+		}
+	}
+}
+
+func TestAttachmentKey_Decrypt_aeadTampered(t *testing.T) {
+	tests := []struct{
+		name string
+		offset int
+		err error
+	}{
+		// The first chunk is authenticated when opening the attachment
+		{"chunk", 30, backend.ErrAttachmentKeyIncorrect},
+		{"final tag", -1, backend.ErrAttachmentIntegrity},
+	}
+
+	for _, test := range tests {
+		data := decodeAttachmentData(t, aeadAttachmentData)
+		if test.offset < 0 {
+			test.offset += len(data)
+		}
+		data[test.offset] ^= 0xff
+
+		if _, err := aeadAttachmentKey.Decrypt(data); err != test.err {
+			t.Errorf("Expected %v when the AEAD %v is modified, got %v", test.err, test.name, err)
+		}
+	}
+
+	wrongKey := &backend.AttachmentKey{Algo: "aes128", Key: attachmentKeyTests[2].key.Key}
+	if _, err := wrongKey.Decrypt(decodeAttachmentData(t, aeadAttachmentData)); err != backend.ErrAttachmentKeyIncorrect {
+		t.Errorf("Expected %v with the wrong key, got %v", backend.ErrAttachmentKeyIncorrect, err)
+	}
+}
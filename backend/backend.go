@@ -7,7 +7,10 @@ type Backend struct {
 	LabelsBackend
 	ConversationsBackend
 	SendBackend
+	ScheduleBackend
 	DomainsBackend
+	DomainsCheckBackend
+	DkimBackend
 	EventsBackend
 	UsersBackend
 	AddressesBackend
@@ -30,9 +33,18 @@ func (b *Backend) Set(backends ...interface{}) {
 		if send, ok := bkd.(SendBackend); ok {
 			b.SendBackend = send
 		}
+		if schedule, ok := bkd.(ScheduleBackend); ok {
+			b.ScheduleBackend = schedule
+		}
 		if domains, ok := bkd.(DomainsBackend); ok {
 			b.DomainsBackend = domains
 		}
+		if check, ok := bkd.(DomainsCheckBackend); ok {
+			b.DomainsCheckBackend = check
+		}
+		if dkim, ok := bkd.(DkimBackend); ok {
+			b.DkimBackend = dkim
+		}
 		if events, ok := bkd.(EventsBackend); ok {
 			b.EventsBackend = events
 		}
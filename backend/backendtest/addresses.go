@@ -0,0 +1,72 @@
+package backendtest
+
+import (
+	"testing"
+
+	"github.com/emersion/neutron/backend"
+)
+
+func testAddresses(t *testing.T, bkd *backend.Backend, opts *Options) {
+	skipUnless(t, bkd.AddressesBackend, "AddressesBackend")
+
+	if addrs, err := bkd.ListAddresses(opts.User); err != nil || len(addrs) != 0 {
+		t.Errorf("ListAddresses() = %v, %v, want no address", addrs, err)
+	}
+
+	a, err := bkd.InsertAddress(opts.User, &backend.Address{Email: "Alice@example.org", Status: 1})
+	if err != nil {
+		t.Fatal("InsertAddress() =", err)
+	}
+	b, _ := bkd.InsertAddress(opts.User, &backend.Address{Email: "alice@example.net"})
+	other, _ := bkd.InsertAddress("other", &backend.Address{Email: "bob@example.org"})
+	if a.ID == "" || a.ID == b.ID {
+		t.Errorf("InsertAddress() IDs = %q, %q, want unique IDs", a.ID, b.ID)
+	}
+
+	addrs, err := bkd.ListAddresses(opts.User)
+	if err != nil || len(addrs) != 2 || addrs[0].ID != a.ID || addrs[1].ID != b.ID {
+		t.Errorf("ListAddresses() = %v, %v, want addresses in insertion order", addrs, err)
+	}
+
+	if got, err := bkd.GetAddress(opts.User, a.ID); err != nil || got.Email != "Alice@example.org" {
+		t.Errorf("GetAddress() = %+v, %v", got, err)
+	}
+	if _, err := bkd.GetAddress(opts.User, other.ID); err == nil {
+		t.Error("GetAddress() with another user's address succeeded")
+	}
+
+	user, got, err := bkd.GetAddressByEmail("alice@EXAMPLE.org")
+	if err != nil || user != opts.User || got.ID != a.ID {
+		t.Errorf("GetAddressByEmail() = %q, %+v, %v, want case-insensitive match", user, got, err)
+	}
+	if user, _, _ := bkd.GetAddressByEmail("bob@example.org"); user != "other" {
+		t.Errorf("GetAddressByEmail() user = %q, want other", user)
+	}
+	if _, _, err := bkd.GetAddressByEmail("missing@example.org"); err == nil {
+		t.Error("GetAddressByEmail() with an unknown e-mail succeeded")
+	}
+
+	updated, err := bkd.UpdateAddress(opts.User, &backend.AddressUpdate{
+		Address: &backend.Address{ID: a.ID, DisplayName: "Alice", Status: 0},
+		DisplayName: true,
+	})
+	if err != nil || updated.DisplayName != "Alice" || updated.Status != 1 {
+		t.Errorf("UpdateAddress() = %+v, %v, want only DisplayName updated", updated, err)
+	}
+	if got, _ := bkd.GetAddress(opts.User, a.ID); got.DisplayName != "Alice" {
+		t.Errorf("GetAddress() after UpdateAddress() = %+v", got)
+	}
+
+	if err := bkd.DeleteAddress(opts.User, a.ID); err != nil {
+		t.Fatal("DeleteAddress() =", err)
+	}
+	if err := bkd.DeleteAddress(opts.User, a.ID); err == nil {
+		t.Error("DeleteAddress() with a deleted address succeeded")
+	}
+	if addrs, _ := bkd.ListAddresses(opts.User); len(addrs) != 1 || addrs[0].ID != b.ID {
+		t.Errorf("ListAddresses() after DeleteAddress() = %v", addrs)
+	}
+	if _, _, err := bkd.GetAddressByEmail("alice@example.org"); err == nil {
+		t.Error("GetAddressByEmail() with a deleted address succeeded")
+	}
+}
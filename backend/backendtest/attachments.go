@@ -0,0 +1,80 @@
+package backendtest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/emersion/neutron/backend"
+)
+
+// Check attachments IDs, regardless of their order.
+func equalAttachments(atts []*backend.Attachment, ids ...string) bool {
+	if len(atts) != len(ids) {
+		return false
+	}
+
+	want := map[string]bool{}
+	for _, id := range ids {
+		want[id] = true
+	}
+	for _, att := range atts {
+		if !want[att.ID] {
+			return false
+		}
+	}
+	return true
+}
+
+func testAttachments(t *testing.T, bkd *backend.Backend, opts *Options) {
+	skipUnless(t, bkd.AttachmentsBackend, "AttachmentsBackend")
+
+	a, err := bkd.InsertAttachment(opts.User, &backend.Attachment{MessageID: "msg", Name: "a.txt", MIMEType: "text/plain"}, []byte("hello"))
+	if err != nil {
+		t.Fatal("InsertAttachment() =", err)
+	}
+	if a.ID == "" || a.Size != 5 {
+		t.Errorf("InsertAttachment() = %+v, want an ID and size 5", a)
+	}
+	b, err := bkd.InsertAttachmentFrom(opts.User, &backend.Attachment{MessageID: "msg", Name: "b.txt"}, bytes.NewReader([]byte("world!")))
+	if err != nil || b.Size != 6 || b.ID == a.ID {
+		t.Fatalf("InsertAttachmentFrom() = %+v, %v", b, err)
+	}
+	bkd.InsertAttachment(opts.User, &backend.Attachment{MessageID: "other", Name: "c.txt"}, []byte("other"))
+
+	atts, err := bkd.ListAttachments(opts.User, "msg")
+	if err != nil || !equalAttachments(atts, a.ID, b.ID) {
+		t.Errorf("ListAttachments() = %v, %v, want the message's attachments", atts, err)
+	}
+
+	att, contents, err := bkd.ReadAttachment(opts.User, a.ID)
+	if err != nil || att.Name != "a.txt" || string(contents) != "hello" {
+		t.Errorf("ReadAttachment() = %+v, %q, %v", att, contents, err)
+	}
+	if _, _, err := bkd.ReadAttachment("other", a.ID); err == nil {
+		t.Error("ReadAttachment() with another user's attachment succeeded")
+	}
+
+	att, rc, err := bkd.OpenAttachment(opts.User, b.ID)
+	if err != nil {
+		t.Fatal("OpenAttachment() =", err)
+	}
+	contents, err = ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil || att.Name != "b.txt" || string(contents) != "world!" {
+		t.Errorf("OpenAttachment() = %+v, %q, %v", att, contents, err)
+	}
+
+	if err := bkd.DeleteAttachment(opts.User, a.ID); err != nil {
+		t.Fatal("DeleteAttachment() =", err)
+	}
+	if err := bkd.DeleteAttachment(opts.User, a.ID); err == nil {
+		t.Error("DeleteAttachment() with a deleted attachment succeeded")
+	}
+	if _, _, err := bkd.ReadAttachment(opts.User, a.ID); err == nil {
+		t.Error("ReadAttachment() with a deleted attachment succeeded")
+	}
+	if atts, _ := bkd.ListAttachments(opts.User, "msg"); !equalAttachments(atts, b.ID) {
+		t.Errorf("ListAttachments() after DeleteAttachment() = %v", atts)
+	}
+}
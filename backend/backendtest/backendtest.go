@@ -0,0 +1,88 @@
+// Checks that backends implement the interfaces of package backend with the
+// same semantics as the memory backend, apart from documented differences.
+package backendtest
+
+import (
+	"testing"
+
+	"github.com/emersion/neutron/backend"
+)
+
+// Creates a new empty backend for a test.
+type NewBackend func(t *testing.T) *backend.Backend
+
+// Describes the backend being tested. Boolean fields are known differences with
+// the memory backend's semantics, tests check the backend's behavior instead.
+type Options struct {
+	// The user owning data in tests, defaults to "backendtest". Backends must
+	// not require it to exist, except backends which only store data of logged
+	// in users: NewBackend must log it in.
+	User string
+	// The user's password, for backends whose users are managed elsewhere.
+	Password string
+
+	// Users are managed elsewhere: they cannot be inserted, only User can log
+	// in and passwords cannot be updated.
+	ExternalUsers bool
+	// Messages can only be inserted as drafts, their labels and flags are
+	// ignored and only their ID is returned. Tests insert messages and then
+	// move them with UpdateMessage.
+	DraftsOnly bool
+	// Messages are listed from the most recent to the oldest.
+	NewestFirst bool
+	// ListMessages without a label only lists messages in the inbox.
+	InboxByDefault bool
+	// Messages cannot be filtered by address.
+	NoAddressFilter bool
+	// Each message is a conversation. Conversation IDs are message IDs.
+	SingleMessageConversations bool
+	// Labels are folders: a message only has one label apart from Starred, and
+	// adding a label moves the message to it.
+	SingleLabel bool
+}
+
+var tests = []struct {
+	name string
+	run func(t *testing.T, bkd *backend.Backend, opts *Options)
+}{
+	{"Users", testUsers},
+	{"Domains", testDomains},
+	{"Dkim", testDkim},
+	{"Addresses", testAddresses},
+	{"Labels", testLabels},
+	{"Contacts", testContacts},
+	{"Keys", testKeys},
+	{"Attachments", testAttachments},
+	{"Messages", testMessages},
+	{"Conversations", testConversations},
+	{"Events", testEvents},
+}
+
+// Run all tests, each one with a new backend. Tests of interfaces which aren't
+// implemented by the backend are skipped.
+func Run(t *testing.T, newBackend NewBackend) {
+	RunOptions(t, newBackend, &Options{})
+}
+
+// Run all tests with a backend having known differences.
+func RunOptions(t *testing.T, newBackend NewBackend, opts *Options) {
+	if opts.User == "" {
+		o := *opts
+		o.User = "backendtest"
+		opts = &o
+	}
+
+	for _, test := range tests {
+		run := test.run
+		t.Run(test.name, func(t *testing.T) {
+			run(t, newBackend(t), opts)
+		})
+	}
+}
+
+// Skip the test if an interface isn't implemented.
+func skipUnless(t *testing.T, impl interface{}, name string) {
+	if impl == nil {
+		t.Skip(name + " isn't implemented")
+	}
+}
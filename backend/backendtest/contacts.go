@@ -0,0 +1,60 @@
+package backendtest
+
+import (
+	"testing"
+
+	"github.com/emersion/neutron/backend"
+)
+
+func testContacts(t *testing.T, bkd *backend.Backend, opts *Options) {
+	skipUnless(t, bkd.ContactsBackend, "ContactsBackend")
+
+	a, err := bkd.InsertContact(opts.User, &backend.Contact{Name: "Bob", Email: "bob@example.org"})
+	if err != nil {
+		t.Fatal("InsertContact() =", err)
+	}
+	b, _ := bkd.InsertContact(opts.User, &backend.Contact{Name: "Carol", Email: "carol@example.org"})
+	bkd.InsertContact("other", &backend.Contact{Name: "Dave", Email: "dave@example.org"})
+	if a.ID == "" || a.ID == b.ID {
+		t.Errorf("InsertContact() IDs = %q, %q, want unique IDs", a.ID, b.ID)
+	}
+
+	contacts, err := bkd.ListContacts(opts.User)
+	if err != nil || len(contacts) != 2 || contacts[0].ID != a.ID || contacts[1].ID != b.ID {
+		t.Errorf("ListContacts() = %v, %v, want contacts in insertion order", contacts, err)
+	}
+
+	updated, err := bkd.UpdateContact(opts.User, &backend.ContactUpdate{
+		Contact: &backend.Contact{ID: a.ID, Name: "Robert", Email: "robert@example.org"},
+		Name: true,
+	})
+	if err != nil || updated.Name != "Robert" || updated.Email != "bob@example.org" {
+		t.Errorf("UpdateContact() = %+v, %v, want only Name updated", updated, err)
+	}
+	if contacts, _ := bkd.ListContacts(opts.User); contacts[0].Name != "Robert" {
+		t.Errorf("ListContacts() after UpdateContact() = %+v", contacts[0])
+	}
+	if _, err := bkd.UpdateContact(opts.User, &backend.ContactUpdate{Contact: &backend.Contact{ID: "missing"}}); err == nil {
+		t.Error("UpdateContact() with an unknown ID succeeded")
+	}
+
+	if err := bkd.DeleteContact(opts.User, a.ID); err != nil {
+		t.Fatal("DeleteContact() =", err)
+	}
+	if err := bkd.DeleteContact(opts.User, a.ID); err == nil {
+		t.Error("DeleteContact() with a deleted contact succeeded")
+	}
+	if contacts, _ := bkd.ListContacts(opts.User); len(contacts) != 1 || contacts[0].ID != b.ID {
+		t.Errorf("ListContacts() after DeleteContact() = %v", contacts)
+	}
+
+	if err := bkd.DeleteAllContacts(opts.User); err != nil {
+		t.Fatal("DeleteAllContacts() =", err)
+	}
+	if contacts, _ := bkd.ListContacts(opts.User); len(contacts) != 0 {
+		t.Errorf("ListContacts() after DeleteAllContacts() = %v", contacts)
+	}
+	if contacts, _ := bkd.ListContacts("other"); len(contacts) != 1 {
+		t.Errorf("DeleteAllContacts() deleted another user's contacts: %v", contacts)
+	}
+}
@@ -0,0 +1,116 @@
+package backendtest
+
+import (
+	"testing"
+
+	"github.com/emersion/neutron/backend"
+)
+
+func testConversations(t *testing.T, bkd *backend.Backend, opts *Options) {
+	skipUnless(t, bkd.ConversationsBackend, "ConversationsBackend")
+
+	msgs, work := insertMessages(t, bkd, opts)
+	if opts.SingleMessageConversations {
+		testSingleMessageConversations(t, bkd, opts, msgs)
+		return
+	}
+
+	first, second := msgs[0].ConversationID, msgs[2].ConversationID
+	if first == second || msgs[1].ConversationID != first {
+		t.Fatalf("InsertMessage() conversation IDs = %q, %q, %q", first, msgs[1].ConversationID, second)
+	}
+
+	conv, err := bkd.GetConversation(opts.User, first)
+	if err != nil {
+		t.Fatal("GetConversation() =", err)
+	}
+	if conv.NumMessages != 2 || conv.NumUnread != 1 || conv.Time != messagesTime+day || conv.Subject != "Re: Hello" {
+		t.Errorf("GetConversation() = %+v", conv)
+	}
+	if len(conv.Senders) != 2 || len(conv.Recipients) != 1 {
+		t.Errorf("GetConversation() senders = %v, recipients = %v", conv.Senders, conv.Recipients)
+	}
+	if _, err := bkd.GetConversation(opts.User, "missing"); err == nil {
+		t.Error("GetConversation() with an unknown ID succeeded")
+	}
+
+	list, err := bkd.ListConversationMessages(opts.User, first)
+	if err != nil || !equalIDs(messageIDs(list), messageIDs(msgs[:2])) {
+		t.Errorf("ListConversationMessages() = %v, %v", messageIDs(list), err)
+	}
+
+	convs, total, err := bkd.ListConversations(opts.User, &backend.MessagesFilter{})
+	if err != nil || total != 2 || len(convs) != 2 || convs[0].ID != first || convs[1].ID != second {
+		t.Errorf("ListConversations() = %v, %v, %v", convs, total, err)
+	}
+	convs, total, err = bkd.ListConversations(opts.User, &backend.MessagesFilter{Label: backend.SentLabel})
+	if err != nil || total != 1 || len(convs) != 1 || convs[0].ID != second {
+		t.Errorf("ListConversations(label) = %v, %v, %v", convs, total, err)
+	}
+	convs, total, err = bkd.ListConversations(opts.User, &backend.MessagesFilter{Limit: 1, Page: 1})
+	if err != nil || total != 2 || len(convs) != 1 || convs[0].ID != second {
+		t.Errorf("ListConversations(page) = %v, %v, %v", convs, total, err)
+	}
+
+	counts, err := bkd.CountConversations(opts.User)
+	if err != nil {
+		t.Fatal("CountConversations() =", err)
+	}
+	wantCounts := map[string][2]int{
+		backend.InboxLabel: {1, 1},
+		backend.SentLabel: {1, 1},
+		work: {1, 1},
+	}
+	if opts.SingleLabel {
+		delete(wantCounts, work)
+	}
+	checkCounts(t, "CountConversations", counts, wantCounts)
+
+	if err := bkd.DeleteConversation(opts.User, first); err != nil {
+		t.Fatal("DeleteConversation() =", err)
+	}
+	if _, err := bkd.GetConversation(opts.User, first); err == nil {
+		t.Error("GetConversation() with a deleted conversation succeeded")
+	}
+	if _, err := bkd.GetMessage(opts.User, msgs[0].ID); err == nil {
+		t.Error("GetMessage() with a message of a deleted conversation succeeded")
+	}
+	if _, total, _ := bkd.ListConversations(opts.User, &backend.MessagesFilter{}); total != 1 {
+		t.Errorf("ListConversations() after DeleteConversation() total = %v, want 1", total)
+	}
+}
+
+// Check conversations of backends where each message is a conversation.
+func testSingleMessageConversations(t *testing.T, bkd *backend.Backend, opts *Options, msgs []*backend.Message) {
+	ids := messageIDs(msgs)
+
+	conv, err := bkd.GetConversation(opts.User, ids[1])
+	if err != nil {
+		t.Fatal("GetConversation() =", err)
+	}
+	if conv.ID != ids[1] || conv.NumMessages != 1 || conv.Subject != "Re: Hello" {
+		t.Errorf("GetConversation() = %+v", conv)
+	}
+	if _, err := bkd.GetConversation(opts.User, "missing"); err == nil {
+		t.Error("GetConversation() with an unknown ID succeeded")
+	}
+
+	list, err := bkd.ListConversationMessages(opts.User, ids[1])
+	if err != nil || !equalIDs(messageIDs(list), ids[1:2]) {
+		t.Errorf("ListConversationMessages() = %v, %v", messageIDs(list), err)
+	}
+
+	filter := &backend.MessagesFilter{Label: backend.InboxLabel}
+	want, wantTotal := listedIDs(opts, filter, ids[:2], ids[:2])
+	convs, total, err := bkd.ListConversations(opts.User, filter)
+	if err != nil || total != wantTotal || len(convs) != len(want) || convs[0].ID != want[0] {
+		t.Errorf("ListConversations(label) = %v, %v, %v", convs, total, err)
+	}
+
+	if err := bkd.DeleteConversation(opts.User, ids[1]); err != nil {
+		t.Fatal("DeleteConversation() =", err)
+	}
+	if _, err := bkd.GetMessage(opts.User, ids[1]); err == nil {
+		t.Error("GetMessage() with a message of a deleted conversation succeeded")
+	}
+}
@@ -0,0 +1,72 @@
+package backendtest
+
+import (
+	"testing"
+
+	"github.com/emersion/neutron/backend"
+)
+
+func testDomains(t *testing.T, bkd *backend.Backend, opts *Options) {
+	skipUnless(t, bkd.DomainsBackend, "DomainsBackend")
+
+	a, err := bkd.InsertDomain(&backend.Domain{DomainName: "a.example.org"})
+	if err != nil {
+		t.Fatal("InsertDomain() =", err)
+	}
+	b, _ := bkd.InsertDomain(&backend.Domain{DomainName: "b.example.org", VerifyCode: "code", UserID: opts.User})
+	if a.ID == "" || a.ID == b.ID {
+		t.Errorf("InsertDomain() IDs = %q, %q, want unique IDs", a.ID, b.ID)
+	}
+
+	domains, err := bkd.ListDomains()
+	if err != nil || len(domains) != 2 || domains[0].ID != a.ID || domains[1].ID != b.ID {
+		t.Errorf("ListDomains() = %v, %v, want domains in insertion order", domains, err)
+	}
+
+	if got, err := bkd.GetDomain(b.ID); err != nil || got.DomainName != "b.example.org" || got.UserID != opts.User {
+		t.Errorf("GetDomain() = %+v, %v", got, err)
+	}
+	if _, err := bkd.GetDomain("missing"); err == nil {
+		t.Error("GetDomain() with an unknown ID succeeded")
+	}
+	if got, err := bkd.GetDomainByName("a.example.org"); err != nil || got.ID != a.ID {
+		t.Errorf("GetDomainByName() = %+v, %v", got, err)
+	}
+	if _, err := bkd.GetDomainByName("missing.example.org"); err == nil {
+		t.Error("GetDomainByName() with an unknown name succeeded")
+	}
+
+	updated, err := bkd.UpdateDomain(&backend.DomainUpdate{
+		Domain: &backend.Domain{ID: a.ID, MxState: 1, SpfState: 1},
+		States: true,
+	})
+	if err != nil || updated.MxState != 1 || updated.DomainName != "a.example.org" {
+		t.Errorf("UpdateDomain() = %+v, %v", updated, err)
+	}
+	if got, _ := bkd.GetDomain(a.ID); got.SpfState != 1 {
+		t.Errorf("GetDomain() after UpdateDomain() = %+v", got)
+	}
+	if _, err := bkd.UpdateDomain(&backend.DomainUpdate{Domain: &backend.Domain{ID: "missing"}}); err == nil {
+		t.Error("UpdateDomain() with an unknown ID succeeded")
+	}
+}
+
+func testDkim(t *testing.T, bkd *backend.Backend, opts *Options) {
+	skipUnless(t, bkd.DkimBackend, "DkimBackend")
+
+	if key, err := bkd.GetDkimKey("example.org"); key != nil || err != nil {
+		t.Errorf("GetDkimKey() = %v, %v, want nil, nil", key, err)
+	}
+
+	for _, selector := range []string{"first", "second"} {
+		key := &backend.DkimKey{Selector: selector, PrivateKey: "key"}
+		if err := bkd.UpdateDkimKey("example.org", key); err != nil {
+			t.Fatal("UpdateDkimKey() =", err)
+		}
+
+		got, err := bkd.GetDkimKey("example.org")
+		if err != nil || got == nil || got.Selector != selector || got.PrivateKey != "key" {
+			t.Errorf("GetDkimKey() = %+v, %v, want selector %q", got, err, selector)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package backendtest
+
+import (
+	"testing"
+
+	"github.com/emersion/neutron/backend"
+)
+
+func testEvents(t *testing.T, bkd *backend.Backend, opts *Options) {
+	skipUnless(t, bkd.EventsBackend, "EventsBackend")
+
+	last, err := bkd.GetLastEvent(opts.User)
+	if err != nil {
+		t.Fatal("GetLastEvent() =", err)
+	}
+	if last.ID == "" {
+		t.Error("GetLastEvent() returned an event without ID")
+	}
+	if again, err := bkd.GetLastEvent(opts.User); err != nil || again.ID != last.ID {
+		t.Errorf("GetLastEvent() = %+v, %v, want the same event", again, err)
+	}
+
+	event, err := bkd.GetEventsAfter(opts.User, last.ID)
+	if err != nil {
+		t.Fatal("GetEventsAfter() =", err)
+	}
+	if len(event.Messages) > 0 || len(event.Labels) > 0 || len(event.Contacts) > 0 {
+		t.Errorf("GetEventsAfter() without new event = %+v", event)
+	}
+	if _, err := bkd.GetEventsAfter(opts.User, "missing"); err == nil {
+		t.Error("GetEventsAfter() with an unknown ID succeeded")
+	}
+
+	if err := bkd.DeleteAllEvents(opts.User); err != nil {
+		t.Fatal("DeleteAllEvents() =", err)
+	}
+}
@@ -0,0 +1,48 @@
+package backendtest
+
+import (
+	"testing"
+
+	"github.com/emersion/neutron/backend"
+)
+
+func testKeys(t *testing.T, bkd *backend.Backend, opts *Options) {
+	skipUnless(t, bkd.KeysBackend, "KeysBackend")
+
+	email := "alice@example.org"
+
+	if pub, err := bkd.GetPublicKey(email); pub != "" || err != nil {
+		t.Errorf("GetPublicKey() = %q, %v, want no key and no error", pub, err)
+	}
+	if _, err := bkd.GetKeypair(email); err == nil {
+		t.Error("GetKeypair() with an unknown e-mail succeeded")
+	}
+
+	kp, err := bkd.InsertKeypair(email, &backend.Keypair{PublicKey: "public", PrivateKey: "private"})
+	if err != nil {
+		t.Fatal("InsertKeypair() =", err)
+	}
+	if kp.ID != email {
+		t.Errorf("InsertKeypair() ID = %q, want %q", kp.ID, email)
+	}
+
+	if pub, err := bkd.GetPublicKey(email); pub != "public" || err != nil {
+		t.Errorf("GetPublicKey() = %q, %v", pub, err)
+	}
+	if got, err := bkd.GetKeypair(email); err != nil || got.PrivateKey != "private" {
+		t.Errorf("GetKeypair() = %+v, %v", got, err)
+	}
+
+	// An empty public key must not be updated
+	updated, err := bkd.UpdateKeypair(email, &backend.Keypair{PrivateKey: "private2"})
+	if err != nil || updated.PublicKey != "public" || updated.PrivateKey != "private2" {
+		t.Errorf("UpdateKeypair() = %+v, %v", updated, err)
+	}
+	updated, err = bkd.UpdateKeypair(email, &backend.Keypair{PublicKey: "public3", PrivateKey: "private3"})
+	if err != nil || updated.PublicKey != "public3" {
+		t.Errorf("UpdateKeypair() = %+v, %v", updated, err)
+	}
+	if got, _ := bkd.GetKeypair(email); got.PublicKey != "public3" || got.PrivateKey != "private3" {
+		t.Errorf("GetKeypair() after UpdateKeypair() = %+v", got)
+	}
+}
@@ -0,0 +1,57 @@
+package backendtest
+
+import (
+	"testing"
+
+	"github.com/emersion/neutron/backend"
+)
+
+func testLabels(t *testing.T, bkd *backend.Backend, opts *Options) {
+	skipUnless(t, bkd.LabelsBackend, "LabelsBackend")
+
+	a, err := bkd.InsertLabel(opts.User, &backend.Label{Name: "Work", Color: "#ff0000"})
+	if err != nil {
+		t.Fatal("InsertLabel() =", err)
+	}
+	b, _ := bkd.InsertLabel(opts.User, &backend.Label{Name: "Personal"})
+	if a.ID == "" || a.ID == b.ID {
+		t.Errorf("InsertLabel() IDs = %q, %q, want unique IDs", a.ID, b.ID)
+	}
+	if a.Order != 0 || b.Order != 1 {
+		t.Errorf("InsertLabel() orders = %v, %v, want 0, 1", a.Order, b.Order)
+	}
+
+	labels, err := bkd.ListLabels(opts.User)
+	if err != nil || len(labels) != 2 || labels[0].ID != a.ID || labels[1].ID != b.ID {
+		t.Errorf("ListLabels() = %v, %v, want labels in insertion order", labels, err)
+	}
+	if labels, _ := bkd.ListLabels("other"); len(labels) != 0 {
+		t.Errorf("ListLabels() of another user = %v", labels)
+	}
+
+	updated, err := bkd.UpdateLabel(opts.User, &backend.LabelUpdate{
+		Label: &backend.Label{ID: a.ID, Name: "Job", Color: "#00ff00"},
+		Name: true,
+	})
+	if err != nil || updated.Name != "Job" || updated.Color != "#ff0000" {
+		t.Fatalf("UpdateLabel() = %+v, %v, want only Name updated", updated, err)
+	}
+	// Some backends identify labels by their name, so the ID can change
+	a = updated
+	if labels, _ := bkd.ListLabels(opts.User); labels[0].Name != "Job" {
+		t.Errorf("ListLabels() after UpdateLabel() = %+v", labels[0])
+	}
+	if _, err := bkd.UpdateLabel(opts.User, &backend.LabelUpdate{Label: &backend.Label{ID: "missing"}}); err == nil {
+		t.Error("UpdateLabel() with an unknown ID succeeded")
+	}
+
+	if err := bkd.DeleteLabel(opts.User, a.ID); err != nil {
+		t.Fatal("DeleteLabel() =", err)
+	}
+	if err := bkd.DeleteLabel(opts.User, a.ID); err == nil {
+		t.Error("DeleteLabel() with a deleted label succeeded")
+	}
+	if labels, _ := bkd.ListLabels(opts.User); len(labels) != 1 || labels[0].ID != b.ID {
+		t.Errorf("ListLabels() after DeleteLabel() = %v", labels)
+	}
+}
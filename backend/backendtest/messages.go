@@ -0,0 +1,326 @@
+package backendtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emersion/neutron/backend"
+)
+
+// Messages used by tests are sent on consecutive days, at noon.
+var messagesTime = time.Date(2017, time.January, 1, 12, 0, 0, 0, time.UTC).Unix()
+
+const day = 24 * 60 * 60
+
+// Get the ID of a label used by tests. The label is created if the backend
+// stores labels.
+func insertLabel(t *testing.T, bkd *backend.Backend, opts *Options, name string) string {
+	if bkd.LabelsBackend == nil {
+		return name
+	}
+
+	label, err := bkd.InsertLabel(opts.User, &backend.Label{Name: name})
+	if err != nil {
+		t.Fatal("InsertLabel() =", err)
+	}
+	return label.ID
+}
+
+// Insert a message. Backends only inserting drafts move it to its labels
+// afterwards.
+func insertMessage(t *testing.T, bkd *backend.Backend, opts *Options, msg *backend.Message) *backend.Message {
+	labels, isRead := msg.LabelIDs, msg.IsRead
+
+	inserted, err := bkd.InsertMessage(opts.User, msg)
+	if err != nil {
+		t.Fatal("InsertMessage() =", err)
+	}
+	if inserted.ID == "" {
+		t.Fatalf("InsertMessage() = %+v, want an ID", inserted)
+	}
+	if !opts.DraftsOnly {
+		return inserted
+	}
+
+	moved, err := bkd.UpdateMessage(opts.User, &backend.MessageUpdate{
+		Message: &backend.Message{ID: inserted.ID, IsRead: isRead, LabelIDs: labels},
+		IsRead: true,
+		LabelIDs: backend.ReplaceLabels,
+	})
+	if err != nil {
+		t.Fatal("UpdateMessage() of an inserted draft =", err)
+	}
+	return moved
+}
+
+// Insert messages used by tests. The first two ones are in the same
+// conversation, the first one also has the returned label unless labels are
+// folders.
+func insertMessages(t *testing.T, bkd *backend.Backend, opts *Options) (msgs []*backend.Message, work string) {
+	work = insertLabel(t, bkd, opts, "Work")
+
+	msgs = []*backend.Message{
+		{
+			Subject: "Hello",
+			Sender: &backend.Email{Name: "Bob", Address: "bob@example.org"},
+			ToList: []*backend.Email{{Address: "alice@example.org"}},
+			Time: messagesTime,
+			Body: "Hello Alice",
+			InReplyTo: "<parent@example.org>",
+			LabelIDs: []string{backend.InboxLabel, work},
+		},
+		{
+			Subject: "Re: Hello",
+			Sender: &backend.Email{Name: "Carol", Address: "carol@example.org"},
+			ToList: []*backend.Email{{Address: "alice@example.org"}},
+			Time: messagesTime + day,
+			IsRead: 1,
+			Body: "Hi",
+			LabelIDs: []string{backend.InboxLabel},
+		},
+		{
+			Subject: "Report",
+			Sender: &backend.Email{Address: "alice@example.org"},
+			ToList: []*backend.Email{{Address: "dave@example.org"}},
+			Time: messagesTime + 2*day,
+			AddressID: "address",
+			Body: "See attached",
+			Attachments: []*backend.Attachment{{Name: "report.pdf"}},
+			LabelIDs: []string{backend.SentLabel},
+		},
+	}
+
+	if opts.SingleLabel {
+		msgs[0].LabelIDs = msgs[0].LabelIDs[:1]
+	}
+
+	for i, msg := range msgs {
+		if i == 1 {
+			msg.ConversationID = msgs[0].ConversationID
+		}
+
+		msgs[i] = insertMessage(t, bkd, opts, msg)
+		if msgs[i].ConversationID == "" && !opts.SingleMessageConversations {
+			t.Fatalf("InsertMessage() = %+v, want a conversation ID", msgs[i])
+		}
+	}
+
+	return
+}
+
+func messageIDs(msgs []*backend.Message) []string {
+	var ids []string
+	for _, msg := range msgs {
+		ids = append(ids, msg.ID)
+	}
+	return ids
+}
+
+func equalIDs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Get the IDs a backend lists, out of IDs of matching messages in insertion
+// order. inbox contains IDs of messages in the inbox.
+func listedIDs(opts *Options, filter *backend.MessagesFilter, matching, inbox []string) (ids []string, total int) {
+	if filter.Label == "" && opts.InboxByDefault {
+		for _, id := range matching {
+			for _, inboxID := range inbox {
+				if id == inboxID {
+					ids = append(ids, id)
+				}
+			}
+		}
+	} else {
+		ids = append(ids, matching...)
+	}
+
+	if opts.NewestFirst {
+		for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+			ids[i], ids[j] = ids[j], ids[i]
+		}
+	}
+
+	total = len(ids)
+	from, to := filter.PageBounds(total)
+	return ids[from:to], total
+}
+
+// Check counts, regardless of their order. Labels without messages can be
+// omitted.
+func checkCounts(t *testing.T, name string, counts []*backend.MessagesCount, want map[string][2]int) {
+	got := map[string][2]int{}
+	for _, count := range counts {
+		if count.Total > 0 {
+			got[count.LabelID] = [2]int{count.Total, count.Unread}
+		}
+	}
+
+	if len(got) != len(want) {
+		t.Errorf("%v() = %v, want %v", name, got, want)
+		return
+	}
+	for label, count := range want {
+		if got[label] != count {
+			t.Errorf("%v() = %v, want %v", name, got, want)
+			return
+		}
+	}
+}
+
+func testMessages(t *testing.T, bkd *backend.Backend, opts *Options) {
+	skipUnless(t, bkd.ConversationsBackend, "ConversationsBackend")
+
+	msgs, work := insertMessages(t, bkd, opts)
+	ids := messageIDs(msgs)
+	if !opts.DraftsOnly {
+		for i, msg := range msgs {
+			if msg.Order != i {
+				t.Errorf("InsertMessage() order = %v, want %v", msg.Order, i)
+			}
+		}
+		if msgs[2].NumAttachments != 1 {
+			t.Errorf("InsertMessage() NumAttachments = %v, want 1", msgs[2].NumAttachments)
+		}
+	}
+
+	msg, err := bkd.GetMessage(opts.User, ids[0])
+	if err != nil || msg.Subject != "Hello" || msg.Body != "Hello Alice" || msg.Sender.Address != "bob@example.org" {
+		t.Errorf("GetMessage() = %+v, %v", msg, err)
+	} else if msg.InReplyTo != "<parent@example.org>" {
+		t.Errorf("GetMessage() InReplyTo = %q, want it to be stored", msg.InReplyTo)
+	}
+	if _, err := bkd.GetMessage(opts.User, "missing"); err == nil {
+		t.Error("GetMessage() with an unknown ID succeeded")
+	}
+	if _, err := bkd.GetMessage("other", ids[0]); err == nil {
+		t.Error("GetMessage() with another user's message succeeded")
+	}
+
+	if bkd.AttachmentsBackend != nil {
+		att, _ := bkd.InsertAttachment(opts.User, &backend.Attachment{MessageID: ids[2], Name: "report.pdf"}, []byte("pdf"))
+		if msg, err := bkd.GetMessage(opts.User, ids[2]); err != nil || len(msg.Attachments) != 1 || msg.Attachments[0].ID != att.ID {
+			t.Errorf("GetMessage() = %+v, %v, want the message's attachments", msg, err)
+		}
+	}
+
+	filterTests := []struct {
+		name string
+		filter *backend.MessagesFilter
+		matching []string
+	}{
+		{"all", &backend.MessagesFilter{}, ids},
+		{"label", &backend.MessagesFilter{Label: backend.InboxLabel}, ids[:2]},
+		{"unread", &backend.MessagesFilter{Unread: true}, []string{ids[0], ids[2]}},
+		{"page", &backend.MessagesFilter{Limit: 2, Page: 1}, ids},
+		{"page past the end", &backend.MessagesFilter{Limit: 2, Page: 5}, ids},
+		{"time", &backend.MessagesFilter{Begin: messagesTime + day/2, End: messagesTime + 3*day/2}, ids[1:2]},
+	}
+	if !opts.NoAddressFilter {
+		filterTests = append(filterTests, struct {
+			name string
+			filter *backend.MessagesFilter
+			matching []string
+		}{"address", &backend.MessagesFilter{Address: "address"}, ids[2:]})
+	}
+	for _, test := range filterTests {
+		want, wantTotal := listedIDs(opts, test.filter, test.matching, ids[:2])
+		list, total, err := bkd.ListMessages(opts.User, test.filter)
+		if err != nil || total != wantTotal || !equalIDs(messageIDs(list), want) {
+			t.Errorf("ListMessages(%v) = %v, %v, %v, want %v, %v", test.name, messageIDs(list), total, err, want, wantTotal)
+		}
+	}
+
+	counts, err := bkd.CountMessages(opts.User)
+	if err != nil {
+		t.Fatal("CountMessages() =", err)
+	}
+	wantCounts := map[string][2]int{
+		backend.InboxLabel: {2, 1},
+		backend.SentLabel: {1, 1},
+		work: {1, 1},
+	}
+	if opts.SingleLabel {
+		delete(wantCounts, work)
+	}
+	checkCounts(t, "CountMessages", counts, wantCounts)
+
+	personal := insertLabel(t, bkd, opts, "Personal")
+	msg, err = bkd.UpdateMessage(opts.User, &backend.MessageUpdate{
+		Message: &backend.Message{ID: ids[0], IsRead: 1, Subject: "Ignored", LabelIDs: []string{personal}},
+		IsRead: true,
+		LabelIDs: backend.AddLabels,
+	})
+	wantLabels := 3
+	if opts.SingleLabel {
+		wantLabels = 1
+	}
+	if err != nil || msg.IsRead != 1 || msg.Subject != "Hello" || len(msg.LabelIDs) != wantLabels {
+		t.Fatalf("UpdateMessage() = %+v, %v", msg, err)
+	}
+
+	// Some backends identify messages by their location, so the ID can change
+	// when a message is moved
+	ids[0] = msg.ID
+	msg, err = bkd.UpdateMessage(opts.User, &backend.MessageUpdate{
+		Message: &backend.Message{ID: ids[0], LabelIDs: []string{backend.ArchiveLabel}},
+		LabelIDs: backend.ReplaceLabels,
+	})
+	if err != nil || len(msg.LabelIDs) != 1 || msg.LabelIDs[0] != backend.ArchiveLabel {
+		t.Fatalf("UpdateMessage() = %+v, %v", msg, err)
+	}
+	ids[0] = msg.ID
+	if msg, err := bkd.GetMessage(opts.User, ids[0]); err != nil || msg.IsRead != 1 || len(msg.LabelIDs) != 1 || msg.LabelIDs[0] != backend.ArchiveLabel {
+		t.Errorf("GetMessage() after UpdateMessage() = %+v, %v", msg, err)
+	}
+
+	// Message-IDs are set on drafts before sending them
+	draft := insertMessage(t, bkd, opts, &backend.Message{
+		Subject: "Draft",
+		Sender: &backend.Email{Name: "Alice", Address: "alice@example.org"},
+		Type: backend.DraftType,
+		LabelIDs: []string{backend.DraftLabel},
+		Time: messagesTime,
+	})
+	draft, err = bkd.UpdateMessage(opts.User, &backend.MessageUpdate{
+		Message: &backend.Message{ID: draft.ID, ExternalID: "draft@example.org"},
+		ExternalID: true,
+	})
+	if err != nil {
+		t.Fatal("UpdateMessage() of the Message-ID =", err)
+	}
+	if msg, err := bkd.GetMessage(opts.User, draft.ID); err != nil || msg.ExternalID != "draft@example.org" {
+		t.Errorf("GetMessage() after updating the Message-ID = %+v, %v", msg, err)
+	}
+	if err := bkd.DeleteMessage(opts.User, draft.ID); err != nil {
+		t.Fatal("DeleteMessage() of a draft =", err)
+	}
+
+	if _, err := bkd.UpdateMessage(opts.User, &backend.MessageUpdate{Message: &backend.Message{ID: "missing"}}); err == nil {
+		t.Error("UpdateMessage() with an unknown ID succeeded")
+	}
+
+	if err := bkd.DeleteMessage(opts.User, ids[2]); err != nil {
+		t.Fatal("DeleteMessage() =", err)
+	}
+	if err := bkd.DeleteMessage(opts.User, ids[2]); err == nil {
+		t.Error("DeleteMessage() with a deleted message succeeded")
+	}
+	if _, err := bkd.GetMessage(opts.User, ids[2]); err == nil {
+		t.Error("GetMessage() with a deleted message succeeded")
+	}
+	if list, total, _ := bkd.ListMessages(opts.User, &backend.MessagesFilter{Label: backend.InboxLabel}); total != 1 || !equalIDs(messageIDs(list), ids[1:2]) {
+		t.Errorf("ListMessages() after UpdateMessage() and DeleteMessage() = %v, %v", messageIDs(list), total)
+	}
+	if _, total, _ := bkd.ListMessages(opts.User, &backend.MessagesFilter{Label: backend.ArchiveLabel}); total != 1 {
+		t.Errorf("ListMessages(archive) after UpdateMessage() total = %v, want 1", total)
+	}
+}
@@ -0,0 +1,101 @@
+package backendtest
+
+import (
+	"testing"
+
+	"github.com/emersion/neutron/backend"
+)
+
+func testUsers(t *testing.T, bkd *backend.Backend, opts *Options) {
+	skipUnless(t, bkd.UsersBackend, "UsersBackend")
+
+	if opts.ExternalUsers {
+		testExternalUsers(t, bkd, opts)
+		return
+	}
+
+	if ok, err := bkd.IsUsernameAvailable("alice"); err != nil || !ok {
+		t.Fatalf("IsUsernameAvailable() = %v, %v, want true", ok, err)
+	}
+
+	u, err := bkd.InsertUser(&backend.User{Name: "alice"}, "secret")
+	if err != nil {
+		t.Fatal("InsertUser() =", err)
+	}
+	if u.ID == "" || u.Name != "alice" {
+		t.Errorf("InsertUser() = %+v, want an ID and name alice", u)
+	}
+
+	if ok, err := bkd.IsUsernameAvailable("alice"); err != nil || ok {
+		t.Errorf("IsUsernameAvailable() = %v, %v, want false", ok, err)
+	}
+	if _, err := bkd.InsertUser(&backend.User{Name: "alice"}, "other"); err == nil {
+		t.Error("InsertUser() with a taken username succeeded")
+	}
+
+	if got, err := bkd.GetUser(u.ID); err != nil || got.Name != "alice" {
+		t.Errorf("GetUser() = %+v, %v", got, err)
+	}
+	if _, err := bkd.GetUser("missing"); err == nil {
+		t.Error("GetUser() with an unknown ID succeeded")
+	}
+
+	if got, err := bkd.Auth("alice", "secret"); err != nil || got.ID != u.ID {
+		t.Errorf("Auth() = %+v, %v", got, err)
+	}
+	if _, err := bkd.Auth("alice", "wrong"); err == nil {
+		t.Error("Auth() with a wrong password succeeded")
+	}
+	if _, err := bkd.Auth("bob", "secret"); err == nil {
+		t.Error("Auth() with an unknown user succeeded")
+	}
+
+	err = bkd.UpdateUser(&backend.UserUpdate{
+		User: &backend.User{ID: u.ID, DisplayName: "Alice"},
+		DisplayName: true,
+	})
+	if err != nil {
+		t.Fatal("UpdateUser() =", err)
+	}
+	if got, _ := bkd.GetUser(u.ID); got.DisplayName != "Alice" || got.Name != "alice" {
+		t.Errorf("GetUser() after UpdateUser() = %+v", got)
+	}
+
+	if err := bkd.UpdateUserPassword(u.ID, "wrong", "new"); err == nil {
+		t.Error("UpdateUserPassword() with a wrong password succeeded")
+	}
+	if err := bkd.UpdateUserPassword(u.ID, "secret", "new"); err != nil {
+		t.Fatal("UpdateUserPassword() =", err)
+	}
+	if _, err := bkd.Auth("alice", "secret"); err == nil {
+		t.Error("Auth() with the old password succeeded")
+	}
+	if _, err := bkd.Auth("alice", "new"); err != nil {
+		t.Error("Auth() with the new password =", err)
+	}
+}
+
+// Check users managed elsewhere: only the test user can log in.
+func testExternalUsers(t *testing.T, bkd *backend.Backend, opts *Options) {
+	u, err := bkd.Auth(opts.User, opts.Password)
+	if err != nil {
+		t.Fatal("Auth() =", err)
+	}
+	if _, err := bkd.Auth(opts.User, "wrong"); err == nil {
+		t.Error("Auth() with a wrong password succeeded")
+	}
+	if _, err := bkd.Auth("missing", opts.Password); err == nil {
+		t.Error("Auth() with an unknown user succeeded")
+	}
+
+	if got, err := bkd.GetUser(u.ID); err != nil || got.Name != opts.User {
+		t.Errorf("GetUser() = %+v, %v", got, err)
+	}
+	if _, err := bkd.GetUser("missing"); err == nil {
+		t.Error("GetUser() with an unknown ID succeeded")
+	}
+
+	if err := bkd.UpdateUserPassword(u.ID, opts.Password, "new"); err == nil {
+		t.Error("UpdateUserPassword() of an external user succeeded")
+	}
+}
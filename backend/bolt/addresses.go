@@ -0,0 +1,144 @@
+package bolt
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"go.etcd.io/bbolt"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util"
+)
+
+// Stores users' addresses.
+type Addresses struct {
+	db *DB
+}
+
+func (b *Addresses) GetAddress(user, id string) (addr *backend.Address, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		bucket, err := userCollection(tx, addressesBucket, user)
+		if err != nil {
+			return err
+		}
+
+		addr = &backend.Address{}
+		ok, err := findObject(bucket, id, addr)
+		if err == nil && !ok {
+			err = errors.New("No such address")
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (b *Addresses) ListAddresses(user string) (addrs []*backend.Address, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		bucket, err := userCollection(tx, addressesBucket, user)
+		if err != nil {
+			return err
+		}
+
+		return forEach(bucket, func(k, data []byte) error {
+			addr := &backend.Address{}
+			addrs = append(addrs, addr)
+			return json.Unmarshal(data, addr)
+		})
+	})
+	return
+}
+
+// All users' addresses are searched.
+func (b *Addresses) GetAddressByEmail(email string) (user string, addr *backend.Address, err error) {
+	errFound := errors.New("found")
+
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(addressesBucket).ForEach(func(k, v []byte) error {
+			return forEach(tx.Bucket(addressesBucket).Bucket(k), func(_, data []byte) error {
+				a := &backend.Address{}
+				if err := json.Unmarshal(data, a); err != nil {
+					return err
+				}
+
+				if strings.EqualFold(a.Email, email) {
+					user = string(k)
+					addr = a
+					return errFound
+				}
+				return nil
+			})
+		})
+	})
+	if err == errFound {
+		return user, addr, nil
+	}
+	if err == nil {
+		err = errors.New("No such address")
+	}
+	return "", nil, err
+}
+
+func (b *Addresses) InsertAddress(user string, addr *backend.Address) (*backend.Address, error) {
+	addr.ID = util.GenerateId()
+
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := userCollection(tx, addressesBucket, user)
+		if err != nil {
+			return err
+		}
+		return appendObject(bucket, addr.ID, addr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addr, nil
+}
+
+func (b *Addresses) UpdateAddress(user string, update *backend.AddressUpdate) (addr *backend.Address, err error) {
+	err = b.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := userCollection(tx, addressesBucket, user)
+		if err != nil {
+			return err
+		}
+
+		addr = &backend.Address{}
+		ok, err := findObject(bucket, update.Address.ID, addr)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("No such address")
+		}
+
+		update.Apply(addr)
+		_, err = updateObject(bucket, addr.ID, addr)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (b *Addresses) DeleteAddress(user, id string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := userCollection(tx, addressesBucket, user)
+		if err != nil {
+			return err
+		}
+
+		ok, err := deleteObject(bucket, id)
+		if err == nil && !ok {
+			err = errors.New("No such address")
+		}
+		return err
+	})
+}
+
+func NewAddresses(db *DB) backend.AddressesBackend {
+	return &Addresses{db}
+}
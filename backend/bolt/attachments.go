@@ -0,0 +1,243 @@
+package bolt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"go.etcd.io/bbolt"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util"
+)
+
+// Stores attachments. Their contents are stored separately by ID, so that
+// listing attachments doesn't load them.
+type Attachments struct {
+	db *DB
+}
+
+// Attachments are indexed by message in a bucket nested in users' collections.
+// Keys are message IDs followed by attachments' sequence numbers, values are
+// attachment IDs.
+var messageAttachmentsBucket = []byte("messages")
+
+func messageAttachmentsPrefix(msgId string) []byte {
+	return []byte(msgId + "\x00")
+}
+
+// Get a user's attachments collection, with its index by message.
+func attachmentsCollection(tx *bbolt.Tx, user string) (*bbolt.Bucket, error) {
+	bucket, err := userCollection(tx, attachmentsBucket, user)
+	if err != nil || !tx.Writable() {
+		return bucket, err
+	}
+
+	_, err = bucket.CreateBucketIfNotExists(messageAttachmentsBucket)
+	return bucket, err
+}
+
+// Add an attachment to the index of its message.
+func indexAttachment(bucket *bbolt.Bucket, att *backend.Attachment) error {
+	seq, _ := getObjectData(bucket, att.ID)
+	k := append(messageAttachmentsPrefix(att.MessageID), seq...)
+	return bucket.Bucket(messageAttachmentsBucket).Put(k, []byte(att.ID))
+}
+
+// Remove an attachment from the index of its message.
+func unindexAttachment(bucket *bbolt.Bucket, att *backend.Attachment) error {
+	seq, _ := getObjectData(bucket, att.ID)
+	k := append(messageAttachmentsPrefix(att.MessageID), seq...)
+	return bucket.Bucket(messageAttachmentsBucket).Delete(k)
+}
+
+// List a user's attachments, by message ID.
+func listAttachments(tx *bbolt.Tx, user string) (map[string][]*backend.Attachment, error) {
+	bucket, err := attachmentsCollection(tx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	atts := map[string][]*backend.Attachment{}
+	err = forEach(bucket, func(k, data []byte) error {
+		att := &backend.Attachment{}
+		if err := json.Unmarshal(data, att); err != nil {
+			return err
+		}
+
+		atts[att.MessageID] = append(atts[att.MessageID], att)
+		return nil
+	})
+	return atts, err
+}
+
+// List attachments of a single message.
+func listMessageAttachments(tx *bbolt.Tx, user, msgId string) (atts []*backend.Attachment, err error) {
+	bucket, err := attachmentsCollection(tx, user)
+	if err != nil {
+		return nil, err
+	}
+	index := nestedBucket(bucket, messageAttachmentsBucket)
+	if index == nil {
+		return nil, nil
+	}
+
+	prefix := messageAttachmentsPrefix(msgId)
+	c := index.Cursor()
+	for k, id := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, id = c.Next() {
+		att := &backend.Attachment{}
+		if _, err := findObject(bucket, string(id), att); err != nil {
+			return nil, err
+		}
+		atts = append(atts, att)
+	}
+	return
+}
+
+func (b *Attachments) ListAttachments(user, msgId string) (atts []*backend.Attachment, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		atts, err = listMessageAttachments(tx, user, msgId)
+		return err
+	})
+	return
+}
+
+func (b *Attachments) ReadAttachment(user, id string) (att *backend.Attachment, contents []byte, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		bucket, err := attachmentsCollection(tx, user)
+		if err != nil {
+			return err
+		}
+
+		att = &backend.Attachment{}
+		ok, err := findObject(bucket, id, att)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("No such attachment")
+		}
+
+		blobs, err := userBucket(tx, contentsBucket, user)
+		if err != nil {
+			return err
+		}
+		if blobs != nil {
+			// Data is only valid during the transaction
+			contents = append([]byte{}, blobs.Get([]byte(id))...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return
+}
+
+func (b *Attachments) OpenAttachment(user, id string) (*backend.Attachment, io.ReadCloser, error) {
+	att, contents, err := b.ReadAttachment(user, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return att, ioutil.NopCloser(bytes.NewReader(contents)), nil
+}
+
+func (b *Attachments) InsertAttachment(user string, att *backend.Attachment, contents []byte) (*backend.Attachment, error) {
+	att.ID = util.GenerateId()
+	att.Size = len(contents)
+
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := attachmentsCollection(tx, user)
+		if err != nil {
+			return err
+		}
+		if err := appendObject(bucket, att.ID, att); err != nil {
+			return err
+		}
+		if err := indexAttachment(bucket, att); err != nil {
+			return err
+		}
+
+		blobs, err := userBucket(tx, contentsBucket, user)
+		if err != nil {
+			return err
+		}
+		return blobs.Put([]byte(att.ID), contents)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return att, nil
+}
+
+func (b *Attachments) InsertAttachmentFrom(user string, att *backend.Attachment, r io.Reader) (*backend.Attachment, error) {
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return b.InsertAttachment(user, att, contents)
+}
+
+func (b *Attachments) DeleteAttachment(user, id string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := attachmentsCollection(tx, user)
+		if err != nil {
+			return err
+		}
+
+		att := &backend.Attachment{}
+		ok, err := findObject(bucket, id, att)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("No such attachment")
+		}
+		if err := unindexAttachment(bucket, att); err != nil {
+			return err
+		}
+		if _, err := deleteObject(bucket, id); err != nil {
+			return err
+		}
+
+		blobs, err := userBucket(tx, contentsBucket, user)
+		if err != nil {
+			return err
+		}
+		return blobs.Delete([]byte(id))
+	})
+}
+
+// Additional function needed for imap.Messages backend
+func (b *Attachments) UpdateAttachmentMessage(user, id, msgId string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := attachmentsCollection(tx, user)
+		if err != nil {
+			return err
+		}
+
+		att := &backend.Attachment{}
+		ok, err := findObject(bucket, id, att)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("No such attachment")
+		}
+		if err := unindexAttachment(bucket, att); err != nil {
+			return err
+		}
+
+		att.MessageID = msgId
+		if _, err := updateObject(bucket, id, att); err != nil {
+			return err
+		}
+		return indexAttachment(bucket, att)
+	})
+}
+
+func NewAttachments(db *DB) backend.AttachmentsBackend {
+	return &Attachments{db}
+}
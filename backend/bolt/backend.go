@@ -0,0 +1,251 @@
+// Stores data in an embedded bbolt key-value database, with the same semantics
+// as the memory backend.
+package bolt
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"go.etcd.io/bbolt"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/events"
+	"github.com/emersion/neutron/backend/memory"
+	"github.com/emersion/neutron/backend/util"
+)
+
+// Top-level buckets. Buckets containing users' data have a nested collection
+// per user.
+var (
+	usersBucket = []byte("users")
+	domainsBucket = []byte("domains")
+	dkimBucket = []byte("dkim")
+	keysBucket = []byte("keys")
+	addressesBucket = []byte("addresses")
+	labelsBucket = []byte("labels")
+	contactsBucket = []byte("contacts")
+	messagesBucket = []byte("messages")
+	attachmentsBucket = []byte("attachments")
+	contentsBucket = []byte("attachments_contents")
+)
+
+// Nested buckets of a collection. Objects are stored by ID, prefixed with their
+// sequence number, and the order bucket maps sequence numbers to IDs so that
+// objects can be listed in insertion order.
+var (
+	objectsBucket = []byte("objects")
+	orderBucket = []byte("order")
+)
+
+type Config struct {
+	// The database file path.
+	Path string
+}
+
+// A bbolt database.
+type DB struct {
+	*bbolt.DB
+}
+
+// Open a database, creating it if it doesn't exist.
+func Open(config *Config) (*DB, error) {
+	db, err := bbolt.Open(config.Path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		buckets := [][]byte{
+			usersBucket, domainsBucket, dkimBucket, keysBucket, addressesBucket,
+			labelsBucket, contactsBucket, messagesBucket, attachmentsBucket,
+			contentsBucket,
+		}
+		for _, name := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return initCollection(tx.Bucket(domainsBucket))
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &DB{db}, nil
+}
+
+// Get a user's bucket nested in a top-level bucket. In a read-only
+// transaction, nil is returned if the user has no bucket yet.
+func userBucket(tx *bbolt.Tx, name []byte, user string) (*bbolt.Bucket, error) {
+	parent := tx.Bucket(name)
+	if !tx.Writable() {
+		return parent.Bucket([]byte(user)), nil
+	}
+	return parent.CreateBucketIfNotExists([]byte(user))
+}
+
+// Get a user's collection nested in a top-level bucket. In a read-only
+// transaction, nil is returned if the user has no collection yet.
+func userCollection(tx *bbolt.Tx, name []byte, user string) (*bbolt.Bucket, error) {
+	b, err := userBucket(tx, name, user)
+	if err != nil || !tx.Writable() {
+		return b, err
+	}
+	return b, initCollection(b)
+}
+
+func initCollection(b *bbolt.Bucket) error {
+	for _, name := range [][]byte{objectsBucket, orderBucket} {
+		if _, err := b.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get a bucket nested in b. b can be nil.
+func nestedBucket(b *bbolt.Bucket, name []byte) *bbolt.Bucket {
+	if b == nil {
+		return nil
+	}
+	return b.Bucket(name)
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func putObject(b *bbolt.Bucket, key []byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+// Get the sequence number and the data of an object of a collection. Both are
+// nil if there is no such object. b can be nil.
+func getObjectData(b *bbolt.Bucket, id string) (seq, data []byte) {
+	objects := nestedBucket(b, objectsBucket)
+	if objects == nil {
+		return nil, nil
+	}
+
+	v := objects.Get([]byte(id))
+	if len(v) < 8 {
+		return nil, nil
+	}
+	return v[:8], v[8:]
+}
+
+func putObjectData(b *bbolt.Bucket, seq []byte, id string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Bucket(objectsBucket).Put([]byte(id), append(append([]byte{}, seq...), data...))
+}
+
+// Append an object to a collection.
+func appendObject(b *bbolt.Bucket, id string, v interface{}) error {
+	n, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	seq := itob(n)
+	if err := b.Bucket(orderBucket).Put(seq, []byte(id)); err != nil {
+		return err
+	}
+	return putObjectData(b, seq, id, v)
+}
+
+// Replace an object of a collection, keeping its position. Returns false if
+// there is no such object.
+func updateObject(b *bbolt.Bucket, id string, v interface{}) (bool, error) {
+	seq, _ := getObjectData(b, id)
+	if seq == nil {
+		return false, nil
+	}
+	return true, putObjectData(b, seq, id, v)
+}
+
+// Delete an object from a collection. Returns false if there is no such object.
+func deleteObject(b *bbolt.Bucket, id string) (bool, error) {
+	seq, _ := getObjectData(b, id)
+	if seq == nil {
+		return false, nil
+	}
+
+	// Data is only valid until the bucket is modified
+	seq = append([]byte{}, seq...)
+	if err := b.Bucket(objectsBucket).Delete([]byte(id)); err != nil {
+		return false, err
+	}
+	return true, b.Bucket(orderBucket).Delete(seq)
+}
+
+// Iterate over a collection's objects, in insertion order. b can be nil.
+func forEach(b *bbolt.Bucket, f func(id, data []byte) error) error {
+	order := nestedBucket(b, orderBucket)
+	if order == nil {
+		return nil
+	}
+
+	objects := b.Bucket(objectsBucket)
+	return order.ForEach(func(_, id []byte) error {
+		return f(id, objects.Get(id)[8:])
+	})
+}
+
+// Count objects in a collection. b can be nil.
+func count(b *bbolt.Bucket) (n int) {
+	order := nestedBucket(b, orderBucket)
+	if order == nil {
+		return 0
+	}
+
+	c := order.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		n++
+	}
+	return
+}
+
+// Find an object by ID and unmarshal it in v. Returns false if there is no such
+// object. b can be nil.
+func findObject(b *bbolt.Bucket, id string, v interface{}) (bool, error) {
+	_, data := getObjectData(b, id)
+	if data == nil {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+// Use a bbolt database for all backends. Events are kept in memory, since they
+// are only useful to connected clients.
+func Use(bkd *backend.Backend, config *Config) (*DB, error) {
+	db, err := Open(config)
+	if err != nil {
+		return nil, err
+	}
+
+	evts := memory.NewEvents()
+	contacts := events.NewContacts(NewContacts(db), evts)
+	labels := events.NewLabels(NewLabels(db), evts)
+	attachments := NewAttachments(db)
+	messages := NewMessages(db)
+	conversations := events.NewConversations(NewConversations(messages.(*Messages)), evts)
+	send := util.NewEchoSend(conversations)
+	domains := NewDomains(db)
+	users := NewUsers(db)
+	addresses := events.NewAddresses(NewAddresses(db), evts)
+	keys := NewKeys(db)
+
+	bkd.Set(contacts, labels, conversations, send, domains, evts, users, addresses, attachments, keys)
+	return db, nil
+}
@@ -0,0 +1,22 @@
+package bolt_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/backendtest"
+	"github.com/emersion/neutron/backend/bolt"
+)
+
+func TestBackend(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) *backend.Backend {
+		bkd := backend.New()
+		db, err := bolt.Use(bkd, &bolt.Config{Path: filepath.Join(t.TempDir(), "neutron.db")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return bkd
+	})
+}
@@ -0,0 +1,103 @@
+package bolt
+
+import (
+	"encoding/json"
+	"errors"
+
+	"go.etcd.io/bbolt"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util"
+)
+
+// Stores users' contacts.
+type Contacts struct {
+	db *DB
+}
+
+func (b *Contacts) ListContacts(user string) (contacts []*backend.Contact, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		bucket, err := userCollection(tx, contactsBucket, user)
+		if err != nil {
+			return err
+		}
+
+		return forEach(bucket, func(k, data []byte) error {
+			contact := &backend.Contact{}
+			contacts = append(contacts, contact)
+			return json.Unmarshal(data, contact)
+		})
+	})
+	return
+}
+
+func (b *Contacts) InsertContact(user string, contact *backend.Contact) (*backend.Contact, error) {
+	contact.ID = util.GenerateId()
+
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := userCollection(tx, contactsBucket, user)
+		if err != nil {
+			return err
+		}
+		return appendObject(bucket, contact.ID, contact)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return contact, nil
+}
+
+func (b *Contacts) UpdateContact(user string, update *backend.ContactUpdate) (contact *backend.Contact, err error) {
+	err = b.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := userCollection(tx, contactsBucket, user)
+		if err != nil {
+			return err
+		}
+
+		contact = &backend.Contact{}
+		ok, err := findObject(bucket, update.Contact.ID, contact)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("No such contact")
+		}
+
+		update.Apply(contact)
+		_, err = updateObject(bucket, contact.ID, contact)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (b *Contacts) DeleteContact(user, id string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := userCollection(tx, contactsBucket, user)
+		if err != nil {
+			return err
+		}
+
+		ok, err := deleteObject(bucket, id)
+		if err == nil && !ok {
+			err = errors.New("No such contact")
+		}
+		return err
+	})
+}
+
+func (b *Contacts) DeleteAllContacts(user string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		err := tx.Bucket(contactsBucket).DeleteBucket([]byte(user))
+		if err == bbolt.ErrBucketNotFound {
+			err = nil
+		}
+		return err
+	})
+}
+
+func NewContacts(db *DB) backend.ContactsBackend {
+	return &Contacts{db}
+}
@@ -0,0 +1,119 @@
+package bolt
+
+import (
+	"errors"
+
+	"go.etcd.io/bbolt"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util"
+)
+
+// Stores conversations, computed from messages.
+type Conversations struct {
+	*Messages
+}
+
+func (b *Conversations) ListConversationMessages(user, id string) (msgs []*backend.Message, err error) {
+	all, err := b.listMessages(user)
+	if err != nil {
+		return
+	}
+
+	for _, msg := range all {
+		if msg.ConversationID == id {
+			msgs = append(msgs, msg)
+		}
+	}
+	return
+}
+
+func (b *Conversations) GetConversation(user, id string) (*backend.Conversation, error) {
+	msgs, err := b.ListConversationMessages(user, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, errors.New("No such conversation")
+	}
+
+	return backend.GroupConversations(msgs)[0], nil
+}
+
+func (b *Conversations) ListConversations(user string, filter *backend.MessagesFilter) ([]*backend.Conversation, int, error) {
+	msgs, err := b.listMessages(user)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// A conversation matches if one of its messages matches
+	matches := map[string]bool{}
+	for _, msg := range msgs {
+		if filter.Match(msg) {
+			matches[msg.ConversationID] = true
+		}
+	}
+
+	filtered := []*backend.Conversation{}
+	for _, conv := range backend.GroupConversations(msgs) {
+		if matches[conv.ID] {
+			filtered = append(filtered, conv)
+		}
+	}
+
+	from, to := filter.PageBounds(len(filtered))
+	return filtered[from:to], len(filtered), nil
+}
+
+func (b *Conversations) CountConversations(user string) ([]*backend.MessagesCount, error) {
+	msgs, err := b.listMessages(user)
+	if err != nil {
+		return nil, err
+	}
+	return backend.CountConversations(backend.GroupConversations(msgs)), nil
+}
+
+func (b *Conversations) DeleteConversation(user, id string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := userCollection(tx, messagesBucket, user)
+		if err != nil {
+			return err
+		}
+
+		// Objects can't be deleted while iterating
+		var ids []string
+		err = forEach(bucket, func(k, data []byte) error {
+			msg, err := unmarshalMessage(data)
+			if err != nil {
+				return err
+			}
+
+			if msg.ConversationID == id {
+				ids = append(ids, msg.ID)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			if _, err := deleteObject(bucket, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *Conversations) InsertMessage(user string, msg *backend.Message) (*backend.Message, error) {
+	if msg.ConversationID == "" {
+		msg.ConversationID = util.GenerateId()
+	}
+
+	return b.Messages.InsertMessage(user, msg)
+}
+
+func NewConversations(messages *Messages) backend.ConversationsBackend {
+	return &Conversations{messages}
+}
@@ -0,0 +1,114 @@
+package bolt
+
+import (
+	"encoding/json"
+	"errors"
+
+	"go.etcd.io/bbolt"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util"
+)
+
+// Stores domains, and their DKIM keys by domain name.
+type Domains struct {
+	db *DB
+}
+
+func (b *Domains) ListDomains() (domains []*backend.Domain, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		return forEach(tx.Bucket(domainsBucket), func(k, data []byte) error {
+			domain := &backend.Domain{}
+			domains = append(domains, domain)
+			return json.Unmarshal(data, domain)
+		})
+	})
+	return
+}
+
+func (b *Domains) GetDomain(id string) (domain *backend.Domain, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		domain = &backend.Domain{}
+		ok, err := findObject(tx.Bucket(domainsBucket), id, domain)
+		if err == nil && !ok {
+			err = errors.New("No such domain")
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (b *Domains) GetDomainByName(name string) (*backend.Domain, error) {
+	domains, err := b.ListDomains()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range domains {
+		if d.DomainName == name {
+			return d, nil
+		}
+	}
+	return nil, errors.New("No such domain")
+}
+
+func (b *Domains) InsertDomain(domain *backend.Domain) (*backend.Domain, error) {
+	domain.ID = util.GenerateId()
+
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		return appendObject(tx.Bucket(domainsBucket), domain.ID, domain)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return domain, nil
+}
+
+func (b *Domains) UpdateDomain(update *backend.DomainUpdate) (domain *backend.Domain, err error) {
+	err = b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(domainsBucket)
+
+		domain = &backend.Domain{}
+		ok, err := findObject(bucket, update.Domain.ID, domain)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("No such domain")
+		}
+
+		update.Apply(domain)
+		_, err = updateObject(bucket, domain.ID, domain)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (b *Domains) GetDkimKey(domain string) (key *backend.DkimKey, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(dkimBucket).Get([]byte(domain))
+		if data == nil {
+			return nil
+		}
+
+		key = &backend.DkimKey{}
+		return json.Unmarshal(data, key)
+	})
+	return
+}
+
+func (b *Domains) UpdateDkimKey(domain string, key *backend.DkimKey) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return putObject(tx.Bucket(dkimBucket), []byte(domain), key)
+	})
+}
+
+func NewDomains(db *DB) backend.DomainsBackend {
+	return &Domains{db}
+}
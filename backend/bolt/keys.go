@@ -0,0 +1,80 @@
+package bolt
+
+import (
+	"encoding/json"
+	"errors"
+
+	"go.etcd.io/bbolt"
+
+	"github.com/emersion/neutron/backend"
+)
+
+// Stores keypairs by e-mail.
+type Keys struct {
+	db *DB
+}
+
+func getKeypair(tx *bbolt.Tx, email string) (*backend.Keypair, error) {
+	data := tx.Bucket(keysBucket).Get([]byte(email))
+	if data == nil {
+		return nil, errors.New("No such keypair")
+	}
+
+	kp := &backend.Keypair{}
+	if err := json.Unmarshal(data, kp); err != nil {
+		return nil, err
+	}
+	return kp, nil
+}
+
+func (b *Keys) GetPublicKey(email string) (string, error) {
+	kp, err := b.GetKeypair(email)
+	if err != nil {
+		return "", nil
+	}
+	return kp.PublicKey, nil
+}
+
+func (b *Keys) GetKeypair(email string) (kp *backend.Keypair, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		kp, err = getKeypair(tx, email)
+		return err
+	})
+	return
+}
+
+func (b *Keys) InsertKeypair(email string, keypair *backend.Keypair) (*backend.Keypair, error) {
+	keypair.ID = email
+
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		return putObject(tx.Bucket(keysBucket), []byte(email), keypair)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keypair, nil
+}
+
+func (b *Keys) UpdateKeypair(email string, keypair *backend.Keypair) (updated *backend.Keypair, err error) {
+	err = b.db.Update(func(tx *bbolt.Tx) error {
+		updated, err = getKeypair(tx, email)
+		if err != nil {
+			return err
+		}
+
+		if keypair.PublicKey != "" {
+			updated.PublicKey = keypair.PublicKey
+		}
+		updated.PrivateKey = keypair.PrivateKey
+
+		return putObject(tx.Bucket(keysBucket), []byte(email), updated)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func NewKeys(db *DB) backend.KeysBackend {
+	return &Keys{db}
+}
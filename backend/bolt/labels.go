@@ -0,0 +1,95 @@
+package bolt
+
+import (
+	"encoding/json"
+	"errors"
+
+	"go.etcd.io/bbolt"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util"
+)
+
+// Stores users' labels.
+type Labels struct {
+	db *DB
+}
+
+func (b *Labels) ListLabels(user string) (labels []*backend.Label, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		bucket, err := userCollection(tx, labelsBucket, user)
+		if err != nil {
+			return err
+		}
+
+		return forEach(bucket, func(k, data []byte) error {
+			label := &backend.Label{}
+			labels = append(labels, label)
+			return json.Unmarshal(data, label)
+		})
+	})
+	return
+}
+
+func (b *Labels) InsertLabel(user string, label *backend.Label) (*backend.Label, error) {
+	label.ID = util.GenerateId()
+
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := userCollection(tx, labelsBucket, user)
+		if err != nil {
+			return err
+		}
+
+		label.Order = count(bucket)
+		return appendObject(bucket, label.ID, label)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return label, nil
+}
+
+func (b *Labels) UpdateLabel(user string, update *backend.LabelUpdate) (label *backend.Label, err error) {
+	err = b.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := userCollection(tx, labelsBucket, user)
+		if err != nil {
+			return err
+		}
+
+		label = &backend.Label{}
+		ok, err := findObject(bucket, update.Label.ID, label)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("No such label")
+		}
+
+		update.Apply(label)
+		_, err = updateObject(bucket, label.ID, label)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (b *Labels) DeleteLabel(user, id string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := userCollection(tx, labelsBucket, user)
+		if err != nil {
+			return err
+		}
+
+		ok, err := deleteObject(bucket, id)
+		if err == nil && !ok {
+			err = errors.New("No such label")
+		}
+		return err
+	})
+}
+
+func NewLabels(db *DB) backend.LabelsBackend {
+	return &Labels{db}
+}
@@ -0,0 +1,214 @@
+package bolt
+
+import (
+	"encoding/json"
+	"errors"
+
+	"go.etcd.io/bbolt"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util"
+)
+
+// Stores messages.
+type Messages struct {
+	db *DB
+}
+
+// A stored message. Attachments are stored separately.
+type message struct {
+	*backend.Message
+	// These fields aren't marshaled by default
+	InReplyTo string
+	References string
+}
+
+func storedMessage(msg *backend.Message) *message {
+	stored := *msg
+	stored.Attachments = nil
+	return &message{
+		Message: &stored,
+		InReplyTo: msg.InReplyTo,
+		References: msg.References,
+	}
+}
+
+func unmarshalMessage(data []byte) (*backend.Message, error) {
+	msg := &message{Message: &backend.Message{}}
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+
+	msg.Message.InReplyTo = msg.InReplyTo
+	msg.Message.References = msg.References
+	return msg.Message, nil
+}
+
+// List all user's messages, with their attachments.
+func listMessages(tx *bbolt.Tx, user string) ([]*backend.Message, error) {
+	bucket, err := userCollection(tx, messagesBucket, user)
+	if err != nil {
+		return nil, err
+	}
+
+	atts, err := listAttachments(tx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []*backend.Message
+	err = forEach(bucket, func(k, data []byte) error {
+		msg, err := unmarshalMessage(data)
+		if err != nil {
+			return err
+		}
+
+		msg.Attachments = atts[msg.ID]
+		msgs = append(msgs, msg)
+		return nil
+	})
+	return msgs, err
+}
+
+func (b *Messages) listMessages(user string) (msgs []*backend.Message, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		msgs, err = listMessages(tx, user)
+		return err
+	})
+	return
+}
+
+// Find a message, with its attachments.
+func getMessage(tx *bbolt.Tx, user, id string) (*backend.Message, error) {
+	bucket, err := userCollection(tx, messagesBucket, user)
+	if err != nil {
+		return nil, err
+	}
+
+	_, data := getObjectData(bucket, id)
+	if data == nil {
+		return nil, errors.New("No such message")
+	}
+
+	msg, err := unmarshalMessage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.Attachments, err = listMessageAttachments(tx, user, id); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (b *Messages) GetMessage(user, id string) (msg *backend.Message, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		msg, err = getMessage(tx, user, id)
+		return err
+	})
+	return
+}
+
+func (b *Messages) ListMessages(user string, filter *backend.MessagesFilter) ([]*backend.Message, int, error) {
+	all, err := b.listMessages(user)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	filtered := []*backend.Message{}
+	for _, msg := range all {
+		if filter.Match(msg) {
+			filtered = append(filtered, msg)
+		}
+	}
+
+	from, to := filter.PageBounds(len(filtered))
+	return filtered[from:to], len(filtered), nil
+}
+
+func (b *Messages) CountMessages(user string) (counts []*backend.MessagesCount, err error) {
+	msgs, err := b.listMessages(user)
+	if err != nil {
+		return
+	}
+
+	indexes := map[string]int{}
+	for _, msg := range msgs {
+		for _, label := range msg.LabelIDs {
+			i, ok := indexes[label]
+			if !ok {
+				i = len(counts)
+				indexes[label] = i
+				counts = append(counts, &backend.MessagesCount{LabelID: label})
+			}
+
+			counts[i].Total++
+			if msg.IsRead == 0 {
+				counts[i].Unread++
+			}
+		}
+	}
+
+	return
+}
+
+func (b *Messages) InsertMessage(user string, msg *backend.Message) (*backend.Message, error) {
+	msg.ID = util.GenerateId()
+	msg.NumAttachments = len(msg.Attachments)
+
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := userCollection(tx, messagesBucket, user)
+		if err != nil {
+			return err
+		}
+
+		msg.Order = count(bucket)
+		return appendObject(bucket, msg.ID, storedMessage(msg))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (b *Messages) UpdateMessage(user string, update *backend.MessageUpdate) (msg *backend.Message, err error) {
+	err = b.db.Update(func(tx *bbolt.Tx) error {
+		m, err := getMessage(tx, user, update.Message.ID)
+		if err != nil {
+			return err
+		}
+
+		update.Apply(m)
+		msg = m
+
+		bucket, err := userCollection(tx, messagesBucket, user)
+		if err != nil {
+			return err
+		}
+		_, err = updateObject(bucket, msg.ID, storedMessage(msg))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (b *Messages) DeleteMessage(user, id string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := userCollection(tx, messagesBucket, user)
+		if err != nil {
+			return err
+		}
+
+		ok, err := deleteObject(bucket, id)
+		if err == nil && !ok {
+			err = errors.New("No such message")
+		}
+		return err
+	})
+}
+
+func NewMessages(db *DB) backend.MessagesBackend {
+	return &Messages{db}
+}
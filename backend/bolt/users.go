@@ -0,0 +1,151 @@
+package bolt
+
+import (
+	"encoding/json"
+	"errors"
+
+	"go.etcd.io/bbolt"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util"
+)
+
+// Stores users, by ID. Passwords are hashed with bcrypt.
+type Users struct {
+	db *DB
+}
+
+type user struct {
+	*backend.User
+	Password []byte
+}
+
+func getUser(tx *bbolt.Tx, id string) (*user, error) {
+	data := tx.Bucket(usersBucket).Get([]byte(id))
+	if data == nil {
+		return nil, errors.New("No such user")
+	}
+
+	u := &user{}
+	if err := json.Unmarshal(data, u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Find a user by name. Returns nil if there is no such user.
+func getUserByName(tx *bbolt.Tx, username string) (found *user, err error) {
+	err = tx.Bucket(usersBucket).ForEach(func(k, data []byte) error {
+		u := &user{}
+		if err := json.Unmarshal(data, u); err != nil {
+			return err
+		}
+
+		if u.Name == username {
+			found = u
+		}
+		return nil
+	})
+	return
+}
+
+func (b *Users) IsUsernameAvailable(username string) (available bool, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		u, err := getUserByName(tx, username)
+		available = u == nil
+		return err
+	})
+	return
+}
+
+func (b *Users) GetUser(id string) (u *backend.User, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		item, err := getUser(tx, id)
+		if err != nil {
+			return err
+		}
+
+		u = item.User
+		return nil
+	})
+	return
+}
+
+func (b *Users) Auth(username, password string) (u *backend.User, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		item, err := getUserByName(tx, username)
+		if err != nil {
+			return err
+		}
+
+		if item == nil || bcrypt.CompareHashAndPassword(item.Password, []byte(password)) != nil {
+			return errors.New("Invalid username and password combination")
+		}
+
+		u = item.User
+		return nil
+	})
+	return
+}
+
+func (b *Users) InsertUser(u *backend.User, password string) (*backend.User, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.db.Update(func(tx *bbolt.Tx) error {
+		existing, err := getUserByName(tx, u.Name)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return errors.New("Username already taken")
+		}
+
+		u.ID = util.GenerateId()
+		return putObject(tx.Bucket(usersBucket), []byte(u.ID), &user{User: u, Password: hash})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return b.GetUser(u.ID)
+}
+
+func (b *Users) UpdateUser(update *backend.UserUpdate) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		item, err := getUser(tx, update.User.ID)
+		if err != nil {
+			return err
+		}
+
+		update.Apply(item.User)
+		return putObject(tx.Bucket(usersBucket), []byte(item.ID), item)
+	})
+}
+
+func (b *Users) UpdateUserPassword(id, current, new string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		item, err := getUser(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if bcrypt.CompareHashAndPassword(item.Password, []byte(current)) != nil {
+			return errors.New("Invalid password")
+		}
+
+		item.Password, err = bcrypt.GenerateFromPassword([]byte(new), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+
+		return putObject(tx.Bucket(usersBucket), []byte(item.ID), item)
+	})
+}
+
+func NewUsers(db *DB) backend.UsersBackend {
+	return &Users{db}
+}
@@ -41,3 +41,97 @@ type ConversationLabel struct {
 	NumMessages int
 	NumUnread int
 }
+
+func isEmailInList(needle *Email, haystack []*Email) bool {
+	for _, email := range haystack {
+		if needle.Address == email.Address {
+			return true
+		}
+	}
+	return false
+}
+
+// Add a message to the conversation, updating its counts and labels.
+func (conv *Conversation) AddMessage(msg *Message) {
+	conv.NumMessages++
+	if msg.IsRead == 0 {
+		conv.NumUnread++
+	}
+
+	if msg.Time > conv.Time {
+		conv.Time = msg.Time
+		conv.Subject = msg.Subject
+	}
+
+	if !isEmailInList(msg.Sender, conv.Senders) {
+		conv.Senders = append(conv.Senders, msg.Sender)
+	}
+
+	for _, email := range msg.ToList {
+		if !isEmailInList(email, conv.Recipients) {
+			conv.Recipients = append(conv.Recipients, email)
+		}
+	}
+
+	for _, labelId := range msg.LabelIDs {
+		var label *ConversationLabel
+		for _, l := range conv.Labels {
+			if l.ID == labelId {
+				label = l
+				break
+			}
+		}
+
+		if label == nil {
+			label = &ConversationLabel{ ID: labelId }
+			conv.Labels = append(conv.Labels, label)
+			conv.LabelIDs = append(conv.LabelIDs, labelId)
+		}
+
+		label.NumMessages++
+		if msg.IsRead == 0 {
+			label.NumUnread++
+		}
+	}
+}
+
+// Group messages by conversation. Conversations are sorted by their first
+// message.
+func GroupConversations(msgs []*Message) []*Conversation {
+	var convs []*Conversation
+	indexes := map[string]int{}
+	for _, msg := range msgs {
+		i, ok := indexes[msg.ConversationID]
+		if !ok {
+			i = len(convs)
+			indexes[msg.ConversationID] = i
+			convs = append(convs, &Conversation{ID: msg.ConversationID})
+		}
+
+		convs[i].AddMessage(msg)
+	}
+	return convs
+}
+
+// Count conversations by label. A conversation is unread if one of its
+// messages is unread.
+func CountConversations(convs []*Conversation) []*MessagesCount {
+	var counts []*MessagesCount
+	indexes := map[string]int{}
+	for _, conv := range convs {
+		for _, label := range conv.LabelIDs {
+			i, ok := indexes[label]
+			if !ok {
+				i = len(counts)
+				indexes[label] = i
+				counts = append(counts, &MessagesCount{LabelID: label})
+			}
+
+			counts[i].Total++
+			if conv.NumUnread > 0 {
+				counts[i].Unread++
+			}
+		}
+	}
+	return counts
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io/ioutil"
 	"os"
+	"strings"
 
 	"github.com/emersion/neutron/backend"
 	"github.com/emersion/neutron/backend/events"
@@ -75,6 +76,34 @@ func (b *Addresses) GetAddress(user, id string) (*backend.Address, error) {
 	return addresses[i], nil
 }
 
+// Addresses are stored per user, so all users' addresses are loaded.
+func (b *Addresses) GetAddressByEmail(email string) (string, *backend.Address, error) {
+	files, err := ioutil.ReadDir(b.config.Directory)
+	if err != nil && !os.IsNotExist(err) {
+		return "", nil, err
+	}
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		user := strings.TrimSuffix(f.Name(), ".json")
+		addresses, err := b.loadAddresses(user)
+		if err != nil {
+			return "", nil, err
+		}
+
+		for _, addr := range addresses {
+			if strings.EqualFold(addr.Email, email) {
+				return user, addr, nil
+			}
+		}
+	}
+
+	return "", nil, errors.New("No such address")
+}
+
 func (b *Addresses) InsertAddress(user string, address *backend.Address) (*backend.Address, error) {
 	addresses, err := b.loadAddresses(user)
 	if err != nil {
@@ -0,0 +1,367 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util"
+)
+
+const attachmentMetadataExt = ".json"
+
+// Attachments more recent than this are never garbage collected, because they
+// can belong to a message being composed.
+const attachmentsGcDelay = time.Hour
+
+// Stores attachments on disk.
+// Attachments contents are stored in USER/ID and their metadata in
+// USER/ID.json. If a users backend is available, uploads exceeding the user's
+// MaxUpload or MaxSpace are rejected.
+type Attachments struct {
+	config *Config
+	users backend.UsersBackend
+
+	// Uploads of a user are serialized, so that they cannot exceed the
+	// available space together
+	lock sync.Mutex
+	userLocks map[string]*sync.Mutex
+}
+
+// Lock a user's uploads. Returns a function unlocking them.
+func (b *Attachments) lockUser(user string) func() {
+	b.lock.Lock()
+	l, ok := b.userLocks[user]
+	if !ok {
+		l = &sync.Mutex{}
+		b.userLocks[user] = l
+	}
+	b.lock.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+func (b *Attachments) getUserPath(user string) string {
+	return b.config.Directory + "/" + user
+}
+
+func (b *Attachments) getDataPath(user, id string) string {
+	return b.getUserPath(user) + "/" + id
+}
+
+func (b *Attachments) getMetadataPath(user, id string) string {
+	return b.getDataPath(user, id) + attachmentMetadataExt
+}
+
+func (b *Attachments) loadAttachment(user, id string) (att *backend.Attachment, err error) {
+	if id == "" || strings.ContainsAny(id, "/\\") {
+		return nil, errors.New("No such attachment")
+	}
+
+	data, err := ioutil.ReadFile(b.getMetadataPath(user, id))
+	if os.IsNotExist(err) {
+		return nil, errors.New("No such attachment")
+	}
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, &att)
+	return
+}
+
+func (b *Attachments) saveAttachment(user string, att *backend.Attachment) error {
+	data, err := json.Marshal(att)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(b.getMetadataPath(user, att.ID), data, 0644)
+}
+
+// List metadata files of all user's attachments.
+func (b *Attachments) listFiles(user string) (files []os.FileInfo, err error) {
+	all, err := ioutil.ReadDir(b.getUserPath(user))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+
+	for _, f := range all {
+		if strings.HasSuffix(f.Name(), attachmentMetadataExt) {
+			files = append(files, f)
+		}
+	}
+	return
+}
+
+func (b *Attachments) listAllAttachments(user string) (atts []*backend.Attachment, err error) {
+	files, err := b.listFiles(user)
+	if err != nil {
+		return
+	}
+
+	for _, f := range files {
+		var att *backend.Attachment
+		att, err = b.loadAttachment(user, strings.TrimSuffix(f.Name(), attachmentMetadataExt))
+		if err != nil {
+			return
+		}
+		atts = append(atts, att)
+	}
+	return
+}
+
+func (b *Attachments) ListAttachments(user, msg string) (atts []*backend.Attachment, err error) {
+	all, err := b.listAllAttachments(user)
+	if err != nil {
+		return
+	}
+
+	for _, att := range all {
+		if att.MessageID == msg {
+			atts = append(atts, att)
+		}
+	}
+	return
+}
+
+// Get the space used by all user's attachments, in bytes.
+func (b *Attachments) UsedSpace(user string) (int, error) {
+	atts, err := b.listAllAttachments(user)
+	if err != nil {
+		return 0, err
+	}
+
+	used := 0
+	for _, att := range atts {
+		used += att.Size
+	}
+	return used, nil
+}
+
+// Get the maximum size of a new attachment. Returns -1 if there is no limit.
+func (b *Attachments) getUploadLimit(user string) (limit int, err error) {
+	limit = -1
+	if b.users == nil {
+		return
+	}
+
+	u, err := b.users.GetUser(user)
+	if err != nil {
+		return
+	}
+
+	if u.MaxUpload > 0 {
+		limit = u.MaxUpload
+	}
+	if u.MaxSpace > 0 {
+		available := u.MaxSpace - u.UsedSpace
+		if available < 0 {
+			available = 0
+		}
+		if limit < 0 || available < limit {
+			limit = available
+		}
+	}
+	return
+}
+
+func (b *Attachments) ReadAttachment(user, id string) (*backend.Attachment, []byte, error) {
+	att, r, err := b.OpenAttachment(user, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return att, data, nil
+}
+
+func (b *Attachments) OpenAttachment(user, id string) (*backend.Attachment, io.ReadCloser, error) {
+	att, err := b.loadAttachment(user, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.Open(b.getDataPath(user, id))
+	if err != nil {
+		return nil, nil, err
+	}
+	return att, f, nil
+}
+
+func (b *Attachments) InsertAttachment(user string, att *backend.Attachment, contents []byte) (*backend.Attachment, error) {
+	return b.InsertAttachmentFrom(user, att, bytes.NewReader(contents))
+}
+
+func (b *Attachments) InsertAttachmentFrom(user string, att *backend.Attachment, r io.Reader) (*backend.Attachment, error) {
+	if err := os.MkdirAll(b.getUserPath(user), 0744); err != nil {
+		return nil, err
+	}
+
+	unlock := b.lockUser(user)
+	defer unlock()
+
+	limit, err := b.getUploadLimit(user)
+	if err != nil {
+		return nil, err
+	}
+	if limit >= 0 {
+		// Read one more byte to detect attachments exceeding the limit
+		r = io.LimitReader(r, int64(limit) + 1)
+	}
+
+	att.ID = util.GenerateId()
+
+	path := b.getDataPath(user, att.ID)
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && limit >= 0 && n > int64(limit) {
+		err = errors.New("Attachment exceeds the maximum upload size or available space")
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	att.Size = int(n)
+	if err := b.saveAttachment(user, att); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return att, nil
+}
+
+func (b *Attachments) DeleteAttachment(user, id string) error {
+	if _, err := b.loadAttachment(user, id); err != nil {
+		return err
+	}
+
+	if err := os.Remove(b.getMetadataPath(user, id)); err != nil {
+		return err
+	}
+	return os.Remove(b.getDataPath(user, id))
+}
+
+// Set the message an attachment belongs to.
+func (b *Attachments) UpdateAttachmentMessage(user, id, msgId string) error {
+	att, err := b.loadAttachment(user, id)
+	if err != nil {
+		return err
+	}
+
+	att.MessageID = msgId
+	return b.saveAttachment(user, att)
+}
+
+// Delete orphaned attachments, i.e. attachments for which isOrphan returns
+// true. Recent attachments are kept. Returns the number of deleted attachments.
+func (b *Attachments) CollectGarbage(user string, isOrphan func(att *backend.Attachment) bool) (n int, err error) {
+	files, err := b.listFiles(user)
+	if err != nil {
+		return
+	}
+
+	for _, f := range files {
+		if time.Since(f.ModTime()) < attachmentsGcDelay {
+			continue
+		}
+
+		var att *backend.Attachment
+		att, err = b.loadAttachment(user, strings.TrimSuffix(f.Name(), attachmentMetadataExt))
+		if err != nil {
+			return
+		}
+
+		if !isOrphan(att) {
+			continue
+		}
+
+		if err = b.DeleteAttachment(user, att.ID); err != nil {
+			return
+		}
+		n++
+	}
+	return
+}
+
+// Create a new disk attachments backend. users can be nil if quotas must not
+// be enforced, otherwise users' UsedSpace must include their attachments.
+func NewAttachments(config *Config, users backend.UsersBackend) backend.AttachmentsBackend {
+	return &Attachments{
+		config: config,
+		users: users,
+		userLocks: make(map[string]*sync.Mutex),
+	}
+}
+
+// Adds the space used by attachments to users' UsedSpace.
+type attachmentsUsers struct {
+	backend.UsersBackend
+
+	attachments *Attachments
+}
+
+func (b *attachmentsUsers) addUsedSpace(user *backend.User) (*backend.User, error) {
+	used, err := b.attachments.UsedSpace(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Don't modify the user stored by the underlying backend
+	u := *user
+	u.UsedSpace += used
+	return &u, nil
+}
+
+func (b *attachmentsUsers) GetUser(id string) (*backend.User, error) {
+	user, err := b.UsersBackend.GetUser(id)
+	if err != nil {
+		return nil, err
+	}
+	return b.addUsedSpace(user)
+}
+
+func (b *attachmentsUsers) Auth(username, password string) (*backend.User, error) {
+	user, err := b.UsersBackend.Auth(username, password)
+	if err != nil {
+		return nil, err
+	}
+	return b.addUsedSpace(user)
+}
+
+// Store attachments on disk. If a users backend is available, attachments are
+// accounted in users' used space and quotas are enforced.
+func UseAttachments(bkd *backend.Backend, config *Config) {
+	atts := NewAttachments(config, nil).(*Attachments)
+	if bkd.UsersBackend != nil {
+		users := &attachmentsUsers{
+			UsersBackend: bkd.UsersBackend,
+			attachments: atts,
+		}
+		atts.users = users
+		bkd.Set(users)
+	}
+	bkd.Set(atts)
+}
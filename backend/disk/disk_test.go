@@ -0,0 +1,61 @@
+package disk_test
+
+import (
+	"testing"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/backendtest"
+	"github.com/emersion/neutron/backend/disk"
+	"github.com/emersion/neutron/backend/memory"
+)
+
+func TestBackend(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) *backend.Backend {
+		// Disk backends store data which isn't stored elsewhere, the memory
+		// backend provides the rest
+		bkd := backend.New()
+		memory.Use(bkd)
+
+		disk.UseKeys(bkd, &disk.Config{Directory: t.TempDir()})
+		disk.UseContacts(bkd, &disk.Config{Directory: t.TempDir()})
+		disk.UseUsersSettings(bkd, &disk.Config{Directory: t.TempDir()})
+		disk.UseAddresses(bkd, &disk.Config{Directory: t.TempDir()})
+		disk.UseDkimKeys(bkd, &disk.Config{Directory: t.TempDir()})
+		return bkd
+	})
+}
+
+// Attachments are tested alone, because messages of the memory backend only
+// have attachments stored in memory.
+func TestAttachments(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) *backend.Backend {
+		// Test users don't exist, so quotas cannot be enforced
+		bkd := backend.New()
+		bkd.Set(disk.NewAttachments(&disk.Config{Directory: t.TempDir()}, nil))
+		return bkd
+	})
+}
+
+func TestAttachmentsQuota(t *testing.T) {
+	bkd := backend.New()
+	memory.Use(bkd)
+	disk.UseAttachments(bkd, &disk.Config{Directory: t.TempDir()})
+
+	u, err := bkd.InsertUser(&backend.User{Name: "quota", MaxSpace: 5}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := bkd.InsertAttachment(u.ID, &backend.Attachment{Name: "a"}, []byte("abc")); err != nil {
+		t.Fatal("InsertAttachment() =", err)
+	}
+	if u, err := bkd.GetUser(u.ID); err != nil || u.UsedSpace != 3 {
+		t.Errorf("GetUser() = %+v, %v, want attachments in used space", u, err)
+	}
+	if _, err := bkd.InsertAttachment(u.ID, &backend.Attachment{Name: "b"}, []byte("def")); err == nil {
+		t.Error("InsertAttachment() exceeding the available space succeeded")
+	}
+	if u, err := bkd.GetUser(u.ID); err != nil || u.UsedSpace != 3 {
+		t.Errorf("GetUser() after a rejected upload = %+v, %v", u, err)
+	}
+}
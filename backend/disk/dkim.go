@@ -0,0 +1,70 @@
+package disk
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/emersion/neutron/backend"
+)
+
+// Stores DKIM keys on disk, in DOMAIN.json.
+type DkimKeys struct {
+	config *Config
+}
+
+func (b *DkimKeys) getKeyPath(domain string) (string, error) {
+	if domain == "" || strings.ContainsAny(domain, "/\\") {
+		return "", errors.New("Invalid domain name")
+	}
+	return b.config.Directory + "/" + domain + ".json", nil
+}
+
+func (b *DkimKeys) GetDkimKey(domain string) (key *backend.DkimKey, err error) {
+	path, err := b.getKeyPath(domain)
+	if err != nil {
+		return
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, &key)
+	return
+}
+
+func (b *DkimKeys) UpdateDkimKey(domain string, key *backend.DkimKey) error {
+	path, err := b.getKeyPath(domain)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(b.config.Directory, 0700); err != nil {
+		return err
+	}
+
+	// Private keys must not be readable by other users
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+func NewDkimKeys(config *Config) backend.DkimBackend {
+	return &DkimKeys{
+		config: config,
+	}
+}
+
+func UseDkimKeys(bkd *backend.Backend, config *Config) {
+	bkd.Set(NewDkimKeys(config))
+}
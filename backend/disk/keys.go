@@ -106,8 +106,7 @@ func (b *Keys) UpdateKeypair(email string, keypair *backend.Keypair) (updated *b
 		return
 	}
 
-	updated = keypair
-	return
+	return b.GetKeypair(email)
 }
 
 func NewKeys(config *Config, users backend.UsersBackend) backend.KeysBackend {
@@ -0,0 +1,50 @@
+// Checks domains' DNS records: ownership verification, MX, SPF, DKIM and DMARC.
+package domaincheck
+
+import (
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util/resolver"
+)
+
+// Prefix of the TXT record proving a domain's ownership. It's followed by the
+// domain's verification code.
+const VerifyPrefix = "neutron-verification="
+
+type Config struct {
+	// DNS server used for lookups. Defaults to servers listed in
+	// /etc/resolv.conf.
+	Resolver string
+	// Hostnames of the servers receiving messages for domains.
+	MxHosts []string
+	// SPF mechanism which must appear in domains' SPF record, e.g.
+	// "include:_spf.example.org". If empty, any SPF record is accepted.
+	Spf string
+}
+
+// A DomainsCheckBackend which performs DNS lookups and stores domains' states
+// with the backend's DomainsBackend.
+type Checker struct {
+	config *Config
+	resolver resolver.Resolver
+	backend *backend.Backend
+}
+
+// Create a new domain checker. If r is nil, a resolver is created from the
+// config.
+func New(config *Config, r resolver.Resolver, bkd *backend.Backend) *Checker {
+	if r == nil {
+		r = resolver.New(config.Resolver)
+	}
+
+	return &Checker{
+		config: config,
+		resolver: r,
+		backend: bkd,
+	}
+}
+
+func Use(bkd *backend.Backend, config *Config) *Checker {
+	checker := New(config, nil, bkd)
+	bkd.Set(checker)
+	return checker
+}
@@ -0,0 +1,236 @@
+package domaincheck
+
+import (
+	"crypto"
+	"strings"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util/dkim"
+	"github.com/emersion/neutron/backend/util/resolver"
+)
+
+// Get the TXT records of a name starting with prefix. A missing record isn't an
+// error.
+func (c *Checker) lookupTXT(name, prefix string) (matches []string, err error) {
+	txts, err := c.resolver.LookupTXT(name)
+	if err == resolver.ErrNoRecord {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+
+	for _, txt := range txts {
+		if strings.HasPrefix(strings.ToLower(txt), strings.ToLower(prefix)) {
+			matches = append(matches, txt)
+		}
+	}
+	return
+}
+
+func (c *Checker) checkVerify(domain *backend.Domain) (int, error) {
+	// Domains added by the administrator don't need to be verified
+	if domain.VerifyCode == "" {
+		return backend.DomainVerifyGood, nil
+	}
+
+	txts, err := c.lookupTXT(domain.DomainName, VerifyPrefix)
+	if err != nil || len(txts) == 0 {
+		return backend.DomainVerifyDefault, err
+	}
+
+	for _, txt := range txts {
+		if strings.TrimSpace(txt[len(VerifyPrefix):]) == domain.VerifyCode {
+			return backend.DomainVerifyGood, nil
+		}
+	}
+	return backend.DomainVerifyExist, nil
+}
+
+func (c *Checker) isOurHost(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	for _, h := range c.config.MxHosts {
+		if strings.EqualFold(host, strings.TrimSuffix(h, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Checker) checkMx(domain *backend.Domain) (int, error) {
+	mxs, _, err := c.resolver.LookupMX(domain.DomainName)
+	if err == resolver.ErrNoRecord || (err == nil && len(mxs) == 0) {
+		return backend.DomainMxDefault, nil
+	}
+	if err != nil {
+		return backend.DomainMxDefault, err
+	}
+
+	ours := 0
+	for _, mx := range mxs {
+		if c.isOurHost(mx.Host) {
+			ours++
+		}
+	}
+
+	switch ours {
+	case 0:
+		return backend.DomainMxNoUs, nil
+	case len(mxs):
+		return backend.DomainMxGood, nil
+	default:
+		return backend.DomainMxIncUs, nil
+	}
+}
+
+func (c *Checker) checkSpf(domain *backend.Domain) (int, error) {
+	txts, err := c.lookupTXT(domain.DomainName, "v=spf1")
+	if err != nil || len(txts) == 0 {
+		return backend.DomainSpfDefault, err
+	}
+	if len(txts) > 1 {
+		// Multiple SPF records are a permanent error, see RFC 7208 section 4.5
+		return backend.DomainSpfMultiple, nil
+	}
+
+	record := strings.Fields(txts[0])
+	if !strings.EqualFold(record[0], "v=spf1") {
+		// Another version, e.g. "v=spf10"
+		return backend.DomainSpfDefault, nil
+	}
+	if c.config.Spf == "" {
+		return backend.DomainSpfGood, nil
+	}
+
+	for _, term := range record[1:] {
+		// Mechanisms can have a qualifier
+		term = strings.TrimLeft(term, "+")
+		if strings.EqualFold(term, c.config.Spf) {
+			return backend.DomainSpfGood, nil
+		}
+	}
+	return backend.DomainSpfOne, nil
+}
+
+func (c *Checker) checkDkim(domain *backend.Domain) (int, error) {
+	if c.backend.DkimBackend == nil {
+		return backend.DomainDkimDefault, nil
+	}
+
+	key, err := c.backend.GetDkimKey(domain.DomainName)
+	if err != nil || key == nil {
+		return backend.DomainDkimDefault, err
+	}
+
+	signer, err := dkim.ParsePrivateKey(key.PrivateKey)
+	if err != nil {
+		return backend.DomainDkimDefault, err
+	}
+
+	txts, err := c.resolver.LookupTXT(dkim.RecordName(domain.DomainName, key.Selector))
+	if err == resolver.ErrNoRecord || (err == nil && len(txts) == 0) {
+		return backend.DomainDkimDefault, nil
+	}
+	if err != nil {
+		return backend.DomainDkimDefault, err
+	}
+
+	pub, err := dkim.ParseRecord(strings.Join(txts, ""))
+	if err != nil {
+		return backend.DomainDkimError, nil
+	}
+
+	if pub, ok := pub.(interface{ Equal(crypto.PublicKey) bool }); ok && pub.Equal(signer.Public()) {
+		return backend.DomainDkimGood, nil
+	}
+	return backend.DomainDkimError, nil
+}
+
+func (c *Checker) checkDmarc(domain *backend.Domain) (int, error) {
+	txts, err := c.lookupTXT("_dmarc." + domain.DomainName, "v=DMARC1")
+	if err != nil || len(txts) == 0 {
+		return backend.DomainDmarcDefault, err
+	}
+	if len(txts) > 1 {
+		return backend.DomainDmarcMultiple, nil
+	}
+
+	// The policy tag is required, see RFC 7489 section 6.3
+	for _, tag := range strings.Split(txts[0], ";") {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == "p" && strings.TrimSpace(kv[1]) != "" {
+			return backend.DomainDmarcGood, nil
+		}
+	}
+	return backend.DomainDmarcOne, nil
+}
+
+// Compute all of a domain's states.
+func (c *Checker) check(domain *backend.Domain) (states *backend.Domain, err error) {
+	states = &backend.Domain{ID: domain.ID}
+
+	if states.VerifyState, err = c.checkVerify(domain); err != nil {
+		return
+	}
+	if states.MxState, err = c.checkMx(domain); err != nil {
+		return
+	}
+	if states.SpfState, err = c.checkSpf(domain); err != nil {
+		return
+	}
+	if states.DkimState, err = c.checkDkim(domain); err != nil {
+		return
+	}
+	if states.DmarcState, err = c.checkDmarc(domain); err != nil {
+		return
+	}
+
+	if states.VerifyState != backend.DomainVerifyGood {
+		states.State = backend.DomainDefault
+	} else if states.MxState == backend.DomainMxGood && states.SpfState == backend.DomainSpfGood &&
+		states.DkimState == backend.DomainDkimGood && states.DmarcState == backend.DomainDmarcGood {
+		states.State = backend.DomainActive
+	} else {
+		states.State = backend.DomainWarning
+	}
+	return
+}
+
+func statesEqual(a, b *backend.Domain) bool {
+	return a.State == b.State && a.VerifyState == b.VerifyState &&
+		a.MxState == b.MxState && a.SpfState == b.SpfState &&
+		a.DkimState == b.DkimState && a.DmarcState == b.DmarcState
+}
+
+func (c *Checker) CheckDomain(user, id string) (*backend.Domain, error) {
+	domain, err := c.backend.GetDomain(id)
+	if err != nil {
+		return nil, err
+	}
+
+	states, err := c.check(domain)
+	if err != nil {
+		return nil, err
+	}
+	if statesEqual(domain, states) {
+		return domain, nil
+	}
+
+	domain, err = c.backend.UpdateDomain(&backend.DomainUpdate{
+		Domain: states,
+		States: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Domains added by users are only visible to their owner
+	if domain.UserID != "" {
+		user = domain.UserID
+	}
+
+	event := backend.NewDomainDeltaEvent(domain.ID, backend.EventUpdate, domain)
+	c.backend.InsertEvent(user, event)
+
+	return domain, nil
+}
@@ -0,0 +1,143 @@
+package domaincheck_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/domaincheck"
+	"github.com/emersion/neutron/backend/memory"
+	"github.com/emersion/neutron/backend/util/dkim"
+	"github.com/emersion/neutron/backend/util/resolver"
+)
+
+// A resolver answering with static records.
+type staticResolver struct {
+	mx map[string][]*net.MX
+	txt map[string][]string
+}
+
+func (r *staticResolver) LookupMX(domain string) ([]*net.MX, bool, error) {
+	if mxs, ok := r.mx[domain]; ok {
+		return mxs, false, nil
+	}
+	return nil, false, resolver.ErrNoRecord
+}
+
+func (r *staticResolver) LookupTXT(name string) ([]string, error) {
+	if txts, ok := r.txt[name]; ok {
+		return txts, nil
+	}
+	return nil, resolver.ErrNoRecord
+}
+
+func (r *staticResolver) LookupTLSA(name string) ([]*resolver.TLSA, error) {
+	return nil, resolver.ErrNoRecord
+}
+
+func (r *staticResolver) LookupIP(host string) ([]net.IP, error) {
+	return nil, resolver.ErrNoRecord
+}
+
+// An events backend recording inserted events.
+type eventsRecorder struct {
+	backend.EventsBackend
+	events map[string][]*backend.Event
+}
+
+func (r *eventsRecorder) InsertEvent(user string, event *backend.Event) error {
+	r.events[user] = append(r.events[user], event)
+	return nil
+}
+
+func TestCheckDomain(t *testing.T) {
+	bkd := backend.New()
+	memory.Use(bkd)
+	evts := &eventsRecorder{bkd.EventsBackend, map[string][]*backend.Event{}}
+	bkd.Set(evts)
+
+	domain, err := bkd.InsertDomain(&backend.Domain{
+		DomainName: "example.org",
+		VerifyCode: "s3cr3t",
+		UserID: "owner",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &staticResolver{
+		mx: map[string][]*net.MX{},
+		txt: map[string][]string{},
+	}
+	checker := domaincheck.New(&domaincheck.Config{
+		MxHosts: []string{"mx.neutron.example"},
+		Spf: "include:_spf.neutron.example",
+	}, r, bkd)
+
+	domain, err = checker.CheckDomain("user", domain.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if domain.State != backend.DomainDefault || domain.VerifyState != backend.DomainVerifyDefault {
+		t.Errorf("Expected domain without records not to be verified, got state %v and verify state %v", domain.State, domain.VerifyState)
+	}
+
+	signer, err := dkim.GenerateKey(dkim.Ed25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := dkim.MarshalPrivateKey(signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := dkim.FormatRecord(signer.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bkd.UpdateDkimKey("example.org", &backend.DkimKey{Selector: "neutron", PrivateKey: priv}); err != nil {
+		t.Fatal(err)
+	}
+
+	r.mx["example.org"] = []*net.MX{{Host: "mx.neutron.example.", Pref: 10}}
+	r.txt["example.org"] = []string{
+		domaincheck.VerifyPrefix + "s3cr3t",
+		"v=spf1 mx include:_spf.neutron.example -all",
+	}
+	r.txt["neutron._domainkey.example.org"] = []string{record}
+	r.txt["_dmarc.example.org"] = []string{"v=DMARC1; p=quarantine"}
+
+	domain, err = checker.CheckDomain("user", domain.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if domain.State != backend.DomainActive {
+		t.Errorf("Expected domain to be active, got states %+v", domain)
+	}
+	if events := evts.events["owner"]; len(events) != 1 || len(events[0].Domains) != 1 {
+		t.Errorf("Expected the domain's owner to receive an event, got %v", events)
+	}
+
+	r.mx["example.org"] = append(r.mx["example.org"], &net.MX{Host: "mx.example.org.", Pref: 20})
+	r.txt["example.org"] = append(r.txt["example.org"], "v=spf1 -all")
+	r.txt["_dmarc.example.org"] = []string{"v=DMARC1; rua=mailto:dmarc@example.org"}
+
+	domain, err = checker.CheckDomain("user", domain.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if domain.State != backend.DomainWarning {
+		t.Errorf("Expected misconfigured domain to have a warning, got state %v", domain.State)
+	}
+	if domain.MxState != backend.DomainMxIncUs {
+		t.Errorf("Invalid MX state: %v", domain.MxState)
+	}
+	if domain.SpfState != backend.DomainSpfMultiple {
+		t.Errorf("Invalid SPF state: %v", domain.SpfState)
+	}
+	if domain.DkimState != backend.DomainDkimGood {
+		t.Errorf("Invalid DKIM state: %v", domain.DkimState)
+	}
+	if domain.DmarcState != backend.DomainDmarcOne {
+		t.Errorf("Invalid DMARC state: %v", domain.DmarcState)
+	}
+}
@@ -10,6 +10,31 @@ type DomainsBackend interface {
 	GetDomainByName(name string) (*Domain, error)
 	// Insert a new domain.
 	InsertDomain(domain *Domain) (*Domain, error)
+	// Update an existing domain.
+	UpdateDomain(update *DomainUpdate) (*Domain, error)
+}
+
+// Checks domains' DNS records.
+type DomainsCheckBackend interface {
+	// Check a domain's DNS records and update its states. If they have changed,
+	// an event is sent to the user.
+	CheckDomain(user, id string) (*Domain, error)
+}
+
+// Stores domains' DKIM keys.
+type DkimBackend interface {
+	// Get a domain's DKIM key.
+	// If the domain has no key, nil and no error must be returned.
+	GetDkimKey(domain string) (*DkimKey, error)
+	// Set a domain's DKIM key, replacing the previous one.
+	UpdateDkimKey(domain string, key *DkimKey) error
+}
+
+// A DKIM key, used to sign messages sent from a domain.
+type DkimKey struct {
+	Selector string
+	// The PEM-encoded private key.
+	PrivateKey string
 }
 
 // A domain name.
@@ -17,6 +42,13 @@ type Domain struct {
 	ID string
 	DomainName string
 
+	// The code which must be published in a TXT record to prove the domain's
+	// ownership. Domains added by the administrator have none.
+	VerifyCode string
+	// The user who added the domain. Domains added by the administrator have
+	// none.
+	UserID string
+
 	State int
 	VerifyState int
 	MxState int
@@ -26,3 +58,70 @@ type Domain struct {
 
 	Addresses []*Address
 }
+
+// Domain states.
+const (
+	DomainDefault int = iota // Not verified
+	DomainActive
+	DomainWarning // Verified, but misconfigured
+)
+
+// Domain verification states.
+const (
+	DomainVerifyDefault int = iota // No verification record
+	DomainVerifyExist // Verification record with another code
+	DomainVerifyGood
+)
+
+// Domain MX states.
+const (
+	DomainMxDefault int = iota // No MX record
+	DomainMxNoUs // No MX record points to our servers
+	DomainMxIncUs // Some MX records point to other servers
+	DomainMxGood
+)
+
+// Domain SPF states.
+const (
+	DomainSpfDefault int = iota // No SPF record
+	DomainSpfOne // SPF record doesn't include our servers
+	DomainSpfMultiple
+	DomainSpfGood
+)
+
+// Domain DKIM states.
+const (
+	DomainDkimDefault int = 0 // No DKIM key or record
+	DomainDkimError int = 3 // DKIM record doesn't match the key
+	DomainDkimGood int = 4
+)
+
+// Domain DMARC states.
+const (
+	DomainDmarcDefault int = iota // No DMARC record
+	DomainDmarcOne // DMARC record without policy
+	DomainDmarcMultiple
+	DomainDmarcGood
+)
+
+type DomainUpdate struct {
+	Domain *Domain
+	States bool
+}
+
+func (update *DomainUpdate) Apply(domain *Domain) {
+	updated := update.Domain
+
+	if updated.ID != domain.ID {
+		panic("Cannot apply update on a domain with a different ID")
+	}
+
+	if update.States {
+		domain.State = updated.State
+		domain.VerifyState = updated.VerifyState
+		domain.MxState = updated.MxState
+		domain.SpfState = updated.SpfState
+		domain.DkimState = updated.DkimState
+		domain.DmarcState = updated.DmarcState
+	}
+}
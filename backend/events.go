@@ -29,7 +29,7 @@ type Event struct {
 	Labels []*EventLabelDelta `json:",omitempty"`
 	Contacts []*EventContactDelta `json:",omitempty"`
 	User *User `json:",omitempty"`
-	//Domains `json:",omitempty"`
+	Domains []*EventDomainDelta `json:",omitempty"`
 	//Members `json:",omitempty"`
 	//Organization `json:",omitempty"`
 
@@ -113,8 +113,60 @@ func NewContactDeltaEvent(id string, action EventAction, contact *Contact) *Even
 	}
 }
 
+type EventDomainDelta struct {
+	EventDelta
+	Domain *Domain
+}
+
+func NewDomainDeltaEvent(id string, action EventAction, domain *Domain) *Event {
+	return &Event{
+		Domains: []*EventDomainDelta{
+			&EventDomainDelta{
+				EventDelta: EventDelta{ID: id, Action: action},
+				Domain: domain,
+			},
+		},
+	}
+}
+
 func NewUserEvent(user *User) *Event {
 	return &Event{
 		User: user,
 	}
 }
+
+// Merge src into dst. If dst is nil, a new event is created.
+func MergeEvents(dst, src *Event) *Event {
+	if dst == nil {
+		dst = &Event{}
+	}
+
+	dst.ID = src.ID
+
+	if src.Refresh != 0 {
+		dst.Refresh = src.Refresh
+	}
+	if src.Reload != 0 {
+		dst.Reload = src.Reload
+	}
+	if src.User != nil {
+		dst.User = src.User
+	}
+
+	dst.Notices = append(dst.Notices, src.Notices...)
+
+	dst.Messages = append(dst.Messages, src.Messages...)
+	dst.Conversations = append(dst.Conversations, src.Conversations...)
+	dst.Labels = append(dst.Labels, src.Labels...)
+	dst.Contacts = append(dst.Contacts, src.Contacts...)
+	dst.Domains = append(dst.Domains, src.Domains...)
+
+	if src.MessageCounts != nil {
+		dst.MessageCounts = src.MessageCounts
+	}
+	if src.ConversationCounts != nil {
+		dst.ConversationCounts = src.ConversationCounts
+	}
+
+	return dst
+}
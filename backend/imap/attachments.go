@@ -1,20 +1,107 @@
 package imap
 
 import (
+	"bytes"
 	"errors"
+	"io"
 	"io/ioutil"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/neutron/backend"
+	_textproto "github.com/emersion/neutron/backend/util/textproto"
 )
 
+// Records written data until stopped.
+type recorder struct {
+	buf bytes.Buffer
+	stopped bool
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if !r.stopped {
+		r.buf.Write(b)
+	}
+	return len(b), nil
+}
+
+func (r *recorder) stop() {
+	r.stopped = true
+	r.buf.Reset()
+}
+
+// Fetch a message's body structure.
+func (b *Messages) getBodyStructure(user, mailbox string, uid uint32) (*imap.BodyStructure, error) {
+	if err := b.selectMailbox(user, mailbox); err != nil {
+		return nil, err
+	}
+
+	c, unlock, err := b.getConn(user)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uid)
+
+	messages := make(chan *imap.Message, 1)
+	if err := c.UidFetch(seqset, []imap.FetchItem{imap.FetchBodyStructure}, messages); err != nil {
+		return nil, err
+	}
+
+	data := <-messages
+	if data == nil || data.BodyStructure == nil {
+		return nil, errNoSuchMessage
+	}
+	return data.BodyStructure, nil
+}
+
+// Errors if a message doesn't exist on the server.
+var errNoSuchMessage = errors.New("No such message")
+
 func (b *Messages) ListAttachments(user, msg string) ([]*backend.Attachment, error) {
-	return nil, errors.New("Not yet implemented")
+	// Attachments of a message which isn't on the server yet, e.g. a draft
+	// being composed, are only temporary ones
+	mailbox, uid, err := parseMessageId(msg)
+	if err != nil {
+		return b.tmpAtts.ListAttachments(user, msg)
+	}
+
+	structure, err := b.getBodyStructure(user, mailbox, uid)
+	if err == errNoSuchMessage {
+		return b.tmpAtts.ListAttachments(user, msg)
+	} else if err != nil {
+		return nil, err
+	}
+
+	attachments := bodyStructureAttachments(structure, mailbox, uid)
+
+	tmpAtts, err := b.tmpAtts.ListAttachments(user, msg)
+	if err == nil {
+		attachments = append(attachments, tmpAtts...)
+	}
+
+	return attachments, nil
 }
 
 func (b *Messages) ReadAttachment(user, id string) (att *backend.Attachment, out []byte, err error) {
+	att, r, err := b.OpenAttachment(user, id)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	if out, err = ioutil.ReadAll(r); err != nil {
+		return
+	}
+
+	att.Size = len(out)
+	return
+}
+
+func (b *Messages) OpenAttachment(user, id string) (att *backend.Attachment, r io.ReadCloser, err error) {
 	// First, try to get attachment from temporary backend
-	att, out, err = b.tmpAtts.ReadAttachment(user, id)
+	att, r, err = b.tmpAtts.OpenAttachment(user, id)
 	if err == nil {
 		return
 	}
@@ -25,12 +112,34 @@ func (b *Messages) ReadAttachment(user, id string) (att *backend.Attachment, out
 	if err != nil {
 		return
 	}
+	if partId == "" {
+		err = errors.New("Invalid attachment ID: no body part specified")
+		return
+	}
+
+	path, err := parsePartPath(partId)
+	if err != nil {
+		return
+	}
 
-	err = b.selectMailbox(user, mailbox)
+	// The body structure contains the part's metadata and encoding
+	structure, err := b.getBodyStructure(user, mailbox, uid)
 	if err != nil {
 		return
 	}
 
+	for _, a := range bodyStructureAttachments(structure, mailbox, uid) {
+		if a.ID == id {
+			att = a
+			break
+		}
+	}
+	part := findBodyPart(structure, path)
+	if att == nil || part == nil {
+		err = errors.New("No such attachment")
+		return
+	}
+
 	c, unlock, err := b.getConn(user)
 	if err != nil {
 		return
@@ -40,10 +149,13 @@ func (b *Messages) ReadAttachment(user, id string) (att *backend.Attachment, out
 	seqset := new(imap.SeqSet)
 	seqset.AddNum(uid)
 
-	items := []imap.FetchItem{imap.FetchItem("BODY.PEEK[" + partId + "]")}
+	section := &imap.BodySectionName{
+		BodyPartName: imap.BodyPartName{Path: path},
+		Peek: true,
+	}
 
 	messages := make(chan *imap.Message, 1)
-	if err = c.UidFetch(seqset, items, messages); err != nil {
+	if err = c.UidFetch(seqset, []imap.FetchItem{section.FetchItem()}, messages); err != nil {
 		return
 	}
 
@@ -53,21 +165,130 @@ func (b *Messages) ReadAttachment(user, id string) (att *backend.Attachment, out
 		return
 	}
 
-	var bodySectionName *imap.BodySectionName
-	bodySectionName, err = imap.ParseBodySectionName(imap.FetchItem("BODY[" + partId + "]"))
-	if err != nil {
+	body := data.GetBody(section)
+	if body == nil {
+		err = errors.New("No such attachment")
 		return
 	}
-	att, r := parseAttachment(data.GetBody(bodySectionName))
 
-	out, err = ioutil.ReadAll(r)
+	// Only decode the transfer encoding, attachments are kept in their charset.
+	// The part is decoded while it's read, without copying it.
+	var decoded io.Reader = _textproto.Decode(body, part.Encoding, "")
+
+	// Encrypted attachments are downloaded without their key packets, which
+	// are sent with attachment metadata
+	if isEncryptedAttachment(att) {
+		// Keep what has been consumed, in case the part isn't a valid OpenPGP
+		// message and must be returned as is
+		consumed := &recorder{}
+		encrypted, err := splitEncryptedAttachment(att, io.TeeReader(decoded, consumed))
+		if err == nil {
+			consumed.stop()
+			decoded = encrypted
+		} else {
+			decoded = io.MultiReader(&consumed.buf, decoded)
+		}
+	}
+
+	r = ioutil.NopCloser(decoded)
 	return
 }
 
+// Get a function opening an attachment, to be used in outgoing messages.
+func (b *Messages) attachmentOpener(user, id string) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		_, r, err := b.OpenAttachment(user, id)
+		return r, err
+	}
+}
+
 func (b *Messages) InsertAttachment(user string, attachment *backend.Attachment, data []byte) (*backend.Attachment, error) {
 	return b.tmpAtts.InsertAttachment(user, attachment, data)
 }
 
+func (b *Messages) InsertAttachmentFrom(user string, attachment *backend.Attachment, r io.Reader) (*backend.Attachment, error) {
+	return b.tmpAtts.InsertAttachmentFrom(user, attachment, r)
+}
+
 func (b *Messages) DeleteAttachment(user, id string) error {
 	return b.tmpAtts.DeleteAttachment(user, id)
 }
+
+// A temporary attachments store which keeps track of used space.
+type measurableAttachments interface {
+	UsedSpace(user string) (int, error)
+}
+
+// A temporary attachments store which can delete orphaned attachments.
+type collectableAttachments interface {
+	CollectGarbage(user string, isOrphan func(att *backend.Attachment) bool) (int, error)
+}
+
+// Get the space used by temporary attachments.
+func (b *Messages) attachmentsUsedSpace(user string) (int, error) {
+	if tmpAtts, ok := b.tmpAtts.(measurableAttachments); ok {
+		return tmpAtts.UsedSpace(user)
+	}
+	return 0, nil
+}
+
+// Check if a message exists on the server.
+func (b *Messages) messageExists(user, id string) (bool, error) {
+	mailbox, uid, err := parseMessageId(id)
+	if err != nil {
+		return false, nil
+	}
+
+	mailboxes, err := b.getMailboxes(user)
+	if err != nil {
+		return false, err
+	}
+	found := false
+	for _, m := range mailboxes {
+		if m.Name == mailbox {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false, nil
+	}
+
+	if err := b.selectMailbox(user, mailbox); err != nil {
+		return false, err
+	}
+
+	c, unlock, err := b.getConn(user)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = new(imap.SeqSet)
+	criteria.Uid.AddNum(uid)
+
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return false, err
+	}
+	return len(uids) > 0, nil
+}
+
+// Delete temporary attachments whose message doesn't exist anymore. Messages
+// which cannot be checked are considered as existing.
+func (b *Messages) collectAttachments(user string) (int, error) {
+	tmpAtts, ok := b.tmpAtts.(collectableAttachments)
+	if !ok {
+		return 0, nil
+	}
+
+	return tmpAtts.CollectGarbage(user, func(att *backend.Attachment) bool {
+		if att.MessageID == "" {
+			return true
+		}
+
+		exists, err := b.messageExists(user, att.MessageID)
+		return err == nil && !exists
+	})
+}
@@ -2,6 +2,7 @@
 package imap
 
 import (
+	"crypto/tls"
 	"strconv"
 
 	"github.com/emersion/neutron/backend"
@@ -13,7 +14,31 @@ type Config struct {
 	Hostname string
 	Port int
 	Tls bool
+	// TLS configuration used to connect to the server. If nil, the default
+	// configuration is used. It cannot be set in the config file.
+	TlsConfig *tls.Config `json:"-"`
 	Suffix string
+	// SASL mechanism used to log in: PLAIN, LOGIN, CRAM-MD5 or XOAUTH2. With
+	// XOAUTH2, users log in with OAuth bearer tokens instead of passwords. If
+	// empty, the LOGIN command is used.
+	Mechanism string
+
+	// Store labels as IMAP keywords, so that a message can have several labels.
+	// Folders are still stored as mailboxes.
+	KeywordLabels bool
+	// Directory where labels metadata that cannot be saved on the server is
+	// stored. If empty, it is only kept in memory.
+	LabelsDirectory string
+	// Directory where attachments of messages being composed are stored until
+	// the message is sent. If empty, they are only kept in memory.
+	AttachmentsDirectory string
+	// Maximum size of an attachment, in bytes. Zero means no limit. Only
+	// enforced if attachments are stored in AttachmentsDirectory.
+	MaxUpload int
+
+	// Encrypt incoming plaintext messages with the user's public key. Messages
+	// are replaced on the server by their encrypted version.
+	EncryptIncoming bool
 }
 
 func (c *Config) Host() string {
@@ -31,10 +56,10 @@ func (c *Config) Host() string {
 
 func Use(bkd *backend.Backend, config *Config) *conns {
 	conns := newConns(config)
-	messages := newMessages(conns)
+	messages := newMessages(conns, bkd)
 	conversations := util.NewDummyConversations(messages)
-	users := newUsers(conns)
-	evts := newEvents(conns, bkd.EventsBackend, conversations)
+	users := newUsers(conns, messages)
+	evts := newEvents(conns, bkd.EventsBackend, conversations, messages, bkd)
 	labels := events.NewLabels(newLabels(conns), evts)
 
 	bkd.Set(messages, conversations, users, labels, evts)
@@ -9,6 +9,9 @@ import (
 	imapidle "github.com/emersion/go-imap-idle"
 	imapquota "github.com/emersion/go-imap-quota"
 	imapclient "github.com/emersion/go-imap/client"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util/sasl"
 )
 
 type idleClient struct{ *imapidle.Client }
@@ -40,12 +43,13 @@ type conns struct {
 	config  *Config
 	clients map[string]*client
 	updates chan *update
+	labels  *labelsStore
 }
 
 func (b *conns) connect(username, password string) (email string, err error) {
 	var c *imapclient.Client
 	if b.config.Tls {
-		c, err = imapclient.DialTLS(b.config.Host(), nil)
+		c, err = imapclient.DialTLS(b.config.Host(), b.config.TlsConfig)
 	} else {
 		c, err = imapclient.Dial(b.config.Host())
 	}
@@ -54,13 +58,13 @@ func (b *conns) connect(username, password string) (email string, err error) {
 	}
 
 	if !b.config.Tls {
-		if err = c.StartTLS(nil); err != nil {
+		if err = c.StartTLS(b.config.TlsConfig); err != nil {
 			return
 		}
 	}
 
-	email = username + b.config.Suffix
-	if err = c.Login(email, password); err != nil {
+	email = b.getEmail(username)
+	if err = b.login(c, email, password); err != nil {
 		return
 	}
 
@@ -77,6 +81,19 @@ func (b *conns) connect(username, password string) (email string, err error) {
 	return
 }
 
+// Authenticate with the configured SASL mechanism, if any.
+func (b *conns) login(c *imapclient.Client, email, password string) error {
+	if b.config.Mechanism == "" {
+		return c.Login(email, password)
+	}
+
+	auth, err := sasl.NewClient(b.config.Mechanism, "", email, password)
+	if err != nil {
+		return err
+	}
+	return c.Authenticate(auth)
+}
+
 func (b *conns) disconnect(user string) error {
 	c, unlock, err := b.getConn(user)
 	if err != nil {
@@ -84,7 +101,7 @@ func (b *conns) disconnect(user string) error {
 	}
 	defer unlock()
 
-	if err := c.Close(); err != nil {
+	if err := c.Logout(); err != nil {
 		return err
 	}
 
@@ -231,6 +248,11 @@ func (b *conns) cancelIdle(clt *client) error {
 	return nil
 }
 
+// Get a user's e-mail address.
+func (b *conns) getEmail(user string) string {
+	return user + b.config.Suffix
+}
+
 // Allow other backends (e.g. a SMTP backend) to access users' password.
 func (b *conns) GetPassword(user string) (string, error) {
 	if client, ok := b.clients[user]; ok {
@@ -276,14 +298,33 @@ func (b *conns) getLabelMailbox(user, label string) (mailbox string, err error)
 	mailbox = label
 	for _, m := range mailboxes {
 		if getLabelID(m.Name) == label {
-			mailbox = m.Name
-			break
+			return m.Name, nil
 		}
 	}
 
+	if label == backend.ScheduledLabel {
+		mailbox = scheduledMailbox
+		err = b.createMailbox(user, mailbox)
+	}
 	return
 }
 
+func (b *conns) createMailbox(user, mailbox string) error {
+	c, unlock, err := b.getConn(user)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := c.Create(mailbox); err != nil {
+		return err
+	}
+
+	// Refresh mailbox list
+	b.clients[user].mailboxes = nil
+	return nil
+}
+
 func (b *conns) selectMailbox(user, mailbox string) (err error) {
 	c, unlock, err := b.getConn(user)
 	if err != nil {
@@ -310,11 +351,48 @@ func (b *conns) selectLabelMailbox(user, label string) (err error) {
 	return b.selectMailbox(user, mailbox)
 }
 
+// Search messages in all mailboxes. Results are UIDs grouped by mailbox name.
+func (b *conns) searchAllMailboxes(user string, criteria *imap.SearchCriteria) (results map[string][]uint32, err error) {
+	mailboxes, err := b.getMailboxes(user)
+	if err != nil {
+		return
+	}
+
+	results = map[string][]uint32{}
+	for _, mailbox := range mailboxes {
+		if hasAttr(mailbox.Attributes, imap.NoSelectAttr) {
+			continue
+		}
+
+		if err = b.selectMailbox(user, mailbox.Name); err != nil {
+			return
+		}
+
+		c, unlock, err := b.getConn(user)
+		if err != nil {
+			return nil, err
+		}
+
+		uids, err := c.UidSearch(criteria)
+		unlock()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(uids) > 0 {
+			results[mailbox.Name] = uids
+		}
+	}
+
+	return
+}
+
 func newConns(config *Config) *conns {
 	return &conns{
 		config: config,
 
 		clients: map[string]*client{},
 		updates: make(chan *update),
+		labels:  newLabelsStore(config.LabelsDirectory),
 	}
 }
@@ -0,0 +1,179 @@
+package imap
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/emersion/go-imap"
+
+	"github.com/emersion/neutron/backend"
+	_textproto "github.com/emersion/neutron/backend/util/textproto"
+)
+
+// A keyword set on messages encrypted by neutron when storing them. Unlike a
+// header field, it cannot be set by the sender of a message.
+const storedEncryptedKeyword = "$NeutronEncrypted"
+
+// Fetch the raw header of a message.
+func (b *Messages) fetchHeader(user, mailbox string, uid uint32) ([]byte, error) {
+	if err := b.selectMailbox(user, mailbox); err != nil {
+		return nil, err
+	}
+
+	c, unlock, err := b.getConn(user)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uid)
+
+	section := &imap.BodySectionName{
+		BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier},
+		Peek: true,
+	}
+
+	ch := make(chan *imap.Message, 1)
+	if err := c.UidFetch(seqset, []imap.FetchItem{section.FetchItem()}, ch); err != nil {
+		return nil, err
+	}
+
+	data := <-ch
+	if data == nil || data.GetBody(section) == nil {
+		return nil, errors.New("No such message header")
+	}
+	return ioutil.ReadAll(data.GetBody(section))
+}
+
+// Check if a header field describes the message's content.
+func isContentField(line string) bool {
+	i := strings.IndexByte(line, ':')
+	if i < 0 {
+		return false
+	}
+
+	name := strings.ToLower(strings.TrimSpace(line[:i]))
+	return name == "mime-version" || strings.HasPrefix(name, "content-")
+}
+
+// Write fields of a raw header, keeping only content fields if content is
+// true and only other fields otherwise. Lines are written with CRLF endings.
+func writeHeaderFields(w *bytes.Buffer, header string, content bool) {
+	keep := false
+	for _, line := range strings.Split(header, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			continue
+		}
+
+		// Continuation lines belong to the previous field
+		if line[0] != ' ' && line[0] != '\t' {
+			keep = isContentField(line) == content
+		}
+		if keep {
+			w.WriteString(line + "\r\n")
+		}
+	}
+}
+
+// Replace the content of a message. The original header is kept, apart from
+// fields describing the content, which are taken from mail.
+func replaceContent(header []byte, mail string) ([]byte, error) {
+	i := strings.Index(mail, "\r\n\r\n")
+	if i < 0 {
+		return nil, errors.New("Invalid message")
+	}
+
+	var b bytes.Buffer
+	writeHeaderFields(&b, string(header), false)
+	writeHeaderFields(&b, mail[:i], true)
+	b.WriteString(mail[i+2:])
+	return b.Bytes(), nil
+}
+
+// Encrypt a plaintext message stored on the server. The encrypted message is
+// appended to the same mailbox and the original one is deleted only if this
+// succeeds. Returns the new message ID.
+func (b *Messages) encryptMessage(user string, msg *backend.Message, publicKey string) (id string, err error) {
+	mailbox, uid, err := parseMessageId(msg.ID)
+	if err != nil {
+		return
+	}
+
+	// Received messages keep their original header fields, e.g. Message-ID
+	// and Received
+	header, err := b.fetchHeader(user, mailbox, uid)
+	if err != nil {
+		return
+	}
+
+	encrypted := *msg
+	if encrypted.Body, err = backend.EncryptBody(msg.Body, publicKey); err != nil {
+		return
+	}
+
+	outgoing := &backend.OutgoingMessage{Message: &encrypted}
+	for _, att := range msg.Attachments {
+		var r io.ReadCloser
+		if _, r, err = b.OpenAttachment(user, att.ID); err != nil {
+			return
+		}
+
+		outgoingAtt := &backend.OutgoingAttachment{}
+		outgoingAtt.Attachment, outgoingAtt.Data, err = backend.EncryptAttachment(att, r, publicKey)
+		r.Close()
+		if err != nil {
+			return
+		}
+		outgoing.Attachments = append(outgoing.Attachments, outgoingAtt)
+	}
+
+	// Keep flags and keyword labels
+	flags := []string{storedEncryptedKeyword}
+	if msg.IsRead == 1 {
+		flags = append(flags, imap.SeenFlag)
+	}
+	if msg.Starred == 1 {
+		flags = append(flags, imap.FlaggedFlag)
+	}
+	if msg.IsReplied == 1 {
+		flags = append(flags, imap.AnsweredFlag)
+	}
+	for _, label := range msg.LabelIDs {
+		if b.isKeywordLabel(user, label) {
+			flags = append(flags, label)
+		}
+	}
+
+	formatted, err := _textproto.FormatOutgoingMessage(outgoing)
+	if err != nil {
+		return
+	}
+	mail, err := replaceContent(header, formatted)
+	if err != nil {
+		return
+	}
+
+	newUid, err := b.insertMessage(user, mailbox, flags, mail)
+	if err != nil {
+		return
+	}
+
+	// The encrypted message has been saved, the original one can be deleted
+	if err = b.selectMailbox(user, mailbox); err != nil {
+		return
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uid)
+	if err = b.deleteMessages(user, seqset); err != nil {
+		return
+	}
+
+	id = formatMessageId(mailbox, newUid)
+	return
+}
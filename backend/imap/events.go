@@ -2,6 +2,7 @@ package imap
 
 import (
 	"errors"
+	"log"
 
 	"github.com/emersion/neutron/backend"
 	"github.com/emersion/go-imap"
@@ -11,6 +12,8 @@ type Events struct {
 	backend.EventsBackend
 	conns *conns
 	msgs backend.MessagesBackend
+	messages *Messages
+	keys backend.KeysBackend
 }
 
 func (b *Events) DeleteAllEvents(user string) error {
@@ -58,22 +61,61 @@ func (b *Events) processUpdate(u *update) error {
 		return err
 	}
 
+	if b.conns.config.EncryptIncoming {
+		if msg.IsEncrypted == backend.StoredEncryptedExternal {
+			// Messages encrypted by neutron have already been notified
+			return nil
+		} else if msg.IsEncrypted == backend.Unencrypted && msg.Type != backend.DraftType {
+			// If the message cannot be encrypted, it's still notified
+			encrypted, err := b.encryptMessage(user, msg)
+			if err != nil {
+				log.Println("WARN: cannot encrypt incoming message", msg.ID, "of", user, err)
+			} else {
+				msg = encrypted
+			}
+		}
+	}
+
 	event := backend.NewMessageDeltaEvent(msg.ID, backend.EventCreate, msg)
 	return b.InsertEvent(user, event)
 }
 
+// Encrypt an incoming message at rest. Returns the encrypted message.
+func (b *Events) encryptMessage(user string, msg *backend.Message) (*backend.Message, error) {
+	publicKey, err := b.keys.GetPublicKey(b.conns.getEmail(user))
+	if err != nil {
+		return nil, err
+	}
+	if publicKey == "" {
+		return msg, nil // No key available, keep the message as is
+	}
+
+	id, err := b.messages.encryptMessage(user, msg, publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.msgs.GetMessage(user, id)
+}
+
 func (b *Events) listenUpdates() {
 	for {
 		u := <-b.conns.updates
-		go b.processUpdate(u)
+		go func() {
+			if err := b.processUpdate(u); err != nil {
+				log.Println("WARN: cannot process IMAP update of", u.user, err)
+			}
+		}()
 	}
 }
 
-func newEvents(conns *conns, events backend.EventsBackend, msgs backend.MessagesBackend) *Events {
+func newEvents(conns *conns, events backend.EventsBackend, msgs backend.MessagesBackend, messages *Messages, keys backend.KeysBackend) *Events {
 	evts := &Events{
 		EventsBackend: events,
 		conns: conns,
 		msgs: msgs,
+		messages: messages,
+		keys: keys,
 	}
 
 	go evts.listenUpdates()
@@ -0,0 +1,110 @@
+package imap_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/backendtest"
+	"github.com/emersion/neutron/backend/imap"
+	"github.com/emersion/neutron/backend/memory"
+	imaprouter "github.com/emersion/neutron/router/imap"
+)
+
+const (
+	user = "backendtest"
+	password = "password"
+)
+
+// Generate a self-signed certificate for the fake server.
+func generateCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// Start a fake IMAP server, which stores messages in memory. Returns the
+// configuration needed to connect to it.
+func newServer(t *testing.T) *imap.Config {
+	bkd := backend.New()
+	memory.Use(bkd)
+	if _, err := bkd.InsertUser(&backend.User{Name: user}, password); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := imaprouter.New(bkd, &imaprouter.Config{PollInterval: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := generateCert(t)
+	s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	s.ErrorLog = log.New(ioutil.Discard, "", 0)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	pool := x509.NewCertPool()
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	pool.AddCert(leaf)
+
+	addr := l.Addr().(*net.TCPAddr)
+	return &imap.Config{
+		Hostname: addr.IP.String(),
+		Port: addr.Port,
+		TlsConfig: &tls.Config{RootCAs: pool},
+	}
+}
+
+func TestBackend(t *testing.T) {
+	backendtest.RunOptions(t, func(t *testing.T) *backend.Backend {
+		bkd := backend.New()
+		memory.Use(bkd)
+		imap.Use(bkd, newServer(t))
+
+		// The IMAP backend only stores data of logged in users
+		if _, err := bkd.Auth(user, password); err != nil {
+			t.Fatal(err)
+		}
+
+		return bkd
+	}, &backendtest.Options{
+		User: user,
+		Password: password,
+
+		ExternalUsers: true,
+		DraftsOnly: true,
+		NewestFirst: true,
+		InboxByDefault: true,
+		NoAddressFilter: true,
+		SingleMessageConversations: true,
+		SingleLabel: true,
+	})
+}
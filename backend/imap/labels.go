@@ -2,10 +2,20 @@ package imap
 
 import (
 	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
 
 	"github.com/emersion/neutron/backend"
 )
 
+// Scheduled messages are stored in a mailbox created when needed, since servers
+// don't provide one.
+const scheduledMailbox = "Scheduled"
+
 func getLabelID(mailbox string) string {
 	lbl := mailbox
 	switch mailbox {
@@ -23,6 +33,8 @@ func getLabelID(mailbox string) string {
 		lbl = backend.ArchiveLabel
 	case "Important", "Starred":
 		lbl = backend.StarredLabel
+	case scheduledMailbox:
+		lbl = backend.ScheduledLabel
 	}
 	return lbl
 }
@@ -57,115 +69,445 @@ func getLabelColor(i int) string {
 	return colors[i % len(colors)]
 }
 
+// Characters that cannot appear in an IMAP keyword, in addition to control
+// characters and spaces.
+const keywordSpecials = "(){%*\"\\]"
+
+// Make an IMAP keyword from a label name. Keywords starting with $ are
+// reserved for well-known keywords, e.g. $Forwarded.
+func formatKeyword(name string) string {
+	kw := strings.Map(func(r rune) rune {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune(keywordSpecials, r) {
+			return '_'
+		}
+		return r
+	}, name)
+
+	kw = strings.TrimLeft(kw, "$")
+	if kw == "" {
+		kw = "Label"
+	}
+	return kw
+}
+
+// Check if a label is stored as a keyword.
+func (b *conns) isKeywordLabel(user, id string) bool {
+	if !b.config.KeywordLabels {
+		return false
+	}
+
+	label, err := b.labels.Get(user, id)
+	return err == nil && label != nil && label.Exclusive == 0
+}
+
+// Get labels stored as keywords.
+func (b *conns) getKeywordLabels(user string) (labels []*backend.Label, err error) {
+	if !b.config.KeywordLabels {
+		return
+	}
+
+	stored, err := b.labels.List(user)
+	if err != nil {
+		return
+	}
+
+	for _, label := range stored {
+		if label.Exclusive == 0 {
+			labels = append(labels, label)
+		}
+	}
+	return
+}
+
+// Get label IDs from a message's keywords.
+func (b *conns) parseKeywords(user string, msg *backend.Message, src *imap.Message) {
+	for _, flag := range src.Flags {
+		if strings.HasPrefix(flag, "\\") {
+			continue // System flag
+		}
+
+		if b.isKeywordLabel(user, flag) {
+			msg.LabelIDs = append(msg.LabelIDs, flag)
+		}
+	}
+}
+
+// Get the hierarchy delimiter used by the server.
+func getDelimiter(mailboxes []*imap.MailboxInfo) string {
+	for _, m := range mailboxes {
+		if m.Delimiter != "" {
+			return m.Delimiter
+		}
+	}
+	return "/"
+}
+
+// Label names use slashes as hierarchy delimiter.
+func getLabelName(mailbox, delim string) string {
+	return strings.Replace(mailbox, delim, "/", -1)
+}
+
+func getMailboxName(label, delim string) string {
+	return strings.Replace(label, "/", delim, -1)
+}
+
+// Get the order of a new label.
+func getNextOrder(labels []*backend.Label) int {
+	next := 0
+	for _, label := range labels {
+		if label.Order >= next {
+			next = label.Order + 1
+		}
+	}
+	return next
+}
+
 type Labels struct {
 	*conns
 }
 
+// Get metadata of a label stored as a mailbox. If the mailbox has no metadata
+// yet, it's initialized so that colors and order don't change when other
+// mailboxes are added. Errors while saving metadata are only logged.
+func (b *Labels) getMailboxLabel(user, mailbox string, next int) (*backend.Label, error) {
+	label, err := b.labels.Get(user, mailbox)
+	if err != nil {
+		return nil, err
+	}
+
+	if label == nil {
+		if ok, _ := b.supportMetadata(user); ok {
+			label, err = b.getMetadata(user, mailbox)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if label != nil {
+			// Keep a local copy of metadata stored on the server
+			label.Type = backend.LabelMessage
+			label.Exclusive = 1
+			err = b.labels.Put(user, label)
+		} else {
+			label = &backend.Label{
+				ID: mailbox,
+				Color: getLabelColor(next),
+				Display: 1,
+				Order: next,
+			}
+			err = b.putMailboxLabel(user, label)
+		}
+		if err != nil {
+			// Listing labels shouldn't fail because metadata cannot be saved, it
+			// will be saved again next time
+			log.Println("WARN: cannot save metadata of mailbox", mailbox, "of", user, err)
+		}
+	}
+
+	result := *label
+	return &result, nil
+}
+
+// Save metadata of a label stored as a mailbox.
+func (b *Labels) putMailboxLabel(user string, label *backend.Label) error {
+	label.Type = backend.LabelMessage
+	label.Exclusive = 1
+
+	if ok, _ := b.supportMetadata(user); ok {
+		if err := b.setMetadata(user, label); err != nil {
+			return err
+		}
+	}
+
+	return b.labels.Put(user, label)
+}
+
 func (b *Labels) ListLabels(user string) (labels []*backend.Label, err error) {
 	mailboxes, err := b.getMailboxes(user)
 	if err != nil {
 		return
 	}
+	delim := getDelimiter(mailboxes)
+
+	stored, err := b.labels.List(user)
+	if err != nil {
+		return
+	}
+	next := getNextOrder(stored)
 
-	i := 0
 	for _, mailbox := range mailboxes {
 		name := mailbox.Name
 
 		if getLabelID(name) != name {
 			continue // This is a system mailbox, not a custom one
 		}
+		if hasAttr(mailbox.Attributes, imap.NoSelectAttr) {
+			continue // This mailbox cannot contain messages
+		}
+
+		var label *backend.Label
+		if label, err = b.getMailboxLabel(user, name, next); err != nil {
+			return
+		}
+		label.Name = getLabelName(name, delim)
+
+		if label.Order >= next {
+			next = label.Order + 1
+		}
 
-		labels = append(labels, &backend.Label{
-			ID: name,
-			Name: name,
-			Color: getLabelColor(i),
-			Display: 1,
-			Order: i,
-			Type: backend.LabelMessage,
-			Exclusive: 1,
-		})
+		labels = append(labels, label)
+	}
 
-		i++
+	keywordLabels, err := b.getKeywordLabels(user)
+	if err != nil {
+		return
 	}
+	labels = append(labels, keywordLabels...)
 
+	sort.SliceStable(labels, func(i, j int) bool {
+		return labels[i].Order < labels[j].Order
+	})
 	return
 }
 
+func (b *Labels) insertKeywordLabel(user string, label *backend.Label, order int) (*backend.Label, error) {
+	mailboxes, err := b.getMailboxes(user)
+	if err != nil {
+		return nil, err
+	}
+
+	labels, err := b.getKeywordLabels(user)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keywords are case-insensitive and must not collide with mailboxes
+	exists := func(id string) bool {
+		for _, m := range mailboxes {
+			if strings.EqualFold(m.Name, id) {
+				return true
+			}
+		}
+		for _, lbl := range labels {
+			if strings.EqualFold(lbl.ID, id) {
+				return true
+			}
+		}
+		return false
+	}
+
+	kw := formatKeyword(label.Name)
+	id := kw
+	for n := 2; exists(id); n++ {
+		id = kw + "_" + strconv.Itoa(n)
+	}
+
+	inserted := label
+	inserted.ID = id
+	if inserted.Color == "" {
+		inserted.Color = getLabelColor(order)
+	}
+	inserted.Order = order
+	inserted.Type = backend.LabelMessage
+	inserted.Exclusive = 0
+
+	// Keywords don't need to be created on the server
+	if err := b.labels.Put(user, inserted); err != nil {
+		return nil, err
+	}
+	return inserted, nil
+}
+
 func (b *Labels) InsertLabel(user string, label *backend.Label) (inserted *backend.Label, err error) {
 	labels, err := b.ListLabels(user)
 	if err != nil {
 		return
 	}
-	i := len(labels)
+	order := getNextOrder(labels)
 
-	c, unlock, err := b.getConn(user)
+	if b.config.KeywordLabels && label.Exclusive == 0 {
+		return b.insertKeywordLabel(user, label, order)
+	}
+
+	mailboxes, err := b.getMailboxes(user)
 	if err != nil {
 		return
 	}
-	defer unlock()
+	mailbox := getMailboxName(label.Name, getDelimiter(mailboxes))
 
-	if err = c.Create(label.Name); err != nil {
+	if err = b.createMailbox(user, mailbox); err != nil {
 		return
 	}
 
+	inserted = label
+	inserted.ID = mailbox
+	if inserted.Color == "" {
+		inserted.Color = getLabelColor(order)
+	}
+	inserted.Order = order
+
+	err = b.putMailboxLabel(user, inserted)
+	return
+}
+
+// Rename a label stored as a mailbox. Inferior mailboxes are renamed by the
+// server, their local metadata is updated too.
+func (b *Labels) renameMailboxLabel(user string, label *backend.Label, name string) error {
+	mailboxes, err := b.getMailboxes(user)
+	if err != nil {
+		return err
+	}
+	delim := getDelimiter(mailboxes)
+	mailbox := getMailboxName(name, delim)
+
+	c, unlock, err := b.getConn(user)
+	if err != nil {
+		return err
+	}
+
+	err = c.Rename(label.ID, mailbox)
+	unlock()
+	if err != nil {
+		return err
+	}
+
 	// Refresh mailbox list
 	b.clients[user].mailboxes = nil
 
-	inserted = label
-	inserted.ID = label.Name
-	inserted.Color = getLabelColor(i)
-	inserted.Order = i
-	inserted.Type = backend.LabelMessage
-	inserted.Exclusive = 1
-	return
+	stored, err := b.labels.List(user)
+	if err != nil {
+		return err
+	}
+
+	var renamed []*backend.Label
+	for _, lbl := range stored {
+		if lbl.Exclusive == 1 && (lbl.ID == label.ID || strings.HasPrefix(lbl.ID, label.ID+delim)) {
+			renamed = append(renamed, lbl)
+		}
+	}
+
+	for _, lbl := range renamed {
+		if err := b.labels.Delete(user, lbl.ID); err != nil {
+			return err
+		}
+
+		moved := *lbl
+		moved.ID = mailbox + strings.TrimPrefix(lbl.ID, label.ID)
+		if err := b.labels.Put(user, &moved); err != nil {
+			return err
+		}
+	}
+
+	label.ID = mailbox
+	return nil
 }
 
 func (b *Labels) UpdateLabel(user string, update *backend.LabelUpdate) (label *backend.Label, err error) {
 	label = update.Label
 
-	if label.ID == label.Name {
-		return // Nothing to do
+	if b.isKeywordLabel(user, label.ID) {
+		// The keyword doesn't change, only metadata is updated
+		label, err = b.labels.Get(user, label.ID)
+		if err != nil {
+			return
+		}
+
+		update.Apply(label)
+		err = b.labels.Put(user, label)
+		return
 	}
 
-	c, unlock, err := b.getConn(user)
+	labels, err := b.ListLabels(user)
 	if err != nil {
 		return
 	}
-	defer unlock()
 
-	if err = c.Rename(label.ID, label.Name); err != nil {
+	label = nil
+	for _, lbl := range labels {
+		if lbl.ID == update.Label.ID {
+			label = lbl
+			break
+		}
+	}
+	if label == nil {
+		err = errors.New("No such label")
 		return
 	}
 
-	// Refresh mailbox list
-	b.clients[user].mailboxes = nil
+	name := label.Name
+	update.Apply(label)
+
+	if label.Name != name {
+		if err = b.renameMailboxLabel(user, label, label.Name); err != nil {
+			return
+		}
+	}
 
-	label.ID = label.Name
+	err = b.putMailboxLabel(user, label)
 	return
 }
 
-func (b *Labels) DeleteLabel(user, id string) error {
-	if err := b.selectMailbox(user, id); err != nil {
+// Remove a keyword from all messages.
+func (b *Labels) removeKeyword(user, kw string) error {
+	criteria := imap.NewSearchCriteria()
+	criteria.WithFlags = []string{kw}
+
+	results, err := b.searchAllMailboxes(user, criteria)
+	if err != nil {
 		return err
 	}
 
+	for mailbox, uids := range results {
+		if err := b.selectMailbox(user, mailbox); err != nil {
+			return err
+		}
+
+		seqset := new(imap.SeqSet)
+		seqset.AddNum(uids...)
+
+		if err := b.storeFlags(user, seqset, false, kw); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *Labels) DeleteLabel(user, id string) error {
+	if b.isKeywordLabel(user, id) {
+		if err := b.removeKeyword(user, id); err != nil {
+			return err
+		}
+		return b.labels.Delete(user, id)
+	}
+
 	c, unlock, err := b.getConn(user)
 	if err != nil {
 		return err
 	}
-	defer unlock()
 
-	if c.Mailbox().Messages > 0 {
-		return errors.New("This label contains mesages, please move all of them before deleting it")
+	status, err := c.Status(id, []imap.StatusItem{imap.StatusMessages})
+	if err == nil && status.Messages > 0 {
+		err = errors.New("This label contains mesages, please move all of them before deleting it")
 	}
-
-	if err := c.Delete(id); err != nil {
+	if err == nil {
+		// Don't delete the selected mailbox
+		if c.Mailbox() != nil && c.Mailbox().Name == id {
+			_, err = c.Select("INBOX", false)
+		}
+	}
+	if err == nil {
+		err = c.Delete(id)
+	}
+	unlock()
+	if err != nil {
 		return err
 	}
 
 	// Refresh mailbox list
 	b.clients[user].mailboxes = nil
-	return nil
+
+	return b.labels.Delete(user, id)
 }
 
 func newLabels(conns *conns) *Labels {
@@ -5,13 +5,17 @@ import (
 	"errors"
 	"io/ioutil"
 	"net/mail"
+	"net/textproto"
+	"sort"
 	"time"
 
 	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
 
 	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/disk"
 	"github.com/emersion/neutron/backend/memory"
-	"github.com/emersion/neutron/backend/util/textproto"
+	_textproto "github.com/emersion/neutron/backend/util/textproto"
 )
 
 type updatableAttachments interface {
@@ -44,7 +48,12 @@ func (be *Messages) GetMessage(user, id string) (msg *backend.Message, err error
 	seqset := new(imap.SeqSet)
 	seqset.AddNum(uid)
 
-	items := []imap.FetchItem{imap.FetchFlags, imap.FetchRFC822Size, imap.FetchBodyStructure, imap.FetchRFC822Header}
+	headerSection := &imap.BodySectionName{
+		BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier},
+		Peek: true,
+	}
+
+	items := []imap.FetchItem{imap.FetchFlags, imap.FetchRFC822Size, imap.FetchBodyStructure, headerSection.FetchItem()}
 
 	// Get message metadata
 
@@ -64,70 +73,77 @@ func (be *Messages) GetMessage(user, id string) (msg *backend.Message, err error
 	msg.LabelIDs = []string{getLabelID(c.Mailbox().Name)}
 	//msg.Header = string(header)
 	parseMessage(msg, data)
+	be.parseKeywords(user, msg, data)
 
 	// Apply body structure to msg
-	msg.Attachments = bodyStructureAttachments(data.BodyStructure)
+	msg.Attachments = bodyStructureAttachments(data.BodyStructure, mailbox, uid)
 
 	// Apply header to msg
-        var bodySectionName *imap.BodySectionName
-        bodySectionName, err = imap.ParseBodySectionName(imap.FetchItem("RFC822.HEADER"))
-        if err != nil {
-                return
-        }
+	header := data.GetBody(headerSection)
+	if header == nil {
+		err = errors.New("No such message header")
+		return
+	}
 
-	m, err := mail.ReadMessage(data.GetBody(bodySectionName))
+	m, err := mail.ReadMessage(header)
 	if err != nil {
 		return
 	}
-	textproto.ParseMessageHeader(msg, &m.Header)
-
-	// Get message content
+	_textproto.ParseMessageHeader(msg, &m.Header)
 
-	path, part := getPreferredPart(data.BodyStructure)
-
-	ch = make(chan *imap.Message, 1)
-	if err = c.UidFetch(seqset, []imap.FetchItem{imap.FetchItem("BODY.PEEK["+path+"]")}, ch); err != nil {
+	if isPgpMime(data.BodyStructure) {
+		// The client decrypts the whole MIME structure
+		msg.IsEncrypted = backend.EncryptedPgpMime
+		msg.Body, err = fetchBodyPart(c, seqset, getPgpMimePart(data.BodyStructure))
 		return
 	}
 
-	data = <-ch
-	if data == nil {
-		err = errors.New("No such message body")
-		return
+	// Get message content, prefer HTML
+	html, text := findBodyParts(data.BodyStructure, nil)
+	if html != nil {
+		if msg.Body, err = fetchBodyPart(c, seqset, html); err != nil {
+			return
+		}
+		msg.Body = resolveContentIds(msg.Body, msg.Attachments)
 	}
 
-        bodySectionName, err = imap.ParseBodySectionName(imap.FetchItem("RFC822.HEADER"))
-        if err != nil {
-                return
-        }
+	// Inline PGP messages are usually sent as text, the HTML part contains a
+	// formatted version of the armored message
+	if text != nil && (html == nil || backend.IsEncrypted(msg.Body)) {
+		if msg.Body, err = fetchBodyPart(c, seqset, text); err != nil {
+			return
+		}
 
-	r := decodePart(part, data.GetBody(bodySectionName))
-	b, err := ioutil.ReadAll(r)
-	if err != nil {
-		return
+		if !backend.IsEncrypted(msg.Body) {
+			msg.Body = _textproto.TextToHTML(msg.Body)
+		}
 	}
-	msg.Body = string(b)
 
-	// Check if some attachments are encrypted
+	if backend.IsEncrypted(msg.Body) {
+		msg.IsEncrypted = backend.EncryptedPgp
+		if hasAttr(data.Flags, storedEncryptedKeyword) {
+			msg.IsEncrypted = backend.StoredEncryptedExternal
+		}
+	}
 
-	/*for _, att := range msg.Attachments {
-		if att.MIMEType == "application/pgp" {
-			// TODO: get correct key packet length
-			// TODO: attachment is assumed to be base64-encoded
-			// TODO: make sure this is a normalized msgInfo.Attrs key
-			cmd, _, err = wait(c.UIDFetch(seqset, "BODY.PEEK["+att.ID+"]<0.2048>"))
-			if err != nil {
-				return
-			}
+	// Give key packets of encrypted attachments to the client
+	for _, att := range msg.Attachments {
+		if !isEncryptedAttachment(att) {
+			continue
+		}
 
-			rsp = cmd.Data[0]
-			msgInfo = rsp.MessageInfo()
-			encryptedKeyPacket := imap.AsBytes(msgInfo.Attrs["BODY["+att.ID+"]<0>"])
-			att.KeyPackets = string(encryptedKeyPacket)
+		_, _, partId, _ := parseAttachmentId(att.ID)
+		path, _ := parsePartPath(partId)
+		part := findBodyPart(data.BodyStructure, path)
+		if part == nil {
+			continue
 		}
 
-		att.ID = formatAttachmentId(mailbox, uid, att.ID)
-	}*/
+		// Attachments which cannot be parsed are left as is
+		if keyPackets, err := readKeyPackets(c, seqset, part); err == nil {
+			att.KeyPackets = keyPackets
+		}
+	}
 
 	tmpAtts, err := be.tmpAtts.ListAttachments(user, id)
 	if err == nil {
@@ -137,54 +153,42 @@ func (be *Messages) GetMessage(user, id string) (msg *backend.Message, err error
 	return
 }
 
-func reverseMessagesList(msgs []*backend.Message) {
-	n := len(msgs)
-	for i := 0; i < n/2; i++ {
-		msgs[i], msgs[n-i-1] = msgs[n-i-1], msgs[i]
+// Fetch and decode a body part.
+func fetchBodyPart(c *conn, seqset *imap.SeqSet, part *bodyPart) (string, error) {
+	section := &imap.BodySectionName{
+		BodyPartName: imap.BodyPartName{Path: part.Path},
+		Peek: true,
 	}
-}
 
-func (b *Messages) ListMessages(user string, filter *backend.MessagesFilter) (msgs []*backend.Message, total int, err error) {
-	// TODO: find a way to search in all mailboxes when label isn't specified
-	if filter.Label == "" {
-		filter.Label = backend.InboxLabel
+	ch := make(chan *imap.Message, 1)
+	if err := c.UidFetch(seqset, []imap.FetchItem{section.FetchItem()}, ch); err != nil {
+		return "", err
 	}
 
-	err = b.selectLabelMailbox(user, filter.Label)
-	if err != nil {
-		return
+	data := <-ch
+	if data == nil || data.GetBody(section) == nil {
+		return "", errors.New("No such message body")
 	}
 
-	c, unlock, err := b.getConn(user)
+	b, err := ioutil.ReadAll(decodePart(part.BodyStructure, data.GetBody(section)))
 	if err != nil {
-		return
+		return "", err
 	}
-	defer unlock()
-
-	total = int(c.Mailbox().Messages)
-
-	// No messages to fetch
-	if c.Mailbox().Messages == 0 {
-		return
-	}
-
-	set := new(imap.SeqSet)
-	if filter.Limit > 0 && filter.Page >= 0 {
-		from := filter.Limit * filter.Page
-		to := filter.Limit * (filter.Page + 1)
+	return string(b), nil
+}
 
-		if uint32(to) < c.Mailbox().Messages {
-			set.AddRange(c.Mailbox().Messages-uint32(from), c.Mailbox().Messages-uint32(to))
-		} else {
-			set.Add("1:*")
-		}
-	} else {
-		set.Add("1:*")
+func reverseMessagesList(msgs []*backend.Message) {
+	n := len(msgs)
+	for i := 0; i < n/2; i++ {
+		msgs[i], msgs[n-i-1] = msgs[n-i-1], msgs[i]
 	}
+}
 
-	// TODO: support filter.Address, filter.Attachments
-	criteria := imap.NewSearchCriteria()
-	search := false
+// Build search criteria from a filter. search is false if there are no
+// criteria, empty is true if no message can match the filter.
+func (b *conns) searchCriteria(user string, filter *backend.MessagesFilter, mailboxLabel string) (criteria *imap.SearchCriteria, search bool, empty bool) {
+	// TODO: support filter.Address
+	criteria = imap.NewSearchCriteria()
 
 	if filter.Begin != 0 {
 		criteria.Since = time.Unix(filter.Begin, 0)
@@ -196,41 +200,113 @@ func (b *Messages) ListMessages(user string, filter *backend.MessagesFilter) (ms
 	}
 
 	if filter.From != "" {
-		criteria.Header.Set("From", filter.From)
+		criteria.Header.Add("From", filter.From)
 		search = true
 	}
 	if filter.To != "" {
-		criteria.Header.Set("To", filter.To)
+		// Matches any of To, Cc or Bcc
+		criteria.Or = append(criteria.Or, [2]*imap.SearchCriteria{
+			&imap.SearchCriteria{Header: textprotoHeader("To", filter.To)},
+			&imap.SearchCriteria{Or: [][2]*imap.SearchCriteria{{
+				&imap.SearchCriteria{Header: textprotoHeader("Cc", filter.To)},
+				&imap.SearchCriteria{Header: textprotoHeader("Bcc", filter.To)},
+			}}},
+		})
+		search = true
+	}
+	if filter.CC != "" {
+		criteria.Header.Add("Cc", filter.CC)
+		search = true
+	}
+	if filter.BCC != "" {
+		criteria.Header.Add("Bcc", filter.BCC)
+		search = true
+	}
+	if filter.Subject != "" {
+		criteria.Header.Add("Subject", filter.Subject)
 		search = true
 	}
 
 	if filter.Keyword != "" {
-		criteria.Text = []string{filter.Keyword}
+		criteria.Text = append(criteria.Text, filter.Keyword)
+		search = true
+	}
+	if len(filter.Keywords) > 0 {
+		criteria.Text = append(criteria.Text, filter.Keywords...)
 		search = true
 	}
 
-	fetchUid := false
-	if search {
-		var uids []uint32
-		if uids, err = c.UidSearch(criteria); err != nil {
-			return
-		}
+	if filter.Attachments {
+		// There is no way to search for attachments, look for multipart/mixed
+		// messages instead
+		criteria.Header.Add("Content-Type", "multipart/mixed")
+		search = true
+	}
 
-		if len(uids) == 0 {
-			return // No result
+	if filter.Unread {
+		criteria.WithoutFlags = append(criteria.WithoutFlags, imap.SeenFlag)
+		search = true
+	}
+	if filter.Read {
+		criteria.WithFlags = append(criteria.WithFlags, imap.SeenFlag)
+		search = true
+	}
+	if filter.Starred {
+		criteria.WithFlags = append(criteria.WithFlags, imap.FlaggedFlag)
+		search = true
+	}
+
+	for _, label := range filter.Labels {
+		switch label {
+		case mailboxLabel:
+			// Already selected
+		case backend.StarredLabel:
+			criteria.WithFlags = append(criteria.WithFlags, imap.FlaggedFlag)
+			search = true
+		default:
+			if b.isKeywordLabel(user, label) {
+				criteria.WithFlags = append(criteria.WithFlags, label)
+				search = true
+			} else {
+				// A message cannot be in two mailboxes at the same time
+				empty = true
+			}
 		}
+	}
 
-		set = new(imap.SeqSet)
-		set.AddNum(uids...)
-		fetchUid = true
+	return
+}
+
+func textprotoHeader(k, v string) textproto.MIMEHeader {
+	h := textproto.MIMEHeader{}
+	h.Add(k, v)
+	return h
+}
+
+// Get the label of the mailbox to select for a filter.
+func (b *conns) filterMailboxLabel(user string, filter *backend.MessagesFilter) string {
+	if filter.Label != "" {
+		return filter.Label
+	}
+
+	for _, label := range filter.Labels {
+		if label != backend.StarredLabel && !b.isKeywordLabel(user, label) {
+			return label
+		}
 	}
 
-	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchRFC822Size, imap.FetchEnvelope}
+	// TODO: find a way to search in all mailboxes when label isn't specified
+	return backend.InboxLabel
+}
+
+// Fetch messages metadata in the currently selected mailbox.
+func (b *Messages) fetchMessages(user string, c *conn, set *imap.SeqSet, uid bool) (msgs []*backend.Message, err error) {
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchRFC822Size, imap.FetchEnvelope, imap.FetchBodyStructure}
 
 	ch := make(chan *imap.Message)
 	done := make(chan error, 1)
 	go func() {
-		if fetchUid {
+		if uid {
 			done <- c.UidFetch(set, items, ch)
 		} else {
 			done <- c.Fetch(set, items, ch)
@@ -242,13 +318,155 @@ func (b *Messages) ListMessages(user string, filter *backend.MessagesFilter) (ms
 		msg.ID = formatMessageId(c.Mailbox().Name, data.Uid)
 		msg.LabelIDs = []string{getLabelID(c.Mailbox().Name)}
 		parseMessage(msg, data)
+		b.parseKeywords(user, msg, data)
 		parseEnvelope(msg, data.Envelope)
 
+		// Inline PGP messages can only be detected when fetching their body
+		if data.BodyStructure != nil && isPgpMime(data.BodyStructure) {
+			msg.IsEncrypted = backend.EncryptedPgpMime
+		}
+
 		msgs = append(msgs, msg)
 	}
 
 	// Check command completion status
-	if err = <-done; err != nil {
+	err = <-done
+	return
+}
+
+// List messages having a keyword label. Keywords can be set on messages in any
+// mailbox, so all mailboxes are searched.
+func (b *Messages) listKeywordMessages(user string, filter *backend.MessagesFilter) (msgs []*backend.Message, total int, err error) {
+	mailboxes, err := b.getMailboxes(user)
+	if err != nil {
+		return
+	}
+
+	for _, mailbox := range mailboxes {
+		if hasAttr(mailbox.Attributes, imap.NoSelectAttr) {
+			continue
+		}
+
+		// The keyword label becomes a criterion, mailbox labels are checked
+		// against the mailbox being searched
+		f := *filter
+		f.Label = ""
+		f.Labels = append([]string{filter.Label}, filter.Labels...)
+
+		criteria, _, empty := b.searchCriteria(user, &f, getLabelID(mailbox.Name))
+		if empty {
+			continue
+		}
+
+		if err = b.selectMailbox(user, mailbox.Name); err != nil {
+			return
+		}
+
+		var found []*backend.Message
+		found, err = b.searchMessages(user, criteria)
+		if err != nil {
+			return
+		}
+		msgs = append(msgs, found...)
+	}
+
+	// Most recent messages come first
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Time > msgs[j].Time
+	})
+
+	total = len(msgs)
+	from, to := filter.PageBounds(total)
+	msgs = msgs[from:to]
+	return
+}
+
+// Search and fetch messages in the currently selected mailbox.
+func (b *Messages) searchMessages(user string, criteria *imap.SearchCriteria) ([]*backend.Message, error) {
+	c, unlock, err := b.getConn(user)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	uids, err := c.UidSearch(criteria)
+	if err != nil || len(uids) == 0 {
+		return nil, err
+	}
+
+	set := new(imap.SeqSet)
+	set.AddNum(uids...)
+	return b.fetchMessages(user, c, set, true)
+}
+
+func (b *Messages) ListMessages(user string, filter *backend.MessagesFilter) (msgs []*backend.Message, total int, err error) {
+	if b.isKeywordLabel(user, filter.Label) {
+		return b.listKeywordMessages(user, filter)
+	}
+
+	filter.Label = b.filterMailboxLabel(user, filter)
+
+	err = b.selectLabelMailbox(user, filter.Label)
+	if err != nil {
+		return
+	}
+
+	criteria, search, empty := b.searchCriteria(user, filter, filter.Label)
+	if empty {
+		return
+	}
+
+	c, unlock, err := b.getConn(user)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	total = int(c.Mailbox().Messages)
+
+	// No messages to fetch
+	if c.Mailbox().Messages == 0 {
+		return
+	}
+
+	// Most recent messages have the highest sequence numbers
+	n := c.Mailbox().Messages
+	from, to := filter.PageBounds(int(n))
+	if from == to {
+		return
+	}
+	set := new(imap.SeqSet)
+	set.AddRange(n-uint32(to)+1, n-uint32(from))
+
+	fetchUid := false
+	if search {
+		var uids []uint32
+		if uids, err = c.UidSearch(criteria); err != nil {
+			return
+		}
+
+		total = len(uids)
+		if total == 0 {
+			return // No result
+		}
+
+		// Most recent messages come first
+		sort.Slice(uids, func(i, j int) bool {
+			return uids[i] > uids[j]
+		})
+		from, to := filter.PageBounds(total)
+		if from == to {
+			return
+		}
+		uids = uids[from:to]
+
+		set = new(imap.SeqSet)
+		set.AddNum(uids...)
+		fetchUid = true
+	}
+
+	msgs, err = b.fetchMessages(user, c, set, fetchUid)
+	if err != nil {
 		return
 	}
 
@@ -256,12 +474,52 @@ func (b *Messages) ListMessages(user string, filter *backend.MessagesFilter) (ms
 	return
 }
 
+// Count messages having a keyword label, in all mailboxes.
+func (b *Messages) countKeywordMessages(user string) (counts []*backend.MessagesCount, err error) {
+	labels, err := b.getKeywordLabels(user)
+	if err != nil {
+		return
+	}
+
+	for _, label := range labels {
+		count := &backend.MessagesCount{LabelID: label.ID}
+
+		criteria := imap.NewSearchCriteria()
+		criteria.WithFlags = []string{label.ID}
+
+		var results map[string][]uint32
+		if results, err = b.searchAllMailboxes(user, criteria); err != nil {
+			return
+		}
+		for _, uids := range results {
+			count.Total += len(uids)
+		}
+
+		criteria.WithoutFlags = []string{imap.SeenFlag}
+		if results, err = b.searchAllMailboxes(user, criteria); err != nil {
+			return
+		}
+		for _, uids := range results {
+			count.Unread += len(uids)
+		}
+
+		counts = append(counts, count)
+	}
+
+	return
+}
+
 func (b *Messages) CountMessages(user string) (counts []*backend.MessagesCount, err error) {
 	mailboxes, err := b.getMailboxes(user)
 	if err != nil {
 		return
 	}
 
+	counts, err = b.countKeywordMessages(user)
+	if err != nil {
+		return
+	}
+
 	c, unlock, err := b.getConn(user)
 	if err != nil {
 		return
@@ -284,6 +542,16 @@ func (b *Messages) CountMessages(user string) (counts []*backend.MessagesCount,
 	return
 }
 
+// Get the UID the next message added to a mailbox will have. Used to find the
+// UID of a message appended or copied on servers not supporting UIDPLUS.
+func uidNext(c *conn, mailbox string) (uint32, error) {
+	status, err := c.Status(mailbox, []imap.StatusItem{imap.StatusUidNext})
+	if err != nil {
+		return 0, err
+	}
+	return status.UidNext, nil
+}
+
 func (b *Messages) insertMessage(user, mailbox string, flags []string, mail []byte) (uid uint32, err error) {
 	c, unlock, err := b.getConn(user)
 	if err != nil {
@@ -291,19 +559,31 @@ func (b *Messages) insertMessage(user, mailbox string, flags []string, mail []by
 	}
 	defer unlock()
 
-	t := time.Time{}
-	literal := bytes.NewBuffer(mail)
-	if err = c.Append(mailbox, flags, t, literal); err != nil {
+	next, err := uidNext(c, mailbox)
+	if err != nil {
 		return
 	}
 
-	/*if imap.AsString(res.Fields[0]) != "APPENDUID" {
-		err = errors.New("APPEND didn't returned an UID (this is not supported for now)")
+	cmd := &commands.Append{
+		Mailbox: mailbox,
+		Flags: flags,
+		Message: bytes.NewBuffer(mail),
+	}
+
+	status, err := c.Execute(cmd, nil)
+	if err != nil {
+		return
+	}
+	if err = status.Err(); err != nil {
 		return
 	}
 
-	uid = imap.AsNumber(res.Fields[2])*/
-	uid = 0 // TODO
+	// Servers supporting UIDPLUS return the new message UID, otherwise it's
+	// the mailbox's next UID
+	uid = next
+	if status.Code == "APPENDUID" && len(status.Arguments) >= 2 {
+		uid, _ = imap.ParseNumber(status.Arguments[1])
+	}
 	return
 }
 
@@ -314,7 +594,7 @@ func (b *Messages) InsertMessage(user string, msg *backend.Message) (inserted *b
 	}
 
 	flags := []string{"\\Seen", "\\Draft"}
-	mail := textproto.FormatMessage(msg)
+	mail := _textproto.FormatMessage(msg)
 
 	uid, err := b.insertMessage(user, mailbox, flags, []byte(mail))
 
@@ -323,7 +603,12 @@ func (b *Messages) InsertMessage(user string, msg *backend.Message) (inserted *b
 	return
 }
 
-func (b *Messages) updateMessageFlags(user string, seqset *imap.SeqSet, flag imap.StoreItem, value bool) error {
+// Add or remove flags on messages in the currently selected mailbox.
+func (b *conns) storeFlags(user string, seqset *imap.SeqSet, value bool, flags ...string) error {
+	if len(flags) == 0 {
+		return nil
+	}
+
 	c, unlock, err := b.getConn(user)
 	if err != nil {
 		return err
@@ -335,8 +620,11 @@ func (b *Messages) updateMessageFlags(user string, seqset *imap.SeqSet, flag ima
 		item = imap.RemoveFlags
 	}
 
-	flags := []imap.StoreItem{flag}
-	return c.UidStore(seqset, imap.StoreItem(item), flags, nil)
+	values := make([]interface{}, len(flags))
+	for i, flag := range flags {
+		values[i] = flag
+	}
+	return c.UidStore(seqset, imap.StoreItem(item), values, nil)
 }
 
 func (b *Messages) deleteMessages(user string, seqset *imap.SeqSet) error {
@@ -346,10 +634,24 @@ func (b *Messages) deleteMessages(user string, seqset *imap.SeqSet) error {
 	}
 	defer unlock()
 
-	flags := []string{imap.DeletedFlag}
-	if err := c.UidStore(seqset, imap.AddFlags, flags, nil); err != nil {
+	// Updated messages are returned, so that missing ones can be detected
+	flags := []interface{}{imap.DeletedFlag}
+	ch := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidStore(seqset, imap.AddFlags, flags, ch)
+	}()
+
+	n := 0
+	for range ch {
+		n++
+	}
+	if err := <-done; err != nil {
 		return err
 	}
+	if n == 0 {
+		return errNoSuchMessage
+	}
 
 	return c.Expunge(nil) // TODO: use UID EXPUNGE
 }
@@ -362,17 +664,13 @@ func (b *Messages) copyMessages(user string, seqset *imap.SeqSet, mbox string) (
 	}
 	defer unlock()
 
-	if err = c.UidCopy(seqset, mbox); err != nil {
+	// The client doesn't expose COPYUID, the copied message gets the
+	// mailbox's next UID
+	if uid, err = uidNext(c, mbox); err != nil {
 		return
 	}
 
-	/*if imap.AsString(res.Fields[0]) != "COPYUID" {
-		err = errors.New("COPY didn't returned an UID (this is not supported for now)")
-		return
-	}
-
-	uid = imap.AsNumber(res.Fields[2])*/
-	uid = 0 // TODO
+	err = c.UidCopy(seqset, mbox)
 	return
 }
 
@@ -405,26 +703,27 @@ func (b *Messages) UpdateMessage(user string, update *backend.MessageUpdate) (ms
 	if err != nil {
 		return
 	}
+	labels := msg.LabelIDs
 
 	// Apply update to message
 	update.Apply(msg)
 
 	if update.IsRead {
-		err = b.updateMessageFlags(user, seqset, imap.SeenFlag, (update.Message.IsRead == 1))
+		err = b.storeFlags(user, seqset, update.Message.IsRead == 1, imap.SeenFlag)
 		if err != nil {
 			return
 		}
 	}
 
 	if update.Starred {
-		err = b.updateMessageFlags(user, seqset, imap.FlaggedFlag, (update.Message.Starred == 1))
+		err = b.storeFlags(user, seqset, update.Message.Starred == 1, imap.FlaggedFlag)
 		if err != nil {
 			return
 		}
 	}
 
 	if update.Type {
-		err = b.updateMessageFlags(user, seqset, imap.DraftFlag, (update.Message.Type == backend.DraftType))
+		err = b.storeFlags(user, seqset, update.Message.Type == backend.DraftType, imap.DraftFlag)
 		if err != nil {
 			return
 		}
@@ -443,12 +742,9 @@ func (b *Messages) UpdateMessage(user string, update *backend.MessageUpdate) (ms
 		}
 
 		for _, att := range tmpAtts {
-			var d []byte
-			att, d, err = b.tmpAtts.ReadAttachment(user, att.ID)
-
 			outgoing.Attachments = append(outgoing.Attachments, &backend.OutgoingAttachment{
 				Attachment: att,
-				Data: d,
+				Open: b.attachmentOpener(user, att.ID),
 			})
 		}
 
@@ -459,7 +755,10 @@ func (b *Messages) UpdateMessage(user string, update *backend.MessageUpdate) (ms
 		}
 
 		flags := []string{imap.SeenFlag}
-		mail := textproto.FormatOutgoingMessage(outgoing)
+		var mail string
+		if mail, err = _textproto.FormatOutgoingMessage(outgoing); err != nil {
+			return
+		}
 
 		var uid uint32
 		uid, err = b.insertMessage(user, mailbox, flags, []byte(mail))
@@ -473,7 +772,7 @@ func (b *Messages) UpdateMessage(user string, update *backend.MessageUpdate) (ms
 		for _, att := range tmpAtts {
 			b.tmpAtts.DeleteAttachment(user, att.ID)
 		}
-	} else if update.ToList || update.CCList || update.BCCList || update.Subject || update.AddressID || update.Body || update.Time {
+	} else if update.ToList || update.CCList || update.BCCList || update.Subject || update.AddressID || update.Body || update.Time || update.ExternalID {
 		// If one of those is modified, we have to re-send the whole message to the server
 
 		// The message ID will change
@@ -497,37 +796,130 @@ func (b *Messages) UpdateMessage(user string, update *backend.MessageUpdate) (ms
 		for _, att := range tmpAtts {
 			b.tmpAtts.UpdateAttachmentMessage(user, att.ID, msg.ID)
 		}
-	} else if update.LabelIDs != backend.RemoveLabels && len(update.Message.LabelIDs) == 1 {
-		// Move the message from its mailbox to another one
-		// TODO: support more scenarios
+	} else if update.LabelIDs != backend.KeepLabels {
+		err = b.updateMessageLabels(user, seqset, msg, update, labels)
+	}
 
-		msg.LabelIDs = update.Message.LabelIDs
-		label := msg.LabelIDs[0]
+	return
+}
 
-		var newMailbox string
-		newMailbox, err = b.getLabelMailbox(user, label)
-		if err != nil {
-			return
+// Apply a labels update to a message. The starred label and keyword labels are
+// stored as flags, other labels are mailboxes. labels contains message labels
+// before the update.
+func (b *Messages) updateMessageLabels(user string, seqset *imap.SeqSet, msg *backend.Message, update *backend.MessageUpdate, labels []string) error {
+	var keywords, mailboxes []string
+	starred := false
+	for _, label := range update.Message.LabelIDs {
+		if label == backend.StarredLabel {
+			starred = true
+		} else if b.isKeywordLabel(user, label) {
+			keywords = append(keywords, label)
+		} else {
+			mailboxes = append(mailboxes, label)
 		}
+	}
 
-		var newUid uint32
-		newUid, err = b.moveMessages(user, seqset, newMailbox)
-		if err != nil {
-			return
+	// If the starred flag is explicitly updated, don't override it
+	starred = starred && !update.Starred
+
+	switch update.LabelIDs {
+	case backend.AddLabels:
+		if starred {
+			keywords = append(keywords, imap.FlaggedFlag)
+		}
+		if err := b.storeFlags(user, seqset, true, keywords...); err != nil {
+			return err
+		}
+	case backend.RemoveLabels:
+		if starred {
+			keywords = append(keywords, imap.FlaggedFlag)
+		}
+		if err := b.storeFlags(user, seqset, false, keywords...); err != nil {
+			return err
 		}
 
-		// Update message ID
-		oldId := msg.ID
-		msg.ID = formatMessageId(newMailbox, newUid)
+		// A message must stay in a mailbox
+		mailboxes = nil
+	case backend.ReplaceLabels:
+		var removed []string
+		for _, label := range labels {
+			if !b.isKeywordLabel(user, label) {
+				continue
+			}
 
-		// Update temporary attachments message ID
-		tmpAtts, _ := b.tmpAtts.ListAttachments(user, oldId)
-		for _, att := range tmpAtts {
-			b.tmpAtts.UpdateAttachmentMessage(user, att.ID, msg.ID)
+			found := false
+			for _, kw := range keywords {
+				if kw == label {
+					found = true
+					break
+				}
+			}
+			if !found {
+				removed = append(removed, label)
+			}
+		}
+
+		// Unless it's explicitly updated, the starred flag follows labels
+		if !update.Starred {
+			if starred {
+				keywords = append(keywords, imap.FlaggedFlag)
+			} else if hasAttr(labels, backend.StarredLabel) {
+				removed = append(removed, imap.FlaggedFlag)
+			}
+		}
+
+		if err := b.storeFlags(user, seqset, false, removed...); err != nil {
+			return err
+		}
+		if err := b.storeFlags(user, seqset, true, keywords...); err != nil {
+			return err
 		}
 	}
 
-	return
+	// Move the message from its mailbox to another one
+	// TODO: a message can only be moved to one mailbox
+	if len(mailboxes) == 0 {
+		return nil
+	}
+
+	mailbox, _, err := parseMessageId(msg.ID)
+	if err != nil {
+		return err
+	}
+	if getLabelID(mailbox) == mailboxes[0] {
+		return nil // Already in this mailbox
+	}
+
+	newMailbox, err := b.getLabelMailbox(user, mailboxes[0])
+	if err != nil {
+		return err
+	}
+
+	newUid, err := b.moveMessages(user, seqset, newMailbox)
+	if err != nil {
+		return err
+	}
+
+	// Update message ID
+	oldId := msg.ID
+	msg.ID = formatMessageId(newMailbox, newUid)
+
+	// The message isn't in its previous mailbox anymore
+	var newLabels []string
+	for _, label := range msg.LabelIDs {
+		if label != getLabelID(mailbox) {
+			newLabels = append(newLabels, label)
+		}
+	}
+	msg.LabelIDs = newLabels
+
+	// Update temporary attachments message ID
+	tmpAtts, _ := b.tmpAtts.ListAttachments(user, oldId)
+	for _, att := range tmpAtts {
+		b.tmpAtts.UpdateAttachmentMessage(user, att.ID, msg.ID)
+	}
+
+	return nil
 }
 
 func (b *Messages) DeleteMessage(user, id string) (err error) {
@@ -545,12 +937,28 @@ func (b *Messages) DeleteMessage(user, id string) (err error) {
 	seqset.AddNum(uid)
 
 	err = b.deleteMessages(user, seqset)
+	if err != nil {
+		return
+	}
+
+	// Remove temporary attachments
+	tmpAtts, _ := b.tmpAtts.ListAttachments(user, id)
+	for _, att := range tmpAtts {
+		b.tmpAtts.DeleteAttachment(user, att.ID)
+	}
 	return
 }
 
-func newMessages(conns *conns) *Messages {
+func newMessages(conns *conns, users backend.UsersBackend) *Messages {
+	var tmpAtts backend.AttachmentsBackend
+	if conns.config.AttachmentsDirectory != "" {
+		tmpAtts = disk.NewAttachments(&disk.Config{Directory: conns.config.AttachmentsDirectory}, users)
+	} else {
+		tmpAtts = memory.NewAttachments()
+	}
+
 	return &Messages{
 		conns:     conns,
-		tmpAtts:   memory.NewAttachments().(updatableAttachments),
+		tmpAtts:   tmpAtts.(updatableAttachments),
 	}
 }
@@ -0,0 +1,176 @@
+package imap
+
+import (
+	"strconv"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/utf7"
+
+	"github.com/emersion/neutron/backend"
+)
+
+// Entries used to store labels metadata on mailboxes, as defined in RFC 5464.
+const (
+	colorEntry   = "/private/vendor/neutron/color"
+	orderEntry   = "/private/vendor/neutron/order"
+	displayEntry = "/private/vendor/neutron/display"
+)
+
+// A GETMETADATA command.
+type getMetadata struct {
+	Mailbox string
+	Entries []string
+}
+
+func (cmd *getMetadata) Command() *imap.Command {
+	mailbox, _ := utf7.Encoding.NewEncoder().String(cmd.Mailbox)
+
+	entries := make([]interface{}, len(cmd.Entries))
+	for i, entry := range cmd.Entries {
+		entries[i] = imap.RawString(entry)
+	}
+
+	return &imap.Command{
+		Name:      "GETMETADATA",
+		Arguments: []interface{}{imap.FormatMailboxName(mailbox), entries},
+	}
+}
+
+// A SETMETADATA command. Empty values remove entries.
+type setMetadata struct {
+	Mailbox string
+	Entries map[string]string
+}
+
+func (cmd *setMetadata) Command() *imap.Command {
+	mailbox, _ := utf7.Encoding.NewEncoder().String(cmd.Mailbox)
+
+	var entries []interface{}
+	for entry, value := range cmd.Entries {
+		var v interface{} = value
+		if value == "" {
+			v = nil
+		}
+		entries = append(entries, imap.RawString(entry), v)
+	}
+
+	return &imap.Command{
+		Name:      "SETMETADATA",
+		Arguments: []interface{}{imap.FormatMailboxName(mailbox), entries},
+	}
+}
+
+// A METADATA response.
+type metadataResp struct {
+	Entries map[string]string
+}
+
+func (r *metadataResp) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok || name != "METADATA" || len(fields) < 2 {
+		return responses.ErrUnhandled
+	}
+
+	list, ok := fields[1].([]interface{})
+	if !ok {
+		return responses.ErrUnhandled
+	}
+
+	for i := 0; i+1 < len(list); i += 2 {
+		entry, err := imap.ParseString(list[i])
+		if err != nil {
+			return err
+		}
+
+		// NIL values are not set
+		if list[i+1] == nil {
+			continue
+		}
+		value, err := imap.ParseString(list[i+1])
+		if err != nil {
+			return err
+		}
+
+		r.Entries[entry] = value
+	}
+
+	return nil
+}
+
+// Check if the server supports METADATA.
+func (b *conns) supportMetadata(user string) (bool, error) {
+	c, unlock, err := b.getConn(user)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	return c.Support("METADATA")
+}
+
+// Get a mailbox's label metadata stored on the server. Returns nil if the
+// mailbox has no metadata.
+func (b *conns) getMetadata(user, mailbox string) (label *backend.Label, err error) {
+	c, unlock, err := b.getConn(user)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	cmd := &getMetadata{
+		Mailbox: mailbox,
+		Entries: []string{colorEntry, orderEntry, displayEntry},
+	}
+	res := &metadataResp{Entries: map[string]string{}}
+
+	status, err := c.Execute(cmd, res)
+	if err != nil {
+		return
+	}
+	if err = status.Err(); err != nil {
+		return
+	}
+
+	color, ok := res.Entries[colorEntry]
+	if !ok {
+		return
+	}
+
+	label = &backend.Label{
+		ID:      mailbox,
+		Color:   color,
+		Display: 1,
+	}
+	if order, ok := res.Entries[orderEntry]; ok {
+		label.Order, _ = strconv.Atoi(order)
+	}
+	if display, ok := res.Entries[displayEntry]; ok {
+		label.Display, _ = strconv.Atoi(display)
+	}
+	return
+}
+
+// Store a mailbox's label metadata on the server.
+func (b *conns) setMetadata(user string, label *backend.Label) error {
+	c, unlock, err := b.getConn(user)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	cmd := &setMetadata{
+		Mailbox: label.ID,
+		Entries: map[string]string{
+			colorEntry:   label.Color,
+			orderEntry:   strconv.Itoa(label.Order),
+			displayEntry: strconv.Itoa(label.Display),
+		},
+	}
+
+	status, err := c.Execute(cmd, nil)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
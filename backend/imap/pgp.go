@@ -0,0 +1,89 @@
+package imap
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-imap"
+
+	"github.com/emersion/neutron/backend"
+	_textproto "github.com/emersion/neutron/backend/util/textproto"
+)
+
+// Number of bytes fetched to read an attachment's key packets.
+const keyPacketsFetchSize = 8192
+
+// Check if a message is a PGP/MIME encrypted message, as defined in RFC 3156.
+func isPgpMime(structure *imap.BodyStructure) bool {
+	return isMultipart(structure) && strings.EqualFold(structure.MIMESubType, "encrypted") &&
+		strings.EqualFold(structure.Params["protocol"], "application/pgp-encrypted") &&
+		len(structure.Parts) == 2
+}
+
+// Get the part containing the encrypted data of a PGP/MIME message.
+func getPgpMimePart(structure *imap.BodyStructure) *bodyPart {
+	return &bodyPart{BodyStructure: structure.Parts[1], Path: []int{2}}
+}
+
+func isEncryptedAttachment(att *backend.Attachment) bool {
+	switch att.MIMEType {
+	case "application/pgp", "application/pgp-encrypted":
+		return true
+	}
+
+	name := strings.ToLower(att.Name)
+	return strings.HasSuffix(name, ".pgp") || strings.HasSuffix(name, ".gpg")
+}
+
+// Fetch a part's key packets. Only the beginning of the part is fetched, unless
+// key packets don't fit in it.
+func readKeyPackets(c *conn, seqset *imap.SeqSet, part *bodyPart) (string, error) {
+	fetch := func(partial []int) ([]byte, error) {
+		section := &imap.BodySectionName{
+			BodyPartName: imap.BodyPartName{Path: part.Path},
+			Peek: true,
+			Partial: partial,
+		}
+
+		messages := make(chan *imap.Message, 1)
+		if err := c.UidFetch(seqset, []imap.FetchItem{section.FetchItem()}, messages); err != nil {
+			return nil, err
+		}
+
+		data := <-messages
+		if data == nil {
+			return nil, errors.New("No such attachment")
+		}
+		body := data.GetBody(section)
+		if body == nil {
+			return nil, errors.New("No such attachment")
+		}
+
+		keyPackets, _, err := backend.SplitPgpMessage(_textproto.Decode(body, part.Encoding, ""))
+		return keyPackets, err
+	}
+
+	keyPackets, err := fetch([]int{0, keyPacketsFetchSize})
+	if err != nil && part.Size > keyPacketsFetchSize {
+		keyPackets, err = fetch(nil)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(keyPackets), nil
+}
+
+// Split an encrypted attachment's content into key packets and data packets.
+// Key packets are stored in the attachment, data packets are returned.
+func splitEncryptedAttachment(att *backend.Attachment, content io.Reader) (io.Reader, error) {
+	keyPackets, data, err := backend.SplitPgpMessage(content)
+	if err != nil {
+		return nil, err
+	}
+
+	att.KeyPackets = base64.StdEncoding.EncodeToString(keyPackets)
+	return data, nil
+}
@@ -0,0 +1,139 @@
+package imap
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/emersion/neutron/backend"
+)
+
+// Stores labels metadata that cannot be saved on the IMAP server, e.g. colors
+// of labels stored as keywords. If no directory is specified, metadata is only
+// kept in memory.
+type labelsStore struct {
+	directory string
+
+	lock sync.Mutex
+	labels map[string][]*backend.Label
+}
+
+func (s *labelsStore) getPath(user string) string {
+	return s.directory + "/" + user + ".json"
+}
+
+func (s *labelsStore) load(user string) (labels []*backend.Label, err error) {
+	if labels, ok := s.labels[user]; ok {
+		return labels, nil
+	}
+
+	if s.directory != "" {
+		var data []byte
+		data, err = ioutil.ReadFile(s.getPath(user))
+		if os.IsNotExist(err) {
+			err = nil
+		} else if err != nil {
+			return
+		} else if err = json.Unmarshal(data, &labels); err != nil {
+			return
+		}
+	}
+
+	s.labels[user] = labels
+	return
+}
+
+func (s *labelsStore) save(user string, labels []*backend.Label) (err error) {
+	s.labels[user] = labels
+
+	if s.directory == "" {
+		return
+	}
+
+	data, err := json.Marshal(labels)
+	if err != nil {
+		return
+	}
+
+	err = os.MkdirAll(s.directory, 0744)
+	if err != nil {
+		return
+	}
+
+	return ioutil.WriteFile(s.getPath(user), data, 0644)
+}
+
+// List all labels stored for a user.
+func (s *labelsStore) List(user string) ([]*backend.Label, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.load(user)
+}
+
+// Get a label. Returns nil if the label isn't in the store.
+func (s *labelsStore) Get(user, id string) (*backend.Label, error) {
+	labels, err := s.List(user)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, lbl := range labels {
+		if lbl.ID == id {
+			return lbl, nil
+		}
+	}
+	return nil, nil
+}
+
+// Insert or replace a label.
+func (s *labelsStore) Put(user string, label *backend.Label) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	labels, err := s.load(user)
+	if err != nil {
+		return err
+	}
+
+	replaced := false
+	for i, lbl := range labels {
+		if lbl.ID == label.ID {
+			labels[i] = label
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		labels = append(labels, label)
+	}
+
+	return s.save(user, labels)
+}
+
+// Delete a label. Deleting a label which isn't in the store does nothing.
+func (s *labelsStore) Delete(user, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	labels, err := s.load(user)
+	if err != nil {
+		return err
+	}
+
+	for i, lbl := range labels {
+		if lbl.ID == id {
+			labels = append(labels[:i:i], labels[i+1:]...)
+			return s.save(user, labels)
+		}
+	}
+	return nil
+}
+
+func newLabelsStore(directory string) *labelsStore {
+	return &labelsStore{
+		directory: directory,
+		labels: map[string][]*backend.Label{},
+	}
+}
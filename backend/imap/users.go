@@ -12,7 +12,10 @@ import (
 type Users struct {
 	*conns
 
+	messages *Messages
 	users map[string]*backend.User
+	// Space used on the IMAP server, temporary attachments are not included
+	usedSpace map[string]int
 }
 
 func (b *Users) getQuota(user *backend.User) error {
@@ -36,7 +39,7 @@ func (b *Users) getQuota(user *backend.User) error {
 	// TODO: support multiple quotas?
 	if len(quotas) > 0 {
 		if usage, ok := quotas[0].Resources[quota.ResourceStorage]; ok {
-			user.UsedSpace = int(usage[0]) * 1024
+			b.usedSpace[user.ID] = int(usage[0]) * 1024
 			user.MaxSpace = int(usage[1]) * 1024
 		}
 	}
@@ -44,11 +47,25 @@ func (b *Users) getQuota(user *backend.User) error {
 	return nil
 }
 
+// Update a user's used space, which includes temporary attachments.
+func (b *Users) updateUsedSpace(user *backend.User) error {
+	attsSpace, err := b.messages.attachmentsUsedSpace(user.ID)
+	if err != nil {
+		return err
+	}
+
+	user.UsedSpace = b.usedSpace[user.ID] + attsSpace
+	return nil
+}
+
 func (b *Users) GetUser(id string) (user *backend.User, err error) {
 	user, ok := b.users[id]
 	if !ok {
 		err = errors.New("No such user")
+		return
 	}
+
+	err = b.updateUsedSpace(user)
 	return
 }
 
@@ -86,10 +103,16 @@ func (b *Users) Auth(username, password string) (user *backend.User, err error)
 		},
 	}
 
+	user.MaxUpload = b.config.MaxUpload
+
 	b.getQuota(user)
+	b.updateUsedSpace(user)
 
 	b.users[user.ID] = user
 
+	// Attachments of drafts deleted by other clients are never removed
+	b.messages.collectAttachments(user.ID)
+
 	return
 }
 
@@ -110,10 +133,12 @@ func (b *Users) UpdateUserPassword(id, current, new string) error {
 	return errors.New("Cannot update user password with IMAP backend")
 }
 
-func newUsers(conns *conns) *Users {
+func newUsers(conns *conns, messages *Messages) *Users {
 	return &Users{
 		conns: conns,
 
+		messages: messages,
 		users: map[string]*backend.User{},
+		usedSpace: map[string]int{},
 	}
 }
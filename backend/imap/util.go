@@ -1,11 +1,9 @@
 package imap
 
 import (
-	"bufio"
 	"encoding/base64"
 	"errors"
 	"io"
-	"mime"
 	"net/textproto"
 	"strconv"
 	"strings"
@@ -59,6 +57,15 @@ func parseMessageId(id string) (mailbox string, uid uint32, err error) {
 	return
 }
 
+func hasAttr(attrs []string, attr string) bool {
+	for _, a := range attrs {
+		if strings.EqualFold(a, attr) {
+			return true
+		}
+	}
+	return false
+}
+
 func parseMessage(msg *backend.Message, src *imap.Message) {
 	msg.Order = int(src.SeqNum)
 	msg.Size = int(src.Size)
@@ -78,83 +85,203 @@ func parseMessage(msg *backend.Message, src *imap.Message) {
 	}
 }
 
-func bodyStructureAttachments(structure *imap.BodyStructure) []*backend.Attachment {
-	// Non-multipart messages don't contain attachments
-	if structure.MIMEType != "multipart" || structure.MIMESubType == "alternative" {
-		return nil
+// A leaf part of a message body.
+type bodyPart struct {
+	*imap.BodyStructure
+
+	// The part path, as used in body section names
+	Path []int
+}
+
+func formatPartPath(path []int) string {
+	parts := make([]string, len(path))
+	for i, n := range path {
+		parts[i] = strconv.Itoa(n)
 	}
+	return strings.Join(parts, ".")
+}
 
-	var attachments []*backend.Attachment
-	for i, part := range structure.Parts {
-		if part.MIMEType == "multipart" {
-			attachments = append(attachments, bodyStructureAttachments(part)...)
-			continue
+func parsePartPath(s string) ([]int, error) {
+	parts := strings.Split(s, ".")
+	path := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n <= 0 {
+			return nil, errors.New("Invalid body part path: " + s)
 		}
+		path[i] = n
+	}
+	return path, nil
+}
 
-		// Apple Mail doesn't format well headers
-		// First child is message content
-		if part.MIMEType == "text" && i == 0 {
-			continue
-		}
+func appendPartPath(path []int, n int) []int {
+	child := make([]int, len(path)+1)
+	copy(child, path)
+	child[len(path)] = n
+	return child
+}
+
+func isMultipart(part *imap.BodyStructure) bool {
+	return strings.EqualFold(part.MIMEType, "multipart")
+}
+
+func isMessagePart(part *imap.BodyStructure) bool {
+	return strings.EqualFold(part.MIMEType, "message") && strings.EqualFold(part.MIMESubType, "rfc822")
+}
 
-		attachments = append(attachments, &backend.Attachment{
-			ID: part.Id,
-			Name: part.Params["name"],
-			MIMEType: part.MIMEType + "/" + part.MIMESubType,
-			Size: int(part.Size),
-		})
+// Check if a part is an attachment rather than a message body.
+func isAttachment(part *imap.BodyStructure) bool {
+	if strings.EqualFold(part.Disposition, "attachment") || part.DispositionParams["filename"] != "" {
+		return true
+	}
+	if !strings.EqualFold(part.MIMEType, "text") {
+		return true
 	}
 
-	return attachments
+	subType := strings.ToLower(part.MIMESubType)
+	return subType != "plain" && subType != "html"
 }
 
-func getPreferredPart(structure *imap.BodyStructure) (path string, part *imap.BodyStructure) {
-	part = structure
+// Call fn for each leaf part of a body structure. Encapsulated messages are
+// leaf parts.
+func walkBodyStructure(structure *imap.BodyStructure, path []int, fn func(part *bodyPart)) {
+	if isMultipart(structure) {
+		for i, part := range structure.Parts {
+			walkBodyStructure(part, appendPartPath(path, i+1), fn)
+		}
+		return
+	}
+
+	if len(path) == 0 {
+		// Non-multipart messages only have a part 1
+		path = []int{1}
+	}
+
+	fn(&bodyPart{BodyStructure: structure, Path: path})
+}
 
-	for i, p := range structure.Parts {
-		if p.MIMEType == "multipart" && p.MIMESubType == "alternative" {
-			path, part = getPreferredPart(p)
-			path = strconv.Itoa(i+1) + "." + path
+// Find parts containing a message's body. If the message has no body of its
+// own, e.g. when forwarding a message as an attachment, the body of the first
+// encapsulated message is used.
+func findBodyParts(structure *imap.BodyStructure, path []int) (html, text *bodyPart) {
+	var nested *bodyPart
+	walkBodyStructure(structure, path, func(part *bodyPart) {
+		if isMessagePart(part.BodyStructure) && part.BodyStructure.BodyStructure != nil && nested == nil {
+			nested = part
 		}
-		if p.MIMEType != "text" {
-			continue
+		if isAttachment(part.BodyStructure) {
+			return
 		}
-		if part.MIMEType == "multipart" || p.MIMESubType == "html" {
-			part = p
-			path = strconv.Itoa(i+1)
+
+		switch strings.ToLower(part.MIMESubType) {
+		case "html":
+			if html == nil {
+				html = part
+			}
+		case "plain":
+			if text == nil {
+				text = part
+			}
 		}
-	}
+	})
 
+	if html == nil && text == nil && nested != nil {
+		inner := nested.BodyStructure.BodyStructure
+		if isMultipart(inner) {
+			return findBodyParts(inner, nested.Path)
+		}
+		return findBodyParts(inner, appendPartPath(nested.Path, 1))
+	}
 	return
 }
 
-func decodePart(part *imap.BodyStructure, r io.Reader) io.Reader {
-	return _textproto.Decode(r, part.Encoding, part.Params["charset"])
+func getPartFilename(part *imap.BodyStructure) string {
+	name := part.DispositionParams["filename"]
+	if name == "" {
+		name = part.Params["name"]
+	}
+	if name == "" && isMessagePart(part) {
+		name = "message.eml"
+		if part.Envelope != nil && part.Envelope.Subject != "" {
+			name = _textproto.DecodeWord(part.Envelope.Subject) + ".eml"
+		}
+	}
+	return _textproto.DecodeWord(name)
 }
 
-func parseAttachment(r io.Reader) (att *backend.Attachment, body io.Reader) {
-	br := bufio.NewReader(r)
-	h, err := textproto.NewReader(br).ReadMIMEHeader()
-	if err != nil {
-		return
+// Get the decoded size of a part. Base64 sizes are approximated.
+func getPartSize(part *imap.BodyStructure) int {
+	size := int(part.Size)
+	if strings.EqualFold(part.Encoding, "base64") {
+		size = size * 3 / 4
 	}
+	return size
+}
 
-	mediaType, params, _ := mime.ParseMediaType(h.Get("Content-Type"))
-
-	att = &backend.Attachment{
-		ID: h.Get("Content-Id"),
-		Name: params["name"],
-		MIMEType: mediaType,
+// Get attachments from a message's body structure. Inline parts, e.g. images
+// referenced with cid: URLs in the HTML body, keep their Content-Id header so
+// that they can be resolved to attachment IDs.
+func bodyStructureAttachments(structure *imap.BodyStructure, mailbox string, uid uint32) []*backend.Attachment {
+	if isPgpMime(structure) {
+		return nil // Attachments are in the encrypted part
 	}
 
-	if size := h.Get("Content-Size"); size != "" {
-		att.Size, _ = strconv.Atoi(size)
+	var attachments []*backend.Attachment
+	walkBodyStructure(structure, nil, func(part *bodyPart) {
+		if !isAttachment(part.BodyStructure) {
+			return
+		}
+
+		att := &backend.Attachment{
+			ID: formatAttachmentId(mailbox, uid, formatPartPath(part.Path)),
+			MessageID: formatMessageId(mailbox, uid),
+			Name: getPartFilename(part.BodyStructure),
+			MIMEType: strings.ToLower(part.MIMEType + "/" + part.MIMESubType),
+			Size: getPartSize(part.BodyStructure),
+			Headers: textproto.MIMEHeader{},
+		}
+
+		if part.Id != "" {
+			att.Headers.Set("Content-Id", part.Id)
+		}
+		if part.Disposition != "" {
+			att.Headers.Set("Content-Disposition", part.Disposition)
+		}
+
+		attachments = append(attachments, att)
+	})
+
+	return attachments
+}
+
+// Resolve cid: URLs of inline parts in an HTML body to attachment IDs.
+func resolveContentIds(body string, attachments []*backend.Attachment) string {
+	for _, att := range attachments {
+		id := strings.Trim(att.Headers.Get("Content-Id"), "<>")
+		if id == "" {
+			continue
+		}
+
+		body = strings.Replace(body, "cid:"+id, "cid:"+att.ID, -1)
 	}
+	return body
+}
 
-	body = _textproto.Decode(br, h.Get("Content-Encoding"), params["charset"])
+// Find a leaf part in a body structure.
+func findBodyPart(structure *imap.BodyStructure, path []int) (found *bodyPart) {
+	s := formatPartPath(path)
+	walkBodyStructure(structure, nil, func(part *bodyPart) {
+		if found == nil && formatPartPath(part.Path) == s {
+			found = part
+		}
+	})
 	return
 }
 
+func decodePart(part *imap.BodyStructure, r io.Reader) io.Reader {
+	return _textproto.Decode(r, part.Encoding, part.Params["charset"])
+}
+
 func parseAddress(addr *imap.Address) *backend.Email {
 	return &backend.Email{
 		Name:    _textproto.DecodeWord(addr.PersonalName),
@@ -188,4 +315,7 @@ func parseEnvelope(msg *backend.Message, envelope *imap.Envelope) {
 	msg.ToList = parseAddressList(envelope.To)
 	msg.CCList = parseAddressList(envelope.Cc)
 	msg.BCCList = parseAddressList(envelope.Bcc)
+
+	msg.ExternalID = strings.Trim(strings.TrimSpace(envelope.MessageId), "<>")
+	msg.InReplyTo = envelope.InReplyTo
 }
@@ -23,7 +23,6 @@ type KeysBackend interface {
 	UpdateKeypair(email string, keypair *Keypair) (*Keypair, error)
 }
 
-
 const PgpMessageType = "PGP MESSAGE"
 
 // Encode a PGP message armor.
@@ -31,6 +30,45 @@ func ArmorMessage(w io.Writer) (io.WriteCloser, error) {
 	return armor.Encode(w, PgpMessageType, map[string]string{})
 }
 
+// Encrypt data to the owner of an armored public key. The output is not armored.
+func EncryptToPublicKey(w io.Writer, publicKey string) (io.WriteCloser, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(publicKey))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entities) == 0 {
+		return nil, errors.New("Key ring does not contain any key")
+	}
+
+	return openpgp.Encrypt(w, entities, nil, nil, nil)
+}
+
+// Encrypt a message body, the result is armored.
+func EncryptBody(body, publicKey string) (string, error) {
+	var b bytes.Buffer
+	armored, err := ArmorMessage(&b)
+	if err != nil {
+		return "", err
+	}
+
+	w, err := EncryptToPublicKey(armored, publicKey)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write([]byte(body)); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	if err := armored.Close(); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
 // A keypair contains a private and a public key.
 type Keypair struct {
 	ID string
@@ -39,6 +39,7 @@ const (
 	SpamLabel = "4"
 	ArchiveLabel = "6"
 	StarredLabel = "10"
+	ScheduledLabel = "12"
 )
 
 // A request to update a label.
@@ -2,6 +2,7 @@ package memory
 
 import (
 	"errors"
+	"strings"
 
 	"github.com/emersion/neutron/backend"
 	"github.com/emersion/neutron/backend/util"
@@ -38,6 +39,17 @@ func (b *Addresses) ListAddresses(user string) (addrs []*backend.Address, err er
 	return
 }
 
+func (b *Addresses) GetAddressByEmail(email string) (string, *backend.Address, error) {
+	for user, addrs := range b.addresses {
+		for _, addr := range addrs {
+			if strings.EqualFold(addr.Email, email) {
+				return user, addr, nil
+			}
+		}
+	}
+	return "", nil, errors.New("No such address")
+}
+
 func (b *Addresses) InsertAddress(user string, addr *backend.Address) (*backend.Address, error) {
 	addr.ID = util.GenerateId()
 	b.addresses[user] = append(b.addresses[user], addr)
@@ -1,7 +1,10 @@
 package memory
 
 import (
+	"bytes"
 	"errors"
+	"io"
+	"io/ioutil"
 
 	"github.com/emersion/neutron/backend"
 	"github.com/emersion/neutron/backend/util"
@@ -44,6 +47,14 @@ func (b *Attachments) ReadAttachment(user, id string) (*backend.Attachment, []by
 	return att.Attachment, att.Contents, nil
 }
 
+func (b *Attachments) OpenAttachment(user, id string) (*backend.Attachment, io.ReadCloser, error) {
+	att, contents, err := b.ReadAttachment(user, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return att, ioutil.NopCloser(bytes.NewReader(contents)), nil
+}
+
 func (b *Attachments) InsertAttachment(user string, att *backend.Attachment, contents []byte) (*backend.Attachment, error) {
 	att.ID = util.GenerateId()
 	att.Size = len(contents)
@@ -54,6 +65,14 @@ func (b *Attachments) InsertAttachment(user string, att *backend.Attachment, con
 	return att, nil
 }
 
+func (b *Attachments) InsertAttachmentFrom(user string, att *backend.Attachment, r io.Reader) (*backend.Attachment, error) {
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return b.InsertAttachment(user, att, contents)
+}
+
 func (b *Attachments) DeleteAttachment(user, id string) (err error) {
 	i, err := b.getAttachmentIndex(user, id)
 	if err != nil {
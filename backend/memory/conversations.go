@@ -11,58 +11,6 @@ type Conversations struct {
 	*Messages
 }
 
-func isEmailInList(needle *backend.Email, haystack []*backend.Email) bool {
-	for _, email := range haystack {
-		if needle.Address == email.Address {
-			return true
-		}
-	}
-	return false
-}
-
-func populateConversation(conv *backend.Conversation, msg *backend.Message) {
-	conv.NumMessages++
-	if msg.IsRead == 0 {
-		conv.NumUnread++
-	}
-
-	if msg.Time > conv.Time {
-		conv.Time = msg.Time
-		conv.Subject = msg.Subject
-	}
-
-	if !isEmailInList(msg.Sender, conv.Senders) {
-		conv.Senders = append(conv.Senders, msg.Sender)
-	}
-
-	for _, email := range msg.ToList {
-		if !isEmailInList(email, conv.Recipients) {
-			conv.Recipients = append(conv.Recipients, email)
-		}
-	}
-
-	for _, labelId := range msg.LabelIDs {
-		var label *backend.ConversationLabel
-		for _, l := range conv.Labels {
-			if l.ID == labelId {
-				label = l
-				break
-			}
-		}
-
-		if label == nil {
-			label = &backend.ConversationLabel{ ID: labelId }
-			conv.Labels = append(conv.Labels, label)
-			conv.LabelIDs = append(conv.LabelIDs, labelId)
-		}
-
-		label.NumMessages++
-		if msg.IsRead == 0 {
-			label.NumUnread++
-		}
-	}
-}
-
 func (b *Conversations) ListConversationMessages(user, id string) (msgs []*backend.Message, err error) {
 	for _, msg := range b.messages[user] {
 		if msg.ConversationID == id {
@@ -87,7 +35,7 @@ func (b *Conversations) listConversations(user string) (convs []*backend.Convers
 			convs = append(convs, conv)
 		}
 
-		populateConversation(conv, msg)
+		conv.AddMessage(msg)
 	}
 
 	return
@@ -99,45 +47,26 @@ func (b *Conversations) ListConversations(user string, filter *backend.MessagesF
 		return
 	}
 
-	filtered := []*backend.Conversation{}
-
-	for _, c := range all {
-		if filter.Label != "" {
-			matches := false
-			for _, lbl := range c.LabelIDs {
-				if lbl == filter.Label {
-					matches = true
-					break
-				}
-			}
+	// A conversation matches if one of its messages matches
+	matches := map[string]bool{}
+	for _, msg := range b.messages[user] {
+		msg.Attachments, _ = b.ListAttachments(user, msg.ID)
 
-			if !matches {
-				continue
-			}
+		if filter.Match(msg) {
+			matches[msg.ConversationID] = true
 		}
-
-		// TODO: other filter fields support
-
-		filtered = append(filtered, c)
 	}
 
-	total = len(filtered)
-
-	if filter.Limit > 0 && filter.Page >= 0 {
-		from := filter.Limit * filter.Page
-		to := filter.Limit * (filter.Page + 1)
-		if from < 0 {
-			from = 0
-		}
-		if to > total {
-			to = total
+	filtered := []*backend.Conversation{}
+	for _, c := range all {
+		if matches[c.ID] {
+			filtered = append(filtered, c)
 		}
-
-		convs = filtered[from:to]
-	} else {
-		convs = filtered
 	}
 
+	total = len(filtered)
+	from, to := filter.PageBounds(total)
+	convs = filtered[from:to]
 	return
 }
 
@@ -177,7 +106,7 @@ func (b *Conversations) GetConversation(user, id string) (conv *backend.Conversa
 				conv = &backend.Conversation{ID: id}
 			}
 
-			populateConversation(conv, msg)
+			conv.AddMessage(msg)
 		}
 	}
 
@@ -9,6 +9,7 @@ import (
 
 type Domains struct {
 	domains []*backend.Domain
+	dkimKeys map[string]*backend.DkimKey
 }
 
 func (b *Domains) ListDomains() (domains []*backend.Domain, err error) {
@@ -40,6 +41,27 @@ func (b *Domains) InsertDomain(domain *backend.Domain) (*backend.Domain, error)
 	return domain, nil
 }
 
+func (b *Domains) UpdateDomain(update *backend.DomainUpdate) (*backend.Domain, error) {
+	domain, err := b.GetDomain(update.Domain.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	update.Apply(domain)
+	return domain, nil
+}
+
+func (b *Domains) GetDkimKey(domain string) (*backend.DkimKey, error) {
+	return b.dkimKeys[domain], nil
+}
+
+func (b *Domains) UpdateDkimKey(domain string, key *backend.DkimKey) error {
+	b.dkimKeys[domain] = key
+	return nil
+}
+
 func NewDomains() backend.DomainsBackend {
-	return &Domains{}
+	return &Domains{
+		dkimKeys: make(map[string]*backend.DkimKey),
+	}
 }
@@ -18,41 +18,6 @@ type event struct {
 	listeners []chan *event
 }
 
-// Merge two events.
-func mergeEvents(dst, src *backend.Event) *backend.Event {
-	if dst == nil {
-		dst = &backend.Event{}
-	}
-
-	dst.ID = src.ID
-
-	if src.Refresh != 0 {
-		dst.Refresh = src.Refresh
-	}
-	if src.Reload != 0 {
-		dst.Reload = src.Reload
-	}
-	if src.User != nil {
-		dst.User = src.User
-	}
-
-	dst.Notices = append(dst.Notices, src.Notices...)
-
-	dst.Messages = append(dst.Messages, src.Messages...)
-	dst.Conversations = append(dst.Conversations, src.Conversations...)
-	dst.Labels = append(dst.Labels, src.Labels...)
-	dst.Contacts = append(dst.Contacts, src.Contacts...)
-
-	if src.MessageCounts != nil {
-		dst.MessageCounts = src.MessageCounts
-	}
-	if src.ConversationCounts != nil {
-		dst.ConversationCounts = src.ConversationCounts
-	}
-
-	return dst
-}
-
 func (b *Events) insertEvent(user string, e *backend.Event) error {
 	e.ID = util.GenerateId()
 	b.events[user] = append(b.events[user], &event{Event: e})
@@ -175,7 +140,7 @@ func (b *Events) GetEventsAfter(user, id string) (*backend.Event, error) {
 
 		// If this is a new event, merge it
 		if from != -1 && i > from {
-			merged = mergeEvents(merged, e.Event)
+			merged = backend.MergeEvents(merged, e.Event)
 		}
 	}
 
@@ -0,0 +1,17 @@
+package memory_test
+
+import (
+	"testing"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/backendtest"
+	"github.com/emersion/neutron/backend/memory"
+)
+
+func TestBackend(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) *backend.Backend {
+		bkd := backend.New()
+		memory.Use(bkd)
+		return bkd
+	})
+}
@@ -44,43 +44,18 @@ func (b *Messages) ListMessages(user string, filter *backend.MessagesFilter) (ms
 	filtered := []*backend.Message{}
 
 	for _, msg := range all {
-		if filter.Label != "" {
-			matches := false
-			for _, lbl := range msg.LabelIDs {
-				if lbl == filter.Label {
-					matches = true
-					break
-				}
-			}
+		msg.Attachments, _ = b.ListAttachments(user, msg.ID)
 
-			if !matches {
-				continue
-			}
+		if !filter.Match(msg) {
+			continue
 		}
 
-		// TODO: other filter fields support
-
-		msg.Attachments, _ = b.ListAttachments(user, msg.ID)
 		filtered = append(filtered, msg)
 	}
 
 	total = len(filtered)
-
-	if filter.Limit > 0 && filter.Page >= 0 {
-		from := filter.Limit * filter.Page
-		to := filter.Limit * (filter.Page + 1)
-		if from < 0 {
-			from = 0
-		}
-		if to > total {
-			to = total
-		}
-
-		msgs = filtered[from:to]
-	} else {
-		msgs = filtered
-	}
-
+	from, to := filter.PageBounds(total)
+	msgs = filtered[from:to]
 	return
 }
 
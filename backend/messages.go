@@ -1,5 +1,9 @@
 package backend
 
+import (
+	"strings"
+)
+
 // Stores messages data.
 type MessagesBackend interface {
 	// Get a message.
@@ -42,6 +46,11 @@ type Message struct {
 	AddressID string
 	Body string `json:",omitempty"`
 	Header string `json:",omitempty"`
+	// The Message-ID header, without angle brackets.
+	ExternalID string `json:",omitempty"`
+	// Threading headers, formatted as in RFC 5322 section 3.6.4.
+	InReplyTo string `json:"-"`
+	References string `json:"-"`
 	ReplyTo *Email
 	Attachments []*Attachment
 	Starred int
@@ -198,11 +207,154 @@ type MessagesFilter struct {
 	Address string // Address ID
 	Attachments bool
 	From string
-	To string
+	To string // Matches To, Cc and Bcc
+	CC string
+	BCC string
 	Begin int64 // Timestamp
 	End int64 // Timestamp
 	Sort string
 	Desc bool
+
+	Subject string
+	Keywords []string // Terms or exact phrases, all of them must match
+	Labels []string // Label IDs, all of them must match
+	Unread bool
+	Read bool
+	Starred bool
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+func emailContainsFold(email *Email, substr string) bool {
+	if email == nil {
+		return false
+	}
+	return containsFold(email.Address, substr) || containsFold(email.Name, substr)
+}
+
+func emailListContainsFold(list []*Email, substr string) bool {
+	for _, email := range list {
+		if emailContainsFold(email, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if a message contains a keyword in its subject, its addresses or its
+// body. Encrypted bodies are not searched.
+func messageContainsKeyword(msg *Message, keyword string) bool {
+	if containsFold(msg.Subject, keyword) {
+		return true
+	}
+	if emailContainsFold(msg.Sender, keyword) {
+		return true
+	}
+	for _, list := range [][]*Email{msg.ToList, msg.CCList, msg.BCCList} {
+		if emailListContainsFold(list, keyword) {
+			return true
+		}
+	}
+	if !IsEncrypted(msg.Body) && containsFold(msg.Body, keyword) {
+		return true
+	}
+	return false
+}
+
+func hasLabel(msg *Message, label string) bool {
+	for _, lbl := range msg.LabelIDs {
+		if lbl == label {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if a message matches this filter. Pagination and sorting fields are
+// ignored.
+func (filter *MessagesFilter) Match(msg *Message) bool {
+	if filter.Label != "" && !hasLabel(msg, filter.Label) {
+		return false
+	}
+	for _, label := range filter.Labels {
+		if !hasLabel(msg, label) {
+			return false
+		}
+	}
+
+	if filter.Address != "" && msg.AddressID != filter.Address {
+		return false
+	}
+	if filter.Attachments && msg.NumAttachments == 0 && len(msg.Attachments) == 0 {
+		return false
+	}
+
+	if filter.From != "" && !emailContainsFold(msg.Sender, filter.From) {
+		return false
+	}
+	if filter.To != "" {
+		recipients := append(append(append([]*Email{}, msg.ToList...), msg.CCList...), msg.BCCList...)
+		if !emailListContainsFold(recipients, filter.To) {
+			return false
+		}
+	}
+	if filter.CC != "" && !emailListContainsFold(msg.CCList, filter.CC) {
+		return false
+	}
+	if filter.BCC != "" && !emailListContainsFold(msg.BCCList, filter.BCC) {
+		return false
+	}
+	if filter.Subject != "" && !containsFold(msg.Subject, filter.Subject) {
+		return false
+	}
+
+	if filter.Begin != 0 && msg.Time < filter.Begin {
+		return false
+	}
+	if filter.End != 0 && msg.Time >= filter.End {
+		return false
+	}
+
+	if filter.Unread && msg.IsRead != 0 {
+		return false
+	}
+	if filter.Read && msg.IsRead == 0 {
+		return false
+	}
+	if filter.Starred && msg.Starred == 0 && !hasLabel(msg, StarredLabel) {
+		return false
+	}
+
+	if filter.Keyword != "" && !messageContainsKeyword(msg, filter.Keyword) {
+		return false
+	}
+	for _, keyword := range filter.Keywords {
+		if !messageContainsKeyword(msg, keyword) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Get the bounds of the page requested by this filter, out of total items.
+// If no page is requested, all items are included.
+func (filter *MessagesFilter) PageBounds(total int) (from, to int) {
+	if filter.Limit <= 0 || filter.Page < 0 {
+		return 0, total
+	}
+
+	from = filter.Limit * filter.Page
+	to = filter.Limit * (filter.Page + 1)
+	if from > total {
+		from = total
+	}
+	if to > total {
+		to = total
+	}
+	return
 }
 
 // A request to update a message.
@@ -219,6 +371,7 @@ type MessageUpdate struct {
 	Body bool
 	Time bool
 	Starred bool
+	ExternalID bool
 	LabelIDs LabelsOperation
 }
 
@@ -267,6 +420,9 @@ func (update *MessageUpdate) Apply(msg *Message) {
 	if update.Time {
 		msg.Time = updated.Time
 	}
+	if update.ExternalID {
+		msg.ExternalID = updated.ExternalID
+	}
 
 	if update.LabelIDs != KeepLabels {
 		switch update.LabelIDs {
@@ -0,0 +1,79 @@
+// Delivers messages directly to recipients' mail exchangers.
+package mx
+
+import (
+	"crypto/x509"
+	"net/http"
+	"sync"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util/resolver"
+)
+
+type Config struct {
+	// Hostname announced to MX hosts. It should match the reverse DNS of the
+	// server's IP address.
+	Hostname string
+	// Port used to connect to MX hosts. Defaults to 25.
+	Port int
+	// DNS server used for lookups. Defaults to servers listed in
+	// /etc/resolv.conf. It must validate DNSSEC for DANE to be used.
+	Resolver string
+	// If true, messages are never delivered over insecure connections.
+	// Otherwise, STARTTLS is used when available.
+	RequireTls bool
+	// Root CAs used to authenticate MX hosts when MTA-STS policies are
+	// enforced. If nil, the system ones are used. It cannot be set in the config
+	// file.
+	RootCAs *x509.CertPool `json:"-"`
+	// HTTP client used to fetch MTA-STS policies. It must not follow redirects.
+	// If nil, a default client is used. It cannot be set in the config file.
+	StsClient *http.Client `json:"-"`
+}
+
+// A SendBackend which delivers messages to recipients' MX hosts. Connections
+// are secured with STARTTLS, and MX hosts are authenticated with DANE or
+// MTA-STS when recipient domains publish them. Messages are signed with the
+// DKIM key of the sender's domain, if any.
+type SendBackend struct {
+	config *Config
+	resolver resolver.Resolver
+	dkim backend.DkimBackend
+
+	lock sync.Mutex
+	policies map[string]*stsPolicy
+}
+
+// Create a new direct delivery backend. If r is nil, a resolver is created from
+// the config. dkim can be nil if messages must not be signed.
+func New(config *Config, r resolver.Resolver, dkim backend.DkimBackend) *SendBackend {
+	if config.Port <= 0 {
+		config.Port = 25
+	}
+	if r == nil {
+		r = resolver.New(config.Resolver)
+	}
+	if config.StsClient == nil {
+		config.StsClient = stsClient
+	}
+
+	return &SendBackend{
+		config: config,
+		resolver: r,
+		dkim: dkim,
+		policies: make(map[string]*stsPolicy),
+	}
+}
+
+func Use(bkd *backend.Backend, config *Config) *SendBackend {
+	var dkim backend.DkimBackend
+	if bkd.DkimBackend != nil {
+		// Keys are retrieved when sending messages, so that another backend
+		// can store them
+		dkim = bkd
+	}
+
+	send := New(config, nil, dkim)
+	bkd.Set(send)
+	return send
+}
@@ -0,0 +1,119 @@
+package mx
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/emersion/neutron/backend/util/resolver"
+)
+
+// TLSA usages suitable for SMTP (RFC 7672 section 3.1).
+const (
+	daneTA = 2
+	daneEE = 3
+)
+
+// Check if a TLSA record can be used to authenticate a MX host. PKIX usages
+// must not be used with SMTP.
+func isUsableTLSA(r *resolver.TLSA) bool {
+	return (r.Usage == daneTA || r.Usage == daneEE) && r.Selector <= 1 && r.MatchingType <= 2
+}
+
+// Keep only TLSA records which can be used with SMTP. Hosts having only
+// unusable records are treated as having no TLSA records at all (RFC 7672
+// section 2.2).
+func filterUsableTLSA(records []*resolver.TLSA) []*resolver.TLSA {
+	var usable []*resolver.TLSA
+	for _, r := range records {
+		if isUsableTLSA(r) {
+			usable = append(usable, r)
+		}
+	}
+	return usable
+}
+
+// Check if a certificate matches a TLSA record.
+func matchTLSA(r *resolver.TLSA, cert *x509.Certificate) bool {
+	var data []byte
+	switch r.Selector {
+	case 0:
+		data = cert.Raw
+	case 1:
+		data = cert.RawSubjectPublicKeyInfo
+	}
+
+	switch r.MatchingType {
+	case 1:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case 2:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	}
+
+	expected, err := hex.DecodeString(r.Certificate)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(data, expected)
+}
+
+// Verify a MX host certificate chain with TLSA records, as specified in RFC
+// 7672 section 3.1. DANE-EE records match the host certificate only, without
+// checking its name nor its expiration date. DANE-TA records match a trust
+// anchor which must have issued the host certificate.
+func verifyDane(records []*resolver.TLSA, host string, rawCerts [][]byte) error {
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	if len(certs) == 0 {
+		return errors.New("MX host didn't send any certificate")
+	}
+
+	for _, r := range records {
+		if !isUsableTLSA(r) {
+			continue
+		}
+
+		if r.Usage == daneEE {
+			if matchTLSA(r, certs[0]) {
+				return nil
+			}
+			continue
+		}
+
+		for _, anchor := range certs {
+			if !matchTLSA(r, anchor) {
+				continue
+			}
+
+			roots := x509.NewCertPool()
+			roots.AddCert(anchor)
+			intermediates := x509.NewCertPool()
+			for _, cert := range certs[1:] {
+				intermediates.AddCert(cert)
+			}
+
+			_, err := certs[0].Verify(x509.VerifyOptions{
+				DNSName: strings.TrimSuffix(host, "."),
+				Roots: roots,
+				Intermediates: intermediates,
+			})
+			if err == nil {
+				return nil
+			}
+		}
+	}
+
+	return errors.New("MX host certificate doesn't match its TLSA records")
+}
@@ -0,0 +1,414 @@
+package mx_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/mx"
+	"github.com/emersion/neutron/backend/util/resolver"
+)
+
+// A resolver answering with static records. All hosts resolve to the loopback
+// address.
+type staticResolver struct {
+	mx map[string][]*net.MX
+	secureMX bool
+	txt map[string][]string
+	tlsa map[string][]*resolver.TLSA
+}
+
+func (r *staticResolver) LookupMX(domain string) ([]*net.MX, bool, error) {
+	if mxs, ok := r.mx[domain]; ok {
+		return mxs, r.secureMX, nil
+	}
+	return nil, false, resolver.ErrNoRecord
+}
+
+func (r *staticResolver) LookupTXT(name string) ([]string, error) {
+	if txts, ok := r.txt[name]; ok {
+		return txts, nil
+	}
+	return nil, resolver.ErrNoRecord
+}
+
+func (r *staticResolver) LookupTLSA(name string) ([]*resolver.TLSA, error) {
+	if records, ok := r.tlsa[name]; ok {
+		return records, nil
+	}
+	return nil, resolver.ErrNoRecord
+}
+
+func (r *staticResolver) LookupIP(host string) ([]net.IP, error) {
+	return []net.IP{net.IPv4(127, 0, 0, 1)}, nil
+}
+
+// A message received by a sink.
+type received struct {
+	from string
+	to []string
+	data string
+	tls bool
+}
+
+// A SMTP server storing received messages. Recipients starting with "temp"
+// are rejected with a temporary error, recipients starting with "perm" with a
+// permanent one.
+type sink struct {
+	lock sync.Mutex
+	messages []*received
+}
+
+func (s *sink) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	return nil, smtp.ErrAuthUnsupported
+}
+
+func (s *sink) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	return &sinkSession{sink: s, tls: state.TLS.HandshakeComplete}, nil
+}
+
+type sinkSession struct {
+	sink *sink
+	tls bool
+	msg *received
+}
+
+func (s *sinkSession) Reset() {
+	s.msg = nil
+}
+
+func (s *sinkSession) Logout() error {
+	return nil
+}
+
+func (s *sinkSession) Mail(from string, opts smtp.MailOptions) error {
+	s.msg = &received{from: from, tls: s.tls}
+	return nil
+}
+
+func (s *sinkSession) Rcpt(to string) error {
+	if strings.HasPrefix(to, "temp") {
+		return &smtp.SMTPError{Code: 450, Message: "Mailbox busy"}
+	}
+	if strings.HasPrefix(to, "perm") {
+		return &smtp.SMTPError{Code: 550, Message: "No such user"}
+	}
+	s.msg.to = append(s.msg.to, to)
+	return nil
+}
+
+func (s *sinkSession) Data(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.msg.data = string(b)
+
+	s.sink.lock.Lock()
+	s.sink.messages = append(s.sink.messages, s.msg)
+	s.sink.lock.Unlock()
+	return nil
+}
+
+func (s *sink) received() []*received {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.messages
+}
+
+// Start a sink. If cert is not nil, STARTTLS is supported. Returns the port the
+// sink is listening on.
+func startSink(t *testing.T, cert *tls.Certificate) (*sink, int) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &sink{}
+	srv := smtp.NewServer(s)
+	srv.Domain = "mx.example.org"
+	if cert != nil {
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{*cert}}
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	return s, l.Addr().(*net.TCPAddr).Port
+}
+
+// Certificates of a MX host, issued by a CA.
+type certs struct {
+	ca *x509.Certificate
+	leaf *x509.Certificate
+	cert tls.Certificate
+}
+
+func generateCerts(t *testing.T, host string) *certs {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: "Test CA"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		IsCA: true,
+		BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageCertSign,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject: pkix.Name{CommonName: host},
+		DNSNames: []string{host},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &certs{
+		ca: ca,
+		leaf: leaf,
+		cert: tls.Certificate{Certificate: [][]byte{der, caDer}, PrivateKey: key},
+	}
+}
+
+// Get a TLSA record matching the public key of a certificate.
+func spkiTLSA(usage uint8, cert *x509.Certificate) *resolver.TLSA {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return &resolver.TLSA{
+		Usage: usage,
+		Selector: 1,
+		MatchingType: 1,
+		Certificate: hex.EncodeToString(sum[:]),
+	}
+}
+
+func tlsaName(port int, host string) string {
+	return "_" + strconv.Itoa(port) + "._tcp." + host
+}
+
+func newMessage(to ...string) *backend.OutgoingMessage {
+	return &backend.OutgoingMessage{
+		Message: &backend.Message{
+			Subject: "Hello",
+			Sender: &backend.Email{Address: "sender@neutron.example"},
+			ToList: []*backend.Email{{Address: to[0]}},
+		},
+		MessagePackage: &backend.MessagePackage{Body: "Hello World!"},
+		Recipients: to,
+	}
+}
+
+func TestSend_implicitMX(t *testing.T) {
+	s, port := startSink(t, nil)
+
+	b := mx.New(&mx.Config{Hostname: "neutron.example", Port: port}, &staticResolver{}, nil)
+	if err := b.SendMessage("user", newMessage("alice@example.org")); err != nil {
+		t.Fatal("Expected no error when sending a message, got", err)
+	}
+
+	msgs := s.received()
+	if len(msgs) != 1 {
+		t.Fatalf("Expected one message to be received, got %v", len(msgs))
+	}
+	if msgs[0].from != "sender@neutron.example" || len(msgs[0].to) != 1 || msgs[0].to[0] != "alice@example.org" {
+		t.Errorf("Invalid envelope: from %q to %v", msgs[0].from, msgs[0].to)
+	}
+	if !strings.Contains(msgs[0].data, "Subject: Hello") {
+		t.Errorf("Invalid message data: %q", msgs[0].data)
+	}
+	if msgs[0].tls {
+		t.Error("Expected the message not to be sent over TLS")
+	}
+}
+
+func TestSend_opportunisticTls(t *testing.T) {
+	c := generateCerts(t, "mx.example.org")
+	s, port := startSink(t, &c.cert)
+
+	r := &staticResolver{
+		mx: map[string][]*net.MX{"example.org": {{Host: "mx.example.org.", Pref: 10}}},
+	}
+	b := mx.New(&mx.Config{Port: port}, r, nil)
+	if err := b.SendMessage("user", newMessage("alice@example.org")); err != nil {
+		t.Fatal("Expected no error when sending a message, got", err)
+	}
+
+	if msgs := s.received(); len(msgs) != 1 || !msgs[0].tls {
+		t.Error("Expected the message to be sent over TLS")
+	}
+}
+
+func TestSend_recipientErrors(t *testing.T) {
+	s, port := startSink(t, nil)
+
+	b := mx.New(&mx.Config{Port: port}, &staticResolver{}, nil)
+	err := b.SendMessage("user", newMessage("alice@example.org", "temp@example.org", "perm@example.org"))
+
+	rcptErrs, ok := err.(backend.RecipientsError)
+	if !ok || len(rcptErrs) != 2 {
+		t.Fatalf("Expected two recipient errors, got %v", err)
+	}
+
+	codes := map[string]int{"temp@example.org": 450, "perm@example.org": 550}
+	for _, rcptErr := range rcptErrs {
+		tpErr, ok := rcptErr.Err.(*textproto.Error)
+		if !ok || tpErr.Code != codes[rcptErr.Address] {
+			t.Errorf("Invalid error for %v: %v", rcptErr.Address, rcptErr.Err)
+		}
+	}
+
+	if msgs := s.received(); len(msgs) != 1 || len(msgs[0].to) != 1 || msgs[0].to[0] != "alice@example.org" {
+		t.Error("Expected the message to be received by accepted recipients only")
+	}
+}
+
+func TestSend_dane(t *testing.T) {
+	c := generateCerts(t, "mx.example.org")
+	other := generateCerts(t, "mx.example.org")
+	_, port := startSink(t, &c.cert)
+	name := tlsaName(port, "mx.example.org")
+
+	testCases := []struct {
+		name string
+		secure bool
+		records []*resolver.TLSA
+		ok bool
+	}{
+		{"DANE-EE", true, []*resolver.TLSA{spkiTLSA(3, c.leaf)}, true},
+		{"DANE-EE mismatch", true, []*resolver.TLSA{spkiTLSA(3, other.leaf)}, false},
+		{"DANE-TA", true, []*resolver.TLSA{spkiTLSA(2, c.ca)}, true},
+		{"DANE-TA mismatch", true, []*resolver.TLSA{spkiTLSA(2, other.ca)}, false},
+		{"PKIX-EE only", true, []*resolver.TLSA{spkiTLSA(1, other.leaf)}, true},
+		{"insecure MX", false, []*resolver.TLSA{spkiTLSA(3, other.leaf)}, true},
+	}
+
+	for _, tc := range testCases {
+		r := &staticResolver{
+			mx: map[string][]*net.MX{"example.org": {{Host: "mx.example.org.", Pref: 10}}},
+			secureMX: tc.secure,
+			tlsa: map[string][]*resolver.TLSA{name: tc.records},
+		}
+		b := mx.New(&mx.Config{Port: port}, r, nil)
+
+		err := b.SendMessage("user", newMessage("alice@example.org"))
+		if tc.ok && err != nil {
+			t.Errorf("%v: expected no error when sending a message, got %v", tc.name, err)
+		} else if !tc.ok && err == nil {
+			t.Errorf("%v: expected an error when sending a message", tc.name)
+		}
+	}
+}
+
+// Start a HTTPS server serving a MTA-STS policy for example.org. Returns a
+// client fetching policies from this server.
+func startStsServer(t *testing.T, policy string) *http.Client {
+	c := generateCerts(t, "mta-sts.example.org")
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Host != "mta-sts.example.org" || req.URL.Path != "/.well-known/mta-sts.txt" {
+			http.NotFound(w, req)
+			return
+		}
+		io.WriteString(w, policy)
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{c.cert}}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(c.ca)
+
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+			},
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func TestSend_stsEnforce(t *testing.T) {
+	c := generateCerts(t, "mx.example.org")
+	_, port := startSink(t, &c.cert)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(c.ca)
+
+	testCases := []struct {
+		name string
+		policy string
+		roots *x509.CertPool
+		ok bool
+	}{
+		{"allowed host", "mx: mx.example.org", roots, true},
+		{"wildcard", "mx: *.example.org", roots, true},
+		{"disallowed host", "mx: other.example.org", roots, false},
+		{"untrusted certificate", "mx: mx.example.org", x509.NewCertPool(), false},
+	}
+
+	for _, tc := range testCases {
+		client := startStsServer(t, "version: STSv1\nmode: enforce\n" + tc.policy + "\nmax_age: 86400\n")
+
+		r := &staticResolver{
+			mx: map[string][]*net.MX{"example.org": {{Host: "mx.example.org.", Pref: 10}}},
+			txt: map[string][]string{"_mta-sts.example.org": {"v=STSv1; id=1"}},
+		}
+		b := mx.New(&mx.Config{Port: port, RootCAs: tc.roots, StsClient: client}, r, nil)
+
+		err := b.SendMessage("user", newMessage("alice@example.org"))
+		if tc.ok && err != nil {
+			t.Errorf("%v: expected no error when sending a message, got %v", tc.name, err)
+		} else if !tc.ok && err == nil {
+			t.Errorf("%v: expected an error when sending a message", tc.name)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package mx
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util/dkim"
+	"github.com/emersion/neutron/backend/util/resolver"
+)
+
+const dialTimeout = 30 * time.Second
+
+func getDomain(addr string) string {
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 {
+		return ""
+	}
+	return addr[i+1:]
+}
+
+// Group recipients by domain, keeping their order.
+func groupByDomain(addrs []string) (domains []string, byDomain map[string][]string) {
+	byDomain = make(map[string][]string)
+	for _, addr := range addrs {
+		domain := strings.ToLower(getDomain(addr))
+		if _, ok := byDomain[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		byDomain[domain] = append(byDomain[domain], addr)
+	}
+	return
+}
+
+// Get the hosts accepting mail for a domain, by order of preference. secure is
+// true if MX records have been validated with DNSSEC, in which case hosts can be
+// authenticated with DANE (RFC 7672 section 2.2.1). Implicit MX hosts are never
+// considered secure.
+func (b *SendBackend) lookupHosts(domain string) (hosts []string, secure bool, err error) {
+	mxs, secure, err := b.resolver.LookupMX(domain)
+	if err == resolver.ErrNoRecord {
+		// Implicit MX (RFC 5321 section 5.1)
+		return []string{domain}, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	// Null MX (RFC 7505)
+	if len(mxs) == 1 && mxs[0].Host == "." {
+		return nil, false, &textproto.Error{Code: 556, Msg: "Domain " + domain + " doesn't accept mail"}
+	}
+
+	hosts = make([]string, len(mxs))
+	for i, mx := range mxs {
+		hosts[i] = strings.TrimSuffix(mx.Host, ".")
+	}
+	return hosts, secure, nil
+}
+
+// Connect to a MX host. If records is not empty, the host is authenticated
+// with DANE. Otherwise, if the MTA-STS policy is enforced, the host is
+// authenticated with WebPKI.
+func (b *SendBackend) dial(host string, records []*resolver.TLSA, policy *stsPolicy) (*smtp.Client, error) {
+	ips, err := b.resolver.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	for _, ip := range ips {
+		conn, err = net.DialTimeout("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(b.config.Port)), dialTimeout)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if b.config.Hostname != "" {
+		if err := c.Hello(b.config.Hostname); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	enforced := policy != nil && policy.Mode == stsEnforce
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		if len(records) > 0 || enforced || b.config.RequireTls {
+			c.Close()
+			return nil, errors.New("MX host " + host + " doesn't support STARTTLS")
+		}
+		return c, nil
+	}
+
+	tlsConfig := &tls.Config{ServerName: host, RootCAs: b.config.RootCAs}
+	if len(records) > 0 {
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyDane(records, host, rawCerts)
+		}
+	} else if !enforced {
+		// Opportunistic TLS, the host isn't authenticated
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	if err := c.StartTLS(tlsConfig); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Send a message in a single SMTP transaction. Rejected recipients are
+// returned, the message is still sent to other recipients.
+func send(c *smtp.Client, from string, to []string, r io.Reader) (rejected backend.RecipientsError, err error) {
+	if err = c.Mail(from); err != nil {
+		return
+	}
+
+	for _, addr := range to {
+		if rcptErr := c.Rcpt(addr); rcptErr != nil {
+			rejected = append(rejected, &backend.RecipientError{Address: addr, Err: rcptErr})
+		}
+	}
+
+	// No recipient accepted the message, abort the transaction
+	if len(rejected) == len(to) {
+		err = c.Reset()
+		return
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return
+	}
+
+	if _, err = io.Copy(w, r); err != nil {
+		return
+	}
+
+	err = w.Close()
+	return
+}
+
+// Deliver a message to recipients of a single domain. MX hosts are tried by
+// order of preference until one of them can be reached.
+func (b *SendBackend) deliver(domain, from string, to []string, msg *dkim.Message) (backend.RecipientsError, error) {
+	hosts, secure, err := b.lookupHosts(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := b.getStsPolicy(domain)
+
+	err = errors.New("No MX host available for " + domain)
+	for _, host := range hosts {
+		if policy != nil && policy.Mode != stsNone && !policy.matches(host) {
+			if policy.Mode == stsEnforce {
+				err = errors.New("MX host " + host + " isn't allowed by the MTA-STS policy of " + domain)
+				continue
+			}
+			log.Println("MX host", host, "isn't allowed by the MTA-STS policy of", domain)
+		}
+
+		// TLSA records of insecure MX hosts cannot be trusted
+		var records []*resolver.TLSA
+		if secure {
+			var lookupErr error
+			records, lookupErr = b.resolver.LookupTLSA("_" + strconv.Itoa(b.config.Port) + "._tcp." + host)
+			if lookupErr != nil && lookupErr != resolver.ErrNoRecord {
+				// The host may be protected by DANE, don't downgrade
+				err = lookupErr
+				continue
+			}
+			records = filterUsableTLSA(records)
+		}
+
+		var c *smtp.Client
+		if c, err = b.dial(host, records, policy); err != nil {
+			continue
+		}
+
+		r, err := msg.Reader()
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+
+		rejected, err := send(c, from, to, r)
+		if err == nil {
+			c.Quit()
+		}
+		c.Close()
+		return rejected, err
+	}
+
+	return nil, err
+}
+
+func (b *SendBackend) SendMessage(user string, msg *backend.OutgoingMessage) error {
+	// The message is formatted once and then sent to all domains
+	signed, err := dkim.SignOutgoingMessage(b.dkim, msg)
+	if err != nil {
+		return err
+	}
+	defer signed.Close()
+
+	var rejected backend.RecipientsError
+	domains, byDomain := groupByDomain(msg.GetRecipients())
+	for _, domain := range domains {
+		to := byDomain[domain]
+
+		domainRejected, err := b.deliver(domain, msg.Sender.Address, to, signed)
+		if err != nil {
+			for _, addr := range to {
+				rejected = append(rejected, &backend.RecipientError{Address: addr, Err: err})
+			}
+			continue
+		}
+		rejected = append(rejected, domainRejected...)
+	}
+
+	if len(rejected) > 0 {
+		return rejected
+	}
+	return nil
+}
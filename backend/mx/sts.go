@@ -0,0 +1,170 @@
+package mx
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MTA-STS policy modes.
+const (
+	stsEnforce = "enforce"
+	stsTesting = "testing"
+	stsNone = "none"
+)
+
+// Policies larger than this are rejected.
+const maxStsPolicySize = 64 * 1024
+
+var stsClient = &http.Client{
+	Timeout: 60 * time.Second,
+	// Redirects must not be followed (RFC 8461 section 3.3)
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// An MTA-STS policy, as defined in RFC 8461.
+type stsPolicy struct {
+	ID string
+	Mode string
+	MX []string
+	MaxAge int
+	Expires time.Time
+}
+
+// Check if a MX host is allowed by the policy.
+func (p *stsPolicy) matches(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range p.MX {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			// Wildcards match a single label
+			i := strings.IndexByte(host, '.')
+			if i > 0 && host[i:] == pattern[1:] {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func parseStsPolicy(r io.Reader) (*stsPolicy, error) {
+	p := &stsPolicy{}
+	version := ""
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		parts := strings.SplitN(s.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		k, v := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+
+		switch k {
+		case "version":
+			version = v
+		case "mode":
+			p.Mode = v
+		case "mx":
+			p.MX = append(p.MX, v)
+		case "max_age":
+			p.MaxAge, _ = strconv.Atoi(v)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if version != "STSv1" {
+		return nil, errors.New("Unsupported MTA-STS policy version")
+	}
+	switch p.Mode {
+	case stsEnforce, stsTesting, stsNone:
+	default:
+		return nil, errors.New("Invalid MTA-STS policy mode")
+	}
+	if p.Mode != stsNone && len(p.MX) == 0 {
+		return nil, errors.New("MTA-STS policy doesn't list any MX host")
+	}
+	return p, nil
+}
+
+// Fetch the MTA-STS policy of a domain over HTTPS.
+func (b *SendBackend) fetchStsPolicy(domain string) (*stsPolicy, error) {
+	res, err := b.config.StsClient.Get("https://mta-sts." + domain + "/.well-known/mta-sts.txt")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New("Cannot fetch MTA-STS policy: " + res.Status)
+	}
+
+	return parseStsPolicy(io.LimitReader(res.Body, maxStsPolicySize))
+}
+
+// Get the ID of the policy advertised in a domain's _mta-sts TXT record.
+func (b *SendBackend) lookupStsID(domain string) (string, error) {
+	txts, err := b.resolver.LookupTXT("_mta-sts." + domain)
+	if err != nil {
+		return "", err
+	}
+
+	for _, txt := range txts {
+		if !strings.HasPrefix(txt, "v=STSv1") {
+			continue
+		}
+
+		for _, field := range strings.Split(txt, ";") {
+			field = strings.TrimSpace(field)
+			if strings.HasPrefix(field, "id=") {
+				return strings.TrimPrefix(field, "id="), nil
+			}
+		}
+	}
+	return "", errors.New("Invalid MTA-STS record")
+}
+
+// Get the MTA-STS policy of a domain. Returns nil if the domain has no policy.
+// Policies are cached until they expire, so that an attacker removing the
+// _mta-sts record cannot downgrade connections (RFC 8461 section 5.1).
+func (b *SendBackend) getStsPolicy(domain string) *stsPolicy {
+	b.lock.Lock()
+	cached := b.policies[domain]
+	b.lock.Unlock()
+	if cached != nil && time.Now().After(cached.Expires) {
+		cached = nil
+	}
+
+	id, err := b.lookupStsID(domain)
+	if err != nil {
+		return cached
+	}
+	if cached != nil && cached.ID == id {
+		return cached
+	}
+
+	p, err := b.fetchStsPolicy(domain)
+	if err != nil {
+		log.Println("Cannot fetch MTA-STS policy of", domain, ":", err)
+		return cached
+	}
+
+	p.ID = id
+	p.Expires = time.Now().Add(time.Duration(p.MaxAge) * time.Second)
+
+	b.lock.Lock()
+	b.policies[domain] = p
+	b.lock.Unlock()
+
+	return p
+}
@@ -0,0 +1,330 @@
+// Queues outgoing messages and delivers them with another SendBackend,
+// retrying on failure.
+package queue
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util"
+)
+
+const jobExt = ".json"
+
+// Interval between two queue scans.
+const pollInterval = 30 * time.Second
+
+type Config struct {
+	// Directory where queued messages are stored.
+	Directory string
+	// Maximum number of delivery attempts before giving up, also used when
+	// notifying users and moving sent messages fails. Defaults to 10.
+	MaxAttempts int
+	// Delay before retrying to deliver a message, in seconds. It is doubled
+	// after each attempt. Defaults to 60.
+	RetryDelay int
+	// Maximum delay between two attempts, in seconds. Defaults to 6 hours.
+	MaxRetryDelay int
+}
+
+// A recipient to which a message couldn't be delivered.
+type failure struct {
+	Address string
+	Error string
+}
+
+// A queued message. Its attachments are stored next to it.
+type job struct {
+	ID string
+	User string
+	Message *backend.Message
+	Package *backend.MessagePackage
+	InReplyTo string
+	References string
+	Attachments []*backend.Attachment
+
+	// Recipients which haven't received the message yet
+	Recipients []string
+	// Recipients which have been given up on
+	Failures []*failure
+	// Whether the user has been notified about failures
+	Notified bool
+
+	Attempts int
+	// Failed attempts to finish the job once delivered
+	FinishAttempts int
+	NextAttempt time.Time
+}
+
+// A SendBackend which stores outgoing messages on disk and delivers them in the
+// background. Messages are moved to the Sent folder once all recipients have
+// received them or have been given up on. It is also a ScheduleBackend.
+type Queue struct {
+	config *Config
+	target backend.SendBackend
+	backend *backend.Backend
+
+	lock sync.Mutex
+	wake chan struct{}
+	// IDs of jobs being delivered, which cannot be cancelled
+	sending map[string]bool
+}
+
+func (q *Queue) getJobPath(id string) string {
+	return q.config.Directory + "/" + id + jobExt
+}
+
+func (q *Queue) getAttachmentPath(id string, i int) string {
+	return q.config.Directory + "/" + id + "." + strconv.Itoa(i)
+}
+
+func (q *Queue) loadJob(id string) (j *job, err error) {
+	data, err := ioutil.ReadFile(q.getJobPath(id))
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, &j)
+	return
+}
+
+func (q *Queue) saveJob(j *job) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(q.getJobPath(j.ID), data, 0600)
+}
+
+func (q *Queue) deleteJob(j *job) error {
+	for i := range j.Attachments {
+		os.Remove(q.getAttachmentPath(j.ID, i))
+	}
+	return os.Remove(q.getJobPath(j.ID))
+}
+
+func (q *Queue) listJobs() (jobs []*job, err error) {
+	files, err := ioutil.ReadDir(q.config.Directory)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), jobExt) {
+			continue
+		}
+
+		var j *job
+		if j, err = q.loadJob(strings.TrimSuffix(f.Name(), jobExt)); err != nil {
+			return
+		}
+		jobs = append(jobs, j)
+	}
+	return
+}
+
+// Create a job from an outgoing message. Attachments are copied to the queue
+// directory, since they can be deleted or decrypted on the fly.
+func (q *Queue) createJob(user string, msg *backend.OutgoingMessage, at time.Time) (j *job, err error) {
+	j = &job{
+		ID: util.GenerateId(),
+		User: user,
+		Message: msg.Message,
+		Package: msg.MessagePackage,
+		InReplyTo: msg.InReplyTo,
+		References: msg.References,
+		Recipients: msg.GetRecipients(),
+		NextAttempt: at,
+	}
+
+	for i, att := range msg.Attachments {
+		if err = q.spoolAttachment(j.ID, i, att); err != nil {
+			q.deleteJob(j)
+			return
+		}
+		j.Attachments = append(j.Attachments, att.Attachment)
+	}
+
+	return
+}
+
+func (q *Queue) spoolAttachment(id string, i int, att *backend.OutgoingAttachment) error {
+	r, err := att.Reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := os.OpenFile(q.getAttachmentPath(id, i), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Get the message to send for a job.
+func (q *Queue) getOutgoingMessage(j *job) *backend.OutgoingMessage {
+	msg := &backend.OutgoingMessage{
+		Message: j.Message,
+		MessagePackage: j.Package,
+		Recipients: j.Recipients,
+	}
+	msg.InReplyTo = j.InReplyTo
+	msg.References = j.References
+
+	for i, att := range j.Attachments {
+		path := q.getAttachmentPath(j.ID, i)
+		msg.Attachments = append(msg.Attachments, &backend.OutgoingAttachment{
+			Attachment: att,
+			Open: func() (io.ReadCloser, error) {
+				return os.Open(path)
+			},
+		})
+	}
+
+	return msg
+}
+
+func (q *Queue) SendMessage(user string, msg *backend.OutgoingMessage) error {
+	return q.SendMessages(user, []*backend.OutgoingMessage{msg})
+}
+
+// Queue messages. Returns backend.ErrSendQueued if messages have been queued.
+func (q *Queue) SendMessages(user string, msgs []*backend.OutgoingMessage) error {
+	if err := q.enqueue(user, msgs, time.Time{}); err != nil {
+		return err
+	}
+	return backend.ErrSendQueued
+}
+
+// Queue messages which must not be delivered before at.
+func (q *Queue) ScheduleMessages(user string, msgs []*backend.OutgoingMessage, at time.Time) error {
+	return q.enqueue(user, msgs, at)
+}
+
+// Cancel the delivery of a message. Messages already sent to some recipients
+// cannot be cancelled.
+func (q *Queue) CancelMessage(user, id string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	jobs, err := q.listJobs()
+	if err != nil {
+		return err
+	}
+
+	var cancelled []*job
+	for _, j := range jobs {
+		if j.User != user || j.Message.ID != id {
+			continue
+		}
+		if j.Attempts > 0 || q.sending[j.ID] {
+			return backend.ErrNotScheduled
+		}
+		cancelled = append(cancelled, j)
+	}
+	if len(cancelled) == 0 {
+		return backend.ErrNotScheduled
+	}
+
+	for _, j := range cancelled {
+		if err := q.deleteJob(j); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *Queue) enqueue(user string, msgs []*backend.OutgoingMessage, at time.Time) error {
+	if err := os.MkdirAll(q.config.Directory, 0700); err != nil {
+		return err
+	}
+
+	var jobs []*job
+	for _, msg := range msgs {
+		j, err := q.createJob(user, msg, at)
+		if err != nil {
+			for _, j := range jobs {
+				q.deleteJob(j)
+			}
+			return err
+		}
+		jobs = append(jobs, j)
+	}
+
+	// Jobs are saved at once, so that a message isn't considered as sent
+	// before all its jobs are queued
+	q.lock.Lock()
+	for i, j := range jobs {
+		if err := q.saveJob(j); err != nil {
+			for _, j := range jobs[:i] {
+				q.deleteJob(j)
+			}
+			for _, j := range jobs[i:] {
+				for k := range j.Attachments {
+					os.Remove(q.getAttachmentPath(j.ID, k))
+				}
+			}
+			q.lock.Unlock()
+			return err
+		}
+	}
+	q.lock.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Create a new queue delivering messages with target. bkd is used to move sent
+// messages to the Sent folder and to notify users about delivery failures.
+func New(config *Config, target backend.SendBackend, bkd *backend.Backend) *Queue {
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 10
+	}
+	if config.RetryDelay <= 0 {
+		config.RetryDelay = 60
+	}
+	if config.MaxRetryDelay <= 0 {
+		config.MaxRetryDelay = 6 * 60 * 60
+	}
+
+	q := &Queue{
+		config: config,
+		target: target,
+		backend: bkd,
+		wake: make(chan struct{}, 1),
+		sending: make(map[string]bool),
+	}
+
+	go q.run()
+
+	return q
+}
+
+// Queue messages sent with the current SendBackend. The queue is also used to
+// schedule messages.
+func Use(bkd *backend.Backend, config *Config) *Queue {
+	q := New(config, bkd.SendBackend, bkd)
+	bkd.Set(q)
+	return q
+}
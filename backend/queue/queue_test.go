@@ -0,0 +1,520 @@
+package queue
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/memory"
+)
+
+const testUser = "queuetest"
+
+// A SendBackend failing to send messages to some recipients.
+type sendBackend struct {
+	// Errors returned for some recipients
+	errs map[string]error
+	// Error returned instead of sending messages, if any
+	err error
+
+	sent []string
+	attachments []string
+}
+
+func (b *sendBackend) SendMessage(user string, msg *backend.OutgoingMessage) error {
+	if b.err != nil {
+		return b.err
+	}
+
+	for _, att := range msg.Attachments {
+		r, err := att.Reader()
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		b.attachments = append(b.attachments, string(data))
+	}
+
+	var errs backend.RecipientsError
+	for _, addr := range msg.GetRecipients() {
+		if err, ok := b.errs[addr]; ok {
+			errs = append(errs, &backend.RecipientError{Address: addr, Err: err})
+		} else {
+			b.sent = append(b.sent, addr)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// An EventsBackend recording notices.
+type noticesBackend struct {
+	backend.EventsBackend
+
+	notices []string
+	err error
+}
+
+func (b *noticesBackend) InsertEvent(user string, event *backend.Event) error {
+	if b.err != nil {
+		return b.err
+	}
+	b.notices = append(b.notices, event.Notices...)
+	return b.EventsBackend.InsertEvent(user, event)
+}
+
+var (
+	tempErr = &textproto.Error{Code: 450, Msg: "Mailbox busy"}
+	permErr = &textproto.Error{Code: 550, Msg: "No such user"}
+)
+
+// Create a queue whose worker isn't started: jobs are processed by calling
+// process.
+func newQueue(t *testing.T, target backend.SendBackend) (*Queue, *backend.Backend, *noticesBackend) {
+	dir, err := ioutil.TempDir("", "neutron-queue-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bkd := backend.New()
+	memory.Use(bkd)
+	notices := &noticesBackend{EventsBackend: bkd.EventsBackend}
+	bkd.Set(notices)
+
+	q := &Queue{
+		config: &Config{
+			Directory: dir,
+			MaxAttempts: 3,
+			RetryDelay: 60,
+			MaxRetryDelay: 60 * 60,
+		},
+		target: target,
+		backend: bkd,
+		wake: make(chan struct{}, 1),
+		sending: make(map[string]bool),
+	}
+	return q, bkd, notices
+}
+
+func insertDraft(t *testing.T, bkd *backend.Backend) *backend.Message {
+	msg, err := bkd.InsertMessage(testUser, &backend.Message{
+		Subject: "Hello",
+		Sender: &backend.Email{Address: "alice@example.org"},
+		LabelIDs: []string{backend.DraftLabel},
+		Type: backend.DraftType,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func newOutgoingMessage(msg *backend.Message, recipients ...string) *backend.OutgoingMessage {
+	return &backend.OutgoingMessage{
+		Message: msg,
+		MessagePackage: &backend.MessagePackage{Body: "Hi!"},
+		Recipients: recipients,
+	}
+}
+
+// Make all jobs due for another attempt.
+func makeDue(t *testing.T, q *Queue) {
+	jobs, err := q.listJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, j := range jobs {
+		j.NextAttempt = time.Now().Add(-time.Second)
+		if err := q.saveJob(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func listJobs(t *testing.T, q *Queue) []*job {
+	jobs, err := q.listJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jobs
+}
+
+func checkSent(t *testing.T, bkd *backend.Backend, id string, want bool) {
+	msg, err := bkd.GetMessage(testUser, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := msg.Type == backend.SentType && len(msg.LabelIDs) == 1 && msg.LabelIDs[0] == backend.SentLabel
+	if sent != want {
+		t.Errorf("Message type = %v and labels = %v, want sent = %v", msg.Type, msg.LabelIDs, want)
+	}
+}
+
+func TestIsPermanent(t *testing.T) {
+	tests := []struct{
+		err error
+		permanent bool
+	}{
+		{tempErr, false},
+		{permErr, true},
+		{&textproto.Error{Code: 554, Msg: "Transaction failed"}, true},
+		{errors.New("connection refused"), false},
+	}
+
+	for _, test := range tests {
+		if permanent := isPermanent(test.err); permanent != test.permanent {
+			t.Errorf("isPermanent(%v) = %v, want %v", test.err, permanent, test.permanent)
+		}
+	}
+}
+
+func TestGetRetryDelay(t *testing.T) {
+	q := &Queue{config: &Config{RetryDelay: 60, MaxRetryDelay: 60 * 60}}
+
+	tests := []struct{
+		attempts int
+		delay time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{6, 32 * time.Minute},
+		{7, time.Hour},
+		{100, time.Hour},
+	}
+
+	for _, test := range tests {
+		if delay := q.getRetryDelay(test.attempts); delay != test.delay {
+			t.Errorf("getRetryDelay(%v) = %v, want %v", test.attempts, delay, test.delay)
+		}
+	}
+}
+
+func TestFormatBounce(t *testing.T) {
+	j := &job{
+		Message: &backend.Message{Subject: "Hello"},
+		Failures: []*failure{
+			{Address: "bob@example.org", Error: "No such user"},
+			{Address: "carol@example.org", Error: "Mailbox full"},
+		},
+	}
+
+	want := "Message \"Hello\" could not be delivered to bob@example.org (No such user), carol@example.org (Mailbox full)"
+	if bounce := formatBounce(j); bounce != want {
+		t.Errorf("formatBounce() = %q, want %q", bounce, want)
+	}
+}
+
+func TestQueue_SendMessage(t *testing.T) {
+	target := &sendBackend{}
+	q, bkd, notices := newQueue(t, target)
+	defer os.RemoveAll(q.config.Directory)
+
+	msg := insertDraft(t, bkd)
+	outgoing := newOutgoingMessage(msg, "bob@example.org", "carol@example.org")
+	outgoing.Attachments = []*backend.OutgoingAttachment{{
+		Attachment: &backend.Attachment{Name: "hello.txt"},
+		Open: func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader("Hello, attachment!")), nil
+		},
+	}}
+
+	if err := q.SendMessage(testUser, outgoing); err != backend.ErrSendQueued {
+		t.Fatalf("SendMessage() = %v, want %v", err, backend.ErrSendQueued)
+	}
+	checkSent(t, bkd, msg.ID, false)
+
+	if _, err := q.process(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(target.sent) != 2 {
+		t.Errorf("Message sent to %v, want both recipients", target.sent)
+	}
+	if len(target.attachments) != 1 || target.attachments[0] != "Hello, attachment!" {
+		t.Errorf("Attachments sent = %v, want the spooled attachment", target.attachments)
+	}
+	if jobs := listJobs(t, q); len(jobs) != 0 {
+		t.Errorf("%v jobs left after delivery, want none", len(jobs))
+	}
+	if len(notices.notices) > 0 {
+		t.Errorf("Notices = %v, want none", notices.notices)
+	}
+	checkSent(t, bkd, msg.ID, true)
+}
+
+func TestQueue_recipientErrors(t *testing.T) {
+	target := &sendBackend{errs: map[string]error{
+		"temp@example.org": tempErr,
+		"perm@example.org": permErr,
+	}}
+	q, bkd, notices := newQueue(t, target)
+	defer os.RemoveAll(q.config.Directory)
+
+	msg := insertDraft(t, bkd)
+	outgoing := newOutgoingMessage(msg, "bob@example.org", "temp@example.org", "perm@example.org")
+	if err := q.SendMessage(testUser, outgoing); err != backend.ErrSendQueued {
+		t.Fatalf("SendMessage() = %v, want %v", err, backend.ErrSendQueued)
+	}
+
+	if _, err := q.process(); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := listJobs(t, q)
+	if len(jobs) != 1 {
+		t.Fatalf("%v jobs left after the first attempt, want 1", len(jobs))
+	}
+	j := jobs[0]
+	if len(j.Recipients) != 1 || j.Recipients[0] != "temp@example.org" {
+		t.Errorf("Recipients after a temporary failure = %v, want temp@example.org", j.Recipients)
+	}
+	if len(j.Failures) != 1 || j.Failures[0].Address != "perm@example.org" {
+		t.Errorf("Failures after a permanent failure = %+v, want perm@example.org", j.Failures)
+	}
+	if delay := time.Until(j.NextAttempt); delay <= 0 || delay > time.Minute {
+		t.Errorf("Next attempt in %v, want in at most a minute", delay)
+	}
+	checkSent(t, bkd, msg.ID, false)
+
+	// The job isn't due yet
+	if next, err := q.process(); err != nil {
+		t.Fatal(err)
+	} else if !next.Equal(j.NextAttempt) {
+		t.Errorf("process() next = %v, want %v", next, j.NextAttempt)
+	}
+	if j := listJobs(t, q)[0]; j.Attempts != 1 {
+		t.Errorf("Attempts before the job is due = %v, want 1", j.Attempts)
+	}
+
+	delete(target.errs, "temp@example.org")
+	makeDue(t, q)
+	if _, err := q.process(); err != nil {
+		t.Fatal(err)
+	}
+
+	if jobs := listJobs(t, q); len(jobs) != 0 {
+		t.Errorf("%v jobs left after delivery, want none", len(jobs))
+	}
+	if len(notices.notices) != 1 || !strings.Contains(notices.notices[0], "perm@example.org") {
+		t.Errorf("Notices = %v, want a bounce for perm@example.org", notices.notices)
+	}
+	checkSent(t, bkd, msg.ID, true)
+}
+
+func TestQueue_maxAttempts(t *testing.T) {
+	target := &sendBackend{err: tempErr}
+	q, bkd, notices := newQueue(t, target)
+	defer os.RemoveAll(q.config.Directory)
+
+	msg := insertDraft(t, bkd)
+	if err := q.SendMessage(testUser, newOutgoingMessage(msg, "bob@example.org")); err != backend.ErrSendQueued {
+		t.Fatalf("SendMessage() = %v, want %v", err, backend.ErrSendQueued)
+	}
+
+	for i := 0; i < q.config.MaxAttempts; i++ {
+		if _, err := q.process(); err != nil {
+			t.Fatal(err)
+		}
+		makeDue(t, q)
+	}
+
+	if jobs := listJobs(t, q); len(jobs) != 0 {
+		t.Errorf("%v jobs left after %v attempts, want none", len(jobs), q.config.MaxAttempts)
+	}
+	if len(notices.notices) != 1 || !strings.Contains(notices.notices[0], "bob@example.org") {
+		t.Errorf("Notices = %v, want a bounce for bob@example.org", notices.notices)
+	}
+	checkSent(t, bkd, msg.ID, true)
+}
+
+func TestQueue_severalJobs(t *testing.T) {
+	target := &sendBackend{errs: map[string]error{"carol@example.org": tempErr}}
+	q, bkd, _ := newQueue(t, target)
+	defer os.RemoveAll(q.config.Directory)
+
+	// Recipients with different packages are delivered in different jobs
+	msg := insertDraft(t, bkd)
+	err := q.SendMessages(testUser, []*backend.OutgoingMessage{
+		newOutgoingMessage(msg, "bob@example.org"),
+		newOutgoingMessage(msg, "carol@example.org"),
+	})
+	if err != backend.ErrSendQueued {
+		t.Fatalf("SendMessages() = %v, want %v", err, backend.ErrSendQueued)
+	}
+
+	if _, err := q.process(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The message is moved to Sent only when all its jobs are done
+	if jobs := listJobs(t, q); len(jobs) != 2 {
+		t.Errorf("%v jobs left while a recipient is waiting, want 2", len(jobs))
+	}
+	checkSent(t, bkd, msg.ID, false)
+
+	delete(target.errs, "carol@example.org")
+	makeDue(t, q)
+	if _, err := q.process(); err != nil {
+		t.Fatal(err)
+	}
+
+	if jobs := listJobs(t, q); len(jobs) != 0 {
+		t.Errorf("%v jobs left after delivery, want none", len(jobs))
+	}
+	checkSent(t, bkd, msg.ID, true)
+}
+
+func TestQueue_finishRetries(t *testing.T) {
+	target := &sendBackend{errs: map[string]error{"perm@example.org": permErr}}
+	q, bkd, notices := newQueue(t, target)
+	defer os.RemoveAll(q.config.Directory)
+
+	msg := insertDraft(t, bkd)
+	if err := q.SendMessage(testUser, newOutgoingMessage(msg, "perm@example.org")); err != backend.ErrSendQueued {
+		t.Fatalf("SendMessage() = %v, want %v", err, backend.ErrSendQueued)
+	}
+
+	// Notifying the user fails
+	notices.err = errors.New("cannot insert event")
+	if _, err := q.process(); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := listJobs(t, q)
+	if len(jobs) != 1 || jobs[0].FinishAttempts != 1 || jobs[0].Notified {
+		t.Fatalf("Jobs after failing to notify the user = %+v, want a job to finish", jobs)
+	}
+	checkSent(t, bkd, msg.ID, false)
+
+	notices.err = nil
+	makeDue(t, q)
+	if _, err := q.process(); err != nil {
+		t.Fatal(err)
+	}
+
+	if jobs := listJobs(t, q); len(jobs) != 0 {
+		t.Errorf("%v jobs left after finishing, want none", len(jobs))
+	}
+	if len(notices.notices) != 1 {
+		t.Errorf("Notices = %v, want a single bounce", notices.notices)
+	}
+	checkSent(t, bkd, msg.ID, true)
+}
+
+func TestQueue_ScheduleMessages(t *testing.T) {
+	target := &sendBackend{}
+	q, bkd, _ := newQueue(t, target)
+	defer os.RemoveAll(q.config.Directory)
+
+	msg := insertDraft(t, bkd)
+	at := time.Now().Add(time.Hour)
+	if err := q.ScheduleMessages(testUser, []*backend.OutgoingMessage{newOutgoingMessage(msg, "bob@example.org")}, at); err != nil {
+		t.Fatal("ScheduleMessages() =", err)
+	}
+
+	next, err := q.process()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(target.sent) != 0 {
+		t.Errorf("Scheduled message sent to %v before it's due", target.sent)
+	}
+	if !next.Equal(at) {
+		t.Errorf("process() next = %v, want %v", next, at)
+	}
+
+	makeDue(t, q)
+	if _, err := q.process(); err != nil {
+		t.Fatal(err)
+	}
+	if len(target.sent) != 1 {
+		t.Errorf("Scheduled message sent to %v once due, want bob@example.org", target.sent)
+	}
+	checkSent(t, bkd, msg.ID, true)
+}
+
+func TestQueue_CancelMessage(t *testing.T) {
+	target := &sendBackend{}
+	q, bkd, _ := newQueue(t, target)
+	defer os.RemoveAll(q.config.Directory)
+
+	msg := insertDraft(t, bkd)
+	outgoing := []*backend.OutgoingMessage{
+		newOutgoingMessage(msg, "bob@example.org"),
+		newOutgoingMessage(msg, "carol@example.org"),
+	}
+	if err := q.ScheduleMessages(testUser, outgoing, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal("ScheduleMessages() =", err)
+	}
+
+	if err := q.CancelMessage("someone-else", msg.ID); err != backend.ErrNotScheduled {
+		t.Errorf("CancelMessage() of another user = %v, want %v", err, backend.ErrNotScheduled)
+	}
+
+	// All jobs of the message are cancelled before the message is due
+	if err := q.CancelMessage(testUser, msg.ID); err != nil {
+		t.Fatal("CancelMessage() before the message is due =", err)
+	}
+	if jobs := listJobs(t, q); len(jobs) != 0 {
+		t.Errorf("%v jobs left after cancelling, want none", len(jobs))
+	}
+	if err := q.CancelMessage(testUser, msg.ID); err != backend.ErrNotScheduled {
+		t.Errorf("CancelMessage() of a cancelled message = %v, want %v", err, backend.ErrNotScheduled)
+	}
+
+	makeDue(t, q)
+	if _, err := q.process(); err != nil {
+		t.Fatal(err)
+	}
+	if len(target.sent) != 0 {
+		t.Errorf("Cancelled message sent to %v", target.sent)
+	}
+	checkSent(t, bkd, msg.ID, false)
+}
+
+func TestQueue_CancelMessage_attempted(t *testing.T) {
+	target := &sendBackend{errs: map[string]error{"carol@example.org": tempErr}}
+	q, bkd, _ := newQueue(t, target)
+	defer os.RemoveAll(q.config.Directory)
+
+	msg := insertDraft(t, bkd)
+	if err := q.ScheduleMessages(testUser, []*backend.OutgoingMessage{newOutgoingMessage(msg, "carol@example.org")}, time.Now()); err != nil {
+		t.Fatal("ScheduleMessages() =", err)
+	}
+
+	// A job being delivered cannot be cancelled
+	jobs := listJobs(t, q)
+	if _, err := q.claimJob(jobs[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.CancelMessage(testUser, msg.ID); err != backend.ErrNotScheduled {
+		t.Errorf("CancelMessage() during delivery = %v, want %v", err, backend.ErrNotScheduled)
+	}
+	delete(q.sending, jobs[0].ID)
+
+	if _, err := q.process(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Some recipients could already have received the message
+	if err := q.CancelMessage(testUser, msg.ID); err != backend.ErrNotScheduled {
+		t.Errorf("CancelMessage() after a delivery attempt = %v, want %v", err, backend.ErrNotScheduled)
+	}
+	if jobs := listJobs(t, q); len(jobs) != 1 {
+		t.Errorf("%v jobs left after failing to cancel, want 1", len(jobs))
+	}
+}
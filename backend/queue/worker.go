@@ -0,0 +1,249 @@
+package queue
+
+import (
+	"log"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/emersion/neutron/backend"
+)
+
+// Check if an error is permanent, i.e. retrying won't help. SMTP 5xx replies are
+// permanent errors.
+func isPermanent(err error) bool {
+	if tpErr, ok := err.(*textproto.Error); ok {
+		return tpErr.Code >= 500
+	}
+	return false
+}
+
+// Get the delay before the next attempt.
+func (q *Queue) getRetryDelay(attempts int) time.Duration {
+	delay := q.config.RetryDelay
+	for i := 1; i < attempts && delay < q.config.MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > q.config.MaxRetryDelay {
+		delay = q.config.MaxRetryDelay
+	}
+	return time.Duration(delay) * time.Second
+}
+
+func (q *Queue) run() {
+	for {
+		delay := pollInterval
+		if next, err := q.process(); err != nil {
+			log.Println("Cannot process outbound queue:", err)
+		} else if !next.IsZero() && time.Until(next) < delay {
+			// Scheduled messages must be sent on time
+			delay = time.Until(next)
+		}
+
+		select {
+		case <-q.wake:
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Deliver all messages due for delivery, and finish delivered ones. Returns
+// the time at which the next job is due, if any. Errors of a single job are
+// logged, so that they don't block other jobs.
+func (q *Queue) process() (next time.Time, err error) {
+	q.lock.Lock()
+	jobs, err := q.listJobs()
+	q.lock.Unlock()
+	if err != nil {
+		return
+	}
+
+	for _, j := range jobs {
+		// Jobs whose last delivery or finishing attempt failed must wait
+		if (len(j.Recipients) > 0 || j.FinishAttempts > 0) && time.Now().Before(j.NextAttempt) {
+			if next.IsZero() || j.NextAttempt.Before(next) {
+				next = j.NextAttempt
+			}
+			continue
+		}
+
+		if len(j.Recipients) > 0 {
+			// The job may have been cancelled in the meantime
+			claimed, err := q.claimJob(j.ID)
+			if err != nil {
+				log.Println("Cannot claim delivery of message", j.Message.ID, ":", err)
+				continue
+			} else if claimed == nil {
+				continue
+			}
+			j = claimed
+
+			if err := q.deliver(j); err != nil {
+				log.Println("Cannot save delivery of message", j.Message.ID, ":", err)
+				continue
+			}
+		}
+
+		if len(j.Recipients) == 0 {
+			if err := q.finish(j); err != nil {
+				log.Println("Cannot finish delivery of message", j.Message.ID, ":", err)
+			}
+		}
+	}
+
+	return
+}
+
+// Mark a job as being delivered, so that it cannot be cancelled. Returns nil if
+// the job doesn't exist anymore.
+func (q *Queue) claimJob(id string) (*job, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	j, err := q.loadJob(id)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	q.sending[id] = true
+	return j, nil
+}
+
+// Try to deliver a message to its remaining recipients.
+func (q *Queue) deliver(j *job) error {
+	failed := map[string]error{}
+	err := q.target.SendMessage(j.User, q.getOutgoingMessage(j))
+	if rcptErrs, ok := err.(backend.RecipientsError); ok {
+		for _, rcptErr := range rcptErrs {
+			failed[rcptErr.Address] = rcptErr.Err
+		}
+	} else if err != nil {
+		for _, addr := range j.Recipients {
+			failed[addr] = err
+		}
+	}
+
+	j.Attempts++
+	giveUp := j.Attempts >= q.config.MaxAttempts
+
+	var retry []string
+	for _, addr := range j.Recipients {
+		err, ok := failed[addr]
+		if !ok {
+			continue
+		}
+
+		if giveUp || isPermanent(err) {
+			j.Failures = append(j.Failures, &failure{Address: addr, Error: err.Error()})
+		} else {
+			retry = append(retry, addr)
+		}
+	}
+
+	j.Recipients = retry
+	j.NextAttempt = time.Now().Add(q.getRetryDelay(j.Attempts))
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	delete(q.sending, j.ID)
+	return q.saveJob(j)
+}
+
+// Finish the delivery of a job: notify the user about failed recipients and
+// move the message to the Sent folder if all its jobs are finished. After
+// MaxAttempts failed attempts, the job is deleted anyway.
+func (q *Queue) finish(j *job) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	// The job may have been finished with another one
+	j, err := q.loadJob(j.ID)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	err = q.finishJob(j)
+	if err == nil {
+		return nil
+	}
+
+	j.FinishAttempts++
+	if j.FinishAttempts < q.config.MaxAttempts {
+		j.NextAttempt = time.Now().Add(q.getRetryDelay(j.FinishAttempts))
+		if saveErr := q.saveJob(j); saveErr != nil {
+			log.Println("Cannot save delivery of message", j.Message.ID, ":", saveErr)
+		}
+		return err
+	}
+
+	log.Println("Giving up finishing delivery of message", j.Message.ID, ":", err)
+	return q.deleteJob(j)
+}
+
+// Errors are only returned before jobs are deleted.
+func (q *Queue) finishJob(j *job) error {
+	if len(j.Failures) > 0 && !j.Notified {
+		if err := q.backend.InsertEvent(j.User, &backend.Event{
+			Notices: []string{formatBounce(j)},
+		}); err != nil {
+			return err
+		}
+
+		j.Notified = true
+		if err := q.saveJob(j); err != nil {
+			return err
+		}
+	}
+
+	jobs, err := q.listJobs()
+	if err != nil {
+		return err
+	}
+
+	var done []*job
+	for _, other := range jobs {
+		if other.User != j.User || other.Message.ID != j.Message.ID {
+			continue
+		}
+		if len(other.Recipients) > 0 {
+			// Other recipients are still waiting for this message
+			return nil
+		}
+		done = append(done, other)
+	}
+
+	_, err = q.backend.UpdateMessage(j.User, &backend.MessageUpdate{
+		Message: &backend.Message{
+			ID: j.Message.ID,
+			LabelIDs: []string{backend.SentLabel},
+			Type: backend.SentType,
+		},
+		Type: true,
+		LabelIDs: backend.ReplaceLabels,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, other := range done {
+		if err := q.deleteJob(other); err != nil {
+			log.Println("Cannot delete delivery of message", other.Message.ID, ":", err)
+		}
+	}
+	return nil
+}
+
+// Format a notice about recipients which didn't receive a message.
+func formatBounce(j *job) string {
+	var failures []string
+	for _, f := range j.Failures {
+		failures = append(failures, f.Address + " (" + f.Error + ")")
+	}
+
+	return "Message \"" + j.Message.Subject + "\" could not be delivered to " + strings.Join(failures, ", ")
+}
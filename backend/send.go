@@ -1,26 +1,141 @@
 package backend
 
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
 // Sends messages to email addresses.
 type SendBackend interface {
-	// Send a message to an e-mail address.
+	// Send a message to its recipients. If the message cannot be sent to some
+	// recipients only, a RecipientsError is returned.
 	SendMessage(user string, msg *OutgoingMessage) error
 }
 
+// A SendBackend which can send several messages at once, e.g. using a single
+// connection.
+type BatchSendBackend interface {
+	SendBackend
+
+	// Send several messages. If some recipients cannot be reached, a
+	// RecipientsError is returned and other recipients still receive their
+	// message.
+	SendMessages(user string, msgs []*OutgoingMessage) error
+}
+
+// Delays the delivery of messages.
+type ScheduleBackend interface {
+	// Send messages at a given time. Messages MUST NOT be delivered before.
+	ScheduleMessages(user string, msgs []*OutgoingMessage, at time.Time) error
+	// Cancel the delivery of a scheduled message. Returns ErrNotScheduled if
+	// the message isn't scheduled anymore.
+	CancelMessage(user, id string) error
+}
+
+// Returned by a ScheduleBackend when a message cannot be cancelled.
+var ErrNotScheduled = errors.New("Message is not scheduled or is being sent")
+
+// Returned by a SendBackend when messages have been queued instead of being
+// sent immediately. The backend is then responsible for moving the message to
+// the Sent folder once it has been delivered.
+var ErrSendQueued = errors.New("Message queued for delivery")
+
+// Send several messages with a SendBackend. Messages are sent in a single batch
+// if the backend supports it.
+func SendMessages(b SendBackend, user string, msgs []*OutgoingMessage) error {
+	if batch, ok := b.(BatchSendBackend); ok {
+		return batch.SendMessages(user, msgs)
+	}
+
+	queued := false
+	var errs RecipientsError
+	for _, msg := range msgs {
+		err := b.SendMessage(user, msg)
+		if err == ErrSendQueued {
+			queued = true
+		} else if rcptErrs, ok := err.(RecipientsError); ok {
+			errs = append(errs, rcptErrs...)
+		} else if err != nil {
+			for _, addr := range msg.GetRecipients() {
+				errs = append(errs, &RecipientError{Address: addr, Err: err})
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	if queued {
+		return ErrSendQueued
+	}
+	return nil
+}
+
 // A message that is going to be sent.
 // Message.Body MUST be ignored, MessagePackage.Body MUST be used instead.
-// The recipient is specified in MessagePackage.Address.
+// Recipients are specified in Recipients, or in MessagePackage.Address if
+// there is only one.
 type OutgoingMessage struct {
 	*Message
 	*MessagePackage
 
-	InReplyTo string
-	References string
 	Attachments []*OutgoingAttachment
+
+	// Addresses of recipients which all receive the same body.
+	Recipients []string
+}
+
+// Get the addresses this message must be sent to.
+func (msg *OutgoingMessage) GetRecipients() []string {
+	if len(msg.Recipients) > 0 {
+		return msg.Recipients
+	}
+	if msg.MessagePackage != nil && msg.MessagePackage.Address != "" {
+		return []string{msg.MessagePackage.Address}
+	}
+	return nil
+}
+
+// An error which occurred while sending a message to a recipient.
+type RecipientError struct {
+	Address string
+	Err error
+}
+
+func (err *RecipientError) Error() string {
+	return "Cannot send message to " + err.Address + ": " + err.Err.Error()
+}
+
+// Errors which occurred while sending messages to some recipients.
+type RecipientsError []*RecipientError
+
+func (errs RecipientsError) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
 }
 
 // An attachment that is going to be sent.
 type OutgoingAttachment struct {
 	*Attachment
 
+	// The attachment content. If nil, Open is used instead.
 	Data []byte
+	// Open the attachment content. It can be called once per sent message, so
+	// that large attachments are never fully loaded in memory.
+	Open func() (io.ReadCloser, error)
+}
+
+// Get a reader for the attachment content. The caller must close it.
+func (att *OutgoingAttachment) Reader() (io.ReadCloser, error) {
+	if att.Data != nil || att.Open == nil {
+		return ioutil.NopCloser(bytes.NewReader(att.Data)), nil
+	}
+	return att.Open()
 }
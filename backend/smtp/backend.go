@@ -3,6 +3,7 @@ package smtp
 
 import (
 	"strconv"
+	"strings"
 
 	"github.com/emersion/neutron/backend"
 )
@@ -17,6 +18,41 @@ type Config struct {
 	Suffix string
 	Tls bool
 	SmtpHost string
+
+	// SASL mechanism used to authenticate: PLAIN (default), LOGIN, CRAM-MD5 or
+	// XOAUTH2. With XOAUTH2, passwords are OAuth bearer tokens.
+	Mechanism string
+	// Service account used to send all users' messages. If set, users'
+	// passwords aren't needed, so messages can still be sent once users have
+	// logged out.
+	Account *Account
+}
+
+// A service account allowed to send messages on behalf of users.
+type Account struct {
+	Username string
+	// The account's password, or its bearer token with XOAUTH2.
+	Password string
+	// Addresses each user can send from, in addition to USERNAME+Suffix. An
+	// entry starting with "@" allows a whole domain.
+	Senders map[string][]string
+}
+
+// Check if a user can send messages from an address with the account.
+func (a *Account) CanSendFrom(user, suffix, addr string) bool {
+	if strings.EqualFold(addr, user + suffix) {
+		return true
+	}
+
+	for _, sender := range a.Senders[user] {
+		if strings.EqualFold(addr, sender) {
+			return true
+		}
+		if strings.HasPrefix(sender, "@") && len(addr) > len(sender) && strings.EqualFold(addr[len(addr)-len(sender):], sender) {
+			return true
+		}
+	}
+	return false
 }
 
 func (c *Config) Host() string {
@@ -32,8 +68,17 @@ func (c *Config) Host() string {
 	return c.Hostname + ":" + strconv.Itoa(port)
 }
 
+// Use a SMTP server to send messages. passwords can be nil if a service account
+// is configured.
 func Use(bkd *backend.Backend, config *Config, passwords PasswordsBackend) {
-	send := New(config, passwords)
+	var dkim backend.DkimBackend
+	if bkd.DkimBackend != nil {
+		// Keys are retrieved when sending messages, so that another backend
+		// can store them
+		dkim = bkd
+	}
+
+	send := New(config, passwords, dkim)
 
 	bkd.Set(send)
 }
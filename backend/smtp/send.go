@@ -3,10 +3,13 @@ package smtp
 import (
 	"errors"
 	"crypto/tls"
+	"io"
 	"net"
 	"net/smtp"
 
 	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util/dkim"
+	"github.com/emersion/neutron/backend/util/sasl"
 	"github.com/emersion/neutron/backend/util/textproto"
 )
 
@@ -14,12 +17,52 @@ type SendBackend struct {
 	PasswordsBackend
 
 	config *Config
+	dkim backend.DkimBackend
 }
 
-func (b *SendBackend) SendMessage(user string, msg *backend.OutgoingMessage) error {
-	password, err := b.GetPassword(user)
+// Adapts a SASL client to net/smtp.
+type saslAuth struct {
+	sasl.Client
+}
+
+func (a *saslAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return a.Client.Start()
+}
+
+func (a *saslAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	return a.Client.Next(fromServer)
+}
+
+// Get the credentials used to send a user's messages.
+func (b *SendBackend) auth(user string) (smtp.Auth, error) {
+	var username, password string
+	if account := b.config.Account; account != nil {
+		username, password = account.Username, account.Password
+	} else if b.PasswordsBackend != nil {
+		var err error
+		if password, err = b.GetPassword(user); err != nil {
+			return nil, err
+		}
+		username = user + b.config.Suffix
+	} else {
+		return nil, errors.New("No SMTP credentials available")
+	}
+
+	c, err := sasl.NewClient(b.config.Mechanism, "", username, password)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return &saslAuth{c}, nil
+}
+
+// Connect and authenticate to the SMTP server.
+func (b *SendBackend) dial(user string) (*smtp.Client, error) {
+	auth, err := b.auth(user)
+	if err != nil {
+		return nil, err
 	}
 
 	cfg := b.config
@@ -32,7 +75,7 @@ func (b *SendBackend) SendMessage(user string, msg *backend.OutgoingMessage) err
 		conn, err = net.Dial("tcp", host)
 	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	smtpHost := cfg.SmtpHost
@@ -41,58 +84,141 @@ func (b *SendBackend) SendMessage(user string, msg *backend.OutgoingMessage) err
 	}
 	c, err := smtp.NewClient(conn, smtpHost)
 	if err != nil {
-		return err
+		conn.Close()
+		return nil, err
 	}
-	defer c.Close()
 
 	if !cfg.Tls {
 		if ok, _ := c.Extension("STARTTLS"); !ok {
-			return errors.New("STMP server doesn't support STARTTLS")
+			c.Close()
+			return nil, errors.New("STMP server doesn't support STARTTLS")
 		}
 
 		tlsConfig := &tls.Config{ServerName: smtpHost}
 		if err = c.StartTLS(tlsConfig); err != nil {
-			return err
+			c.Close()
+			return nil, err
 		}
 	}
 
-	auth := smtp.PlainAuth("", user + b.config.Suffix, password, smtpHost)
 	if err = c.Auth(auth); err != nil {
-		return err
+		c.Close()
+		return nil, err
 	}
 
-	from := msg.Sender.Address
-	to := []string{msg.MessagePackage.Address}
+	return c, nil
+}
 
-	if err = c.Mail(from); err != nil {
-		return err
+// Send a message in a single SMTP transaction. Rejected recipients are
+// returned, the message is still sent to other recipients.
+func (b *SendBackend) send(c *smtp.Client, msg *backend.OutgoingMessage) (rejected backend.RecipientsError, err error) {
+	if err = c.Mail(msg.Sender.Address); err != nil {
+		return
 	}
 
+	to := msg.GetRecipients()
 	for _, addr := range to {
-		if err = c.Rcpt(addr); err != nil {
-			return err
+		if rcptErr := c.Rcpt(addr); rcptErr != nil {
+			rejected = append(rejected, &backend.RecipientError{Address: addr, Err: rcptErr})
 		}
 	}
 
+	// No recipient accepted the message, abort the transaction
+	if len(rejected) == len(to) {
+		err = c.Reset()
+		return
+	}
+
 	w, err := c.Data()
 	if err != nil {
-		return err
+		return
 	}
 
-	mail := []byte(textproto.FormatOutgoingMessage(msg))
+	if err = b.writeMessage(w, msg); err != nil {
+		// The message is incomplete, it must not be delivered and the
+		// connection cannot be used anymore
+		c.Close()
+		return
+	}
 
-	if _, err = w.Write(mail); err != nil {
+	err = w.Close()
+	return
+}
+
+// Write a message, signed with DKIM if a key is available for the sender's
+// domain.
+func (b *SendBackend) writeMessage(w io.Writer, msg *backend.OutgoingMessage) error {
+	if b.dkim == nil {
+		return textproto.WriteOutgoingMessage(w, msg)
+	}
+
+	signed, err := dkim.SignOutgoingMessage(b.dkim, msg)
+	if err != nil {
 		return err
 	}
+	defer signed.Close()
 
-	if err = w.Close(); err != nil {
+	r, err := signed.Reader()
+	if err != nil {
 		return err
 	}
 
-	return c.Quit()
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func (b *SendBackend) SendMessage(user string, msg *backend.OutgoingMessage) error {
+	return b.SendMessages(user, []*backend.OutgoingMessage{msg})
+}
+
+// Send messages using a single connection.
+func (b *SendBackend) SendMessages(user string, msgs []*backend.OutgoingMessage) error {
+	c, err := b.dial(user)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	var rejected backend.RecipientsError
+	reject := func(msg *backend.OutgoingMessage, err error) {
+		for _, addr := range msg.GetRecipients() {
+			rejected = append(rejected, &backend.RecipientError{Address: addr, Err: err})
+		}
+	}
+
+	for i, msg := range msgs {
+		if account := b.config.Account; account != nil && !account.CanSendFrom(user, b.config.Suffix, msg.Sender.Address) {
+			reject(msg, errors.New("Not allowed to send from " + msg.Sender.Address))
+			continue
+		}
+
+		msgRejected, err := b.send(c, msg)
+		if err == nil {
+			rejected = append(rejected, msgRejected...)
+			continue
+		}
+
+		// The transaction failed, try to send other messages anyway
+		reject(msg, err)
+		if resetErr := c.Reset(); resetErr != nil {
+			// The connection cannot be used anymore
+			for _, msg := range msgs[i+1:] {
+				reject(msg, resetErr)
+			}
+			return rejected
+		}
+	}
+
+	c.Quit()
+
+	if len(rejected) > 0 {
+		return rejected
+	}
+	return nil
 }
 
-func New(config *Config, passwords PasswordsBackend) backend.SendBackend {
+// Create a new SMTP backend. dkim can be nil if messages must not be signed.
+func New(config *Config, passwords PasswordsBackend, dkim backend.DkimBackend) backend.SendBackend {
 	if config.Port <= 0 {
 		config.Port = 25
 	}
@@ -101,5 +227,6 @@ func New(config *Config, passwords PasswordsBackend) backend.SendBackend {
 		PasswordsBackend: passwords,
 
 		config: config,
+		dkim: dkim,
 	}
 }
@@ -0,0 +1,97 @@
+package sqlite
+
+import (
+	"database/sql"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util"
+)
+
+// Stores users' addresses. E-mails are compared case-insensitively.
+type Addresses struct {
+	db *DB
+}
+
+func getAddress(q querier, user, id string) (*backend.Address, error) {
+	addr := &backend.Address{}
+	err := queryObject(q, addr, "SELECT data FROM addresses WHERE user_id = ? AND id = ?", user, id)
+	if err != nil {
+		return nil, rowError(err, "address")
+	}
+	return addr, nil
+}
+
+func (b *Addresses) GetAddress(user, id string) (*backend.Address, error) {
+	return getAddress(b.db, user, id)
+}
+
+func (b *Addresses) ListAddresses(user string) (addrs []*backend.Address, err error) {
+	err = queryObjects(b.db, func(data string) error {
+		addr := &backend.Address{}
+		addrs = append(addrs, addr)
+		return unmarshal(data, addr)
+	}, "SELECT data FROM addresses WHERE user_id = ? ORDER BY rowid", user)
+	return
+}
+
+func (b *Addresses) GetAddressByEmail(email string) (string, *backend.Address, error) {
+	var user, data string
+	err := b.db.QueryRow("SELECT user_id, data FROM addresses WHERE email = ? ORDER BY rowid LIMIT 1", email).Scan(&user, &data)
+	if err != nil {
+		return "", nil, rowError(err, "address")
+	}
+
+	addr := &backend.Address{}
+	if err := unmarshal(data, addr); err != nil {
+		return "", nil, err
+	}
+	return user, addr, nil
+}
+
+func (b *Addresses) InsertAddress(user string, addr *backend.Address) (*backend.Address, error) {
+	addr.ID = util.GenerateId()
+
+	data, err := marshal(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = b.db.Exec("INSERT INTO addresses(id, user_id, email, data) VALUES (?, ?, ?, ?)", addr.ID, user, addr.Email, data)
+	if err != nil {
+		return nil, err
+	}
+	return addr, nil
+}
+
+func (b *Addresses) UpdateAddress(user string, update *backend.AddressUpdate) (*backend.Address, error) {
+	var addr *backend.Address
+	err := b.db.transaction(func(tx *sql.Tx) (err error) {
+		addr, err = getAddress(tx, user, update.Address.ID)
+		if err != nil {
+			return
+		}
+
+		update.Apply(addr)
+
+		data, err := marshal(addr)
+		if err != nil {
+			return
+		}
+
+		_, err = tx.Exec("UPDATE addresses SET email = ?, data = ? WHERE id = ?", addr.Email, data, addr.ID)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addr, nil
+}
+
+func (b *Addresses) DeleteAddress(user, id string) error {
+	res, err := b.db.Exec("DELETE FROM addresses WHERE user_id = ? AND id = ?", user, id)
+	return changeError(res, err, "address")
+}
+
+func NewAddresses(db *DB) backend.AddressesBackend {
+	return &Addresses{db}
+}
@@ -0,0 +1,93 @@
+package sqlite
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util"
+)
+
+// Stores attachments, with their contents.
+type Attachments struct {
+	db *DB
+}
+
+func listAttachments(q querier, user, msgId string) (atts []*backend.Attachment, err error) {
+	err = queryObjects(q, func(data string) error {
+		att := &backend.Attachment{}
+		atts = append(atts, att)
+		return unmarshal(data, att)
+	}, "SELECT data FROM attachments WHERE user_id = ? AND message_id = ? ORDER BY rowid", user, msgId)
+	return
+}
+
+func (b *Attachments) ListAttachments(user, msgId string) ([]*backend.Attachment, error) {
+	return listAttachments(b.db, user, msgId)
+}
+
+func (b *Attachments) ReadAttachment(user, id string) (*backend.Attachment, []byte, error) {
+	var data string
+	var contents []byte
+	err := b.db.QueryRow("SELECT data, contents FROM attachments WHERE user_id = ? AND id = ?", user, id).Scan(&data, &contents)
+	if err != nil {
+		return nil, nil, rowError(err, "attachment")
+	}
+
+	att := &backend.Attachment{}
+	if err := unmarshal(data, att); err != nil {
+		return nil, nil, err
+	}
+	return att, contents, nil
+}
+
+func (b *Attachments) OpenAttachment(user, id string) (*backend.Attachment, io.ReadCloser, error) {
+	att, contents, err := b.ReadAttachment(user, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return att, ioutil.NopCloser(bytes.NewReader(contents)), nil
+}
+
+func (b *Attachments) InsertAttachment(user string, att *backend.Attachment, contents []byte) (*backend.Attachment, error) {
+	att.ID = util.GenerateId()
+	att.Size = len(contents)
+	if contents == nil {
+		contents = []byte{}
+	}
+
+	data, err := marshal(att)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = b.db.Exec("INSERT INTO attachments(id, user_id, message_id, data, contents) VALUES (?, ?, ?, ?, ?)", att.ID, user, att.MessageID, data, contents)
+	if err != nil {
+		return nil, err
+	}
+	return att, nil
+}
+
+func (b *Attachments) InsertAttachmentFrom(user string, att *backend.Attachment, r io.Reader) (*backend.Attachment, error) {
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return b.InsertAttachment(user, att, contents)
+}
+
+func (b *Attachments) DeleteAttachment(user, id string) error {
+	res, err := b.db.Exec("DELETE FROM attachments WHERE user_id = ? AND id = ?", user, id)
+	return changeError(res, err, "attachment")
+}
+
+// Additional function needed for imap.Messages backend
+func (b *Attachments) UpdateAttachmentMessage(user, id, msgId string) error {
+	res, err := b.db.Exec("UPDATE attachments SET message_id = ?, data = json_set(data, '$.MessageID', ?) WHERE user_id = ? AND id = ?", msgId, msgId, user, id)
+	return changeError(res, err, "attachment")
+}
+
+func NewAttachments(db *DB) backend.AttachmentsBackend {
+	return &Attachments{db}
+}
@@ -0,0 +1,198 @@
+// Stores data in a SQLite database.
+package sqlite
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	_ "modernc.org/sqlite"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/events"
+	"github.com/emersion/neutron/backend/util"
+)
+
+const driverName = "sqlite"
+
+type Config struct {
+	// The database file path.
+	Path string
+}
+
+// A SQLite database.
+type DB struct {
+	*sql.DB
+}
+
+// Executes queries, either directly on the database or in a transaction.
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Open a database and apply missing schema migrations.
+func Open(config *Config) (*DB, error) {
+	db, err := sql.Open(driverName, config.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite doesn't support concurrent writes, and pragmas are set per
+	// connection
+	db.SetMaxOpenConns(1)
+
+	pragmas := []string{
+		"PRAGMA journal_mode = WAL",
+		"PRAGMA busy_timeout = 5000",
+	}
+	for _, pragma := range pragmas {
+		if _, err := db.Exec(pragma); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &DB{db}, nil
+}
+
+// Run f in a transaction. The transaction is committed if f succeeds and
+// rolled back otherwise.
+func (db *DB) transaction(f func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Apply migrations which haven't been applied yet. The database's user_version
+// is the number of applied migrations.
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("Database schema version %v is newer than supported version %v", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Cannot apply migration %v: %v", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func marshal(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+func unmarshal(data string, v interface{}) error {
+	return json.Unmarshal([]byte(data), v)
+}
+
+// Query an object stored as JSON.
+func queryObject(q querier, v interface{}, query string, args ...interface{}) error {
+	var data string
+	if err := q.QueryRow(query, args...).Scan(&data); err != nil {
+		return err
+	}
+	return unmarshal(data, v)
+}
+
+// Query objects stored as JSON. add is called with each object's data.
+func queryObjects(q querier, add func(data string) error, query string, args ...interface{}) error {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return err
+		}
+		if err := add(data); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// Returns err, or notFound if there is no such row.
+func rowError(err error, notFound string) error {
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("No such %v", notFound)
+	}
+	return err
+}
+
+// Returns err, or notFound if no row has been changed.
+func changeError(res sql.Result, err error, notFound string) error {
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return rowError(sql.ErrNoRows, notFound)
+	}
+	return nil
+}
+
+// Use a SQLite database for all backends.
+func Use(bkd *backend.Backend, config *Config) (*DB, error) {
+	db, err := Open(config)
+	if err != nil {
+		return nil, err
+	}
+
+	evts := NewEvents(db)
+	contacts := events.NewContacts(NewContacts(db), evts)
+	labels := events.NewLabels(NewLabels(db), evts)
+	attachments := NewAttachments(db)
+	conversations := events.NewConversations(NewMessages(db), evts)
+	send := util.NewEchoSend(conversations)
+	domains := NewDomains(db)
+	users := NewUsers(db)
+	addresses := events.NewAddresses(NewAddresses(db), evts)
+	keys := NewKeys(db)
+
+	bkd.Set(contacts, labels, conversations, send, domains, evts, users, addresses, attachments, keys)
+	return db, nil
+}
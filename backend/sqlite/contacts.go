@@ -0,0 +1,75 @@
+package sqlite
+
+import (
+	"database/sql"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util"
+)
+
+// Stores users' contacts.
+type Contacts struct {
+	db *DB
+}
+
+func (b *Contacts) ListContacts(user string) (contacts []*backend.Contact, err error) {
+	err = queryObjects(b.db, func(data string) error {
+		contact := &backend.Contact{}
+		contacts = append(contacts, contact)
+		return unmarshal(data, contact)
+	}, "SELECT data FROM contacts WHERE user_id = ? ORDER BY rowid", user)
+	return
+}
+
+func (b *Contacts) InsertContact(user string, contact *backend.Contact) (*backend.Contact, error) {
+	contact.ID = util.GenerateId()
+
+	data, err := marshal(contact)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = b.db.Exec("INSERT INTO contacts(id, user_id, data) VALUES (?, ?, ?)", contact.ID, user, data)
+	if err != nil {
+		return nil, err
+	}
+	return contact, nil
+}
+
+func (b *Contacts) UpdateContact(user string, update *backend.ContactUpdate) (*backend.Contact, error) {
+	contact := &backend.Contact{}
+	err := b.db.transaction(func(tx *sql.Tx) error {
+		err := queryObject(tx, contact, "SELECT data FROM contacts WHERE user_id = ? AND id = ?", user, update.Contact.ID)
+		if err != nil {
+			return rowError(err, "contact")
+		}
+
+		update.Apply(contact)
+
+		data, err := marshal(contact)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE contacts SET data = ? WHERE id = ?", data, contact.ID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return contact, nil
+}
+
+func (b *Contacts) DeleteContact(user, id string) error {
+	res, err := b.db.Exec("DELETE FROM contacts WHERE user_id = ? AND id = ?", user, id)
+	return changeError(res, err, "contact")
+}
+
+func (b *Contacts) DeleteAllContacts(user string) error {
+	_, err := b.db.Exec("DELETE FROM contacts WHERE user_id = ?", user)
+	return err
+}
+
+func NewContacts(db *DB) backend.ContactsBackend {
+	return &Contacts{db}
+}
@@ -0,0 +1,109 @@
+package sqlite
+
+import (
+	"database/sql"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util"
+)
+
+// Stores domains and their DKIM keys.
+type Domains struct {
+	db *DB
+}
+
+func (b *Domains) ListDomains() (domains []*backend.Domain, err error) {
+	err = queryObjects(b.db, func(data string) error {
+		domain := &backend.Domain{}
+		domains = append(domains, domain)
+		return unmarshal(data, domain)
+	}, "SELECT data FROM domains ORDER BY rowid")
+	return
+}
+
+func getDomain(q querier, id string) (*backend.Domain, error) {
+	domain := &backend.Domain{}
+	err := queryObject(q, domain, "SELECT data FROM domains WHERE id = ?", id)
+	if err != nil {
+		return nil, rowError(err, "domain")
+	}
+	return domain, nil
+}
+
+func (b *Domains) GetDomain(id string) (*backend.Domain, error) {
+	return getDomain(b.db, id)
+}
+
+func (b *Domains) GetDomainByName(name string) (*backend.Domain, error) {
+	domain := &backend.Domain{}
+	err := queryObject(b.db, domain, "SELECT data FROM domains WHERE name = ? ORDER BY rowid LIMIT 1", name)
+	if err != nil {
+		return nil, rowError(err, "domain")
+	}
+	return domain, nil
+}
+
+func (b *Domains) InsertDomain(domain *backend.Domain) (*backend.Domain, error) {
+	domain.ID = util.GenerateId()
+
+	data, err := marshal(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = b.db.Exec("INSERT INTO domains(id, name, data) VALUES (?, ?, ?)", domain.ID, domain.DomainName, data)
+	if err != nil {
+		return nil, err
+	}
+	return domain, nil
+}
+
+func (b *Domains) UpdateDomain(update *backend.DomainUpdate) (*backend.Domain, error) {
+	var domain *backend.Domain
+	err := b.db.transaction(func(tx *sql.Tx) (err error) {
+		domain, err = getDomain(tx, update.Domain.ID)
+		if err != nil {
+			return
+		}
+
+		update.Apply(domain)
+
+		data, err := marshal(domain)
+		if err != nil {
+			return
+		}
+
+		_, err = tx.Exec("UPDATE domains SET name = ?, data = ? WHERE id = ?", domain.DomainName, data, domain.ID)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return domain, nil
+}
+
+func (b *Domains) GetDkimKey(domain string) (*backend.DkimKey, error) {
+	key := &backend.DkimKey{}
+	err := queryObject(b.db, key, "SELECT data FROM dkim_keys WHERE domain = ?", domain)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (b *Domains) UpdateDkimKey(domain string, key *backend.DkimKey) error {
+	data, err := marshal(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.db.Exec("INSERT OR REPLACE INTO dkim_keys(domain, data) VALUES (?, ?)", domain, data)
+	return err
+}
+
+func NewDomains(db *DB) backend.DomainsBackend {
+	return &Domains{db}
+}
@@ -0,0 +1,89 @@
+package sqlite
+
+import (
+	"database/sql"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util"
+)
+
+// Stores events. Like in the memory backend, events are only stored once a
+// client has requested the last event, and until all of them are deleted.
+type Events struct {
+	db *DB
+}
+
+func insertEvent(q querier, user string, e *backend.Event) error {
+	e.ID = util.GenerateId()
+
+	data, err := marshal(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.Exec("INSERT INTO events(id, user_id, data) VALUES (?, ?, ?)", e.ID, user, data)
+	return err
+}
+
+func (b *Events) InsertEvent(user string, e *backend.Event) error {
+	return b.db.transaction(func(tx *sql.Tx) error {
+		// If nobody is listening, do not insert the event
+		var n int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM events WHERE user_id = ?", user).Scan(&n); err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+
+		return insertEvent(tx, user, e)
+	})
+}
+
+func (b *Events) GetLastEvent(user string) (*backend.Event, error) {
+	e := &backend.Event{}
+	err := b.db.transaction(func(tx *sql.Tx) error {
+		err := queryObject(tx, e, "SELECT data FROM events WHERE user_id = ? ORDER BY seq DESC LIMIT 1", user)
+		if err == sql.ErrNoRows {
+			// No events for this user, create an empty one
+			return insertEvent(tx, user, e)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (b *Events) GetEventsAfter(user, id string) (*backend.Event, error) {
+	var seq int64
+	err := b.db.QueryRow("SELECT seq FROM events WHERE user_id = ? AND id = ?", user, id).Scan(&seq)
+	if err != nil {
+		return nil, rowError(err, "event")
+	}
+
+	merged := &backend.Event{ID: id}
+	err = queryObjects(b.db, func(data string) error {
+		e := &backend.Event{}
+		if err := unmarshal(data, e); err != nil {
+			return err
+		}
+
+		merged = backend.MergeEvents(merged, e)
+		return nil
+	}, "SELECT data FROM events WHERE user_id = ? AND seq > ? ORDER BY seq", user, seq)
+	if err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+func (b *Events) DeleteAllEvents(user string) error {
+	_, err := b.db.Exec("DELETE FROM events WHERE user_id = ?", user)
+	return err
+}
+
+func NewEvents(db *DB) backend.EventsBackend {
+	return &Events{db}
+}
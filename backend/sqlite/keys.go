@@ -0,0 +1,76 @@
+package sqlite
+
+import (
+	"database/sql"
+
+	"github.com/emersion/neutron/backend"
+)
+
+// Stores keypairs by e-mail.
+type Keys struct {
+	db *DB
+}
+
+func getKeypair(q querier, email string) (*backend.Keypair, error) {
+	kp := &backend.Keypair{}
+	err := queryObject(q, kp, "SELECT data FROM keys WHERE email = ?", email)
+	if err != nil {
+		return nil, rowError(err, "keypair")
+	}
+	return kp, nil
+}
+
+func putKeypair(q querier, email string, kp *backend.Keypair) error {
+	data, err := marshal(kp)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.Exec("INSERT OR REPLACE INTO keys(email, data) VALUES (?, ?)", email, data)
+	return err
+}
+
+func (b *Keys) GetPublicKey(email string) (string, error) {
+	kp, err := getKeypair(b.db, email)
+	if err != nil {
+		return "", nil
+	}
+	return kp.PublicKey, nil
+}
+
+func (b *Keys) GetKeypair(email string) (*backend.Keypair, error) {
+	return getKeypair(b.db, email)
+}
+
+func (b *Keys) InsertKeypair(email string, keypair *backend.Keypair) (*backend.Keypair, error) {
+	keypair.ID = email
+	if err := putKeypair(b.db, email, keypair); err != nil {
+		return nil, err
+	}
+	return keypair, nil
+}
+
+func (b *Keys) UpdateKeypair(email string, keypair *backend.Keypair) (*backend.Keypair, error) {
+	var updated *backend.Keypair
+	err := b.db.transaction(func(tx *sql.Tx) (err error) {
+		updated, err = getKeypair(tx, email)
+		if err != nil {
+			return
+		}
+
+		if keypair.PublicKey != "" {
+			updated.PublicKey = keypair.PublicKey
+		}
+		updated.PrivateKey = keypair.PrivateKey
+
+		return putKeypair(tx, email, updated)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+func NewKeys(db *DB) backend.KeysBackend {
+	return &Keys{db}
+}
@@ -0,0 +1,77 @@
+package sqlite
+
+import (
+	"database/sql"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util"
+)
+
+// Stores users' labels.
+type Labels struct {
+	db *DB
+}
+
+func (b *Labels) ListLabels(user string) (labels []*backend.Label, err error) {
+	err = queryObjects(b.db, func(data string) error {
+		label := &backend.Label{}
+		labels = append(labels, label)
+		return unmarshal(data, label)
+	}, "SELECT data FROM labels WHERE user_id = ? ORDER BY rowid", user)
+	return
+}
+
+func (b *Labels) InsertLabel(user string, label *backend.Label) (*backend.Label, error) {
+	label.ID = util.GenerateId()
+
+	err := b.db.transaction(func(tx *sql.Tx) error {
+		if err := tx.QueryRow("SELECT COUNT(*) FROM labels WHERE user_id = ?", user).Scan(&label.Order); err != nil {
+			return err
+		}
+
+		data, err := marshal(label)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("INSERT INTO labels(id, user_id, data) VALUES (?, ?, ?)", label.ID, user, data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return label, nil
+}
+
+func (b *Labels) UpdateLabel(user string, update *backend.LabelUpdate) (*backend.Label, error) {
+	label := &backend.Label{}
+	err := b.db.transaction(func(tx *sql.Tx) error {
+		err := queryObject(tx, label, "SELECT data FROM labels WHERE user_id = ? AND id = ?", user, update.Label.ID)
+		if err != nil {
+			return rowError(err, "label")
+		}
+
+		update.Apply(label)
+
+		data, err := marshal(label)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE labels SET data = ? WHERE id = ?", data, label.ID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return label, nil
+}
+
+func (b *Labels) DeleteLabel(user, id string) error {
+	res, err := b.db.Exec("DELETE FROM labels WHERE user_id = ? AND id = ?", user, id)
+	return changeError(res, err, "label")
+}
+
+func NewLabels(db *DB) backend.LabelsBackend {
+	return &Labels{db}
+}
@@ -0,0 +1,299 @@
+package sqlite
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util"
+)
+
+// Stores messages. Conversations are computed from messages.
+//
+// Messages' label IDs are also stored in the message_labels table, so that
+// messages can be counted by label without being loaded.
+type Messages struct {
+	db *DB
+}
+
+// Query a user's messages, with their attachments. where is appended to the
+// query's WHERE clause.
+func queryMessages(q querier, user, where string, args ...interface{}) ([]*backend.Message, error) {
+	args = append([]interface{}{user}, args...)
+	rows, err := q.Query("SELECT in_reply_to, refs, data FROM messages WHERE user_id = ? "+where+" ORDER BY rowid", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []*backend.Message
+	for rows.Next() {
+		var data string
+		msg := &backend.Message{}
+		if err := rows.Scan(&msg.InReplyTo, &msg.References, &data); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if err := unmarshal(data, msg); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Rows must be closed before running another query, since there is only
+	// one connection
+	byID := map[string]*backend.Message{}
+	for _, msg := range msgs {
+		byID[msg.ID] = msg
+	}
+
+	rows, err = q.Query("SELECT message_id, data FROM attachments WHERE user_id = ? AND message_id IN (SELECT id FROM messages WHERE user_id = ? "+where+") ORDER BY rowid", append([]interface{}{user}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var msgId, data string
+		if err := rows.Scan(&msgId, &data); err != nil {
+			return nil, err
+		}
+
+		att := &backend.Attachment{}
+		if err := unmarshal(data, att); err != nil {
+			return nil, err
+		}
+		if msg, ok := byID[msgId]; ok {
+			msg.Attachments = append(msg.Attachments, att)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return msgs, nil
+}
+
+func getMessage(q querier, user, id string) (*backend.Message, error) {
+	msgs, err := queryMessages(q, user, "AND id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, errors.New("No such message")
+	}
+	return msgs[0], nil
+}
+
+// Save a message's columns and labels. Attachments are stored separately.
+func updateMessage(tx *sql.Tx, msg *backend.Message) error {
+	stored := *msg
+	stored.Attachments = nil
+	data, err := marshal(&stored)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE messages SET conversation_id = ?, is_read = ?, in_reply_to = ?, refs = ?, data = ? WHERE id = ?",
+		msg.ConversationID, msg.IsRead, msg.InReplyTo, msg.References, data, msg.ID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM message_labels WHERE message_id = ?", msg.ID); err != nil {
+		return err
+	}
+	for _, label := range msg.LabelIDs {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO message_labels(message_id, label_id) VALUES (?, ?)", msg.ID, label); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *Messages) GetMessage(user, id string) (*backend.Message, error) {
+	return getMessage(b.db, user, id)
+}
+
+func (b *Messages) ListMessages(user string, filter *backend.MessagesFilter) ([]*backend.Message, int, error) {
+	var all []*backend.Message
+	var err error
+	if filter.Label != "" {
+		all, err = queryMessages(b.db, user, "AND id IN (SELECT message_id FROM message_labels WHERE label_id = ?)", filter.Label)
+	} else {
+		all, err = queryMessages(b.db, user, "")
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	filtered := []*backend.Message{}
+	for _, msg := range all {
+		if filter.Match(msg) {
+			filtered = append(filtered, msg)
+		}
+	}
+
+	from, to := filter.PageBounds(len(filtered))
+	return filtered[from:to], len(filtered), nil
+}
+
+func (b *Messages) CountMessages(user string) (counts []*backend.MessagesCount, err error) {
+	rows, err := b.db.Query(`SELECT ml.label_id, COUNT(*), SUM(m.is_read = 0)
+		FROM message_labels ml JOIN messages m ON m.id = ml.message_id
+		WHERE m.user_id = ?
+		GROUP BY ml.label_id ORDER BY MIN(m.rowid)`, user)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		count := &backend.MessagesCount{}
+		if err = rows.Scan(&count.LabelID, &count.Total, &count.Unread); err != nil {
+			return
+		}
+		counts = append(counts, count)
+	}
+
+	err = rows.Err()
+	return
+}
+
+func (b *Messages) InsertMessage(user string, msg *backend.Message) (*backend.Message, error) {
+	msg.ID = util.GenerateId()
+	if msg.ConversationID == "" {
+		msg.ConversationID = util.GenerateId()
+	}
+	msg.NumAttachments = len(msg.Attachments)
+
+	err := b.db.transaction(func(tx *sql.Tx) error {
+		if err := tx.QueryRow("SELECT COUNT(*) FROM messages WHERE user_id = ?", user).Scan(&msg.Order); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec("INSERT INTO messages(id, user_id, conversation_id, is_read, in_reply_to, refs, data) VALUES (?, ?, '', 0, '', '', '')", msg.ID, user)
+		if err != nil {
+			return err
+		}
+
+		return updateMessage(tx, msg)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (b *Messages) UpdateMessage(user string, update *backend.MessageUpdate) (*backend.Message, error) {
+	var msg *backend.Message
+	err := b.db.transaction(func(tx *sql.Tx) (err error) {
+		msg, err = getMessage(tx, user, update.Message.ID)
+		if err != nil {
+			return
+		}
+
+		update.Apply(msg)
+		return updateMessage(tx, msg)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Delete messages matching where, with their labels and attachments.
+func deleteMessages(tx *sql.Tx, user, where string, args ...interface{}) (int64, error) {
+	args = append([]interface{}{user}, args...)
+
+	_, err := tx.Exec("DELETE FROM attachments WHERE user_id = ? AND message_id IN (SELECT id FROM messages WHERE user_id = ? "+where+")", append([]interface{}{user}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec("DELETE FROM message_labels WHERE message_id IN (SELECT id FROM messages WHERE user_id = ? "+where+")", args...)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec("DELETE FROM messages WHERE user_id = ? "+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (b *Messages) DeleteMessage(user, id string) error {
+	return b.db.transaction(func(tx *sql.Tx) error {
+		n, err := deleteMessages(tx, user, "AND id = ?", id)
+		if err == nil && n == 0 {
+			err = errors.New("No such message")
+		}
+		return err
+	})
+}
+
+func (b *Messages) ListConversationMessages(user, id string) ([]*backend.Message, error) {
+	return queryMessages(b.db, user, "AND conversation_id = ?", id)
+}
+
+func (b *Messages) GetConversation(user, id string) (*backend.Conversation, error) {
+	msgs, err := b.ListConversationMessages(user, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, errors.New("No such conversation")
+	}
+
+	return backend.GroupConversations(msgs)[0], nil
+}
+
+func (b *Messages) ListConversations(user string, filter *backend.MessagesFilter) ([]*backend.Conversation, int, error) {
+	msgs, err := queryMessages(b.db, user, "")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// A conversation matches if one of its messages matches
+	matches := map[string]bool{}
+	for _, msg := range msgs {
+		if filter.Match(msg) {
+			matches[msg.ConversationID] = true
+		}
+	}
+
+	filtered := []*backend.Conversation{}
+	for _, conv := range backend.GroupConversations(msgs) {
+		if matches[conv.ID] {
+			filtered = append(filtered, conv)
+		}
+	}
+
+	from, to := filter.PageBounds(len(filtered))
+	return filtered[from:to], len(filtered), nil
+}
+
+func (b *Messages) CountConversations(user string) ([]*backend.MessagesCount, error) {
+	msgs, err := queryMessages(b.db, user, "")
+	if err != nil {
+		return nil, err
+	}
+	return backend.CountConversations(backend.GroupConversations(msgs)), nil
+}
+
+func (b *Messages) DeleteConversation(user, id string) error {
+	return b.db.transaction(func(tx *sql.Tx) error {
+		_, err := deleteMessages(tx, user, "AND conversation_id = ?", id)
+		return err
+	})
+}
+
+func NewMessages(db *DB) backend.ConversationsBackend {
+	return &Messages{db}
+}
@@ -0,0 +1,93 @@
+package sqlite
+
+// Schema migrations, in order. Once released, a migration must never be
+// changed: add a new one instead.
+//
+// Objects are stored as JSON in data columns, other columns are only used to
+// look them up. Objects are listed in insertion order, by rowid.
+var migrations = []string{
+	`
+	CREATE TABLE users (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE,
+		password TEXT NOT NULL,
+		data TEXT NOT NULL
+	);
+
+	CREATE TABLE domains (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		data TEXT NOT NULL
+	);
+	CREATE INDEX domains_name ON domains(name);
+
+	CREATE TABLE dkim_keys (
+		domain TEXT PRIMARY KEY,
+		data TEXT NOT NULL
+	);
+
+	CREATE TABLE addresses (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		email TEXT NOT NULL COLLATE NOCASE,
+		data TEXT NOT NULL
+	);
+	CREATE INDEX addresses_user_id ON addresses(user_id);
+	CREATE INDEX addresses_email ON addresses(email);
+
+	CREATE TABLE labels (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		data TEXT NOT NULL
+	);
+	CREATE INDEX labels_user_id ON labels(user_id);
+
+	CREATE TABLE contacts (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		data TEXT NOT NULL
+	);
+	CREATE INDEX contacts_user_id ON contacts(user_id);
+
+	CREATE TABLE keys (
+		email TEXT PRIMARY KEY,
+		data TEXT NOT NULL
+	);
+
+	CREATE TABLE messages (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		conversation_id TEXT NOT NULL,
+		is_read INTEGER NOT NULL,
+		in_reply_to TEXT NOT NULL,
+		refs TEXT NOT NULL,
+		data TEXT NOT NULL
+	);
+	CREATE INDEX messages_user_id ON messages(user_id);
+	CREATE INDEX messages_conversation_id ON messages(user_id, conversation_id);
+
+	CREATE TABLE message_labels (
+		message_id TEXT NOT NULL,
+		label_id TEXT NOT NULL,
+		PRIMARY KEY (message_id, label_id)
+	);
+	CREATE INDEX message_labels_label_id ON message_labels(label_id);
+
+	CREATE TABLE attachments (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		message_id TEXT NOT NULL,
+		data TEXT NOT NULL,
+		contents BLOB NOT NULL
+	);
+	CREATE INDEX attachments_message_id ON attachments(user_id, message_id);
+
+	CREATE TABLE events (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		id TEXT NOT NULL UNIQUE,
+		user_id TEXT NOT NULL,
+		data TEXT NOT NULL
+	);
+	CREATE INDEX events_user_id ON events(user_id);
+	`,
+}
@@ -0,0 +1,47 @@
+package sqlite_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/backendtest"
+	"github.com/emersion/neutron/backend/sqlite"
+)
+
+func TestBackend(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) *backend.Backend {
+		bkd := backend.New()
+		db, err := sqlite.Use(bkd, &sqlite.Config{Path: filepath.Join(t.TempDir(), "neutron.db")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return bkd
+	})
+}
+
+func TestDeleteMessageAttachments(t *testing.T) {
+	bkd := backend.New()
+	db, err := sqlite.Use(bkd, &sqlite.Config{Path: filepath.Join(t.TempDir(), "neutron.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	msg, err := bkd.InsertMessage("user", &backend.Message{Subject: "Hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	att, err := bkd.InsertAttachment("user", &backend.Attachment{MessageID: msg.ID, Name: "hello.txt"}, []byte("Hello World!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bkd.DeleteMessage("user", msg.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := bkd.ReadAttachment("user", att.ID); err == nil {
+		t.Error("Expected attachments to be deleted with their message")
+	}
+}
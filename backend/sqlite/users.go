@@ -0,0 +1,129 @@
+package sqlite
+
+import (
+	"database/sql"
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util"
+)
+
+// Stores users. Passwords are hashed with bcrypt.
+type Users struct {
+	db *DB
+}
+
+func (b *Users) IsUsernameAvailable(username string) (bool, error) {
+	var n int
+	err := b.db.QueryRow("SELECT COUNT(*) FROM users WHERE name = ?", username).Scan(&n)
+	return n == 0, err
+}
+
+func getUser(q querier, id string) (user *backend.User, hash string, err error) {
+	var data string
+	err = q.QueryRow("SELECT password, data FROM users WHERE id = ?", id).Scan(&hash, &data)
+	if err != nil {
+		err = rowError(err, "user")
+		return
+	}
+
+	user = &backend.User{}
+	err = unmarshal(data, user)
+	return
+}
+
+func (b *Users) GetUser(id string) (user *backend.User, err error) {
+	user, _, err = getUser(b.db, id)
+	return
+}
+
+func (b *Users) Auth(username, password string) (*backend.User, error) {
+	var id, hash string
+	err := b.db.QueryRow("SELECT id, password FROM users WHERE name = ?", username).Scan(&id, &hash)
+	if err == nil {
+		err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	}
+	if err != nil {
+		return nil, errors.New("Invalid username and password combination")
+	}
+
+	return b.GetUser(id)
+}
+
+func (b *Users) InsertUser(u *backend.User, password string) (*backend.User, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	u.ID = util.GenerateId()
+
+	data, err := marshal(u)
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.db.transaction(func(tx *sql.Tx) error {
+		var n int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE name = ?", u.Name).Scan(&n); err != nil {
+			return err
+		}
+		if n > 0 {
+			return errors.New("Username already taken")
+		}
+
+		_, err := tx.Exec("INSERT INTO users(id, name, password, data) VALUES (?, ?, ?, ?)", u.ID, u.Name, string(hash), data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return b.GetUser(u.ID)
+}
+
+func (b *Users) UpdateUser(update *backend.UserUpdate) error {
+	return b.db.transaction(func(tx *sql.Tx) error {
+		user, _, err := getUser(tx, update.User.ID)
+		if err != nil {
+			return err
+		}
+
+		update.Apply(user)
+
+		data, err := marshal(user)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE users SET data = ? WHERE id = ?", data, user.ID)
+		return err
+	})
+}
+
+func (b *Users) UpdateUserPassword(id, current, new string) error {
+	return b.db.transaction(func(tx *sql.Tx) error {
+		_, hash, err := getUser(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(current)) != nil {
+			return errors.New("Invalid password")
+		}
+
+		newHash, err := bcrypt.GenerateFromPassword([]byte(new), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE users SET password = ? WHERE id = ?", string(newHash), id)
+		return err
+	})
+}
+
+func NewUsers(db *DB) backend.UsersBackend {
+	return &Users{db}
+}
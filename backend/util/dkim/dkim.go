@@ -0,0 +1,179 @@
+// Signs and verifies messages with DomainKeys Identified Mail, as defined in
+// RFC 6376. Messages are canonicalized with the relaxed algorithm, both for
+// the header and the body. RSA and Ed25519 (RFC 8463) keys are supported.
+package dkim
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"strings"
+)
+
+const crlf = "\r\n"
+
+const signatureField = "DKIM-Signature"
+
+// Read the header of a message. Folded fields are kept as is.
+func readHeader(br *bufio.Reader) (fields []string, err error) {
+	for {
+		var line string
+		line, err = br.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return fields, nil // Message without body
+		} else if err != nil && err != io.EOF {
+			return
+		}
+		err = nil
+
+		if strings.TrimRight(line, crlf) == "" {
+			return // End of header
+		}
+
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+		} else {
+			fields = append(fields, line)
+		}
+	}
+}
+
+func getFieldKey(field string) string {
+	i := strings.IndexByte(field, ':')
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimSpace(field[:i])
+}
+
+// Replace sequences of whitespace with a single space.
+func compressWhitespace(s string) string {
+	var b bytes.Buffer
+	space := false
+	for _, r := range s {
+		if r == ' ' || r == '\t' {
+			space = true
+			continue
+		}
+
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteRune(r)
+	}
+	if space {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// Canonicalize a header field with the relaxed algorithm (RFC 6376 section
+// 3.4.2).
+func relaxedHeader(field string) string {
+	i := strings.IndexByte(field, ':')
+	if i < 0 {
+		return ""
+	}
+
+	k := strings.ToLower(strings.TrimSpace(field[:i]))
+
+	v := strings.Replace(field[i+1:], "\r", "", -1)
+	v = strings.Replace(v, "\n", "", -1)
+	v = strings.Trim(compressWhitespace(v), " ")
+
+	return k + ":" + v + crlf
+}
+
+// Canonicalize a body line by line with the relaxed algorithm (RFC 6376
+// section 3.4.4) and write it to a hash.
+type relaxedBody struct {
+	h hash.Hash
+	// Empty lines are written only if they are followed by a non-empty one
+	emptyLines int
+}
+
+func (b *relaxedBody) writeLine(line string) {
+	line = strings.TrimRight(compressWhitespace(strings.TrimRight(line, crlf)), " ")
+	if line == "" {
+		b.emptyLines++
+		return
+	}
+
+	for ; b.emptyLines > 0; b.emptyLines-- {
+		io.WriteString(b.h, crlf)
+	}
+	io.WriteString(b.h, line + crlf)
+}
+
+// Hash the body of a message.
+func hashBody(br *bufio.Reader) ([]byte, error) {
+	b := &relaxedBody{h: sha256.New()}
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			b.writeLine(line)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return b.h.Sum(nil), nil
+}
+
+// Select the header fields to sign or verify. For each key, the last field not
+// already selected is used.
+func selectFields(fields []string, keys []string) (selected, selectedKeys []string) {
+	used := make([]bool, len(fields))
+	for _, k := range keys {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(getFieldKey(fields[i]), k) {
+				continue
+			}
+
+			used[i] = true
+			selected = append(selected, fields[i])
+			selectedKeys = append(selectedKeys, k)
+			break
+		}
+	}
+	return
+}
+
+// Hash selected header fields and the signature field, without its trailing
+// CRLF.
+func hashHeader(fields []string, sig string) []byte {
+	h := sha256.New()
+	for _, f := range fields {
+		io.WriteString(h, relaxedHeader(f))
+	}
+	io.WriteString(h, strings.TrimSuffix(relaxedHeader(sig), crlf))
+	return h.Sum(nil)
+}
+
+// Parse a tag list, e.g. a DKIM-Signature field value or a key record (RFC
+// 6376 section 3.2). Whitespace is removed from values.
+func parseTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(s, ";") {
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		k := strings.TrimSpace(parts[0])
+		v := strings.Map(func(r rune) rune {
+			switch r {
+			case ' ', '\t', '\r', '\n':
+				return -1
+			}
+			return r
+		}, parts[1])
+		tags[k] = v
+	}
+	return tags
+}
@@ -0,0 +1,254 @@
+package dkim_test
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/memory"
+	"github.com/emersion/neutron/backend/util/dkim"
+)
+
+// Signed message from RFC 8463 appendix A.
+const rfc8463Message = "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+	" d=football.example.com; i=@football.example.com;\r\n" +
+	" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+	" subject : date : message-id : from : subject : date;\r\n" +
+	" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+	" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n" +
+	"From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+const rfc8463Record = "v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="
+
+const testMessage = "From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"X-Unsigned: hello\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+// A local DNS stand-in serving a single key record.
+func lookupRecord(name, record string) dkim.LookupTXT {
+	return func(n string) ([]string, error) {
+		if n != name {
+			return nil, errors.New("No such record")
+		}
+		return []string{record}, nil
+	}
+}
+
+func sign(t *testing.T, algo, msg string) (string, dkim.LookupTXT) {
+	signer, err := dkim.GenerateKey(algo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig, err := dkim.Signature(strings.NewReader(msg), &dkim.SignOptions{
+		Domain: "football.example.com",
+		Selector: "test",
+		Signer: signer,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := dkim.FormatRecord(signer.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sig + msg, lookupRecord("test._domainkey.football.example.com", record)
+}
+
+func TestVerify_rfc8463(t *testing.T) {
+	lookup := lookupRecord("brisbane._domainkey.football.example.com", rfc8463Record)
+
+	domains, err := dkim.Verify(strings.NewReader(rfc8463Message), lookup)
+	if err != nil {
+		t.Fatal("Expected RFC 8463 message to be valid, got:", err)
+	}
+	if len(domains) != 1 || domains[0] != "football.example.com" {
+		t.Error("Invalid signing domains:", domains)
+	}
+}
+
+func TestSignature(t *testing.T) {
+	for _, algo := range []string{dkim.RSA, dkim.Ed25519} {
+		signed, lookup := sign(t, algo, testMessage)
+
+		if !strings.HasPrefix(signed, "DKIM-Signature: v=1; a=" + algo + "-sha256; c=relaxed/relaxed;") {
+			t.Errorf("Invalid %v signature field: %v", algo, signed)
+		}
+
+		if _, err := dkim.Verify(strings.NewReader(signed), lookup); err != nil {
+			t.Errorf("Expected %v signature to be valid, got: %v", algo, err)
+		}
+	}
+}
+
+func TestSignature_relaxed(t *testing.T) {
+	signed, lookup := sign(t, dkim.Ed25519, testMessage)
+
+	// Changes allowed by the relaxed canonicalization
+	replacer := strings.NewReplacer(
+		"Subject: Is dinner ready?", "subject:\tIs dinner\r\n   ready?  ",
+		"We lost the game.  Are", "We lost   the game. Are",
+		"Joe.\r\n", "Joe.  \r\n\r\n\r\n",
+	)
+	modified := replacer.Replace(signed)
+
+	if _, err := dkim.Verify(strings.NewReader(modified), lookup); err != nil {
+		t.Error("Expected modified message to be valid, got:", err)
+	}
+}
+
+func TestSignature_tampered(t *testing.T) {
+	signed, lookup := sign(t, dkim.RSA, testMessage)
+
+	tests := map[string]string{
+		"body": strings.Replace(signed, "hungry", "thirsty", 1),
+		"header": strings.Replace(signed, "Is dinner ready?", "Is lunch ready?", 1),
+		"added header": strings.Replace(signed, "X-Unsigned", "Subject: Spam\r\nX-Unsigned", 1),
+	}
+	for name, msg := range tests {
+		if _, err := dkim.Verify(strings.NewReader(msg), lookup); err == nil {
+			t.Errorf("Expected message with tampered %v to be invalid", name)
+		}
+	}
+
+	// Unsigned fields can be changed
+	msg := strings.Replace(signed, "X-Unsigned: hello", "X-Unsigned: world", 1)
+	if _, err := dkim.Verify(strings.NewReader(msg), lookup); err != nil {
+		t.Error("Expected message with modified unsigned field to be valid, got:", err)
+	}
+}
+
+func TestSignature_wrongKey(t *testing.T) {
+	signed, _ := sign(t, dkim.Ed25519, testMessage)
+	_, lookup := sign(t, dkim.Ed25519, testMessage)
+
+	if _, err := dkim.Verify(strings.NewReader(signed), lookup); err == nil {
+		t.Error("Expected message signed with another key to be invalid")
+	}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	for _, algo := range []string{dkim.RSA, dkim.Ed25519} {
+		signer, err := dkim.GenerateKey(algo)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := dkim.MarshalPrivateKey(signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parsed, err := dkim.ParsePrivateKey(s)
+		if err != nil {
+			t.Fatalf("Cannot parse %v key: %v", algo, err)
+		}
+
+		pub := parsed.Public().(interface{ Equal(crypto.PublicKey) bool })
+		if !pub.Equal(signer.Public()) {
+			t.Errorf("Parsed %v key doesn't match generated key", algo)
+		}
+	}
+}
+
+func TestSignOutgoingMessage(t *testing.T) {
+	signer, err := dkim.GenerateKey(dkim.Ed25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := dkim.MarshalPrivateKey(signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := dkim.FormatRecord(signer.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := memory.NewDomains().(backend.DkimBackend)
+	if err := keys.UpdateDkimKey("example.org", &backend.DkimKey{Selector: "neutron", PrivateKey: priv}); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := dkim.SignOutgoingMessage(keys, &backend.OutgoingMessage{
+		Message: &backend.Message{
+			Subject: "Hello",
+			Sender: &backend.Email{Address: "alice@example.org"},
+			ToList: []*backend.Email{{Address: "bob@example.com"}},
+		},
+		MessagePackage: &backend.MessagePackage{Body: "Hi Bob!"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	r, err := m.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lookup := lookupRecord("neutron._domainkey.example.org", record)
+	domains, err := dkim.Verify(strings.NewReader(string(b)), lookup)
+	if err != nil {
+		t.Fatal("Expected outgoing message to be signed, got:", err)
+	}
+	if len(domains) != 1 || domains[0] != "example.org" {
+		t.Error("Invalid signing domains:", domains)
+	}
+}
+
+func TestCreateKey(t *testing.T) {
+	keys := memory.NewDomains().(backend.DkimBackend)
+
+	key, err := dkim.CreateKey(keys, "example.org", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key.Selector, "neutron") {
+		t.Errorf("CreateKey() selector = %q, want a default selector", key.Selector)
+	}
+	if signer, err := dkim.ParsePrivateKey(key.PrivateKey); err != nil {
+		t.Error("ParsePrivateKey() of a created key =", err)
+	} else if _, ok := signer.Public().(*rsa.PublicKey); !ok {
+		t.Errorf("CreateKey() generated a %T key, want RSA by default", signer.Public())
+	}
+
+	saved, err := keys.GetDkimKey("example.org")
+	if err != nil || saved == nil || saved.PrivateKey != key.PrivateKey {
+		t.Errorf("GetDkimKey() = %+v, %v, want the created key", saved, err)
+	}
+
+	if _, err := dkim.CreateKey(keys, "example.org", "dsa", "s"); err == nil {
+		t.Error("CreateKey() with an unsupported algorithm succeeded")
+	}
+}
@@ -0,0 +1,166 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"time"
+
+	"github.com/emersion/neutron/backend"
+)
+
+// Key algorithms, as used in the k= tag of key records.
+const (
+	RSA = "rsa"
+	Ed25519 = "ed25519"
+)
+
+// Size of generated RSA keys, in bits.
+const rsaKeySize = 2048
+
+// Generate a new private key. algo is either RSA or Ed25519.
+func GenerateKey(algo string) (crypto.Signer, error) {
+	switch algo {
+	case RSA:
+		return rsa.GenerateKey(rand.Reader, rsaKeySize)
+	case Ed25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	}
+	return nil, errors.New("Unsupported DKIM key algorithm: " + algo)
+}
+
+// Generate a new key for a domain and save it, replacing the previous one. If
+// algo is empty, an RSA key is generated. If selector is empty, one is derived
+// from the current date: keys are rotated by publishing the new one with a
+// different selector.
+func CreateKey(keys backend.DkimBackend, domain, algo, selector string) (*backend.DkimKey, error) {
+	if algo == "" {
+		algo = RSA
+	}
+	if selector == "" {
+		selector = "neutron" + time.Now().Format("20060102")
+	}
+
+	signer, err := GenerateKey(algo)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := MarshalPrivateKey(signer)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &backend.DkimKey{
+		Selector: selector,
+		PrivateKey: priv,
+	}
+	if err := keys.UpdateDkimKey(domain, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Encode a private key in PEM format.
+func MarshalPrivateKey(key crypto.Signer) (string, error) {
+	b, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b})), nil
+}
+
+// Decode a PEM-encoded private key. Both PKCS#8 and PKCS#1 keys are accepted.
+func ParsePrivateKey(s string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("Invalid DKIM key: no PEM block found")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if signer, ok := key.(crypto.Signer); ok {
+			if _, err := getAlgorithm(signer); err == nil {
+				return signer, nil
+			}
+		}
+	}
+	return nil, errors.New("Unsupported DKIM key type")
+}
+
+// Format the key record to publish in a TXT record at
+// SELECTOR._domainkey.DOMAIN.
+func FormatRecord(pub crypto.PublicKey) (string, error) {
+	var algo string
+	var b []byte
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		algo = RSA
+		var err error
+		if b, err = x509.MarshalPKIXPublicKey(pub); err != nil {
+			return "", err
+		}
+	case ed25519.PublicKey:
+		// Ed25519 keys are published raw (RFC 8463 section 4.2)
+		algo = Ed25519
+		b = pub
+	default:
+		return "", errors.New("Unsupported DKIM key type")
+	}
+
+	return "v=DKIM1; k=" + algo + "; p=" + base64.StdEncoding.EncodeToString(b), nil
+}
+
+// Get the name of the TXT record containing a key.
+func RecordName(domain, selector string) string {
+	return selector + "._domainkey." + domain
+}
+
+// Parse a key record, e.g. one formatted with FormatRecord.
+func ParseRecord(s string) (crypto.PublicKey, error) {
+	tags := parseTags(s)
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, errors.New("Unsupported DKIM key record version")
+	}
+
+	p := tags["p"]
+	if p == "" {
+		return nil, errors.New("DKIM key has been revoked")
+	}
+	b, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, err
+	}
+
+	switch algo := tags["k"]; algo {
+	case "", RSA:
+		pub, err := x509.ParsePKIXPublicKey(b)
+		if err != nil {
+			// Some records contain a PKCS#1 public key
+			return x509.ParsePKCS1PublicKey(b)
+		}
+		if pub, ok := pub.(*rsa.PublicKey); ok {
+			return pub, nil
+		}
+		return nil, errors.New("DKIM key record doesn't contain an RSA key")
+	case Ed25519:
+		if len(b) != ed25519.PublicKeySize {
+			return nil, errors.New("Invalid Ed25519 DKIM key")
+		}
+		return ed25519.PublicKey(b), nil
+	default:
+		return nil, errors.New("Unsupported DKIM key algorithm: " + algo)
+	}
+}
@@ -0,0 +1,90 @@
+package dkim
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util/textproto"
+)
+
+// A formatted and signed outgoing message. It's stored in a temporary file, so
+// that it can be read several times.
+type Message struct {
+	f *os.File
+	signature string
+}
+
+// Get a reader for the message. Readers previously returned must not be used
+// anymore.
+func (m *Message) Reader() (io.Reader, error) {
+	if _, err := m.f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.MultiReader(strings.NewReader(m.signature), m.f), nil
+}
+
+// Delete the message.
+func (m *Message) Close() error {
+	m.f.Close()
+	return os.Remove(m.f.Name())
+}
+
+// Get the DKIM key of an address' domain. Returns nil if there is none.
+func getKey(keys backend.DkimBackend, addr string) (domain string, key *backend.DkimKey, err error) {
+	i := strings.LastIndexByte(addr, '@')
+	if keys == nil || i < 0 {
+		return
+	}
+
+	domain = strings.ToLower(addr[i+1:])
+	key, err = keys.GetDkimKey(domain)
+	return
+}
+
+// Format an outgoing message and sign it with the DKIM key of its sender's
+// domain. If keys is nil or if the domain has no key, the message isn't signed.
+func SignOutgoingMessage(keys backend.DkimBackend, msg *backend.OutgoingMessage) (*Message, error) {
+	domain, key, err := getKey(keys, msg.Sender.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := ioutil.TempFile("", "neutron-dkim-")
+	if err != nil {
+		return nil, err
+	}
+	m := &Message{f: f}
+
+	if err := textproto.WriteOutgoingMessage(f, msg); err != nil {
+		m.Close()
+		return nil, err
+	}
+
+	if key != nil {
+		signer, err := ParsePrivateKey(key.PrivateKey)
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			m.Close()
+			return nil, err
+		}
+
+		m.signature, err = Signature(f, &SignOptions{
+			Domain: domain,
+			Selector: key.Selector,
+			Signer: signer,
+		})
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
@@ -0,0 +1,106 @@
+package dkim
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Header fields signed by default.
+var defaultHeaderKeys = []string{
+	"From",
+	"Reply-To",
+	"Subject",
+	"Date",
+	"To",
+	"Cc",
+	"Message-Id",
+	"In-Reply-To",
+	"References",
+	"Mime-Version",
+	"Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+type SignOptions struct {
+	// The signing domain and the selector of the key.
+	Domain string
+	Selector string
+	// The private key, either RSA or Ed25519.
+	Signer crypto.Signer
+
+	// Header fields to sign. Defaults to a list of common fields.
+	HeaderKeys []string
+	// The signature time. Defaults to now.
+	Time time.Time
+}
+
+// Get the a= tag value for a key.
+func getAlgorithm(signer crypto.Signer) (string, error) {
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		return "rsa-sha256", nil
+	case ed25519.PublicKey:
+		return "ed25519-sha256", nil
+	}
+	return "", errors.New("Unsupported DKIM key type")
+}
+
+// Compute the DKIM-Signature header field of a message. The message must use
+// CRLF line endings. The returned field, which ends with CRLF, must be
+// prepended to the message.
+func Signature(r io.Reader, options *SignOptions) (string, error) {
+	algo, err := getAlgorithm(options.Signer)
+	if err != nil {
+		return "", err
+	}
+
+	keys := options.HeaderKeys
+	if len(keys) == 0 {
+		keys = defaultHeaderKeys
+	}
+	t := options.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	br := bufio.NewReader(r)
+	fields, err := readHeader(br)
+	if err != nil {
+		return "", err
+	}
+	bodyHash, err := hashBody(br)
+	if err != nil {
+		return "", err
+	}
+
+	fields, keys = selectFields(fields, keys)
+
+	sig := signatureField + ": v=1; a=" + algo + "; c=relaxed/relaxed;" + crlf +
+		" d=" + options.Domain + "; s=" + options.Selector + "; t=" + strconv.FormatInt(t.Unix(), 10) + ";" + crlf +
+		" h=" + strings.Join(keys, ":") + ";" + crlf +
+		" bh=" + base64.StdEncoding.EncodeToString(bodyHash) + ";" + crlf +
+		" b="
+
+	// Ed25519 signs the hash itself (RFC 8463 section 3)
+	hashed := hashHeader(fields, sig)
+	var opts crypto.SignerOpts = crypto.SHA256
+	if algo == "ed25519-sha256" {
+		opts = crypto.Hash(0)
+	}
+
+	b, err := options.Signer.Sign(rand.Reader, hashed, opts)
+	if err != nil {
+		return "", err
+	}
+
+	return sig + base64.StdEncoding.EncodeToString(b) + crlf, nil
+}
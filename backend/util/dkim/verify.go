@@ -0,0 +1,126 @@
+package dkim
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Matches the b= tag value of a DKIM-Signature field.
+var signatureValueRegexp = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+
+// Looks up TXT records, e.g. net.LookupTXT.
+type LookupTXT func(name string) ([]string, error)
+
+// Verify a DKIM-Signature field. The body hash must have already been computed.
+func verifySignature(field string, fields []string, bodyHash []byte, lookup LookupTXT) (domain string, err error) {
+	tags := parseTags(field[strings.IndexByte(field, ':')+1:])
+	domain = tags["d"]
+
+	if tags["v"] != "1" {
+		return domain, errors.New("Unsupported DKIM signature version")
+	}
+	if c := tags["c"]; c != "relaxed/relaxed" && c != "relaxed" {
+		return domain, errors.New("Unsupported DKIM canonicalization: " + c)
+	}
+	if _, ok := tags["l"]; ok {
+		return domain, errors.New("DKIM body length limits are not supported")
+	}
+	if domain == "" || tags["s"] == "" || tags["h"] == "" {
+		return domain, errors.New("Malformed DKIM signature")
+	}
+
+	bh, err := base64.StdEncoding.DecodeString(tags["bh"])
+	if err != nil {
+		return
+	}
+	if !bytes.Equal(bh, bodyHash) {
+		return domain, errors.New("DKIM body hash doesn't match")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return
+	}
+
+	txts, err := lookup(RecordName(domain, tags["s"]))
+	if err != nil {
+		return
+	}
+	if len(txts) == 0 {
+		return domain, errors.New("No DKIM key found")
+	}
+	pub, err := ParseRecord(strings.Join(txts, ""))
+	if err != nil {
+		return
+	}
+
+	keys := strings.Split(tags["h"], ":")
+	for i, k := range keys {
+		keys[i] = strings.TrimSpace(k)
+	}
+	selected, _ := selectFields(fields, keys)
+
+	// The signature field is hashed with an empty b= tag
+	i := strings.IndexByte(field, ':')
+	unsigned := field[:i+1] + signatureValueRegexp.ReplaceAllString(field[i+1:], "$1$2")
+	hashed := hashHeader(selected, unsigned)
+
+	switch tags["a"] {
+	case "rsa-sha256":
+		if pub, ok := pub.(*rsa.PublicKey); ok {
+			err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed, sig)
+			return
+		}
+	case "ed25519-sha256":
+		if pub, ok := pub.(ed25519.PublicKey); ok {
+			if !ed25519.Verify(pub, hashed, sig) {
+				err = errors.New("Invalid DKIM signature")
+			}
+			return
+		}
+	default:
+		return domain, errors.New("Unsupported DKIM algorithm: " + tags["a"])
+	}
+	return domain, errors.New("DKIM key doesn't match signature algorithm")
+}
+
+// Verify DKIM signatures of a message. Returns domains of valid signatures. If
+// no signature is valid, an error is returned.
+func Verify(r io.Reader, lookup LookupTXT) (domains []string, err error) {
+	br := bufio.NewReader(r)
+	fields, err := readHeader(br)
+	if err != nil {
+		return
+	}
+	bodyHash, err := hashBody(br)
+	if err != nil {
+		return
+	}
+
+	err = errors.New("Message isn't signed with DKIM")
+	for _, field := range fields {
+		if !strings.EqualFold(getFieldKey(field), signatureField) {
+			continue
+		}
+
+		domain, verifyErr := verifySignature(strings.TrimRight(field, crlf), fields, bodyHash, lookup)
+		if verifyErr != nil {
+			err = verifyErr
+			continue
+		}
+		domains = append(domains, domain)
+	}
+
+	if len(domains) > 0 {
+		err = nil
+	}
+	return
+}
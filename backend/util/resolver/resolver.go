@@ -0,0 +1,198 @@
+// Performs DNS lookups, including DNSSEC-validated ones.
+package resolver
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// A TLSA record, as defined in RFC 6698.
+type TLSA struct {
+	Usage uint8
+	Selector uint8
+	MatchingType uint8
+	// Hex-encoded certificate association data
+	Certificate string
+}
+
+// Performs DNS lookups.
+type Resolver interface {
+	// Get the MX records of a domain, sorted by preference. secure is true if
+	// records have been validated with DNSSEC.
+	LookupMX(domain string) (mxs []*net.MX, secure bool, err error)
+	// Get the TXT records of a name.
+	LookupTXT(name string) ([]string, error)
+	// Get the TLSA records of a name. Records MUST be returned only if they
+	// have been validated with DNSSEC.
+	LookupTLSA(name string) ([]*TLSA, error)
+	// Get the IPv4 and IPv6 addresses of a host.
+	LookupIP(host string) ([]net.IP, error)
+}
+
+// Returned by a Resolver when a name doesn't exist or has no record of the
+// requested type.
+var ErrNoRecord = errors.New("No such DNS record")
+
+// A Resolver sending queries to a DNS server. Answers are trusted to be
+// validated with DNSSEC if the server sets the AD bit, so the server should
+// be a local validating resolver.
+type dnsResolver struct {
+	servers []string
+	client *dns.Client
+	tcpClient *dns.Client
+}
+
+func (r *dnsResolver) query(name string, qtype uint16) ([]dns.RR, bool, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	msg.SetEdns0(4096, true)
+	msg.AuthenticatedData = true
+
+	var err error
+	for _, server := range r.servers {
+		var res *dns.Msg
+		res, _, err = r.client.Exchange(msg, server)
+		if err == nil && res.Truncated {
+			res, _, err = r.tcpClient.Exchange(msg, server)
+		}
+		if err != nil {
+			continue
+		}
+
+		switch res.Rcode {
+		case dns.RcodeSuccess:
+		case dns.RcodeNameError:
+			return nil, false, ErrNoRecord
+		default:
+			err = errors.New("DNS query for " + name + " failed: " + dns.RcodeToString[res.Rcode])
+			continue
+		}
+
+		var answers []dns.RR
+		for _, rr := range res.Answer {
+			if rr.Header().Rrtype == qtype {
+				answers = append(answers, rr)
+			}
+		}
+		if len(answers) == 0 {
+			return nil, false, ErrNoRecord
+		}
+		return answers, res.AuthenticatedData, nil
+	}
+	return nil, false, err
+}
+
+func (r *dnsResolver) LookupMX(domain string) ([]*net.MX, bool, error) {
+	answers, secure, err := r.query(domain, dns.TypeMX)
+	if err != nil {
+		return nil, false, err
+	}
+
+	mxs := make([]*net.MX, len(answers))
+	for i, rr := range answers {
+		mx := rr.(*dns.MX)
+		mxs[i] = &net.MX{Host: mx.Mx, Pref: mx.Preference}
+	}
+
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Pref < mxs[j].Pref
+	})
+	return mxs, secure, nil
+}
+
+func (r *dnsResolver) LookupTXT(name string) ([]string, error) {
+	answers, _, err := r.query(name, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+
+	txts := make([]string, len(answers))
+	for i, rr := range answers {
+		// Long records are split in several strings
+		txts[i] = strings.Join(rr.(*dns.TXT).Txt, "")
+	}
+	return txts, nil
+}
+
+func (r *dnsResolver) LookupTLSA(name string) ([]*TLSA, error) {
+	answers, secure, err := r.query(name, dns.TypeTLSA)
+	if err != nil {
+		return nil, err
+	}
+	if !secure {
+		return nil, ErrNoRecord
+	}
+
+	records := make([]*TLSA, len(answers))
+	for i, rr := range answers {
+		tlsa := rr.(*dns.TLSA)
+		records[i] = &TLSA{
+			Usage: tlsa.Usage,
+			Selector: tlsa.Selector,
+			MatchingType: tlsa.MatchingType,
+			Certificate: tlsa.Certificate,
+		}
+	}
+	return records, nil
+}
+
+func (r *dnsResolver) LookupIP(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	var ips []net.IP
+	var err error
+	for _, qtype := range []uint16{dns.TypeAAAA, dns.TypeA} {
+		var answers []dns.RR
+		answers, _, err = r.query(host, qtype)
+		if err == ErrNoRecord {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		for _, rr := range answers {
+			switch rr := rr.(type) {
+			case *dns.A:
+				ips = append(ips, rr.A)
+			case *dns.AAAA:
+				ips = append(ips, rr.AAAA)
+			}
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, ErrNoRecord
+	}
+	return ips, nil
+}
+
+// Create a Resolver querying a DNS server. If server is empty, servers listed
+// in /etc/resolv.conf are used.
+func New(server string) Resolver {
+	var servers []string
+	if server != "" {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		servers = []string{server}
+	} else if conf, err := dns.ClientConfigFromFile("/etc/resolv.conf"); err == nil {
+		for _, s := range conf.Servers {
+			servers = append(servers, net.JoinHostPort(s, conf.Port))
+		}
+	} else {
+		servers = []string{"127.0.0.1:53"}
+	}
+
+	return &dnsResolver{
+		servers: servers,
+		client: &dns.Client{Timeout: 10 * time.Second},
+		tcpClient: &dns.Client{Net: "tcp", Timeout: 10 * time.Second},
+	}
+}
@@ -0,0 +1,125 @@
+// Implements SASL client mechanisms used to authenticate to IMAP and SMTP
+// servers.
+package sasl
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// Supported mechanisms.
+const (
+	Plain = "PLAIN"
+	Login = "LOGIN"
+	CramMd5 = "CRAM-MD5"
+	// OAuth 2.0 bearer tokens, as implemented by Gmail and Outlook.
+	Xoauth2 = "XOAUTH2"
+)
+
+// A SASL client. It's compatible with go-sasl's Client, which is used by
+// go-imap.
+type Client interface {
+	// Begin authentication. Returns the mechanism name and an optional initial
+	// response.
+	Start() (mech string, ir []byte, err error)
+	// Respond to a server challenge.
+	Next(challenge []byte) (response []byte, err error)
+}
+
+type plainClient struct {
+	identity, username, password string
+}
+
+func (c *plainClient) Start() (string, []byte, error) {
+	ir := c.identity + "\x00" + c.username + "\x00" + c.password
+	return Plain, []byte(ir), nil
+}
+
+func (c *plainClient) Next(challenge []byte) ([]byte, error) {
+	return nil, errors.New("Unexpected server challenge")
+}
+
+type loginClient struct {
+	username, password string
+}
+
+func (c *loginClient) Start() (string, []byte, error) {
+	return Login, nil, nil
+}
+
+func (c *loginClient) Next(challenge []byte) ([]byte, error) {
+	// Servers usually send "Username:" and "Password:" prompts, but some send
+	// something else
+	switch strings.ToLower(strings.TrimSpace(string(challenge))) {
+	case "username:", "user name", "username":
+		return []byte(c.username), nil
+	case "password:", "password":
+		return []byte(c.password), nil
+	}
+
+	// Answer the first prompt with the username, the next one with the
+	// password
+	if c.username != "" {
+		username := c.username
+		c.username = ""
+		return []byte(username), nil
+	}
+	return []byte(c.password), nil
+}
+
+type cramMd5Client struct {
+	username, password string
+}
+
+func (c *cramMd5Client) Start() (string, []byte, error) {
+	return CramMd5, nil, nil
+}
+
+func (c *cramMd5Client) Next(challenge []byte) ([]byte, error) {
+	mac := hmac.New(md5.New, []byte(c.password))
+	mac.Write(challenge)
+	return []byte(c.username + " " + hex.EncodeToString(mac.Sum(nil))), nil
+}
+
+type xoauth2Client struct {
+	username, token string
+}
+
+func (c *xoauth2Client) Start() (string, []byte, error) {
+	ir := "user=" + c.username + "\x01auth=Bearer " + c.token + "\x01\x01"
+	return Xoauth2, []byte(ir), nil
+}
+
+func (c *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	// The server sent a JSON error, an empty response is expected before it
+	// fails
+	return []byte{}, nil
+}
+
+// Create a new SASL client. If mech is empty, PLAIN is used. identity is the
+// optional authorization identity, only supported by PLAIN. With XOAUTH2, the
+// password is a bearer token.
+func NewClient(mech, identity, username, password string) (Client, error) {
+	switch strings.ToUpper(mech) {
+	case "", Plain:
+		return &plainClient{identity, username, password}, nil
+	}
+
+	if identity != "" {
+		return nil, errors.New("SASL mechanism " + mech + " doesn't support authorization identities")
+	}
+
+	switch strings.ToUpper(mech) {
+	case Login:
+		return &loginClient{username, password}, nil
+	case CramMd5:
+		return &cramMd5Client{username, password}, nil
+	case Xoauth2:
+		return &xoauth2Client{username, password}, nil
+	default:
+		return nil, errors.New("Unsupported SASL mechanism: " + mech)
+	}
+}
@@ -0,0 +1,70 @@
+package sasl_test
+
+import (
+	"testing"
+
+	"github.com/emersion/neutron/backend/util/sasl"
+)
+
+func TestCramMd5(t *testing.T) {
+	// Example from RFC 2195 section 2
+	c, err := sasl.NewClient(sasl.CramMd5, "", "tim", "tanstaaftanstaaf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mech, ir, err := c.Start(); err != nil || mech != sasl.CramMd5 || ir != nil {
+		t.Fatalf("Invalid start: %v %q %v", mech, ir, err)
+	}
+
+	resp, err := c.Next([]byte("<1896.697170952@postoffice.reston.mci.net>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "tim b913a602c7eda7a495b4e6e7334d3890"; string(resp) != expected {
+		t.Errorf("Invalid response: expected %q, got %q", expected, resp)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	c, err := sasl.NewClient(sasl.Login, "", "tim", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start()
+
+	for _, challenge := range []string{"Username:", "Password:"} {
+		resp, err := c.Next([]byte(challenge))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if challenge == "Username:" && string(resp) != "tim" || challenge == "Password:" && string(resp) != "secret" {
+			t.Errorf("Invalid response to %q: %q", challenge, resp)
+		}
+	}
+}
+
+func TestXoauth2(t *testing.T) {
+	c, err := sasl.NewClient(sasl.Xoauth2, "", "someuser@example.com", "ya29.vF9dft4qmTc2Nvb3RlckBhdHRhdmlzdGEuY29tCg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mech, ir, err := c.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "user=someuser@example.com\x01auth=Bearer ya29.vF9dft4qmTc2Nvb3RlckBhdHRhdmlzdGEuY29tCg\x01\x01"
+	if mech != sasl.Xoauth2 || string(ir) != expected {
+		t.Errorf("Invalid initial response: %v %q", mech, ir)
+	}
+}
+
+func TestNewClient_unsupported(t *testing.T) {
+	if _, err := sasl.NewClient("DIGEST-MD5", "", "tim", "secret"); err == nil {
+		t.Error("Expected unsupported mechanism to fail")
+	}
+	if _, err := sasl.NewClient(sasl.Login, "admin", "tim", "secret"); err == nil {
+		t.Error("Expected LOGIN with an authorization identity to fail")
+	}
+}
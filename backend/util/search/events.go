@@ -0,0 +1,58 @@
+package search
+
+import (
+	"log"
+
+	"github.com/emersion/neutron/backend"
+)
+
+// Log an error updating an index. The operation that changed messages has
+// succeeded, only searches can return stale results.
+func logIndexError(err error) {
+	if err != nil {
+		log.Println("WARN: cannot update search index:", err)
+	}
+}
+
+// An EventsBackend that updates an index when message events are inserted.
+// This catches messages changed by other backends, e.g. a SendBackend
+// delivering a message to a local mailbox.
+type Events struct {
+	backend.EventsBackend
+	index *Index
+}
+
+func (b *Events) InsertEvent(user string, event *backend.Event) error {
+	for _, delta := range event.Messages {
+		switch delta.Action {
+		case backend.EventDelete:
+			logIndexError(b.index.Remove(user, delta.ID))
+		case backend.EventCreate, backend.EventUpdate:
+			if delta.Message != nil {
+				logIndexError(b.index.Add(user, delta.Message))
+			}
+		}
+	}
+
+	return b.EventsBackend.InsertEvent(user, event)
+}
+
+func NewEvents(bkd backend.EventsBackend, index *Index) backend.EventsBackend {
+	return &Events{
+		EventsBackend: bkd,
+		index: index,
+	}
+}
+
+// Update an index with events inserted in a backend. This must be called
+// before setting up backends which insert message events by themselves, e.g.
+// the IMAP backend when new messages arrive.
+func UseEvents(bkd *backend.Backend, index *Index) {
+	bkd.Set(NewEvents(bkd.EventsBackend, index))
+}
+
+// Put an index in front of a backend's messages. See NewMessages for
+// defaultLabel.
+func Use(bkd *backend.Backend, index *Index, defaultLabel string) {
+	bkd.Set(NewConversations(bkd.ConversationsBackend, index, defaultLabel))
+}
@@ -0,0 +1,526 @@
+// Provides a local full-text index for messages.
+package search
+
+import (
+	"bytes"
+	"encoding/json"
+	"html"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/emersion/neutron/backend"
+)
+
+// Minimum length of an indexed term, in runes.
+const minTermLength = 2
+
+// Maximum number of changes in a journal. Past this length, the whole index is
+// saved and the journal is cleared.
+const maxJournalLength = 1000
+
+type Config struct {
+	Directory string
+}
+
+// An indexed message.
+type document struct {
+	ID string
+	ConversationID string
+	Time int64
+	LabelIDs []string
+	Terms []string
+}
+
+func (doc *document) hasLabel(label string) bool {
+	if label == "" {
+		return true
+	}
+
+	for _, lbl := range doc.LabelIDs {
+		if lbl == label {
+			return true
+		}
+	}
+	return false
+}
+
+// A change to an index, appended to its journal.
+type change struct {
+	Add *document `json:",omitempty"`
+	Remove string `json:",omitempty"`
+}
+
+// A user's index. Terms maps each term to the IDs of the documents containing
+// it.
+type userIndex struct {
+	Documents map[string]*document
+	Terms map[string]map[string]bool
+
+	// Number of changes in the journal
+	journaled int
+	// Labels which have been synchronized
+	synced map[string]bool
+}
+
+func newUserIndex() *userIndex {
+	return &userIndex{
+		Documents: map[string]*document{},
+		Terms: map[string]map[string]bool{},
+		synced: map[string]bool{},
+	}
+}
+
+func (idx *userIndex) apply(c *change) {
+	if c.Add != nil {
+		idx.add(c.Add)
+	} else if c.Remove != "" {
+		idx.remove(c.Remove)
+	}
+}
+
+func (idx *userIndex) add(doc *document) {
+	idx.remove(doc.ID)
+
+	idx.Documents[doc.ID] = doc
+	for _, term := range doc.Terms {
+		ids, ok := idx.Terms[term]
+		if !ok {
+			ids = map[string]bool{}
+			idx.Terms[term] = ids
+		}
+		ids[doc.ID] = true
+	}
+}
+
+func (idx *userIndex) remove(id string) bool {
+	doc, ok := idx.Documents[id]
+	if !ok {
+		return false
+	}
+
+	for _, term := range doc.Terms {
+		ids := idx.Terms[term]
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(idx.Terms, term)
+		}
+	}
+
+	delete(idx.Documents, id)
+	return true
+}
+
+// Get IDs of documents containing a term, or a term starting with it.
+func (idx *userIndex) lookup(prefix string) map[string]bool {
+	matches := map[string]bool{}
+	for term, ids := range idx.Terms {
+		if !strings.HasPrefix(term, prefix) {
+			continue
+		}
+
+		for id := range ids {
+			matches[id] = true
+		}
+	}
+	return matches
+}
+
+// Get documents matching all terms of a query. Terms too short to be indexed
+// are ignored, if there are no other terms all documents are returned.
+func (idx *userIndex) search(query string) []*document {
+	terms := tokenize(query)
+	if len(terms) == 0 {
+		docs := make([]*document, 0, len(idx.Documents))
+		for _, doc := range idx.Documents {
+			docs = append(docs, doc)
+		}
+		return docs
+	}
+
+	var matches map[string]bool
+	for _, term := range terms {
+		ids := idx.lookup(term)
+
+		if matches == nil {
+			matches = ids
+			continue
+		}
+
+		for id := range matches {
+			if !ids[id] {
+				delete(matches, id)
+			}
+		}
+	}
+
+	docs := make([]*document, 0, len(matches))
+	for id := range matches {
+		docs = append(docs, idx.Documents[id])
+	}
+	return docs
+}
+
+func splitTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// Split a text into lower-case terms.
+func tokenize(text string) []string {
+	fields := splitTerms(text)
+
+	terms := make([]string, 0, len(fields))
+	for _, f := range fields {
+		if len([]rune(f)) >= minTermLength {
+			terms = append(terms, f)
+		}
+	}
+	return terms
+}
+
+// Get terms of a text which are too short to be indexed.
+func shortTerms(text string) []string {
+	var terms []string
+	for _, f := range splitTerms(text) {
+		if len([]rune(f)) < minTermLength {
+			terms = append(terms, f)
+		}
+	}
+	return terms
+}
+
+// Remove HTML tags from a message body.
+func stripTags(s string) string {
+	var b bytes.Buffer
+	inTag := false
+	for _, r := range s {
+		switch {
+		case r == '<':
+			inTag = true
+		case r == '>' && inTag:
+			inTag = false
+			b.WriteRune(' ')
+		case !inTag:
+			b.WriteRune(r)
+		}
+	}
+	return html.UnescapeString(b.String())
+}
+
+func appendEmailTerms(terms []string, email *backend.Email) []string {
+	if email == nil {
+		return terms
+	}
+	terms = append(terms, tokenize(email.Name)...)
+	return append(terms, tokenize(email.Address)...)
+}
+
+// Build a document from a message. Bodies of encrypted messages are not
+// indexed.
+func newDocument(msg *backend.Message) *document {
+	terms := tokenize(msg.Subject)
+
+	terms = appendEmailTerms(terms, msg.Sender)
+	for _, list := range [][]*backend.Email{msg.ToList, msg.CCList, msg.BCCList} {
+		for _, email := range list {
+			terms = appendEmailTerms(terms, email)
+		}
+	}
+
+	if msg.Body != "" && !backend.IsEncrypted(msg.Body) {
+		terms = append(terms, tokenize(stripTags(msg.Body))...)
+	}
+
+	// Remove duplicates
+	sort.Strings(terms)
+	unique := terms[:0]
+	for i, term := range terms {
+		if i == 0 || term != terms[i-1] {
+			unique = append(unique, term)
+		}
+	}
+
+	return &document{
+		ID: msg.ID,
+		ConversationID: msg.ConversationID,
+		Time: msg.Time,
+		LabelIDs: msg.LabelIDs,
+		Terms: unique,
+	}
+}
+
+// A full-text index of messages. Each user's index is stored in its own file,
+// changes since it has been saved are appended to a journal.
+type Index struct {
+	config *Config
+
+	lock sync.Mutex
+	users map[string]*userIndex
+}
+
+func (idx *Index) getUserPath(user string) string {
+	return idx.config.Directory + "/" + user + ".json"
+}
+
+func (idx *Index) getJournalPath(user string) string {
+	return idx.config.Directory + "/" + user + ".log"
+}
+
+// Replay a user's journal. A change which has only been partially written is
+// ignored, the message will be indexed again when synchronizing.
+func (idx *Index) replay(user string, ui *userIndex) error {
+	f, err := os.Open(idx.getJournalPath(user))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	for {
+		c := &change{}
+		err := dec.Decode(c)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		ui.apply(c)
+		ui.journaled++
+	}
+}
+
+func (idx *Index) load(user string) (ui *userIndex, err error) {
+	if ui, ok := idx.users[user]; ok {
+		return ui, nil
+	}
+
+	ui = newUserIndex()
+
+	data, err := ioutil.ReadFile(idx.getUserPath(user))
+	if os.IsNotExist(err) {
+		err = nil
+	} else if err != nil {
+		return
+	} else if err = json.Unmarshal(data, ui); err != nil {
+		return
+	}
+
+	if err = idx.replay(user, ui); err != nil {
+		return
+	}
+
+	idx.users[user] = ui
+	return
+}
+
+func (idx *Index) save(user string) (err error) {
+	ui, ok := idx.users[user]
+	if !ok {
+		return
+	}
+
+	data, err := json.Marshal(ui)
+	if err != nil {
+		return
+	}
+
+	err = os.MkdirAll(idx.config.Directory, 0744)
+	if err != nil {
+		return
+	}
+
+	if err = ioutil.WriteFile(idx.getUserPath(user), data, 0644); err != nil {
+		return
+	}
+
+	// The saved index contains all changes
+	if err = os.Remove(idx.getJournalPath(user)); os.IsNotExist(err) {
+		err = nil
+	}
+	ui.journaled = 0
+	return
+}
+
+// Persist changes to a user's index. They are appended to the journal, unless
+// it's too long: in this case the whole index is saved.
+func (idx *Index) record(user string, ui *userIndex, changes []*change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	if ui.journaled+len(changes) > maxJournalLength {
+		return idx.save(user)
+	}
+
+	if err := os.MkdirAll(idx.config.Directory, 0744); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(idx.getJournalPath(user), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+	for _, c := range changes {
+		if err = enc.Encode(c); err != nil {
+			break
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	ui.journaled += len(changes)
+	return nil
+}
+
+// Add or replace messages in a user's index.
+func (idx *Index) Add(user string, msgs ...*backend.Message) error {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	ui, err := idx.load(user)
+	if err != nil {
+		return err
+	}
+
+	changes := make([]*change, len(msgs))
+	for i, msg := range msgs {
+		changes[i] = &change{Add: newDocument(msg)}
+		ui.apply(changes[i])
+	}
+
+	return idx.record(user, ui, changes)
+}
+
+// Remove messages from a user's index.
+func (idx *Index) Remove(user string, ids ...string) error {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	ui, err := idx.load(user)
+	if err != nil {
+		return err
+	}
+
+	var changes []*change
+	for _, id := range ids {
+		if ui.remove(id) {
+			changes = append(changes, &change{Remove: id})
+		}
+	}
+
+	return idx.record(user, ui, changes)
+}
+
+// Search a user's messages with a label. Results are sorted by time, most
+// recent first.
+func (idx *Index) search(user, query, label string) ([]*document, error) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	ui, err := idx.load(user)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []*document
+	for _, doc := range ui.search(query) {
+		if doc.hasLabel(label) {
+			docs = append(docs, doc)
+		}
+	}
+
+	sort.Slice(docs, func(i, j int) bool {
+		return docs[i].Time > docs[j].Time
+	})
+	return docs, nil
+}
+
+// Index messages with a label that aren't indexed yet, and forget about
+// indexed messages that don't have this label anymore. If label is empty, all
+// messages are synchronized.
+//
+// Each label is only synchronized once, the index is then kept up to date when
+// messages change.
+func (idx *Index) sync(user, label string, msgs backend.MessagesBackend) error {
+	idx.lock.Lock()
+	ui, err := idx.load(user)
+	if err != nil {
+		idx.lock.Unlock()
+		return err
+	}
+	synced := ui.synced[label]
+	idx.lock.Unlock()
+	if synced {
+		return nil
+	}
+
+	list, _, err := msgs.ListMessages(user, &backend.MessagesFilter{Label: label})
+	if err != nil {
+		return err
+	}
+
+	idx.lock.Lock()
+	listed := map[string]bool{}
+	var missing []string
+	for _, msg := range list {
+		listed[msg.ID] = true
+		if _, ok := ui.Documents[msg.ID]; !ok {
+			missing = append(missing, msg.ID)
+		}
+	}
+
+	var removed []string
+	for id, doc := range ui.Documents {
+		if !listed[id] && doc.hasLabel(label) {
+			removed = append(removed, id)
+		}
+	}
+	idx.lock.Unlock()
+
+	if err := idx.Remove(user, removed...); err != nil {
+		return err
+	}
+
+	// List results don't always include bodies, fetch whole messages
+	var fetched []*backend.Message
+	for _, id := range missing {
+		msg, err := msgs.GetMessage(user, id)
+		if err != nil {
+			return err
+		}
+		fetched = append(fetched, msg)
+	}
+
+	if err := idx.Add(user, fetched...); err != nil {
+		return err
+	}
+
+	idx.lock.Lock()
+	ui.synced[label] = true
+	idx.lock.Unlock()
+	return nil
+}
+
+// Open an index stored in a directory.
+func Open(config *Config) *Index {
+	return &Index{
+		config: config,
+		users: map[string]*userIndex{},
+	}
+}
@@ -0,0 +1,126 @@
+package search_test
+
+import (
+	"testing"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/memory"
+	"github.com/emersion/neutron/backend/util/search"
+)
+
+// A messages backend counting fetched messages.
+type countingMessages struct {
+	backend.MessagesBackend
+	gets int
+}
+
+func (b *countingMessages) GetMessage(user, id string) (*backend.Message, error) {
+	b.gets++
+	return b.MessagesBackend.GetMessage(user, id)
+}
+
+func searchMessages(t *testing.T, msgs backend.MessagesBackend, keyword string) []*backend.Message {
+	list, total, err := msgs.ListMessages("user", &backend.MessagesFilter{Keyword: keyword})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != len(list) {
+		t.Errorf("Expected total %v to be the number of results %v", total, len(list))
+	}
+	return list
+}
+
+func TestIndex(t *testing.T) {
+	dir := t.TempDir()
+
+	bkd := backend.New()
+	memory.Use(bkd)
+	msgs := &countingMessages{MessagesBackend: bkd.ConversationsBackend}
+
+	// Messages inserted before the index is used are found by synchronizing it
+	for _, subject := range []string{"Quarterly report", "Lunch"} {
+		_, err := bkd.InsertMessage("user", &backend.Message{
+			Subject: subject,
+			Body: "<p>Hello Alice</p>",
+			LabelIDs: []string{backend.InboxLabel},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	indexed := search.NewMessages(msgs, search.Open(&search.Config{Directory: dir}), "")
+	if list := searchMessages(t, indexed, "report"); len(list) != 1 || list[0].Subject != "Quarterly report" {
+		t.Errorf("Expected to find the quarterly report, got %v", list)
+	}
+	if list := searchMessages(t, indexed, "alice"); len(list) != 2 {
+		t.Errorf("Expected body terms to be indexed, got %v", list)
+	}
+	if list := searchMessages(t, indexed, "q"); len(list) != 1 || list[0].Subject != "Quarterly report" {
+		t.Errorf("Expected messages to be scanned for terms too short to be indexed, got %v", list)
+	}
+
+	// Messages inserted through the index are indexed, the label isn't
+	// synchronized again
+	annual, err := indexed.InsertMessage("user", &backend.Message{
+		Subject: "Annual report",
+		Time: 10,
+		LabelIDs: []string{backend.InboxLabel},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs.gets = 0
+	if list := searchMessages(t, indexed, "report"); len(list) != 2 || list[0].ID != annual.ID {
+		t.Errorf("Expected to find both reports, most recent first, got %v", list)
+	}
+	if msgs.gets != 2 {
+		t.Errorf("Expected only results to be fetched, got %v fetched messages", msgs.gets)
+	}
+
+	// A reopened index doesn't fetch indexed messages again
+	reopened := search.NewMessages(msgs, search.Open(&search.Config{Directory: dir}), "")
+	msgs.gets = 0
+	if list := searchMessages(t, reopened, "annual"); len(list) != 1 || list[0].ID != annual.ID {
+		t.Errorf("Expected to find the annual report in the reopened index, got %v", list)
+	}
+	if msgs.gets != 1 {
+		t.Errorf("Expected indexed messages not to be fetched again, got %v fetched messages", msgs.gets)
+	}
+
+	if err := reopened.DeleteMessage("user", annual.ID); err != nil {
+		t.Fatal(err)
+	}
+	if list := searchMessages(t, reopened, "annual"); len(list) != 0 {
+		t.Errorf("Expected deleted message not to be found, got %v", list)
+	}
+}
+
+func TestIndex_defaultLabel(t *testing.T) {
+	bkd := backend.New()
+	memory.Use(bkd)
+
+	for _, label := range []string{backend.InboxLabel, backend.ArchiveLabel} {
+		_, err := bkd.InsertMessage("user", &backend.Message{
+			Subject: "Report",
+			LabelIDs: []string{label},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Queries without a label only search messages with the default label
+	indexed := search.NewMessages(bkd.ConversationsBackend, search.Open(&search.Config{Directory: t.TempDir()}), backend.InboxLabel)
+	if list := searchMessages(t, indexed, "report"); len(list) != 1 || list[0].LabelIDs[0] != backend.InboxLabel {
+		t.Errorf("Expected to only find the message in the default label, got %v", list)
+	}
+
+	list, _, err := indexed.ListMessages("user", &backend.MessagesFilter{Label: backend.ArchiveLabel, Keyword: "report"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].LabelIDs[0] != backend.ArchiveLabel {
+		t.Errorf("Expected to find the message in the requested label, got %v", list)
+	}
+}
@@ -0,0 +1,243 @@
+package search
+
+import (
+	"strings"
+
+	"github.com/emersion/neutron/backend"
+)
+
+// A MessagesBackend that keeps an index up to date and uses it to answer
+// keyword queries.
+type Messages struct {
+	backend.MessagesBackend
+	index *Index
+	defaultLabel string
+}
+
+func hasKeywords(filter *backend.MessagesFilter) bool {
+	return filter.Keyword != "" || len(filter.Keywords) > 0
+}
+
+// Check if a filter has criteria that cannot be checked with indexed metadata.
+func hasOtherCriteria(filter *backend.MessagesFilter) bool {
+	return filter.From != "" || filter.To != "" || filter.CC != "" ||
+		filter.BCC != "" || filter.Subject != "" ||
+		filter.Address != "" || filter.Attachments || len(filter.Labels) > 0 ||
+		filter.Unread || filter.Read || filter.Starred
+}
+
+// Get indexed messages matching a filter's keywords.
+func (b *Messages) search(user string, filter *backend.MessagesFilter) ([]*document, error) {
+	label := filter.Label
+	if label == "" {
+		label = b.defaultLabel
+	}
+	if err := b.index.sync(user, label, b.MessagesBackend); err != nil {
+		return nil, err
+	}
+
+	query := strings.Join(append([]string{filter.Keyword}, filter.Keywords...), " ")
+	docs, err := b.index.search(user, query, label)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keywords have already been checked by the index, except terms too short
+	// to be indexed and words of a phrase, which must be adjacent
+	criteria := *filter
+	criteria.Label = ""
+	criteria.Keyword = ""
+	criteria.Keywords = shortTerms(query)
+	for _, keyword := range filter.Keywords {
+		if len(tokenize(keyword)) > 1 {
+			criteria.Keywords = append(criteria.Keywords, keyword)
+		}
+	}
+	fetch := hasOtherCriteria(&criteria) || len(criteria.Keywords) > 0
+
+	filtered := docs[:0]
+	for _, doc := range docs {
+		// Time constraints are applied on indexed metadata
+		if filter.Begin != 0 && doc.Time < filter.Begin {
+			continue
+		}
+		if filter.End != 0 && doc.Time >= filter.End {
+			continue
+		}
+
+		if fetch {
+			msg, err := b.MessagesBackend.GetMessage(user, doc.ID)
+			if err != nil {
+				return nil, err
+			}
+			if !criteria.Match(msg) {
+				continue
+			}
+		}
+
+		filtered = append(filtered, doc)
+	}
+
+	return filtered, nil
+}
+
+func (b *Messages) ListMessages(user string, filter *backend.MessagesFilter) ([]*backend.Message, int, error) {
+	if !hasKeywords(filter) {
+		return b.MessagesBackend.ListMessages(user, filter)
+	}
+
+	docs, err := b.search(user, filter)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	total := len(docs)
+	from, to := filter.PageBounds(total)
+
+	msgs := make([]*backend.Message, 0, to-from)
+	for _, doc := range docs[from:to] {
+		msg, err := b.MessagesBackend.GetMessage(user, doc.ID)
+		if err != nil {
+			return nil, -1, err
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, total, nil
+}
+
+func (b *Messages) InsertMessage(user string, msg *backend.Message) (*backend.Message, error) {
+	msg, err := b.MessagesBackend.InsertMessage(user, msg)
+
+	if err == nil {
+		logIndexError(b.index.Add(user, msg))
+	}
+
+	return msg, err
+}
+
+func (b *Messages) UpdateMessage(user string, update *backend.MessageUpdate) (*backend.Message, error) {
+	oldId := update.Message.ID
+
+	msg, err := b.MessagesBackend.UpdateMessage(user, update)
+
+	if err == nil {
+		// Some backends change the message ID when updating it
+		if msg.ID != oldId {
+			logIndexError(b.index.Remove(user, oldId))
+		}
+		logIndexError(b.index.Add(user, msg))
+	}
+
+	return msg, err
+}
+
+func (b *Messages) DeleteMessage(user, id string) error {
+	err := b.MessagesBackend.DeleteMessage(user, id)
+
+	if err == nil {
+		logIndexError(b.index.Remove(user, id))
+	}
+
+	return err
+}
+
+// Create a MessagesBackend using an index. Keyword queries without a label
+// search messages with defaultLabel, which can be empty to search all messages.
+func NewMessages(bkd backend.MessagesBackend, index *Index, defaultLabel string) backend.MessagesBackend {
+	return &Messages{
+		MessagesBackend: bkd,
+		index: index,
+		defaultLabel: defaultLabel,
+	}
+}
+
+// A ConversationsBackend that keeps an index up to date and uses it to answer
+// keyword queries.
+type Conversations struct {
+	backend.ConversationsBackend
+	messages *Messages
+}
+
+func (b *Conversations) ListConversations(user string, filter *backend.MessagesFilter) ([]*backend.Conversation, int, error) {
+	if !hasKeywords(filter) {
+		return b.ConversationsBackend.ListConversations(user, filter)
+	}
+
+	docs, err := b.messages.search(user, filter)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	// Documents are sorted by time, keep the most recent message of each
+	// conversation
+	var ids []string
+	found := map[string]bool{}
+	for _, doc := range docs {
+		id := doc.ConversationID
+		if id == "" {
+			id = doc.ID
+		}
+
+		if !found[id] {
+			found[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	total := len(ids)
+	from, to := filter.PageBounds(total)
+
+	convs := make([]*backend.Conversation, 0, to-from)
+	for _, id := range ids[from:to] {
+		conv, err := b.GetConversation(user, id)
+		if err != nil {
+			return nil, -1, err
+		}
+		convs = append(convs, conv)
+	}
+
+	return convs, total, nil
+}
+
+func (b *Conversations) ListMessages(user string, filter *backend.MessagesFilter) ([]*backend.Message, int, error) {
+	return b.messages.ListMessages(user, filter)
+}
+
+func (b *Conversations) InsertMessage(user string, msg *backend.Message) (*backend.Message, error) {
+	return b.messages.InsertMessage(user, msg)
+}
+
+func (b *Conversations) UpdateMessage(user string, update *backend.MessageUpdate) (*backend.Message, error) {
+	return b.messages.UpdateMessage(user, update)
+}
+
+func (b *Conversations) DeleteMessage(user, id string) error {
+	return b.messages.DeleteMessage(user, id)
+}
+
+func (b *Conversations) DeleteConversation(user, id string) error {
+	msgs, err := b.ListConversationMessages(user, id)
+	if err != nil {
+		return err
+	}
+
+	err = b.ConversationsBackend.DeleteConversation(user, id)
+
+	if err == nil {
+		ids := make([]string, len(msgs))
+		for i, msg := range msgs {
+			ids[i] = msg.ID
+		}
+		logIndexError(b.messages.index.Remove(user, ids...))
+	}
+
+	return err
+}
+
+func NewConversations(bkd backend.ConversationsBackend, index *Index, defaultLabel string) backend.ConversationsBackend {
+	return &Conversations{
+		ConversationsBackend: bkd,
+		messages: NewMessages(bkd, index, defaultLabel).(*Messages),
+	}
+}
@@ -0,0 +1,184 @@
+package search
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/emersion/neutron/backend"
+)
+
+// Date formats accepted by before: and after: operators.
+var dateLayouts = []string{"2006-01-02", "2006/01/02"}
+
+// Names of system labels, as used by label: and in: operators.
+var systemLabels = map[string]string{
+	"inbox": backend.InboxLabel,
+	"draft": backend.DraftLabel,
+	"drafts": backend.DraftLabel,
+	"sent": backend.SentLabel,
+	"scheduled": backend.ScheduledLabel,
+	"trash": backend.TrashLabel,
+	"spam": backend.SpamLabel,
+	"archive": backend.ArchiveLabel,
+	"starred": backend.StarredLabel,
+}
+
+// A query token. Key is empty for free text.
+type queryToken struct {
+	Key string
+	Value string
+}
+
+// Read a word or a quoted phrase at the beginning of s.
+func readQueryValue(s string) (value, rest string, err error) {
+	if strings.HasPrefix(s, "\"") {
+		end := strings.Index(s[1:], "\"")
+		if end < 0 {
+			return "", "", errors.New("Unterminated quoted string in search query")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	}
+
+	end := strings.IndexFunc(s, unicode.IsSpace)
+	if end < 0 {
+		end = len(s)
+	}
+	return s[:end], s[end:], nil
+}
+
+func tokenizeQuery(query string) (tokens []*queryToken, err error) {
+	s := strings.TrimSpace(query)
+	for s != "" {
+		tok := &queryToken{}
+
+		// Operators are words followed by a colon, e.g. from:alice
+		if i := strings.Index(s, ":"); i > 0 && !strings.ContainsAny(s[:i], " \t\r\n\"") {
+			tok.Key = strings.ToLower(s[:i])
+			s = s[i+1:]
+		}
+
+		tok.Value, s, err = readQueryValue(s)
+		if err != nil {
+			return
+		}
+
+		tokens = append(tokens, tok)
+		s = strings.TrimSpace(s)
+	}
+	return
+}
+
+func parseQueryDate(s string) (t time.Time, err error) {
+	for _, layout := range dateLayouts {
+		t, err = time.ParseInLocation(layout, s, time.Local)
+		if err == nil {
+			return
+		}
+	}
+
+	err = errors.New("Invalid date in search query: " + s)
+	return
+}
+
+func resolveLabel(name string, labels []*backend.Label) string {
+	if id, ok := systemLabels[strings.ToLower(name)]; ok {
+		return id
+	}
+
+	for _, lbl := range labels {
+		if strings.EqualFold(lbl.Name, name) {
+			return lbl.ID
+		}
+	}
+
+	// Unknown label, maybe the backend knows about it
+	return name
+}
+
+// Set the value of an operator which can only be used once, because filters
+// have a single value for it.
+func setOnce(field *string, key, value string) error {
+	if *field != "" {
+		return errors.New("Repeated " + key + ": operator in search query")
+	}
+	*field = value
+	return nil
+}
+
+// Parse a search query and add its criteria to a filter. Label names are
+// resolved using the provided labels.
+//
+// Supported operators are from:, to:, cc:, bcc:, subject:, label:, in:,
+// has:attachment, is:read, is:unread, is:starred, before: and after:. Other
+// words and quoted phrases must all be contained in matching messages. Labels
+// are combined, other operators with a value can only be used once. to:
+// matches all recipients, cc: and bcc: only match Cc and Bcc recipients.
+func ParseQuery(filter *backend.MessagesFilter, query string, labels []*backend.Label) error {
+	tokens, err := tokenizeQuery(query)
+	if err != nil {
+		return err
+	}
+
+	for _, tok := range tokens {
+		switch tok.Key {
+		case "from":
+			err = setOnce(&filter.From, tok.Key, tok.Value)
+		case "to":
+			err = setOnce(&filter.To, tok.Key, tok.Value)
+		case "cc":
+			err = setOnce(&filter.CC, tok.Key, tok.Value)
+		case "bcc":
+			err = setOnce(&filter.BCC, tok.Key, tok.Value)
+		case "subject":
+			err = setOnce(&filter.Subject, tok.Key, tok.Value)
+		case "label", "in":
+			filter.Labels = append(filter.Labels, resolveLabel(tok.Value, labels))
+		case "has":
+			switch strings.ToLower(tok.Value) {
+			case "attachment", "attachments":
+				filter.Attachments = true
+			default:
+				return errors.New("Unsupported has: value in search query: " + tok.Value)
+			}
+		case "is":
+			switch strings.ToLower(tok.Value) {
+			case "read":
+				filter.Read = true
+			case "unread":
+				filter.Unread = true
+			case "starred":
+				filter.Starred = true
+			default:
+				return errors.New("Unsupported is: value in search query: " + tok.Value)
+			}
+		case "before", "after":
+			t, err := parseQueryDate(tok.Value)
+			if err != nil {
+				return err
+			}
+
+			bound := &filter.Begin
+			if tok.Key == "before" {
+				bound = &filter.End
+			}
+			if *bound != 0 {
+				return errors.New("Repeated " + tok.Key + ": operator in search query")
+			}
+			*bound = t.Unix()
+		case "":
+			if tok.Value != "" {
+				filter.Keywords = append(filter.Keywords, tok.Value)
+			}
+		default:
+			// Not an operator, e.g. a URL
+			filter.Keywords = append(filter.Keywords, tok.Key+":"+tok.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package search_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util/search"
+)
+
+func TestParseQuery(t *testing.T) {
+	labels := []*backend.Label{
+		&backend.Label{ID: "work_id", Name: "Work"},
+	}
+
+	date := func(s string) int64 {
+		d, _ := time.ParseInLocation("2006-01-02", s, time.Local)
+		return d.Unix()
+	}
+
+	tests := []struct{
+		query string
+		expected *backend.MessagesFilter
+	}{
+		{
+			query: "hello world",
+			expected: &backend.MessagesFilter{Keywords: []string{"hello", "world"}},
+		},
+		{
+			query: "from:alice to:bob has:attachment label:Work",
+			expected: &backend.MessagesFilter{
+				From: "alice",
+				To: "bob",
+				Attachments: true,
+				Labels: []string{"work_id"},
+			},
+		},
+		{
+			query: "cc:carol bcc:dave",
+			expected: &backend.MessagesFilter{CC: "carol", BCC: "dave"},
+		},
+		{
+			query: "in:inbox is:unread is:starred subject:\"weekly report\"",
+			expected: &backend.MessagesFilter{
+				Labels: []string{backend.InboxLabel},
+				Unread: true,
+				Starred: true,
+				Subject: "weekly report",
+			},
+		},
+		{
+			query: "after:2025-12-01 before:2026-01-01 \"exact phrase\" http://example.org",
+			expected: &backend.MessagesFilter{
+				Begin: date("2025-12-01"),
+				End: date("2026-01-01"),
+				Keywords: []string{"exact phrase", "http://example.org"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		filter := &backend.MessagesFilter{}
+		if err := search.ParseQuery(filter, test.query, labels); err != nil {
+			t.Errorf("Cannot parse %q: %v", test.query, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(filter, test.expected) {
+			t.Errorf("Got %+v instead of %+v for %q", filter, test.expected, test.query)
+		}
+	}
+}
+
+func TestParseQuery_invalid(t *testing.T) {
+	queries := []string{
+		"before:yesterday",
+		"is:important",
+		"has:nothing",
+		"\"unterminated phrase",
+		"from:alice from:bob",
+		"cc:alice cc:bob",
+		"after:2025-12-01 after:2026-01-01",
+	}
+
+	for _, query := range queries {
+		filter := &backend.MessagesFilter{}
+		if err := search.ParseQuery(filter, query, nil); err == nil {
+			t.Errorf("Expected an error when parsing %q", query)
+		}
+	}
+}
+
+func TestParseQuery_recipients(t *testing.T) {
+	msg := &backend.Message{
+		ToList: []*backend.Email{{Address: "bob@example.org"}},
+		CCList: []*backend.Email{{Address: "carol@example.org"}},
+		BCCList: []*backend.Email{{Address: "dave@example.org"}},
+	}
+
+	tests := map[string]bool{
+		"to:bob": true,
+		"to:carol": true,
+		"cc:carol": true,
+		"cc:bob": false,
+		"bcc:dave": true,
+		"bcc:carol": false,
+	}
+
+	for query, expected := range tests {
+		filter := &backend.MessagesFilter{}
+		if err := search.ParseQuery(filter, query, nil); err != nil {
+			t.Errorf("Cannot parse %q: %v", query, err)
+			continue
+		}
+
+		if filter.Match(msg) != expected {
+			t.Errorf("Expected %q to match a message: %v", query, expected)
+		}
+	}
+}
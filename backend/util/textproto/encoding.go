@@ -7,28 +7,32 @@ import (
 	"io"
 	"log"
 
-	"golang.org/x/text/encoding"
-	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
 )
 
-func decodeCharset(r io.Reader, charset string) io.Reader {
-	var enc encoding.Encoding
+// Get a reader converting a charset to UTF-8. Charset names and aliases are
+// the ones defined by the WHATWG Encoding Standard, which covers names found in
+// the wild. It can be used as mime.WordDecoder.CharsetReader.
+func CharsetReader(charset string, input io.Reader) (io.Reader, error) {
 	switch strings.ToLower(charset) {
-	case "iso-8859-1":
-		enc = charmap.ISO8859_1
-	case "windows-1252":
-		enc = charmap.Windows1252
 	case "utf-8", "us-ascii":
-		// Nothing to do
-	default:
-		if charset != "" {
-			log.Println("WARN: unsupported charset:", charset)
-		}
+		return input, nil // Nothing to do
+	}
+
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, err
 	}
-	if enc != nil {
-		r = enc.NewDecoder().Reader(r)
+	return enc.NewDecoder().Reader(input), nil
+}
+
+func decodeCharset(r io.Reader, charset string) io.Reader {
+	decoded, err := CharsetReader(charset, r)
+	if err != nil {
+		log.Println("WARN: unsupported charset:", charset)
+		return r
 	}
-	return r
+	return decoded
 }
 
 func decodeContentEncoding(r io.Reader, contentEncoding string) io.Reader {
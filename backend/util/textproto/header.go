@@ -1,18 +1,22 @@
 package textproto
 
 import (
+	"mime"
 	"net/textproto"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util"
 )
 
 func GetMessageHeader(msg *backend.Message) textproto.MIMEHeader {
 	h := textproto.MIMEHeader{}
 
-	h.Set("MIME-Version", "1")
+	h.Set("MIME-Version", "1.0")
 
-	h.Set("Subject", msg.Subject)
+	h.Set("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
 	h.Set("From", FormatEmail(msg.Sender))
 	h.Set("Date", time.Unix(msg.Time, 0).Format(time.RFC1123Z))
 
@@ -22,31 +26,81 @@ func GetMessageHeader(msg *backend.Message) textproto.MIMEHeader {
 	for _, cc := range msg.CCList {
 		h.Add("Cc", FormatEmail(cc))
 	}
+	for _, bcc := range msg.BCCList {
+		h.Add("Bcc", FormatEmail(bcc))
+	}
 
 	if msg.ReplyTo != nil {
 		h.Set("Reply-To", FormatEmail(msg.ReplyTo))
 	}
 
+	if msg.ExternalID != "" {
+		h.Set("Message-Id", "<" + msg.ExternalID + ">")
+	}
+	if msg.InReplyTo != "" {
+		h.Set("In-Reply-To", msg.InReplyTo)
+	}
+	if msg.References != "" {
+		h.Set("References", msg.References)
+	}
+
 	return h
 }
 
+// Get the header of a message that is going to be sent. BCC recipients are
+// only part of the envelope and are removed from the header.
 func GetOutgoingMessageHeader(msg *backend.OutgoingMessage) textproto.MIMEHeader {
 	h := GetMessageHeader(msg.Message)
+	h.Del("Bcc")
+	return h
+}
 
-	if msg.InReplyTo != "" {
-		h.Set("In-Reply-To", msg.InReplyTo)
+// Generate a new Message-ID, without angle brackets, for a message sent by
+// sender.
+func GenerateMessageId(sender *backend.Email) string {
+	domain := "localhost"
+	if sender != nil {
+		if i := strings.LastIndex(sender.Address, "@"); i >= 0 {
+			domain = sender.Address[i+1:]
+		}
 	}
-	if msg.References != "" {
-		h.Set("References", msg.References)
+
+	return util.GenerateId() + "@" + domain
+}
+
+// Get threading headers of a reply to parent, as defined in RFC 5322 section
+// 3.6.4.
+func GetReplyHeaders(parent *backend.Message) (inReplyTo, references string) {
+	if parent.ExternalID == "" {
+		return "", parent.References
 	}
 
-	return h
+	inReplyTo = "<" + parent.ExternalID + ">"
+
+	references = parent.References
+	if references == "" && parent.InReplyTo != "" && !strings.Contains(parent.InReplyTo, " ") {
+		// The parent has no References but a single In-Reply-To
+		references = parent.InReplyTo
+	}
+	if references != "" {
+		references += " "
+	}
+	references += inReplyTo
+	return
 }
 
+// Format a header. Fields are sorted, so that formatting the same header twice
+// gives the same result.
 func FormatHeader(h textproto.MIMEHeader) string {
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
 	output := ""
-	for key, values := range h {
-		for _, value := range values {
+	for _, key := range keys {
+		for _, value := range h[key] {
 			output += key + ": " + value + "\r\n"
 		}
 	}
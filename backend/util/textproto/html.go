@@ -0,0 +1,20 @@
+package textproto
+
+import (
+	"html"
+	"strings"
+)
+
+// Convert a text/plain body to HTML, so that it can be displayed like other
+// bodies.
+func TextToHTML(text string) string {
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	text = strings.TrimRight(text, "\n")
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = html.EscapeString(line)
+	}
+
+	return "<div>" + strings.Join(lines, "<br>\n") + "</div>"
+}
@@ -6,11 +6,11 @@ import (
 	"encoding/base64"
 	"net/mail"
 	"net/textproto"
-	//"mime"
+	"mime"
 	"mime/multipart"
 	"mime/quotedprintable"
-	//"strings"
-	//"io"
+	"strings"
+	"io"
 
 	"github.com/emersion/neutron/backend"
 	"github.com/emersion/neutron/backend/util/textproto/chunksplit"
@@ -34,14 +34,14 @@ func ParseMessageHeader(msg *backend.Message, header *mail.Header) {
 	cc, err := header.AddressList("Cc")
 	if err == nil {
 		for _, addr := range cc {
-			msg.ToList = append(msg.ToList, ParseEmail(addr))
+			msg.CCList = append(msg.CCList, ParseEmail(addr))
 		}
 	}
 
 	bcc, err := header.AddressList("Bcc")
 	if err == nil {
 		for _, addr := range bcc {
-			msg.ToList = append(msg.ToList, ParseEmail(addr))
+			msg.BCCList = append(msg.BCCList, ParseEmail(addr))
 		}
 	}
 
@@ -54,6 +54,10 @@ func ParseMessageHeader(msg *backend.Message, header *mail.Header) {
 	if err == nil {
 		msg.Time = time.Unix()
 	}
+
+	msg.ExternalID = strings.Trim(strings.TrimSpace(header.Get("Message-Id")), "<>")
+	msg.InReplyTo = header.Get("In-Reply-To")
+	msg.References = header.Get("References")
 }
 
 /*func ParseMessagePart(header textproto.MIMEHeader, body io.Reader) (structure *BodyStructure, err error) {
@@ -112,13 +116,33 @@ func formatMessage(header textproto.MIMEHeader, body string) string {
 
 func FormatMessage(msg *backend.Message) string {
 	header := GetMessageHeader(msg)
-	header.Set("Content-Type", "text/html")
+	header.Set("Content-Type", "text/html; charset=utf-8")
 	return formatMessage(header, msg.Body)
 }
 
-func FormatOutgoingMessage(msg *backend.OutgoingMessage) string {
+func FormatOutgoingMessage(msg *backend.OutgoingMessage) (string, error) {
 	var b bytes.Buffer
-	m := multipart.NewWriter(&b)
+	if err := WriteOutgoingMessage(&b, msg); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Write an outgoing message to w. Attachments are streamed, so that they are
+// never fully loaded in memory.
+func WriteOutgoingMessage(w io.Writer, msg *backend.OutgoingMessage) error {
+	pgpType := getPgpType(msg)
+	if pgpType == backend.EncryptedPgpMime {
+		return writePgpMimeMessage(w, msg)
+	}
+
+	m := multipart.NewWriter(w)
+
+	mh := GetOutgoingMessageHeader(msg)
+	mh.Set("Content-Type", "multipart/mixed; boundary=" + m.Boundary())
+	if _, err := io.WriteString(w, FormatHeader(mh) + "\r\n"); err != nil {
+		return err
+	}
 
 	var body string
 	if msg.MessagePackage != nil {
@@ -127,42 +151,84 @@ func FormatOutgoingMessage(msg *backend.OutgoingMessage) string {
 		body = msg.Message.Body
 	}
 
-	h := textproto.MIMEHeader{}
-	h.Set("Content-Type", "text/html; charset=UTF-8")
-	h.Set("Content-Disposition", "inline")
-	h.Set("Content-Transfer-Encoding", "quoted-printable")
-	w, _ := m.CreatePart(h)
-	enc := quotedprintable.NewWriter(w)
-	enc.Write([]byte(body))
-	enc.Close()
-
-	for _, att := range msg.Attachments {
-		mimeType := att.MIMEType
-		if att.KeyPackets != "" {
-			mimeType = "application/pgp"
+	if pgpType == backend.EncryptedPgp {
+		// Inline PGP messages contain an armored plaintext message
+		if err := writeInlinePgpBody(m, body); err != nil {
+			return err
 		}
-
+	} else {
 		h := textproto.MIMEHeader{}
-		h.Set("Content-Type", mimeType + "; name=\"" + att.Name + "\"")
-		h.Set("Content-Disposition", "attachment")
-		h.Set("Content-Transfer-Encoding", "base64")
+		h.Set("Content-Type", "text/html; charset=UTF-8")
+		h.Set("Content-Disposition", "inline")
+		h.Set("Content-Transfer-Encoding", "quoted-printable")
+		pw, err := m.CreatePart(h)
+		if err != nil {
+			return err
+		}
+		enc := quotedprintable.NewWriter(pw)
+		if _, err := enc.Write([]byte(body)); err != nil {
+			return err
+		}
+		if err := enc.Close(); err != nil {
+			return err
+		}
+	}
 
-		w, _ := m.CreatePart(h)
-		splitter := chunksplit.New("\r\n", 76, w)
-		enc := base64.NewEncoder(base64.StdEncoding, splitter)
+	for i, att := range msg.Attachments {
+		if err := writeOutgoingAttachment(m, att, getAttachmentKeyPackets(msg, i), pgpType); err != nil {
+			return err
+		}
+	}
+
+	return m.Close()
+}
 
-		if att.KeyPackets != "" {
-			kp, _ := base64.StdEncoding.DecodeString(att.KeyPackets)
-			enc.Write(kp)
+// Write an attachment. keyPackets are prepended to its content, they're
+// base64-encoded.
+func writeOutgoingAttachment(m *multipart.Writer, att *backend.OutgoingAttachment, keyPackets string, pgpType int) error {
+	mimeType := att.MIMEType
+	name := att.Name
+	if keyPackets != "" {
+		if pgpType == backend.EncryptedPgp {
+			// As written by GnuPG and understood by most clients
+			mimeType = "application/octet-stream"
+			name = getEncryptedFilename(name)
+		} else {
+			mimeType = "application/pgp"
 		}
-		enc.Write(att.Data)
-		enc.Close()
 	}
 
-	m.Close()
+	h := textproto.MIMEHeader{}
+	contentType := mime.FormatMediaType(mimeType, map[string]string{"name": name})
+	if contentType == "" {
+		contentType = mime.FormatMediaType("application/octet-stream", map[string]string{"name": name})
+	}
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	h.Set("Content-Transfer-Encoding", "base64")
 
-	mh := GetOutgoingMessageHeader(msg)
-	mh.Set("Content-Type", "multipart/mixed; boundary=" + m.Boundary())
+	w, err := m.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	splitter := chunksplit.New("\r\n", 76, w)
+	enc := base64.NewEncoder(base64.StdEncoding, splitter)
+
+	if keyPackets != "" {
+		kp, _ := base64.StdEncoding.DecodeString(keyPackets)
+		if _, err := enc.Write(kp); err != nil {
+			return err
+		}
+	}
 
-	return formatMessage(mh, b.String())
+	r, err := att.Reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if _, err := io.Copy(enc, r); err != nil {
+		return err
+	}
+	return enc.Close()
 }
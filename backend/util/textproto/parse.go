@@ -0,0 +1,179 @@
+package textproto
+
+import (
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"github.com/emersion/neutron/backend"
+)
+
+// An attachment read from a message.
+type Attachment struct {
+	*backend.Attachment
+	Data []byte
+}
+
+type messageParser struct {
+	html, text string
+	hasHtml, hasText bool
+	attachments []*Attachment
+}
+
+func isAttachmentPart(mediaType, disp string, dispParams map[string]string) bool {
+	if strings.EqualFold(disp, "attachment") || dispParams["filename"] != "" {
+		return true
+	}
+	return mediaType != "text/plain" && mediaType != "text/html"
+}
+
+func getAttachmentName(mediaType string, params, dispParams map[string]string) string {
+	name := dispParams["filename"]
+	if name == "" {
+		name = params["name"]
+	}
+	if name == "" && mediaType == "message/rfc822" {
+		name = "message.eml"
+	}
+	return DecodeWord(name)
+}
+
+func (p *messageParser) parsePart(header textproto.MIMEHeader, body io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// Parts without a valid type are plaintext, see RFC 2045 section 5.2
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			if err := p.parsePart(part.Header, part); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Quoted-printable parts of multipart messages have already been decoded
+	// and their Content-Transfer-Encoding removed
+	encoding := header.Get("Content-Transfer-Encoding")
+	disp, dispParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+
+	if !isAttachmentPart(mediaType, disp, dispParams) {
+		b, err := ioutil.ReadAll(Decode(body, encoding, params["charset"]))
+		if err != nil {
+			return err
+		}
+
+		if mediaType == "text/html" && !p.hasHtml {
+			p.html, p.hasHtml = string(b), true
+		} else if mediaType == "text/plain" && !p.hasText {
+			p.text, p.hasText = string(b), true
+		}
+		return nil
+	}
+
+	b, err := ioutil.ReadAll(Decode(body, encoding, ""))
+	if err != nil {
+		return err
+	}
+
+	att := &backend.Attachment{
+		Name: getAttachmentName(mediaType, params, dispParams),
+		MIMEType: mediaType,
+		Size: len(b),
+		Headers: textproto.MIMEHeader{},
+	}
+	if id := header.Get("Content-Id"); id != "" {
+		att.Headers.Set("Content-Id", id)
+	}
+	if disp != "" {
+		att.Headers.Set("Content-Disposition", disp)
+	}
+
+	p.attachments = append(p.attachments, &Attachment{Attachment: att, Data: b})
+	return nil
+}
+
+// Read a PGP/MIME message, as defined in RFC 3156. The body is the encrypted
+// part, which contains the whole MIME structure.
+func readPgpMimeBody(body io.Reader, boundary string) (string, error) {
+	mr := multipart.NewReader(body, boundary)
+
+	// Skip the version part
+	if _, err := mr.NextPart(); err != nil {
+		return "", err
+	}
+
+	part, err := mr.NextPart()
+	if err != nil {
+		return "", err
+	}
+
+	b, err := ioutil.ReadAll(part)
+	return string(b), err
+}
+
+// Read a message. Its body is its HTML part if any, its plaintext part
+// otherwise. Other parts are returned as attachments.
+func ReadMessage(r io.Reader) (*backend.Message, []*Attachment, error) {
+	m, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := textproto.MIMEHeader(m.Header)
+
+	msg := &backend.Message{Header: FormatHeader(header)}
+	ParseMessageHeader(msg, &m.Header)
+
+	mediaType, params, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if mediaType == "multipart/encrypted" && strings.EqualFold(params["protocol"], "application/pgp-encrypted") {
+		// The client decrypts the whole MIME structure
+		msg.IsEncrypted = backend.EncryptedPgpMime
+		msg.Body, err = readPgpMimeBody(m.Body, params["boundary"])
+		return msg, nil, err
+	}
+
+	p := &messageParser{}
+	if err := p.parsePart(header, m.Body); err != nil {
+		return nil, nil, err
+	}
+
+	msg.Body = p.html
+
+	// Inline PGP messages are usually sent as text, the HTML part contains a
+	// formatted version of the armored message
+	if p.hasText && (!p.hasHtml || backend.IsEncrypted(msg.Body)) {
+		msg.Body = p.text
+		if !backend.IsEncrypted(msg.Body) {
+			msg.Body = TextToHTML(msg.Body)
+		}
+	}
+
+	if backend.IsEncrypted(msg.Body) {
+		msg.IsEncrypted = backend.EncryptedPgp
+	}
+
+	for _, att := range p.attachments {
+		msg.Attachments = append(msg.Attachments, att.Attachment)
+	}
+	msg.NumAttachments = len(msg.Attachments)
+	if msg.NumAttachments > 0 {
+		msg.HasAttachment = 1
+	}
+
+	return msg, p.attachments, nil
+}
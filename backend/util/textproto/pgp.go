@@ -0,0 +1,105 @@
+package textproto
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+
+	"github.com/emersion/neutron/backend"
+)
+
+// Get the OpenPGP format of an outgoing message, either backend.EncryptedPgp,
+// backend.EncryptedPgpMime or zero.
+func getPgpType(msg *backend.OutgoingMessage) int {
+	if msg.MessagePackage == nil {
+		return 0
+	}
+
+	switch msg.MessagePackage.Type {
+	case backend.EncryptedPgp, backend.EncryptedPgpMime:
+		return msg.MessagePackage.Type
+	}
+	return 0
+}
+
+// Get the base64-encoded key packets of the i-th attachment. Packages contain
+// key packets encrypted for their recipient, if any.
+func getAttachmentKeyPackets(msg *backend.OutgoingMessage, i int) string {
+	if msg.MessagePackage != nil && i < len(msg.MessagePackage.KeyPackets) && msg.MessagePackage.KeyPackets[i] != "" {
+		return msg.MessagePackage.KeyPackets[i]
+	}
+	return msg.Attachments[i].KeyPackets
+}
+
+// Get the name of an encrypted attachment.
+func getEncryptedFilename(name string) string {
+	lower := strings.ToLower(name)
+	if strings.HasSuffix(lower, ".pgp") || strings.HasSuffix(lower, ".gpg") {
+		return name
+	}
+	return name + ".pgp"
+}
+
+func writeInlinePgpBody(m *multipart.Writer, body string) error {
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", "text/plain; charset=UTF-8")
+	h.Set("Content-Disposition", "inline")
+	h.Set("Content-Transfer-Encoding", "7bit")
+
+	w, err := m.CreatePart(h)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, toCRLF(body))
+	return err
+}
+
+// Write a PGP/MIME message, as defined in RFC 3156 section 4. The package body
+// is an armored OpenPGP message containing the whole MIME entity, including
+// attachments.
+func writePgpMimeMessage(w io.Writer, msg *backend.OutgoingMessage) error {
+	m := multipart.NewWriter(w)
+
+	mh := GetOutgoingMessageHeader(msg)
+	mh.Set("Content-Type", mime.FormatMediaType("multipart/encrypted", map[string]string{
+		"protocol": "application/pgp-encrypted",
+		"boundary": m.Boundary(),
+	}))
+	if _, err := io.WriteString(w, FormatHeader(mh) + "\r\n"); err != nil {
+		return err
+	}
+
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", "application/pgp-encrypted")
+	h.Set("Content-Description", "PGP/MIME version identification")
+	pw, err := m.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(pw, "Version: 1\r\n"); err != nil {
+		return err
+	}
+
+	h = textproto.MIMEHeader{}
+	h.Set("Content-Type", mime.FormatMediaType("application/octet-stream", map[string]string{"name": "encrypted.asc"}))
+	h.Set("Content-Description", "OpenPGP encrypted message")
+	h.Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": "encrypted.asc"}))
+	pw, err = m.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(pw, toCRLF(msg.MessagePackage.Body)); err != nil {
+		return err
+	}
+
+	return m.Close()
+}
+
+// Convert line endings to CRLF, as required in message bodies.
+func toCRLF(s string) string {
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	return strings.Replace(s, "\n", "\r\n", -1)
+}
@@ -5,6 +5,14 @@ import (
 	"github.com/emersion/neutron/backend/imap"
 	"github.com/emersion/neutron/backend/smtp"
 	"github.com/emersion/neutron/backend/disk"
+	"github.com/emersion/neutron/backend/sqlite"
+	"github.com/emersion/neutron/backend/bolt"
+	"github.com/emersion/neutron/backend/domaincheck"
+	"github.com/emersion/neutron/backend/mx"
+	"github.com/emersion/neutron/backend/queue"
+	"github.com/emersion/neutron/backend/util/search"
+	imapserver "github.com/emersion/neutron/router/imap"
+	smtpserver "github.com/emersion/neutron/router/smtp"
 )
 
 // Configuration for all backends.
@@ -19,8 +27,32 @@ type Config struct {
 	// SMTP config.
 	Smtp *SmtpConfig
 
+	// Direct delivery config, replaces SMTP.
+	Mx *MxConfig
+
 	// Disk config.
 	Disk *DiskConfig
+
+	// SQLite config.
+	Sqlite *SqliteConfig
+
+	// bbolt config.
+	Bolt *BoltConfig
+
+	// Domains DNS checks config.
+	DomainCheck *DomainCheckConfig
+
+	// Outbound queue config.
+	Queue *QueueConfig
+
+	// Search index config.
+	Search *SearchConfig
+
+	// Incoming SMTP or LMTP server config.
+	SmtpServer *SmtpServerConfig
+
+	// IMAP server config.
+	ImapServer *ImapServerConfig
 }
 
 type BackendConfig struct {
@@ -43,6 +75,11 @@ type SmtpConfig struct {
 	*smtp.Config
 }
 
+type MxConfig struct {
+	*BackendConfig
+	*mx.Config
+}
+
 type DiskConfig struct {
 	*BackendConfig
 	*disk.Config
@@ -51,4 +88,43 @@ type DiskConfig struct {
 	Keys *DiskConfig
 	UsersSettings *DiskConfig
 	Addresses *DiskConfig
+	Dkim *DiskConfig
+	Attachments *DiskConfig
+}
+
+type SqliteConfig struct {
+	*BackendConfig
+	*sqlite.Config
+	Domains []string
+}
+
+type BoltConfig struct {
+	*BackendConfig
+	*bolt.Config
+	Domains []string
+}
+
+type DomainCheckConfig struct {
+	*BackendConfig
+	*domaincheck.Config
+}
+
+type QueueConfig struct {
+	*BackendConfig
+	*queue.Config
+}
+
+type SearchConfig struct {
+	*BackendConfig
+	*search.Config
+}
+
+type SmtpServerConfig struct {
+	*BackendConfig
+	*smtpserver.Config
+}
+
+type ImapServerConfig struct {
+	*BackendConfig
+	*imapserver.Config
 }
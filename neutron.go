@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"io/ioutil"
+	"log"
 
 	"gopkg.in/macaron.v1"
 
@@ -12,7 +13,16 @@ import (
 	"github.com/emersion/neutron/backend/imap"
 	"github.com/emersion/neutron/backend/smtp"
 	"github.com/emersion/neutron/backend/disk"
+	"github.com/emersion/neutron/backend/sqlite"
+	"github.com/emersion/neutron/backend/bolt"
+	"github.com/emersion/neutron/backend/domaincheck"
+	"github.com/emersion/neutron/backend/mx"
+	"github.com/emersion/neutron/backend/queue"
+	"github.com/emersion/neutron/backend/util/dkim"
+	"github.com/emersion/neutron/backend/util/search"
 	"github.com/emersion/neutron/router/api"
+	imapserver "github.com/emersion/neutron/router/imap"
+	smtpserver "github.com/emersion/neutron/router/smtp"
 )
 
 const (
@@ -20,6 +30,47 @@ const (
 	indexFile = "app.html"
 )
 
+// Generate DKIM keys for domains added by the operator that don't have one yet.
+// The records to publish are logged.
+func createDkimKeys(bkd *backend.Backend) error {
+	if bkd.DomainsBackend == nil || bkd.DkimBackend == nil {
+		return nil
+	}
+
+	domains, err := bkd.ListDomains()
+	if err != nil {
+		return err
+	}
+
+	for _, domain := range domains {
+		if domain.VerifyCode != "" {
+			continue
+		}
+
+		if key, err := bkd.GetDkimKey(domain.DomainName); err != nil {
+			return err
+		} else if key != nil {
+			continue
+		}
+
+		key, err := dkim.CreateKey(bkd, domain.DomainName, "", "")
+		if err != nil {
+			return err
+		}
+
+		signer, err := dkim.ParsePrivateKey(key.PrivateKey)
+		if err != nil {
+			return err
+		}
+		record, err := dkim.FormatRecord(signer.Public())
+		if err != nil {
+			return err
+		}
+		log.Println("Generated DKIM key for", domain.DomainName + ", publish this TXT record at", dkim.RecordName(domain.DomainName, key.Selector) + ":", record)
+	}
+	return nil
+}
+
 func main() {
 	// CLI arguments
 	cfgPath := flag.String("config", "config.json", "Config file path")
@@ -44,12 +95,48 @@ func main() {
 			memory.Populate(bkd)
 		}
 	}
-	if c.Imap != nil && c.Imap.Enabled {
-		passwords := imap.Use(bkd, c.Imap.Config)
 
-		if c.Smtp != nil && c.Smtp.Enabled {
-			smtp.Use(bkd, c.Smtp.Config, passwords)
+	if c.Sqlite != nil && c.Sqlite.Enabled {
+		if _, err := sqlite.Use(bkd, c.Sqlite.Config); err != nil {
+			panic(err)
+		}
+
+		// Domains are persisted, only insert new ones
+		for _, name := range c.Sqlite.Domains {
+			if _, err := bkd.GetDomainByName(name); err != nil {
+				bkd.InsertDomain(&backend.Domain{DomainName: name})
+			}
+		}
+	}
+
+	if c.Bolt != nil && c.Bolt.Enabled {
+		if _, err := bolt.Use(bkd, c.Bolt.Config); err != nil {
+			panic(err)
 		}
+
+		for _, name := range c.Bolt.Domains {
+			if _, err := bkd.GetDomainByName(name); err != nil {
+				bkd.InsertDomain(&backend.Domain{DomainName: name})
+			}
+		}
+	}
+
+	var index *search.Index
+	if c.Search != nil && c.Search.Enabled {
+		index = search.Open(c.Search.Config)
+		search.UseEvents(bkd, index)
+	}
+
+	var passwords smtp.PasswordsBackend
+	if c.Imap != nil && c.Imap.Enabled {
+		passwords = imap.Use(bkd, c.Imap.Config)
+	}
+	if c.Smtp != nil && c.Smtp.Enabled {
+		// Without IMAP, a SMTP service account must be configured
+		smtp.Use(bkd, c.Smtp.Config, passwords)
+	}
+	if c.Mx != nil && c.Mx.Enabled {
+		mx.Use(bkd, c.Mx.Config)
 	}
 	if c.Disk != nil && c.Disk.Enabled {
 		if c.Disk.Config != nil {
@@ -67,6 +154,59 @@ func main() {
 		if c.Disk.Addresses != nil {
 			disk.UseAddresses(bkd, c.Disk.Addresses.Config)
 		}
+		if c.Disk.Dkim != nil {
+			disk.UseDkimKeys(bkd, c.Disk.Dkim.Config)
+		}
+		if c.Disk.Attachments != nil {
+			disk.UseAttachments(bkd, c.Disk.Attachments.Config)
+		}
+	}
+
+	// Keys of domains added by the operator cannot be managed with the API
+	if err := createDkimKeys(bkd); err != nil {
+		panic(err)
+	}
+
+	if c.DomainCheck != nil && c.DomainCheck.Enabled {
+		domaincheck.Use(bkd, c.DomainCheck.Config)
+	}
+
+	if c.Queue != nil && c.Queue.Enabled {
+		queue.Use(bkd, c.Queue.Config)
+	}
+
+	if index != nil {
+		// The IMAP backend cannot list messages in all mailboxes, it falls back
+		// to INBOX
+		defaultLabel := ""
+		if c.Imap != nil && c.Imap.Enabled {
+			defaultLabel = backend.InboxLabel
+		}
+		search.Use(bkd, index, defaultLabel)
+	}
+
+	// Receive messages
+	if c.SmtpServer != nil && c.SmtpServer.Enabled {
+		s, err := smtpserver.New(bkd, c.SmtpServer.Config)
+		if err != nil {
+			panic(err)
+		}
+
+		go func() {
+			log.Fatal(s.ListenAndServe())
+		}()
+	}
+
+	// Serve messages
+	if c.ImapServer != nil && c.ImapServer.Enabled {
+		s, err := imapserver.New(bkd, c.ImapServer.Config)
+		if err != nil {
+			panic(err)
+		}
+
+		go func() {
+			log.Fatal(s.ListenAndServe())
+		}()
 	}
 
 	// Create server
@@ -35,6 +35,14 @@ func (api *Api) CreateAddress(ctx *macaron.Context, req CreateAddressReq) (err e
 	if err != nil {
 		return
 	}
+	if !canUseDomain(userId, domain) {
+		return errors.New("No such domain")
+	}
+
+	populateDomain(domain)
+	if domain.VerifyState != backend.DomainVerifyGood {
+		return errors.New("Domain hasn't been verified")
+	}
 
 	email := req.Local + "@" + req.Domain
 
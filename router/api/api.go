@@ -196,6 +196,7 @@ func New(m *macaron.Macaron, backend *backend.Backend) {
 		m.Post("/draft", binding.Json(MessageReq{}), api.CreateDraft)
 		m.Put("/draft/:id", binding.Json(MessageReq{}), api.UpdateDraft)
 		m.Post("/send/:id", binding.Json(SendMessageReq{}), api.SendMessage)
+		m.Post("/send/:id/cancel", api.CancelSendMessage)
 		m.Put("/delete", binding.Json(BatchReq{}), api.DeleteMessages)
 		m.Put("/label", binding.Json(UpdateMessagesLabelReq{}), api.UpdateMessagesLabel)
 	})
@@ -243,7 +244,11 @@ func New(m *macaron.Macaron, backend *backend.Backend) {
 
 	m.Group("/domains", func() {
 		m.Get("/", api.GetUserDomains)
+		m.Post("/", binding.Json(CreateDomainReq{}), api.CreateDomain)
 		m.Get("/:id", api.GetDomain)
+		m.Put("/:id/refresh", api.RefreshDomain)
+		m.Get("/:id/dkim", api.GetDkimKey)
+		m.Post("/:id/dkim", binding.Json(DkimKeyReq{}), api.CreateDkimKey)
 		m.Get("/available", api.GetAvailableDomains)
 	})
 
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"encoding/base64"
@@ -9,14 +10,15 @@ import (
 	"github.com/emersion/neutron/backend"
 )
 
-func (api *Api) GetAttachment(ctx *macaron.Context) (b []byte, err error) {
+func (api *Api) GetAttachment(ctx *macaron.Context) (err error) {
 	userId := api.getUserId(ctx)
 	id := ctx.Params("id")
 
-	att, b, err := api.backend.ReadAttachment(userId, id)
+	att, r, err := api.backend.OpenAttachment(userId, id)
 	if err != nil {
 		return
 	}
+	defer r.Close()
 
 	if att.KeyPackets != "" {
 		ctx.Resp.Header().Set("Content-Type", "application/pgp")
@@ -29,9 +31,24 @@ func (api *Api) GetAttachment(ctx *macaron.Context) (b []byte, err error) {
 	ctx.Resp.Header().Set("Expires", "0")
 	ctx.Resp.Header().Set("Cache-Control", "must-revalidate")
 	ctx.Resp.Header().Set("Pragma", "public")
+	ctx.Resp.WriteHeader(200)
+
+	_, err = io.Copy(ctx.Resp, r)
 	return
 }
 
+// A decrypted attachment, which closes both the decrypted and the encrypted
+// readers.
+type decryptedAttachment struct {
+	io.ReadCloser
+	encrypted io.Closer
+}
+
+func (r *decryptedAttachment) Close() error {
+	r.ReadCloser.Close()
+	return r.encrypted.Close()
+}
+
 // form: attributes are needed to parse multipart form
 // See https://github.com/go-macaron/binding/issues/10
 type UploadAttachmentReq struct {
@@ -63,17 +80,14 @@ func (api *Api) UploadAttachment(ctx *macaron.Context, req UploadAttachmentReq)
 		return
 	}
 
+	// Key packets are small, but the data packet can be large and is streamed
+	// to the backend
 	df, err := req.DataPacket.Open()
 	if err != nil {
 		return
 	}
 	defer df.Close()
 
-	data, err := ioutil.ReadAll(df)
-	if err != nil {
-		return
-	}
-
 	att := &backend.Attachment{
 		Name: req.Filename,
 		MessageID: req.MessageID,
@@ -81,7 +95,7 @@ func (api *Api) UploadAttachment(ctx *macaron.Context, req UploadAttachmentReq)
 		KeyPackets: base64.StdEncoding.EncodeToString(kp),
 	}
 
-	att, err = api.backend.InsertAttachment(userId, att, data)
+	att, err = api.backend.InsertAttachmentFrom(userId, att, df)
 	if err != nil {
 		return
 	}
@@ -16,6 +16,10 @@ func (api *Api) ListConversations(ctx *macaron.Context) (err error) {
 	userId := api.getUserId(ctx)
 	filter := getMessagesFilter(ctx)
 
+	if err = api.parseMessagesQuery(userId, filter); err != nil {
+		return
+	}
+
 	conversations, total, err := api.backend.ListConversations(userId, filter)
 	if err != nil {
 		return
@@ -1,8 +1,13 @@
 package api
 
 import (
+	"errors"
+	"strings"
+
 	"gopkg.in/macaron.v1"
 	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util"
+	"github.com/emersion/neutron/backend/util/dkim"
 )
 
 type AvailableDomainsResp struct {
@@ -16,9 +21,12 @@ func (api *Api) GetAvailableDomains(ctx *macaron.Context) (err error) {
 		return
 	}
 
-	domainNames := make([]string, len(domains))
-	for i, d := range domains {
-		domainNames[i] = d.DomainName
+	// Domains added by users aren't available to everyone
+	var domainNames []string
+	for _, d := range domains {
+		if d.VerifyCode == "" {
+			domainNames = append(domainNames, d.DomainName)
+		}
 	}
 
 	ctx.JSON(200, &AvailableDomainsResp{
@@ -28,9 +36,31 @@ func (api *Api) GetAvailableDomains(ctx *macaron.Context) (err error) {
 	return
 }
 
+// Domains added by the administrator are verified even if they haven't been
+// checked.
 func populateDomain(domain *backend.Domain) {
-	domain.State = 1
-	domain.VerifyState = 2
+	if domain.VerifyCode == "" && domain.VerifyState == backend.DomainVerifyDefault {
+		domain.State = backend.DomainActive
+		domain.VerifyState = backend.DomainVerifyGood
+	}
+}
+
+// Check that a user can use a domain. Domains added by the administrator can be
+// used by everyone, domains added by users only by their owner.
+func canUseDomain(userId string, domain *backend.Domain) bool {
+	return domain.VerifyCode == "" || domain.UserID == userId
+}
+
+// Get a domain the user can use.
+func (api *Api) getUserDomain(userId, id string) (*backend.Domain, error) {
+	domain, err := api.backend.GetDomain(id)
+	if err != nil {
+		return nil, err
+	}
+	if !canUseDomain(userId, domain) {
+		return nil, errors.New("No such domain")
+	}
+	return domain, nil
 }
 
 type DomainResp struct {
@@ -39,9 +69,77 @@ type DomainResp struct {
 }
 
 func (api *Api) GetDomain(ctx *macaron.Context) (err error) {
+	userId := api.getUserId(ctx)
 	domainId := ctx.Params("id")
 
-	domain, err := api.backend.GetDomain(domainId)
+	domain, err := api.getUserDomain(userId, domainId)
+	if err != nil {
+		return
+	}
+
+	populateDomain(domain)
+
+	ctx.JSON(200, &DomainResp{
+		Resp: Resp{Ok},
+		Domain: domain,
+	})
+	return
+}
+
+type CreateDomainReq struct {
+	Req
+	Name string
+}
+
+func (api *Api) CreateDomain(ctx *macaron.Context, req CreateDomainReq) (err error) {
+	userId := api.getUserId(ctx)
+
+	name := strings.ToLower(strings.TrimSuffix(req.Name, "."))
+	if name == "" || strings.ContainsAny(name, "@/ ") {
+		return errors.New("Invalid domain name")
+	}
+	if _, err := api.backend.GetDomainByName(name); err == nil {
+		return errors.New("Domain already exists")
+	}
+
+	// The user must publish this code to prove they own the domain
+	domain, err := api.backend.InsertDomain(&backend.Domain{
+		DomainName: name,
+		VerifyCode: util.GenerateId(),
+		UserID: userId,
+	})
+	if err != nil {
+		return
+	}
+
+	// If DNS lookups fail, the user can refresh the domain later
+	if api.backend.DomainsCheckBackend != nil {
+		if checked, err := api.backend.CheckDomain(userId, domain.ID); err == nil {
+			domain = checked
+		}
+	}
+
+	ctx.JSON(200, &DomainResp{
+		Resp: Resp{Ok},
+		Domain: domain,
+	})
+	return
+}
+
+// Check a domain's DNS records again.
+func (api *Api) RefreshDomain(ctx *macaron.Context) (err error) {
+	userId := api.getUserId(ctx)
+
+	if api.backend.DomainsCheckBackend == nil {
+		return errors.New("Domain checks are disabled")
+	}
+
+	domain, err := api.getUserDomain(userId, ctx.Params("id"))
+	if err != nil {
+		return
+	}
+
+	domain, err = api.backend.CheckDomain(userId, domain.ID)
 	if err != nil {
 		return
 	}
@@ -63,14 +161,21 @@ type DomainsResp struct {
 func (api *Api) GetUserDomains(ctx *macaron.Context) (err error) {
 	userId := api.getUserId(ctx)
 
-	domains, err := api.backend.ListDomains()
+	all, err := api.backend.ListDomains()
 	if err != nil {
 		return
 	}
 
-	for _, dom := range domains {
+	// Only list domains added by the user
+	var domains []*backend.Domain
+	for _, dom := range all {
+		if dom.UserID != userId {
+			continue
+		}
+
 		populateDomain(dom)
 		dom.Addresses = nil
+		domains = append(domains, dom)
 	}
 
 	addresses, err := api.backend.ListAddresses(userId)
@@ -95,3 +200,85 @@ func (api *Api) GetUserDomains(ctx *macaron.Context) (err error) {
 	})
 	return
 }
+
+type DkimKeyReq struct {
+	Req
+	Algorithm string
+	Selector string
+}
+
+// The DNS record to publish for a domain's DKIM key.
+type DkimKeyResp struct {
+	Resp
+	Selector string
+	Hostname string
+	Record string
+}
+
+func (api *Api) respondDkimKey(ctx *macaron.Context, domain *backend.Domain, key *backend.DkimKey) error {
+	signer, err := dkim.ParsePrivateKey(key.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	record, err := dkim.FormatRecord(signer.Public())
+	if err != nil {
+		return err
+	}
+
+	ctx.JSON(200, &DkimKeyResp{
+		Resp: Resp{Ok},
+		Selector: key.Selector,
+		Hostname: dkim.RecordName(domain.DomainName, key.Selector),
+		Record: record,
+	})
+	return nil
+}
+
+// Get a domain whose DKIM key can be managed by the user. Keys of domains added
+// by the administrator cannot be managed with the API, they are generated at
+// startup.
+func (api *Api) getDkimDomain(ctx *macaron.Context) (*backend.Domain, error) {
+	userId := api.getUserId(ctx)
+
+	domain, err := api.backend.GetDomain(ctx.Params("id"))
+	if err != nil {
+		return nil, err
+	}
+	if domain.VerifyCode == "" || domain.UserID != userId {
+		return nil, errors.New("No such domain")
+	}
+	return domain, nil
+}
+
+func (api *Api) GetDkimKey(ctx *macaron.Context) (err error) {
+	domain, err := api.getDkimDomain(ctx)
+	if err != nil {
+		return
+	}
+
+	key, err := api.backend.GetDkimKey(domain.DomainName)
+	if err != nil {
+		return
+	}
+	if key == nil {
+		return errors.New("Domain has no DKIM key")
+	}
+
+	return api.respondDkimKey(ctx, domain, key)
+}
+
+// Generate a new DKIM key for a domain. The previous key is replaced.
+func (api *Api) CreateDkimKey(ctx *macaron.Context, req DkimKeyReq) (err error) {
+	domain, err := api.getDkimDomain(ctx)
+	if err != nil {
+		return
+	}
+
+	key, err := dkim.CreateKey(api.backend, domain.DomainName, req.Algorithm, req.Selector)
+	if err != nil {
+		return
+	}
+
+	return api.respondDkimKey(ctx, domain, key)
+}
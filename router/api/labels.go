@@ -48,6 +48,7 @@ func (api *Api) CreateLabel(ctx *macaron.Context, req LabelReq) (err error) {
 		Name: req.Name,
 		Display: req.Display,
 		Color: req.Color,
+		Exclusive: req.Exclusive,
 	})
 	if err != nil {
 		return
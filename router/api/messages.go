@@ -2,11 +2,16 @@ package api
 
 import (
 	"errors"
+	"io"
+	"log"
+	"strings"
 	"time"
 
 	"gopkg.in/macaron.v1"
 
 	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util/search"
+	"github.com/emersion/neutron/backend/util/textproto"
 )
 
 func getLabelID(name string) (label string) {
@@ -42,6 +47,22 @@ func getMessagesFilter(ctx *macaron.Context) *backend.MessagesFilter {
 	}
 }
 
+// Parse the search query contained in a filter's keyword.
+func (api *Api) parseMessagesQuery(userId string, filter *backend.MessagesFilter) error {
+	if filter.Keyword == "" {
+		return nil
+	}
+
+	labels, err := api.backend.ListLabels(userId)
+	if err != nil {
+		return err
+	}
+
+	query := filter.Keyword
+	filter.Keyword = ""
+	return search.ParseQuery(filter, query, labels)
+}
+
 func (api *Api) populateMessage(userId string, msg *backend.Message) {
 	if msg.ToList == nil {
 		msg.ToList = []*backend.Email{}
@@ -147,6 +168,10 @@ func (api *Api) ListMessages(ctx *macaron.Context) (err error) {
 	userId := api.getUserId(ctx)
 	filter := getMessagesFilter(ctx)
 
+	if err = api.parseMessagesQuery(userId, filter); err != nil {
+		return
+	}
+
 	msgs, total, err := api.backend.ListMessages(userId, filter)
 	if err != nil {
 		return
@@ -377,6 +402,7 @@ func (api *Api) CreateDraft(ctx *macaron.Context, req MessageReq) (err error) {
 		}
 
 		msg.ConversationID = parent.ConversationID
+		msg.InReplyTo, msg.References = textproto.GetReplyHeaders(parent)
 	}
 
 	for _, address := range user.Addresses {
@@ -390,6 +416,8 @@ func (api *Api) CreateDraft(ctx *macaron.Context, req MessageReq) (err error) {
 		return
 	}
 
+	msg.ExternalID = textproto.GenerateMessageId(msg.Sender)
+
 	msg, err = api.backend.InsertMessage(userId, msg)
 	if err != nil {
 		return
@@ -442,62 +470,146 @@ type SendMessageReq struct {
 	Packages []*backend.MessagePackage
 	AttachmentKeys []*backend.AttachmentKey
 	ClearBody string
+
+	// If set, the message is sent at this time (a UNIX timestamp)
+	DeliveryTime int64
+	// Number of seconds during which sending the message can be cancelled
+	UndoDelay int
 }
 
+// Maximum undo delay, in seconds.
+const maxUndoDelay = 60
+
 type SendMessageResp struct {
 	Resp
 	Sent *backend.Message
+	Failures []*SendMessageFailure `json:",omitempty"`
+	DeliveryTime int64 `json:",omitempty"`
+}
+
+// A recipient to which a message couldn't be sent.
+type SendMessageFailure struct {
+	Address string
+	Error string
+}
+
+// Packages with the same key only differ by their recipient.
+type packageKey struct {
+	Type int
+	Body string
+	KeyPackets string
+}
+
+func getPackageKey(pkg *backend.MessagePackage) packageKey {
+	return packageKey{
+		Type: pkg.Type,
+		Body: pkg.Body,
+		KeyPackets: strings.Join(pkg.KeyPackets, ","),
+	}
 }
 
 func (api *Api) SendMessage(ctx *macaron.Context, req SendMessageReq) (err error) {
 	userId := api.getUserId(ctx)
 	msgId := ctx.Params("id")
 
+	if req.UndoDelay < 0 || req.UndoDelay > maxUndoDelay {
+		err = errors.New("Invalid undo delay")
+		return
+	}
+
 	msg, err := api.backend.GetMessage(userId, msgId)
 	if err != nil {
 		return
 	}
 
-	outgoing := &backend.OutgoingMessage{Message: msg}
-
-	outgoing.Attachments = make([]*backend.OutgoingAttachment, len(msg.Attachments))
-	for i, att := range msg.Attachments {
-		att, data, err := api.backend.ReadAttachment(userId, att.ID)
+	// Drafts created by other clients may not have a Message-ID. It's saved, so
+	// that the sent message keeps it.
+	if msg.ExternalID == "" {
+		var updated *backend.Message
+		updated, err = api.backend.UpdateMessage(userId, &backend.MessageUpdate{
+			Message: &backend.Message{
+				ID: msgId,
+				ExternalID: textproto.GenerateMessageId(msg.Sender),
+			},
+			ExternalID: true,
+		})
 		if err != nil {
-			return err
+			return
 		}
 
-		outgoing.Attachments[i] = &backend.OutgoingAttachment{
+		// Saving the message can change its ID
+		msgId = updated.ID
+		if msg, err = api.backend.GetMessage(userId, msgId); err != nil {
+			return
+		}
+	}
+
+	attachments := make([]*backend.OutgoingAttachment, len(msg.Attachments))
+	for i, att := range msg.Attachments {
+		// Attachments are read each time a message is sent, instead of being
+		// loaded in memory
+		id := att.ID
+		attachments[i] = &backend.OutgoingAttachment{
 			Attachment: att,
-			Data: data,
+			Open: func() (io.ReadCloser, error) {
+				_, r, err := api.backend.OpenAttachment(userId, id)
+				return r, err
+			},
 		}
 	}
 
-	// Send each package
+	// Identical packages are sent in a single transaction
+	var outgoing []*backend.OutgoingMessage
+	byPackage := map[packageKey]*backend.OutgoingMessage{}
 	for _, pkg := range req.Packages {
-		outgoing.MessagePackage = pkg
-		err = api.backend.SendMessage(userId, outgoing)
-		if err != nil {
-			return
+		k := getPackageKey(pkg)
+		if o, ok := byPackage[k]; ok {
+			o.Recipients = append(o.Recipients, pkg.Address)
+			continue
+		}
+
+		o := &backend.OutgoingMessage{
+			Message: msg,
+			MessagePackage: pkg,
+			Attachments: attachments,
+			Recipients: []string{pkg.Address},
 		}
+		byPackage[k] = o
+		outgoing = append(outgoing, o)
 	}
 
 	// If clear body is available, send it to recipients without package
 	if req.ClearBody != "" {
 		// Decrypt attachments
-		if len(req.AttachmentKeys) != len(outgoing.Attachments) {
+		if len(req.AttachmentKeys) != len(attachments) {
 			err = errors.New("AttachmentKeys count doesn't match Attachments count")
 			return
 		}
-		for i, att := range outgoing.Attachments {
-			attKey := req.AttachmentKeys[i]
 
-			data, err := attKey.Decrypt(att.Data)
-			if err != nil {
-				return err
+		clearAttachments := make([]*backend.OutgoingAttachment, len(attachments))
+		for i, att := range attachments {
+			attKey := req.AttachmentKeys[i]
+			open := att.Open
+
+			// The decrypted attachment is sent without its key packets
+			clear := *att.Attachment
+			clear.KeyPackets = ""
+			clearAttachments[i] = &backend.OutgoingAttachment{
+				Attachment: &clear,
+				Open: func() (io.ReadCloser, error) {
+					r, err := open()
+					if err != nil {
+						return nil, err
+					}
+
+					decrypted, err := attKey.DecryptReader(r)
+					if err != nil {
+						r.Close()
+						return nil, err
+					}
+					return &decryptedAttachment{decrypted, r}, nil
+				},
 			}
-
-			att.Data = data
 		}
 
 		recipients := []*backend.Email{}
@@ -506,6 +618,11 @@ func (api *Api) SendMessage(ctx *macaron.Context, req SendMessageReq) (err error
 		recipients = append(recipients, msg.BCCList...)
 
 		// Send clear text message to remaining recipients
+		clearOutgoing := &backend.OutgoingMessage{
+			Message: msg,
+			MessagePackage: &backend.MessagePackage{Body: req.ClearBody},
+			Attachments: clearAttachments,
+		}
 		for _, email := range recipients {
 			alreadySent := false
 			for _, pkg := range req.Packages {
@@ -518,18 +635,51 @@ func (api *Api) SendMessage(ctx *macaron.Context, req SendMessageReq) (err error
 				continue
 			}
 
-			outgoing.MessagePackage = &backend.MessagePackage{
-				Address: email.Address,
-				Body: req.ClearBody,
-			}
+			clearOutgoing.Recipients = append(clearOutgoing.Recipients, email.Address)
+		}
 
-			err = api.backend.SendMessage(userId, outgoing)
-			if err != nil {
-				return
-			}
+		if len(clearOutgoing.Recipients) > 0 {
+			outgoing = append(outgoing, clearOutgoing)
 		}
 	}
 
+	if req.DeliveryTime > 0 || req.UndoDelay > 0 {
+		return api.scheduleMessage(ctx, userId, msg, outgoing, &req)
+	}
+
+	// Send all messages at once, failures for some recipients don't prevent
+	// the message from being sent to others
+	var failures []*SendMessageFailure
+	err = backend.SendMessages(api.backend.SendBackend, userId, outgoing)
+	if err == backend.ErrSendQueued {
+		// The message will be moved to the Sent folder once delivered
+		api.populateMessage(userId, msg)
+
+		ctx.JSON(200, &SendMessageResp{
+			Resp: Resp{Ok},
+			Sent: msg,
+		})
+		return nil
+	} else if rcptErrs, ok := err.(backend.RecipientsError); ok {
+		total := 0
+		for _, o := range outgoing {
+			total += len(o.GetRecipients())
+		}
+		if len(rcptErrs) >= total {
+			return
+		}
+
+		for _, rcptErr := range rcptErrs {
+			failures = append(failures, &SendMessageFailure{
+				Address: rcptErr.Address,
+				Error: rcptErr.Err.Error(),
+			})
+		}
+		err = nil
+	} else if err != nil {
+		return
+	}
+
 	// Move message to Sent folder
 	msg, err = api.backend.UpdateMessage(userId, &backend.MessageUpdate{
 		Message: &backend.Message{
@@ -549,10 +699,107 @@ func (api *Api) SendMessage(ctx *macaron.Context, req SendMessageReq) (err error
 	ctx.JSON(200, &SendMessageResp{
 		Resp: Resp{Ok},
 		Sent: msg,
+		Failures: failures,
 	})
 	return
 }
 
+// Schedule a message instead of sending it immediately. The message stays in
+// the Scheduled folder until it's sent.
+func (api *Api) scheduleMessage(ctx *macaron.Context, userId string, msg *backend.Message, outgoing []*backend.OutgoingMessage, req *SendMessageReq) error {
+	at := time.Now().Add(time.Duration(req.UndoDelay) * time.Second)
+	if deliveryTime := time.Unix(req.DeliveryTime, 0); deliveryTime.After(at) {
+		at = deliveryTime
+	}
+
+	scheduled, err := api.schedule(userId, msg, outgoing, at)
+	if err != nil {
+		return err
+	}
+
+	api.populateMessage(userId, scheduled)
+
+	ctx.JSON(200, &SendMessageResp{
+		Resp: Resp{Ok},
+		Sent: scheduled,
+		DeliveryTime: at.Unix(),
+	})
+	return nil
+}
+
+// Move a message to the Scheduled folder and schedule its delivery. If it
+// cannot be scheduled, the message is moved back to drafts.
+func (api *Api) schedule(userId string, msg *backend.Message, outgoing []*backend.OutgoingMessage, at time.Time) (*backend.Message, error) {
+	if api.backend.ScheduleBackend == nil {
+		return nil, errors.New("Scheduled sending is not supported")
+	}
+
+	scheduled, err := api.backend.UpdateMessage(userId, &backend.MessageUpdate{
+		Message: &backend.Message{
+			ID: msg.ID,
+			LabelIDs: []string{backend.ScheduledLabel},
+		},
+		LabelIDs: backend.ReplaceLabels,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Moving the message can change its ID
+	msg.ID = scheduled.ID
+
+	if err := api.backend.ScheduleMessages(userId, outgoing, at); err != nil {
+		if _, moveErr := api.moveToDrafts(userId, scheduled.ID); moveErr != nil {
+			log.Println("WARN: cannot move message", scheduled.ID, "of", userId, "back to drafts:", moveErr)
+		}
+		return nil, err
+	}
+
+	return scheduled, nil
+}
+
+func (api *Api) moveToDrafts(userId, msgId string) (*backend.Message, error) {
+	return api.backend.UpdateMessage(userId, &backend.MessageUpdate{
+		Message: &backend.Message{
+			ID: msgId,
+			LabelIDs: []string{backend.DraftLabel},
+		},
+		LabelIDs: backend.ReplaceLabels,
+	})
+}
+
+// Cancel a scheduled message and move it back to drafts.
+func (api *Api) CancelSendMessage(ctx *macaron.Context) (err error) {
+	userId := api.getUserId(ctx)
+
+	msg, err := api.cancelScheduled(userId, ctx.Params("id"))
+	if err != nil {
+		return
+	}
+
+	api.populateMessage(userId, msg)
+
+	ctx.JSON(200, &MessageResp{
+		Resp: Resp{Ok},
+		Message: msg,
+	})
+	return
+}
+
+// Cancel the delivery of a scheduled message. Returns backend.ErrNotScheduled
+// if it isn't scheduled anymore.
+func (api *Api) cancelScheduled(userId, msgId string) (*backend.Message, error) {
+	if api.backend.ScheduleBackend == nil {
+		return nil, backend.ErrNotScheduled
+	}
+
+	if err := api.backend.CancelMessage(userId, msgId); err != nil {
+		return nil, err
+	}
+
+	return api.moveToDrafts(userId, msgId)
+}
+
 func (api *Api) DeleteMessages(ctx *macaron.Context, req BatchReq) {
 	userId := api.getUserId(ctx)
 
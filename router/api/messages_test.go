@@ -0,0 +1,149 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/memory"
+	"github.com/emersion/neutron/backend/queue"
+)
+
+const testUser = "apitest"
+
+// A SendBackend failing temporarily, which signals delivery attempts.
+type failingSendBackend struct {
+	attempts chan struct{}
+}
+
+func (b *failingSendBackend) SendMessage(user string, msg *backend.OutgoingMessage) error {
+	select {
+	case b.attempts <- struct{}{}:
+	default:
+	}
+	return &textproto.Error{Code: 451, Msg: "Try again later"}
+}
+
+func newScheduleApi(t *testing.T, dir string) (*Api, *failingSendBackend) {
+	bkd := backend.New()
+	memory.Use(bkd)
+
+	target := &failingSendBackend{attempts: make(chan struct{}, 1)}
+	bkd.Set(queue.New(&queue.Config{Directory: dir}, target, bkd))
+
+	return &Api{backend: bkd, sessions: map[string]*Session{}}, target
+}
+
+func insertScheduleDraft(t *testing.T, api *Api) (*backend.Message, []*backend.OutgoingMessage) {
+	msg, err := api.backend.InsertMessage(testUser, &backend.Message{
+		Subject: "Hello",
+		Sender: &backend.Email{Address: "alice@example.org"},
+		ToList: []*backend.Email{{Address: "bob@example.org"}},
+		LabelIDs: []string{backend.DraftLabel},
+		Type: backend.DraftType,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outgoing := []*backend.OutgoingMessage{{
+		Message: msg,
+		MessagePackage: &backend.MessagePackage{Body: "Hi Bob!"},
+		Recipients: []string{"bob@example.org"},
+	}}
+	return msg, outgoing
+}
+
+func checkLabel(t *testing.T, api *Api, id, label string) {
+	msg, err := api.backend.GetMessage(testUser, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.LabelIDs) != 1 || msg.LabelIDs[0] != label {
+		t.Errorf("Message labels = %v, want %v", msg.LabelIDs, label)
+	}
+}
+
+func TestApi_cancelScheduled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "neutron-api-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	api, target := newScheduleApi(t, dir)
+	msg, outgoing := insertScheduleDraft(t, api)
+
+	scheduled, err := api.schedule(testUser, msg, outgoing, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal("schedule() =", err)
+	}
+	checkLabel(t, api, scheduled.ID, backend.ScheduledLabel)
+
+	// The message is cancelled before it's due
+	draft, err := api.cancelScheduled(testUser, scheduled.ID)
+	if err != nil {
+		t.Fatal("cancelScheduled() =", err)
+	}
+	checkLabel(t, api, draft.ID, backend.DraftLabel)
+
+	if _, err := api.cancelScheduled(testUser, draft.ID); err != backend.ErrNotScheduled {
+		t.Errorf("cancelScheduled() of a cancelled message = %v, want %v", err, backend.ErrNotScheduled)
+	}
+
+	select {
+	case <-target.attempts:
+		t.Error("Cancelled message has been delivered")
+	default:
+	}
+}
+
+func TestApi_cancelScheduled_attempted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "neutron-api-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	api, target := newScheduleApi(t, dir)
+	msg, outgoing := insertScheduleDraft(t, api)
+
+	scheduled, err := api.schedule(testUser, msg, outgoing, time.Now())
+	if err != nil {
+		t.Fatal("schedule() =", err)
+	}
+
+	select {
+	case <-target.attempts:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Scheduled message hasn't been delivered")
+	}
+
+	// Some recipients may have received the message
+	if _, err := api.cancelScheduled(testUser, scheduled.ID); err != backend.ErrNotScheduled {
+		t.Errorf("cancelScheduled() after a delivery attempt = %v, want %v", err, backend.ErrNotScheduled)
+	}
+	checkLabel(t, api, scheduled.ID, backend.ScheduledLabel)
+}
+
+func TestApi_schedule_failure(t *testing.T) {
+	f, err := ioutil.TempFile("", "neutron-api-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	// The queue directory cannot be created
+	api, _ := newScheduleApi(t, filepath.Join(f.Name(), "queue"))
+	msg, outgoing := insertScheduleDraft(t, api)
+
+	if _, err := api.schedule(testUser, msg, outgoing, time.Now().Add(time.Hour)); err == nil {
+		t.Fatal("schedule() succeeded without a queue directory")
+	}
+	checkLabel(t, api, msg.ID, backend.DraftLabel)
+}
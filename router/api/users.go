@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/base64"
+	"errors"
 	"strings"
 
 	"gopkg.in/macaron.v1"
@@ -119,6 +120,9 @@ func (api *Api) CreateUser(ctx *macaron.Context, req CreateUserReq) (err error)
 	if err != nil {
 		return
 	}
+	if domain.VerifyCode != "" {
+		return errors.New("Domain isn't available")
+	}
 
 	email := req.Username + "@" + domain.DomainName
 
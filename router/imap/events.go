@@ -0,0 +1,156 @@
+package imap
+
+import (
+	"log"
+	"time"
+
+	imapbackend "github.com/emersion/go-imap/backend"
+
+	"github.com/emersion/neutron/backend"
+)
+
+// Send updates to clients. The user's lock must be held: the server receives
+// updates without calling back into the backend.
+func (u *user) notify(updates ...imapbackend.Update) []imapbackend.Update {
+	for _, update := range updates {
+		// Done lazily creates its channel, make sure it's created before the
+		// server receives the update
+		update.Done()
+		u.be.updates <- update
+	}
+	return updates
+}
+
+// Wait for updates to be sent to clients. The user's lock must not be held.
+func wait(updates []imapbackend.Update) {
+	for _, update := range updates {
+		<-update.Done()
+	}
+}
+
+// Apply a message change to opened mailboxes and notify clients. msg is nil if
+// the message has been deleted. Changes which have already been applied are
+// ignored. The user's lock must be held.
+func (u *user) apply(id string, msg *backend.Message) []imapbackend.Update {
+	var updates []imapbackend.Update
+	for _, mbox := range u.mailboxes {
+		if !mbox.loaded {
+			continue
+		}
+
+		i := mbox.index(id)
+		in := msg != nil && hasLabel(msg, mbox.label)
+
+		if i >= 0 && !in {
+			mbox.remove(i)
+			updates = append(updates, &imapbackend.ExpungeUpdate{
+				Update: mbox.newUpdate(),
+				SeqNum: uint32(i + 1),
+			})
+		} else if i >= 0 {
+			flags := mbox.messages[i].flags()
+			mbox.messages[i].Message = copyMessage(msg)
+			if !flagsEqual(flags, mbox.messages[i].flags()) {
+				updates = append(updates, mbox.flagsUpdate(i))
+			}
+		} else if in {
+			mbox.add(msg)
+			updates = append(updates, mbox.existsUpdate())
+		}
+	}
+
+	return u.notify(updates...)
+}
+
+// Forget a deleted mailbox. Its messages are expunged, so that connections
+// which have it selected don't keep stale messages. The user's lock must be
+// held.
+func (u *user) removeMailbox(label string) []imapbackend.Update {
+	mbox, ok := u.mailboxes[label]
+	if !ok {
+		return nil
+	}
+	delete(u.mailboxes, label)
+
+	// The last message is expunged first, so that sequence numbers don't change
+	var updates []imapbackend.Update
+	for i := len(mbox.messages) - 1; i >= 0; i-- {
+		updates = append(updates, &imapbackend.ExpungeUpdate{
+			Update: mbox.newUpdate(),
+			SeqNum: uint32(i + 1),
+		})
+	}
+	mbox.messages = nil
+
+	return u.notify(updates...)
+}
+
+func (u *user) handleEvent(event *backend.Event) {
+	u.locker.Lock()
+	defer u.locker.Unlock()
+
+	for _, delta := range event.Labels {
+		mbox, ok := u.mailboxes[delta.ID]
+		if !ok {
+			continue
+		}
+
+		switch delta.Action {
+		case backend.EventDelete:
+			u.removeMailbox(delta.ID)
+		case backend.EventUpdate:
+			if delta.Label != nil {
+				mbox.setName(delta.Label.Name)
+			}
+		}
+	}
+
+	for _, delta := range event.Messages {
+		if delta.Action == backend.EventDelete {
+			u.apply(delta.ID, nil)
+		} else if delta.Message != nil {
+			u.apply(delta.ID, delta.Message)
+		}
+	}
+}
+
+// Check for changes made by other clients, until all the user's connections
+// are closed.
+func (u *user) poll() {
+	events := u.be.backend.EventsBackend
+	if events == nil {
+		return
+	}
+
+	event, err := events.GetLastEvent(u.id)
+	if err != nil {
+		log.Println("WARN: cannot get last event of", u.username, err)
+		return
+	}
+	last := event.ID
+
+	ticker := time.NewTicker(u.be.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-u.stop:
+			return
+		case <-ticker.C:
+		}
+
+		event, err := events.GetEventsAfter(u.id, last)
+		if err != nil {
+			log.Println("WARN: cannot get events of", u.username, err)
+
+			// The event may have expired, start again from the last one
+			if event, err = events.GetLastEvent(u.id); err == nil {
+				last = event.ID
+			}
+			continue
+		}
+
+		last = event.ID
+		u.handleEvent(event)
+	}
+}
@@ -0,0 +1,226 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+
+	"github.com/emersion/neutron/backend"
+	_textproto "github.com/emersion/neutron/backend/util/textproto"
+)
+
+// A message whose body is only fetched when needed.
+type lazyMessage struct {
+	*message
+	user *user
+	formatted []byte
+}
+
+func (u *user) lazyMessage(msg *message) *lazyMessage {
+	return &lazyMessage{message: msg, user: u}
+}
+
+// Get the formatted message. Attachments aren't included.
+func (m *lazyMessage) bytes() ([]byte, error) {
+	if m.formatted == nil {
+		full, err := m.user.be.backend.GetMessage(m.user.id, m.ID)
+		if err != nil {
+			return nil, err
+		}
+		m.formatted = []byte(_textproto.FormatMessage(full))
+	}
+	return m.formatted, nil
+}
+
+// Split a formatted message into its header, including the final blank line,
+// and its body.
+func splitMessage(b []byte) (header, body []byte) {
+	i := bytes.Index(b, []byte("\r\n\r\n"))
+	if i < 0 {
+		return b, nil
+	}
+	return b[:i+4], b[i+4:]
+}
+
+func getAddress(email *backend.Email) *imap.Address {
+	addr := &imap.Address{PersonalName: email.Name}
+	parts := strings.SplitN(email.Address, "@", 2)
+	addr.MailboxName = parts[0]
+	if len(parts) == 2 {
+		addr.HostName = parts[1]
+	}
+	return addr
+}
+
+func getAddressList(emails []*backend.Email) []*imap.Address {
+	var list []*imap.Address
+	for _, email := range emails {
+		list = append(list, getAddress(email))
+	}
+	return list
+}
+
+func getEnvelope(msg *backend.Message) *imap.Envelope {
+	env := &imap.Envelope{
+		Date: time.Unix(msg.Time, 0),
+		Subject: msg.Subject,
+		To: getAddressList(msg.ToList),
+		Cc: getAddressList(msg.CCList),
+		Bcc: getAddressList(msg.BCCList),
+		InReplyTo: msg.InReplyTo,
+	}
+
+	if msg.Sender != nil {
+		from := []*imap.Address{getAddress(msg.Sender)}
+		env.From = from
+		env.Sender = from
+		env.ReplyTo = from
+	}
+	if msg.ReplyTo != nil {
+		env.ReplyTo = []*imap.Address{getAddress(msg.ReplyTo)}
+	}
+	if msg.ExternalID != "" {
+		env.MessageId = "<" + msg.ExternalID + ">"
+	}
+
+	return env
+}
+
+// Formatted messages only contain an HTML part.
+func getBodyStructure(body []byte) *imap.BodyStructure {
+	return &imap.BodyStructure{
+		MIMEType: "text",
+		MIMESubType: "html",
+		Params: map[string]string{"charset": "utf-8"},
+		Encoding: "8bit",
+		Size: uint32(len(body)),
+		Lines: uint32(bytes.Count(body, []byte("\n"))),
+	}
+}
+
+// Keep only some fields of a header, or remove them if not is true.
+func filterHeader(header []byte, fields []string, not bool) []byte {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(header)))
+	h, err := r.ReadMIMEHeader()
+	if err != nil {
+		return nil
+	}
+
+	filtered := textproto.MIMEHeader{}
+	for k, v := range h {
+		found := false
+		for _, field := range fields {
+			if textproto.CanonicalMIMEHeaderKey(field) == k {
+				found = true
+				break
+			}
+		}
+
+		if found != not {
+			filtered[k] = v
+		}
+	}
+
+	return []byte(_textproto.FormatHeader(filtered) + "\r\n")
+}
+
+// Get a body section of a formatted message, as defined in RFC 3501 section
+// 6.4.5. Formatted messages have a single part, so the only valid part is 1.
+func getBodySection(b []byte, section *imap.BodySectionName) []byte {
+	header, body := splitMessage(b)
+
+	if len(section.Path) > 0 {
+		if len(section.Path) > 1 || section.Path[0] != 1 {
+			return nil
+		}
+
+		switch section.Specifier {
+		case imap.EntireSpecifier:
+			return body
+		case imap.MIMESpecifier:
+			return filterHeader(header, []string{"Content-Type"}, false)
+		}
+		return nil
+	}
+
+	switch section.Specifier {
+	case imap.HeaderSpecifier:
+		if len(section.Fields) == 0 {
+			return header
+		}
+		return filterHeader(header, section.Fields, section.NotFields)
+	case imap.TextSpecifier:
+		return body
+	}
+	return b
+}
+
+// Fetch a message's items. The user's lock must be held.
+func (mbox *mailbox) fetch(msg *message, items []imap.FetchItem) (*imap.Message, error) {
+	u := mbox.user
+	lazy := u.lazyMessage(msg)
+
+	fetched := imap.NewMessage(uint32(mbox.index(msg.ID) + 1), items)
+	seen := false
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			fetched.Envelope = getEnvelope(msg.Message)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			b, err := lazy.bytes()
+			if err != nil {
+				return nil, err
+			}
+			_, body := splitMessage(b)
+			fetched.BodyStructure = getBodyStructure(body)
+		case imap.FetchFlags:
+			fetched.Flags = msg.flags()
+		case imap.FetchInternalDate:
+			fetched.InternalDate = time.Unix(msg.Time, 0)
+		case imap.FetchRFC822Size:
+			b, err := lazy.bytes()
+			if err != nil {
+				return nil, err
+			}
+			fetched.Size = uint32(len(b))
+		case imap.FetchUid:
+			fetched.Uid = msg.uid
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				return nil, err
+			}
+
+			b, err := lazy.bytes()
+			if err != nil {
+				return nil, err
+			}
+			fetched.Body[section] = bytes.NewReader(section.ExtractPartial(getBodySection(b, section)))
+
+			if !section.Peek {
+				seen = true
+			}
+		}
+	}
+
+	// Fetching a body section sets the \Seen flag
+	if seen && msg.IsRead == 0 {
+		m, err := u.be.backend.UpdateMessage(u.id, &backend.MessageUpdate{
+			Message: &backend.Message{ID: msg.ID, IsRead: 1},
+			IsRead: true,
+		})
+		if err != nil {
+			return nil, err
+		}
+		u.apply(m.ID, m)
+
+		fetched.Items[imap.FetchFlags] = nil
+		fetched.Flags = msg.flags()
+	}
+
+	return fetched, nil
+}
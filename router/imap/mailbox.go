@@ -0,0 +1,554 @@
+package imap
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+
+	"github.com/emersion/neutron/backend"
+	_textproto "github.com/emersion/neutron/backend/util/textproto"
+)
+
+const delimiter = "/"
+
+// Flags supported by mailboxes. \Answered and \Draft cannot be changed.
+var (
+	mailboxFlags = []string{imap.SeenFlag, imap.AnsweredFlag, imap.FlaggedFlag, imap.DeletedFlag, imap.DraftFlag}
+	permanentFlags = []string{imap.SeenFlag, imap.FlaggedFlag, imap.DeletedFlag}
+)
+
+// A message in a mailbox. Its body isn't kept in memory.
+type message struct {
+	*backend.Message
+	uid uint32
+	// The \Deleted flag, only kept until the mailbox is expunged
+	deleted bool
+}
+
+func (msg *message) flags() []string {
+	var flags []string
+	if msg.IsRead != 0 {
+		flags = append(flags, imap.SeenFlag)
+	}
+	if msg.IsReplied != 0 || msg.IsRepliedAll != 0 {
+		flags = append(flags, imap.AnsweredFlag)
+	}
+	if hasLabel(msg.Message, backend.StarredLabel) {
+		flags = append(flags, imap.FlaggedFlag)
+	}
+	if msg.deleted {
+		flags = append(flags, imap.DeletedFlag)
+	}
+	if msg.Type == backend.DraftType {
+		flags = append(flags, imap.DraftFlag)
+	}
+	return flags
+}
+
+func hasLabel(msg *backend.Message, label string) bool {
+	for _, id := range msg.LabelIDs {
+		if id == label {
+			return true
+		}
+	}
+	return false
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if imap.CanonicalFlag(f) == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func flagsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply a STORE operation on flags.
+func updateFlags(current []string, op imap.FlagsOp, flags []string) []string {
+	switch op {
+	case imap.SetFlags:
+		return flags
+	case imap.AddFlags:
+		return append(current, flags...)
+	case imap.RemoveFlags:
+		var updated []string
+		for _, flag := range current {
+			if !hasFlag(flags, flag) {
+				updated = append(updated, flag)
+			}
+		}
+		return updated
+	}
+	return current
+}
+
+// Keep a copy of a message, without its body. Backends can modify the
+// messages they return.
+func copyMessage(msg *backend.Message) *backend.Message {
+	m := *msg
+	m.Body = ""
+	m.Attachments = nil
+	m.LabelIDs = append([]string(nil), msg.LabelIDs...)
+	return &m
+}
+
+// A mailbox, showing messages with a label. Messages are sorted by UID. All
+// fields but name must only be accessed with the user's lock held.
+type mailbox struct {
+	user *user
+	label string
+	// Read without the user's lock by go-imap when dispatching updates, use
+	// Name and setName
+	name atomic.Value
+	attr string
+
+	loaded bool
+	uidNext uint32
+	messages []*message
+}
+
+// Load the mailbox's messages, if not already done.
+func (mbox *mailbox) load() error {
+	if mbox.loaded {
+		return nil
+	}
+
+	u := mbox.user
+	msgs, _, err := u.be.backend.ListMessages(u.id, &backend.MessagesFilter{Label: mbox.label})
+	if err != nil {
+		return err
+	}
+
+	// Older messages get lower UIDs
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].Time < msgs[j].Time
+	})
+
+	mbox.uidNext = 1
+	for _, msg := range msgs {
+		mbox.add(msg)
+	}
+
+	mbox.loaded = true
+	return nil
+}
+
+func (mbox *mailbox) add(msg *backend.Message) {
+	mbox.messages = append(mbox.messages, &message{
+		Message: copyMessage(msg),
+		uid: mbox.uidNext,
+	})
+	mbox.uidNext++
+}
+
+// Get the index of a message, or -1 if it isn't in this mailbox.
+func (mbox *mailbox) index(id string) int {
+	for i, msg := range mbox.messages {
+		if msg.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (mbox *mailbox) remove(i int) {
+	mbox.messages = append(mbox.messages[:i], mbox.messages[i+1:]...)
+}
+
+// Get messages matching a sequence set. A copy of the list is returned, so that
+// it can be iterated while messages are removed.
+func (mbox *mailbox) match(uid bool, seqset *imap.SeqSet) []*message {
+	var matched []*message
+	for i, msg := range mbox.messages {
+		id := uint32(i + 1)
+		if uid {
+			id = msg.uid
+		}
+
+		// "*" is the last message
+		last := i == len(mbox.messages) - 1
+		if seqset.Contains(id) || last && seqset.Contains(0) {
+			matched = append(matched, msg)
+		}
+	}
+	return matched
+}
+
+func (mbox *mailbox) newUpdate() imapbackend.Update {
+	return imapbackend.NewUpdate(mbox.user.username, mbox.Name())
+}
+
+// Notify clients that the number of messages has changed.
+func (mbox *mailbox) existsUpdate() imapbackend.Update {
+	status := imap.NewMailboxStatus(mbox.Name(), []imap.StatusItem{imap.StatusMessages})
+	status.Messages = uint32(len(mbox.messages))
+	return &imapbackend.MailboxUpdate{Update: mbox.newUpdate(), MailboxStatus: status}
+}
+
+// Notify clients that a message's flags have changed.
+func (mbox *mailbox) flagsUpdate(i int) imapbackend.Update {
+	msg := mbox.messages[i]
+	fetched := imap.NewMessage(uint32(i + 1), []imap.FetchItem{imap.FetchFlags, imap.FetchUid})
+	fetched.Flags = msg.flags()
+	fetched.Uid = msg.uid
+	return &imapbackend.MessageUpdate{Update: mbox.newUpdate(), Message: fetched}
+}
+
+func (mbox *mailbox) Name() string {
+	name, _ := mbox.name.Load().(string)
+	return name
+}
+
+func (mbox *mailbox) setName(name string) {
+	mbox.name.Store(name)
+}
+
+func (mbox *mailbox) Info() (*imap.MailboxInfo, error) {
+	info := &imap.MailboxInfo{
+		Delimiter: delimiter,
+		Name: mbox.Name(),
+	}
+	if mbox.attr != "" {
+		info.Attributes = []string{mbox.attr}
+	}
+	return info, nil
+}
+
+func (mbox *mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	mbox.user.locker.Lock()
+	defer mbox.user.locker.Unlock()
+
+	if err := mbox.load(); err != nil {
+		return nil, err
+	}
+
+	status := imap.NewMailboxStatus(mbox.Name(), items)
+	status.Flags = mailboxFlags
+	status.PermanentFlags = permanentFlags
+
+	var unseen uint32
+	for i, msg := range mbox.messages {
+		if msg.IsRead == 0 {
+			if unseen == 0 {
+				status.UnseenSeqNum = uint32(i + 1)
+			}
+			unseen++
+		}
+	}
+
+	for _, item := range items {
+		switch item {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(mbox.messages))
+		case imap.StatusRecent:
+			status.Recent = 0
+		case imap.StatusUnseen:
+			status.Unseen = unseen
+		case imap.StatusUidNext:
+			status.UidNext = mbox.uidNext
+		case imap.StatusUidValidity:
+			status.UidValidity = mbox.user.be.uidValidity
+		}
+	}
+
+	return status, nil
+}
+
+// All mailboxes are always subscribed.
+func (mbox *mailbox) SetSubscribed(subscribed bool) error {
+	return nil
+}
+
+func (mbox *mailbox) Check() error {
+	return nil
+}
+
+func (mbox *mailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	mbox.user.locker.Lock()
+	defer mbox.user.locker.Unlock()
+
+	if err := mbox.load(); err != nil {
+		return err
+	}
+
+	for _, msg := range mbox.match(uid, seqset) {
+		fetched, err := mbox.fetch(msg, items)
+		if err != nil {
+			return err
+		}
+		ch <- fetched
+	}
+
+	return nil
+}
+
+func (mbox *mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	mbox.user.locker.Lock()
+	defer mbox.user.locker.Unlock()
+
+	if err := mbox.load(); err != nil {
+		return nil, err
+	}
+
+	var ids []uint32
+	for i, msg := range mbox.messages {
+		seqNum := uint32(i + 1)
+
+		ok, err := mbox.user.lazyMessage(msg).match(seqNum, criteria)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		if uid {
+			ids = append(ids, msg.uid)
+		} else {
+			ids = append(ids, seqNum)
+		}
+	}
+
+	return ids, nil
+}
+
+func (mbox *mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	u := mbox.user
+
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	msg, atts, err := _textproto.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	msg.LabelIDs = []string{mbox.label}
+	msg.Size = len(b)
+	if !date.IsZero() {
+		msg.Time = date.Unix()
+	} else if msg.Time == 0 {
+		msg.Time = time.Now().Unix()
+	}
+
+	switch mbox.label {
+	case backend.DraftLabel:
+		msg.Type = backend.DraftType
+	case backend.SentLabel:
+		msg.Type = backend.SentType
+	}
+	if hasFlag(flags, imap.SeenFlag) {
+		msg.IsRead = 1
+	}
+	if hasFlag(flags, imap.AnsweredFlag) {
+		msg.IsReplied = 1
+	}
+	if hasFlag(flags, imap.FlaggedFlag) && mbox.label != backend.StarredLabel {
+		msg.Starred = 1
+		msg.LabelIDs = append(msg.LabelIDs, backend.StarredLabel)
+	}
+	if hasFlag(flags, imap.DraftFlag) {
+		msg.Type = backend.DraftType
+	}
+
+	// Messages sent from one of the user's addresses belong to it
+	if msg.Sender != nil {
+		owner, addr, err := u.be.backend.GetAddressByEmail(msg.Sender.Address)
+		if err == nil && owner == u.id {
+			msg.AddressID = addr.ID
+		}
+	}
+
+	inserted, err := u.be.backend.InsertMessage(u.id, msg)
+	if err != nil {
+		return err
+	}
+
+	for _, att := range atts {
+		att.MessageID = inserted.ID
+		if _, err := u.be.backend.InsertAttachment(u.id, att.Attachment, att.Data); err != nil {
+			return err
+		}
+	}
+
+	u.locker.Lock()
+	updates := u.apply(inserted.ID, inserted)
+	u.locker.Unlock()
+
+	wait(updates)
+	return nil
+}
+
+func (mbox *mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	u := mbox.user
+
+	u.locker.Lock()
+	var updates []imapbackend.Update
+	err := func() error {
+		if err := mbox.load(); err != nil {
+			return err
+		}
+
+		for _, msg := range mbox.match(uid, seqset) {
+			updated := updateFlags(msg.flags(), op, flags)
+
+			update := &backend.MessageUpdate{Message: &backend.Message{ID: msg.ID}}
+			changed := false
+			if seen := hasFlag(updated, imap.SeenFlag); seen != (msg.IsRead != 0) {
+				update.IsRead = true
+				if seen {
+					update.Message.IsRead = 1
+				}
+				changed = true
+			}
+			if flagged := hasFlag(updated, imap.FlaggedFlag); flagged != hasLabel(msg.Message, backend.StarredLabel) {
+				update.Starred = true
+				update.LabelIDs = backend.RemoveLabels
+				update.Message.LabelIDs = []string{backend.StarredLabel}
+				if flagged {
+					update.LabelIDs = backend.AddLabels
+					update.Message.Starred = 1
+				}
+				changed = true
+			}
+
+			if deleted := hasFlag(updated, imap.DeletedFlag); deleted != msg.deleted {
+				msg.deleted = deleted
+				if !changed {
+					updates = append(updates, u.notify(mbox.flagsUpdate(mbox.index(msg.ID)))...)
+				}
+			}
+
+			if changed {
+				m, err := u.be.backend.UpdateMessage(u.id, update)
+				if err != nil {
+					return err
+				}
+				updates = append(updates, u.apply(m.ID, m)...)
+			}
+		}
+		return nil
+	}()
+	u.locker.Unlock()
+
+	wait(updates)
+	return err
+}
+
+func (mbox *mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	u := mbox.user
+
+	label, _, _, err := u.getLabel(dest)
+	if err != nil {
+		return err
+	}
+
+	u.locker.Lock()
+	var updates []imapbackend.Update
+	err = func() error {
+		if err := mbox.load(); err != nil {
+			return err
+		}
+
+		for _, msg := range mbox.match(uid, seqset) {
+			if hasLabel(msg.Message, label) {
+				continue
+			}
+
+			update := &backend.MessageUpdate{
+				Message: &backend.Message{ID: msg.ID, LabelIDs: []string{label}},
+				LabelIDs: backend.AddLabels,
+			}
+			if label == backend.StarredLabel {
+				update.Starred = true
+				update.Message.Starred = 1
+			}
+
+			m, err := u.be.backend.UpdateMessage(u.id, update)
+			if err != nil {
+				return err
+			}
+			updates = append(updates, u.apply(m.ID, m)...)
+		}
+		return nil
+	}()
+	u.locker.Unlock()
+
+	wait(updates)
+	return err
+}
+
+// Remove messages flagged as deleted from this mailbox. Messages which aren't
+// in any other mailbox are deleted.
+func (mbox *mailbox) Expunge() error {
+	u := mbox.user
+
+	u.locker.Lock()
+	var updates []imapbackend.Update
+	err := func() error {
+		if err := mbox.load(); err != nil {
+			return err
+		}
+
+		for _, msg := range append([]*message(nil), mbox.messages...) {
+			if !msg.deleted {
+				continue
+			}
+
+			remaining := false
+			for _, label := range msg.LabelIDs {
+				if label != mbox.label && label != backend.StarredLabel {
+					remaining = true
+				}
+			}
+
+			if !remaining {
+				if err := u.be.backend.DeleteMessage(u.id, msg.ID); err != nil {
+					return err
+				}
+				updates = append(updates, u.apply(msg.ID, nil)...)
+				continue
+			}
+
+			update := &backend.MessageUpdate{
+				Message: &backend.Message{ID: msg.ID, LabelIDs: []string{mbox.label}},
+				LabelIDs: backend.RemoveLabels,
+			}
+			if mbox.label == backend.StarredLabel {
+				update.Starred = true
+			}
+
+			m, err := u.be.backend.UpdateMessage(u.id, update)
+			if err != nil {
+				return err
+			}
+			updates = append(updates, u.apply(m.ID, m)...)
+		}
+		return nil
+	}()
+	u.locker.Unlock()
+
+	wait(updates)
+	return err
+}
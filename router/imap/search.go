@@ -0,0 +1,120 @@
+package imap
+
+import (
+	"bytes"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+
+	_textproto "github.com/emersion/neutron/backend/util/textproto"
+)
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// Check if a message header contains a field, as defined in RFC 3501 section
+// 6.4.4. The subject is compared decoded.
+func (m *lazyMessage) matchHeader(key, value string) bool {
+	h := _textproto.GetMessageHeader(m.Message)
+	h.Set("Subject", m.Subject)
+
+	values, ok := h[textproto.CanonicalMIMEHeaderKey(key)]
+	if !ok {
+		return false
+	}
+	for _, v := range values {
+		if containsFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if a message matches search criteria. The user's lock must be held.
+func (m *lazyMessage) match(seqNum uint32, c *imap.SearchCriteria) (bool, error) {
+	if c.SeqNum != nil && !c.SeqNum.Contains(seqNum) {
+		return false, nil
+	}
+	if c.Uid != nil && !c.Uid.Contains(m.uid) {
+		return false, nil
+	}
+
+	// The internal date is the date the message was sent
+	date := time.Unix(m.Time, 0)
+	if !c.Since.IsZero() && date.Before(c.Since) || !c.SentSince.IsZero() && date.Before(c.SentSince) {
+		return false, nil
+	}
+	if !c.Before.IsZero() && !date.Before(c.Before) || !c.SentBefore.IsZero() && !date.Before(c.SentBefore) {
+		return false, nil
+	}
+
+	for key, values := range c.Header {
+		for _, value := range values {
+			if !m.matchHeader(key, value) {
+				return false, nil
+			}
+		}
+	}
+
+	flags := m.flags()
+	for _, flag := range c.WithFlags {
+		if !hasFlag(flags, imap.CanonicalFlag(flag)) {
+			return false, nil
+		}
+	}
+	for _, flag := range c.WithoutFlags {
+		if hasFlag(flags, imap.CanonicalFlag(flag)) {
+			return false, nil
+		}
+	}
+
+	if len(c.Body) > 0 || len(c.Text) > 0 || c.Larger > 0 || c.Smaller > 0 {
+		b, err := m.bytes()
+		if err != nil {
+			return false, err
+		}
+		_, body := splitMessage(b)
+
+		for _, s := range c.Body {
+			if !containsFold(string(body), s) {
+				return false, nil
+			}
+		}
+		for _, s := range c.Text {
+			if !bytes.Contains(bytes.ToLower(b), bytes.ToLower([]byte(s))) {
+				return false, nil
+			}
+		}
+
+		if c.Larger > 0 && uint32(len(b)) <= c.Larger {
+			return false, nil
+		}
+		if c.Smaller > 0 && uint32(len(b)) >= c.Smaller {
+			return false, nil
+		}
+	}
+
+	for _, not := range c.Not {
+		ok, err := m.match(seqNum, not)
+		if err != nil || ok {
+			return false, err
+		}
+	}
+	for _, or := range c.Or {
+		ok, err := m.match(seqNum, or[0])
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			ok, err = m.match(seqNum, or[1])
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+	}
+
+	return true, nil
+}
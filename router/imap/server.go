@@ -0,0 +1,112 @@
+// Exposes users' messages over IMAP. Labels are mailboxes and changes made by
+// other clients are received from events.
+package imap
+
+import (
+	"crypto/tls"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/server"
+
+	"github.com/emersion/neutron/backend"
+)
+
+// Default interval between two events checks.
+const defaultPollInterval = 10 * time.Second
+
+type Config struct {
+	// Address to listen on.
+	Addr string
+	// TLS certificate and key files. If set, STARTTLS is supported.
+	TlsCert string
+	TlsKey string
+	// Allow authentication over unencrypted connections.
+	AllowInsecureAuth bool
+	// Interval between two events checks, in seconds.
+	PollInterval int
+}
+
+// Implements go-imap's backend. Users logged in several times share the same
+// state, so that all their connections agree on messages UIDs.
+type imapBackend struct {
+	backend *backend.Backend
+	interval time.Duration
+	// UIDs are only kept in memory, they change when the server restarts
+	uidValidity uint32
+	updates chan imapbackend.Update
+
+	locker sync.Mutex
+	users map[string]*user
+}
+
+func (be *imapBackend) Login(connInfo *imap.ConnInfo, username, password string) (imapbackend.User, error) {
+	u, err := be.backend.Auth(username, password)
+	if err != nil {
+		return nil, imapbackend.ErrInvalidCredentials
+	}
+
+	be.locker.Lock()
+	defer be.locker.Unlock()
+
+	if usr, ok := be.users[u.ID]; ok {
+		usr.conns++
+		return usr, nil
+	}
+
+	usr := newUser(be, u)
+	be.users[u.ID] = usr
+	go usr.poll()
+	return usr, nil
+}
+
+func (be *imapBackend) Updates() <-chan imapbackend.Update {
+	return be.updates
+}
+
+// Called when a connection is closed.
+func (be *imapBackend) logout(u *user) {
+	be.locker.Lock()
+	defer be.locker.Unlock()
+
+	u.conns--
+	if u.conns == 0 {
+		close(u.stop)
+		delete(be.users, u.id)
+	}
+}
+
+// An IMAP server exposing users' messages.
+type Server struct {
+	*server.Server
+}
+
+// Create a new IMAP server. It isn't listening yet.
+func New(bkd *backend.Backend, config *Config) (*Server, error) {
+	be := &imapBackend{
+		backend: bkd,
+		interval: defaultPollInterval,
+		uidValidity: uint32(time.Now().Unix()),
+		updates: make(chan imapbackend.Update),
+		users: map[string]*user{},
+	}
+	if config.PollInterval > 0 {
+		be.interval = time.Duration(config.PollInterval) * time.Second
+	}
+
+	s := &Server{server.New(be)}
+	s.Addr = config.Addr
+	s.AllowInsecureAuth = config.AllowInsecureAuth
+
+	if config.TlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(config.TlsCert, config.TlsKey)
+		if err != nil {
+			return nil, err
+		}
+		s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	return s, nil
+}
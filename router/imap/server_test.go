@@ -0,0 +1,347 @@
+package imap_test
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/memory"
+	imapserver "github.com/emersion/neutron/router/imap"
+)
+
+// An EventsBackend keeping all events, so that changes made by other clients
+// can be simulated.
+type eventsBackend struct {
+	lock sync.Mutex
+	events []*backend.Event
+}
+
+func (b *eventsBackend) InsertEvent(user string, event *backend.Event) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	event.ID = strconv.Itoa(len(b.events) + 1)
+	b.events = append(b.events, event)
+	return nil
+}
+
+func (b *eventsBackend) GetLastEvent(user string) (*backend.Event, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return &backend.Event{ID: strconv.Itoa(len(b.events))}, nil
+}
+
+func (b *eventsBackend) GetEventsAfter(user, id string) (*backend.Event, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	i, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := &backend.Event{ID: strconv.Itoa(len(b.events))}
+	for _, event := range b.events[i:] {
+		merged.Messages = append(merged.Messages, event.Messages...)
+		merged.Labels = append(merged.Labels, event.Labels...)
+	}
+	return merged, nil
+}
+
+func (b *eventsBackend) DeleteAllEvents(user string) error {
+	return nil
+}
+
+const (
+	testUsername = "alice"
+	testPassword = "secret"
+)
+
+var testTime = time.Date(2017, time.January, 1, 12, 0, 0, 0, time.UTC).Unix()
+
+func newBackend(t *testing.T) (*backend.Backend, *eventsBackend, string) {
+	bkd := backend.New()
+	memory.Use(bkd)
+	events := &eventsBackend{}
+	bkd.Set(events)
+
+	u, err := bkd.InsertUser(&backend.User{Name: testUsername}, testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, subject := range []string{"Hello", "Meeting"} {
+		_, err := bkd.InsertMessage(u.ID, &backend.Message{
+			Subject: subject,
+			Sender: &backend.Email{Name: "Bob", Address: "bob@example.org"},
+			ToList: []*backend.Email{{Address: "alice@example.org"}},
+			Body: "Hi Alice!",
+			Time: testTime + int64(i),
+			LabelIDs: []string{backend.InboxLabel},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := bkd.InsertLabel(u.ID, &backend.Label{Name: "Work", Type: backend.LabelMessage}); err != nil {
+		t.Fatal(err)
+	}
+
+	return bkd, events, u.ID
+}
+
+// Start a server for bkd. The caller must close it.
+func startServer(t *testing.T, bkd *backend.Backend) (*imapserver.Server, string) {
+	s, err := imapserver.New(bkd, &imapserver.Config{AllowInsecureAuth: true, PollInterval: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+
+	return s, l.Addr().String()
+}
+
+// Connect, log in and select INBOX.
+func dial(t *testing.T, addr string) *client.Client {
+	c, err := client.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Login(testUsername, testPassword); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Select("INBOX", false); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func fetch(t *testing.T, c *client.Client, items ...imap.FetchItem) []*imap.Message {
+	seqset, _ := imap.ParseSeqSet("1:*")
+	ch := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Fetch(seqset, items, ch)
+	}()
+
+	var msgs []*imap.Message
+	for msg := range ch {
+		msgs = append(msgs, msg)
+	}
+	if err := <-done; err != nil {
+		t.Fatal("Fetch() =", err)
+	}
+	return msgs
+}
+
+// Wait for a unilateral update matching a condition. The update is received
+// while polling the server with NOOP.
+func waitUpdate(t *testing.T, c *client.Client, updates <-chan client.Update, match func(client.Update) bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if err := c.Noop(); err != nil {
+			t.Fatal(err)
+		}
+
+		for drained := false; !drained; {
+			select {
+			case update := <-updates:
+				if match(update) {
+					return
+				}
+			default:
+				drained = true
+			}
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("Timed out waiting for an update")
+}
+
+func TestServer(t *testing.T) {
+	bkd, _, userId := newBackend(t)
+	s, addr := startServer(t, bkd)
+	defer s.Close()
+
+	c := dial(t, addr)
+	defer c.Logout()
+
+	ch := make(chan *imap.MailboxInfo, 20)
+	if err := c.List("", "*", ch); err != nil {
+		t.Fatal("List() =", err)
+	}
+	names := map[string]bool{}
+	for info := range ch {
+		names[info.Name] = true
+	}
+	for _, name := range []string{"INBOX", "Drafts", "Sent", "Trash", "Work"} {
+		if !names[name] {
+			t.Errorf("List() = %v, want %v", names, name)
+		}
+	}
+
+	if n := c.Mailbox().Messages; n != 2 {
+		t.Fatalf("Select() messages = %v, want 2", n)
+	}
+
+	// Older messages come first
+	msgs := fetch(t, c, imap.FetchEnvelope, imap.FetchFlags, imap.FetchUid)
+	if len(msgs) != 2 {
+		t.Fatalf("Fetch() returned %v messages, want 2", len(msgs))
+	}
+	if msgs[0].Envelope.Subject != "Hello" || msgs[1].Envelope.Subject != "Meeting" {
+		t.Errorf("Fetch() subjects = %q, %q, want Hello, Meeting", msgs[0].Envelope.Subject, msgs[1].Envelope.Subject)
+	}
+	if msgs[0].Uid >= msgs[1].Uid {
+		t.Errorf("Fetch() UIDs = %v, %v, want increasing UIDs", msgs[0].Uid, msgs[1].Uid)
+	}
+
+	seqset, _ := imap.ParseSeqSet("1")
+	if err := c.Store(seqset, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.SeenFlag}, nil); err != nil {
+		t.Fatal("Store() =", err)
+	}
+	inbox, _, err := bkd.ListMessages(userId, &backend.MessagesFilter{Label: backend.InboxLabel})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range inbox {
+		if read := msg.IsRead != 0; read != (msg.Subject == "Hello") {
+			t.Errorf("Message %q read = %v after storing \\Seen on the first message", msg.Subject, read)
+		}
+	}
+
+	if err := c.Store(seqset, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil); err != nil {
+		t.Fatal("Store() =", err)
+	}
+	expunged := make(chan uint32, 10)
+	if err := c.Expunge(expunged); err != nil {
+		t.Fatal("Expunge() =", err)
+	}
+	if seqNum := <-expunged; seqNum != 1 {
+		t.Errorf("Expunge() = %v, want 1", seqNum)
+	}
+	if _, total, err := bkd.ListMessages(userId, &backend.MessagesFilter{Label: backend.InboxLabel}); err != nil || total != 1 {
+		t.Errorf("ListMessages() after expunging = %v, %v, want 1 message", total, err)
+	}
+}
+
+func TestServer_events(t *testing.T) {
+	bkd, events, userId := newBackend(t)
+	s, addr := startServer(t, bkd)
+	defer s.Close()
+
+	c := dial(t, addr)
+	defer c.Logout()
+	updates := make(chan client.Update, 10)
+	c.Updates = updates
+
+	// Another client receives a message
+	msg, err := bkd.InsertMessage(userId, &backend.Message{
+		Subject: "News",
+		Sender: &backend.Email{Address: "carol@example.org"},
+		Time: testTime + 2,
+		LabelIDs: []string{backend.InboxLabel},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events.InsertEvent(userId, backend.NewMessageDeltaEvent(msg.ID, backend.EventCreate, msg))
+	waitUpdate(t, c, updates, func(update client.Update) bool {
+		mboxUpdate, ok := update.(*client.MailboxUpdate)
+		return ok && mboxUpdate.Mailbox.Messages == 3
+	})
+
+	msgs := fetch(t, c, imap.FetchEnvelope)
+	if len(msgs) != 3 || msgs[2].Envelope.Subject != "News" {
+		t.Errorf("Fetch() after a message is received = %v messages, want News last", len(msgs))
+	}
+
+	// Another client deletes it
+	if err := bkd.DeleteMessage(userId, msg.ID); err != nil {
+		t.Fatal(err)
+	}
+	events.InsertEvent(userId, backend.NewMessageDeltaEvent(msg.ID, backend.EventDelete, nil))
+	waitUpdate(t, c, updates, func(update client.Update) bool {
+		expunge, ok := update.(*client.ExpungeUpdate)
+		return ok && expunge.SeqNum == 3
+	})
+
+	if msgs := fetch(t, c, imap.FetchEnvelope); len(msgs) != 2 {
+		t.Errorf("Fetch() after a message is deleted = %v messages, want 2", len(msgs))
+	}
+}
+
+func TestServer_concurrent(t *testing.T) {
+	bkd, _, _ := newBackend(t)
+	s, addr := startServer(t, bkd)
+	defer s.Close()
+
+	// Connections of the same user share its state
+	a := dial(t, addr)
+	defer a.Logout()
+	b := dial(t, addr)
+	defer b.Logout()
+
+	done := make(chan error, 2)
+	go func() {
+		seqset, _ := imap.ParseSeqSet("1:*")
+		for i := 0; i < 20; i++ {
+			var op imap.FlagsOp = imap.AddFlags
+			if i%2 == 1 {
+				op = imap.RemoveFlags
+			}
+			item := imap.FormatFlagsOp(op, false)
+			if err := a.Store(seqset, item, []interface{}{imap.SeenFlag, imap.FlaggedFlag}, nil); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	go func() {
+		seqset, _ := imap.ParseSeqSet("1:*")
+		for i := 0; i < 20; i++ {
+			ch := make(chan *imap.Message, 10)
+			if err := b.Fetch(seqset, []imap.FetchItem{imap.FetchFlags, imap.FetchEnvelope}, ch); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	timeout := time.After(10 * time.Second)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Error("Concurrent command failed:", err)
+			}
+		case <-timeout:
+			t.Fatal("Concurrent commands on two connections timed out")
+		}
+	}
+
+	// Both connections agree on the messages' flags
+	for _, c := range []*client.Client{a, b} {
+		for _, msg := range fetch(t, c, imap.FetchFlags) {
+			if len(msg.Flags) != 0 {
+				t.Errorf("Message %v flags = %v, want none", msg.SeqNum, msg.Flags)
+			}
+		}
+	}
+}
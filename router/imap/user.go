@@ -0,0 +1,213 @@
+package imap
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+
+	"github.com/emersion/neutron/backend"
+)
+
+var errSystemMailbox = errors.New("System mailboxes cannot be modified")
+
+// Color of labels created from IMAP.
+const defaultLabelColor = "#7272a7"
+
+// Mailboxes of system labels.
+var systemMailboxes = []struct{
+	label, name, attr string
+}{
+	{backend.InboxLabel, "INBOX", ""},
+	{backend.DraftLabel, "Drafts", imap.DraftsAttr},
+	{backend.SentLabel, "Sent", imap.SentAttr},
+	{backend.ArchiveLabel, "Archive", imap.ArchiveAttr},
+	{backend.SpamLabel, "Spam", imap.JunkAttr},
+	{backend.TrashLabel, "Trash", imap.TrashAttr},
+	{backend.StarredLabel, "Starred", imap.FlaggedAttr},
+}
+
+func isSystemLabel(label string) bool {
+	for _, mbox := range systemMailboxes {
+		if mbox.label == label {
+			return true
+		}
+	}
+	return false
+}
+
+// A logged in user. It's shared by all the user's connections.
+type user struct {
+	be *imapBackend
+	id string
+	username string
+	// Number of connections using this user
+	conns int
+	// Closed when the last connection logs out
+	stop chan struct{}
+
+	locker sync.Mutex
+	// Mailboxes which have been opened, by label ID
+	mailboxes map[string]*mailbox
+}
+
+func newUser(be *imapBackend, u *backend.User) *user {
+	return &user{
+		be: be,
+		id: u.ID,
+		username: u.Name,
+		conns: 1,
+		stop: make(chan struct{}),
+		mailboxes: map[string]*mailbox{},
+	}
+}
+
+func (u *user) Username() string {
+	return u.username
+}
+
+// Get the label ID, the canonical name and the special-use attribute of a
+// mailbox.
+func (u *user) getLabel(name string) (label, canonical, attr string, err error) {
+	for _, mbox := range systemMailboxes {
+		if mbox.name == name || mbox.label == backend.InboxLabel && strings.EqualFold(name, mbox.name) {
+			return mbox.label, mbox.name, mbox.attr, nil
+		}
+	}
+
+	labels, err := u.be.backend.ListLabels(u.id)
+	if err != nil {
+		return
+	}
+	for _, lbl := range labels {
+		if lbl.Name == name {
+			return lbl.ID, lbl.Name, "", nil
+		}
+	}
+
+	err = imapbackend.ErrNoSuchMailbox
+	return
+}
+
+// Get a mailbox. Its messages are only loaded when needed. The user's lock must
+// be held.
+func (u *user) mailbox(label, name, attr string) *mailbox {
+	mbox, ok := u.mailboxes[label]
+	if !ok {
+		mbox = &mailbox{
+			user: u,
+			label: label,
+			attr: attr,
+		}
+		u.mailboxes[label] = mbox
+	}
+
+	mbox.setName(name)
+	return mbox
+}
+
+func (u *user) getMailbox(name string) (*mailbox, error) {
+	label, name, attr, err := u.getLabel(name)
+	if err != nil {
+		return nil, err
+	}
+
+	u.locker.Lock()
+	defer u.locker.Unlock()
+
+	return u.mailbox(label, name, attr), nil
+}
+
+func (u *user) ListMailboxes(subscribed bool) ([]imapbackend.Mailbox, error) {
+	labels, err := u.be.backend.ListLabels(u.id)
+	if err != nil {
+		return nil, err
+	}
+
+	u.locker.Lock()
+	defer u.locker.Unlock()
+
+	var mailboxes []imapbackend.Mailbox
+	for _, mbox := range systemMailboxes {
+		mailboxes = append(mailboxes, u.mailbox(mbox.label, mbox.name, mbox.attr))
+	}
+	for _, lbl := range labels {
+		mailboxes = append(mailboxes, u.mailbox(lbl.ID, lbl.Name, ""))
+	}
+
+	return mailboxes, nil
+}
+
+func (u *user) GetMailbox(name string) (imapbackend.Mailbox, error) {
+	return u.getMailbox(name)
+}
+
+func (u *user) CreateMailbox(name string) error {
+	if _, _, _, err := u.getLabel(name); err == nil {
+		return imapbackend.ErrMailboxAlreadyExists
+	}
+
+	_, err := u.be.backend.InsertLabel(u.id, &backend.Label{
+		Name: name,
+		Color: defaultLabelColor,
+		Display: 1,
+		Type: backend.LabelMessage,
+	})
+	return err
+}
+
+func (u *user) DeleteMailbox(name string) error {
+	label, _, _, err := u.getLabel(name)
+	if err != nil {
+		return err
+	}
+	if isSystemLabel(label) {
+		return errSystemMailbox
+	}
+
+	if err := u.be.backend.DeleteLabel(u.id, label); err != nil {
+		return err
+	}
+
+	u.locker.Lock()
+	updates := u.removeMailbox(label)
+	u.locker.Unlock()
+
+	wait(updates)
+	return nil
+}
+
+func (u *user) RenameMailbox(existingName, newName string) error {
+	label, _, _, err := u.getLabel(existingName)
+	if err != nil {
+		return err
+	}
+	if isSystemLabel(label) {
+		return errSystemMailbox
+	}
+	if _, _, _, err := u.getLabel(newName); err == nil {
+		return imapbackend.ErrMailboxAlreadyExists
+	}
+
+	_, err = u.be.backend.UpdateLabel(u.id, &backend.LabelUpdate{
+		Label: &backend.Label{ID: label, Name: newName},
+		Name: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	u.locker.Lock()
+	if mbox, ok := u.mailboxes[label]; ok {
+		mbox.setName(newName)
+	}
+	u.locker.Unlock()
+	return nil
+}
+
+func (u *user) Logout() error {
+	u.be.logout(u)
+	return nil
+}
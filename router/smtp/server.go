@@ -0,0 +1,118 @@
+// Receives messages over SMTP or LMTP and delivers them to users' inbox.
+package smtp
+
+import (
+	"crypto/tls"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/emersion/neutron/backend"
+)
+
+type Config struct {
+	// Address to listen on. With LMTP, it's the path of a Unix socket.
+	Addr string
+	// Use LMTP instead of SMTP, e.g. to receive messages from a local MTA.
+	Lmtp bool
+	// Hostname announced to clients.
+	Hostname string
+	// TLS certificate and key files. If set, STARTTLS is supported.
+	TlsCert string
+	TlsKey string
+	// Maximum message size, in bytes. Defaults to DefaultMaxSize.
+	MaxSize int
+	// Encrypt received plaintext messages with the recipient's public key.
+	EncryptIncoming bool
+}
+
+// The default maximum message size, in bytes.
+const DefaultMaxSize = 25 * 1024 * 1024
+
+// A SMTP server accepting messages for addresses of the backend's domains.
+type Server struct {
+	*smtp.Server
+
+	config *Config
+	backend *backend.Backend
+}
+
+func (s *Server) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	return nil, smtp.ErrAuthUnsupported
+}
+
+func (s *Server) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	return &session{server: s}, nil
+}
+
+// Domains added by users can only receive messages once verified.
+func isDomainVerified(domain *backend.Domain) bool {
+	return domain.VerifyCode == "" || domain.VerifyState == backend.DomainVerifyGood
+}
+
+// Get the user owning a recipient address.
+func (s *Server) resolve(to string) (*recipient, error) {
+	i := strings.LastIndexByte(to, '@')
+	if i < 0 {
+		return nil, &smtp.SMTPError{
+			Code: 553,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 3},
+			Message: "Invalid recipient address",
+		}
+	}
+
+	domain, err := s.backend.GetDomainByName(strings.ToLower(to[i+1:]))
+	if err != nil || !isDomainVerified(domain) {
+		return nil, &smtp.SMTPError{
+			Code: 550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message: "Relay access denied",
+		}
+	}
+
+	user, addr, err := s.backend.GetAddressByEmail(to)
+	if err != nil {
+		return nil, &smtp.SMTPError{
+			Code: 550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message: "No such user",
+		}
+	}
+	if addr.Receive == 0 || addr.Status == 0 {
+		return nil, &smtp.SMTPError{
+			Code: 550,
+			EnhancedCode: smtp.EnhancedCode{5, 2, 1},
+			Message: "Mailbox disabled",
+		}
+	}
+
+	return &recipient{to: to, user: user, address: addr}, nil
+}
+
+// Create a new SMTP server. It isn't listening yet.
+func New(bkd *backend.Backend, config *Config) (*Server, error) {
+	s := &Server{
+		config: config,
+		backend: bkd,
+	}
+
+	s.Server = smtp.NewServer(s)
+	s.Addr = config.Addr
+	s.LMTP = config.Lmtp
+	s.Domain = config.Hostname
+	s.MaxMessageBytes = config.MaxSize
+	if s.MaxMessageBytes <= 0 {
+		s.MaxMessageBytes = DefaultMaxSize
+	}
+	s.AuthDisabled = true
+
+	if config.TlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(config.TlsCert, config.TlsKey)
+		if err != nil {
+			return nil, err
+		}
+		s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	return s, nil
+}
@@ -0,0 +1,334 @@
+package smtp_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/memory"
+	smtpserver "github.com/emersion/neutron/router/smtp"
+)
+
+const testMessage = "From: Mallory <mallory@example.com>\r\n" +
+	"To: Alice <alice@example.org>\r\n" +
+	"Subject: Hello\r\n" +
+	"\r\n" +
+	"Hi Alice!\r\n"
+
+const testMessageAttachments = "From: Mallory <mallory@example.com>\r\n" +
+	"To: Alice <alice@example.org>\r\n" +
+	"Subject: Files\r\n" +
+	"Content-Type: multipart/mixed; boundary=frontier\r\n" +
+	"\r\n" +
+	"--frontier\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Here are the files.\r\n" +
+	"--frontier\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"Content-Disposition: attachment; filename=a.txt\r\n" +
+	"\r\n" +
+	"A\r\n" +
+	"--frontier\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"Content-Disposition: attachment; filename=b.txt\r\n" +
+	"\r\n" +
+	"B\r\n" +
+	"--frontier--\r\n"
+
+// A ConversationsBackend failing to insert messages for a user.
+type failingMessages struct {
+	backend.ConversationsBackend
+	user string
+}
+
+func (b *failingMessages) InsertMessage(user string, msg *backend.Message) (*backend.Message, error) {
+	if user == b.user {
+		return nil, errors.New("Mailbox is full")
+	}
+	return b.ConversationsBackend.InsertMessage(user, msg)
+}
+
+// An AttachmentsBackend failing to insert more than one attachment.
+type failingAttachments struct {
+	backend.AttachmentsBackend
+
+	lock sync.Mutex
+	inserted []string
+	deleted []string
+}
+
+func (b *failingAttachments) InsertAttachment(user string, att *backend.Attachment, data []byte) (*backend.Attachment, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if len(b.inserted) > 0 {
+		return nil, errors.New("Disk is full")
+	}
+
+	inserted, err := b.AttachmentsBackend.InsertAttachment(user, att, data)
+	if err == nil {
+		b.inserted = append(b.inserted, inserted.ID)
+	}
+	return inserted, err
+}
+
+func (b *failingAttachments) DeleteAttachment(user, id string) error {
+	b.lock.Lock()
+	b.deleted = append(b.deleted, id)
+	b.lock.Unlock()
+
+	return b.AttachmentsBackend.DeleteAttachment(user, id)
+}
+
+// Create a backend with these users:
+// * alice has alice@example.org and alias@example.org
+// * bob has bob@verified.example, a verified domain added by a user
+// * carol has carol@unverified.example, whose owner didn't verify it
+func newBackend(t *testing.T) *backend.Backend {
+	bkd := backend.New()
+	memory.Use(bkd)
+
+	domains := []*backend.Domain{
+		{DomainName: "example.org"},
+		{DomainName: "verified.example", VerifyCode: "code", VerifyState: backend.DomainVerifyGood},
+		{DomainName: "unverified.example", VerifyCode: "code"},
+	}
+	for _, domain := range domains {
+		if _, err := bkd.InsertDomain(domain); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	addresses := map[string]string{
+		"alice@example.org": "alice",
+		"alias@example.org": "alice",
+		"bob@verified.example": "bob",
+		"carol@unverified.example": "carol",
+	}
+	for email, user := range addresses {
+		if _, err := bkd.InsertAddress(user, &backend.Address{Email: email, Receive: 1, Status: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return bkd
+}
+
+// Start a server for bkd. The caller must close it.
+func startServer(t *testing.T, bkd *backend.Backend, lmtp bool) (*smtpserver.Server, string) {
+	s, err := smtpserver.New(bkd, &smtpserver.Config{Lmtp: lmtp, Hostname: "mx.example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+
+	return s, l.Addr().String()
+}
+
+func dial(t *testing.T, addr string, lmtp bool) *smtp.Client {
+	if !lmtp {
+		c, err := smtp.Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := smtp.NewClientLMTP(conn, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func writeData(t *testing.T, w io.WriteCloser, msg string) error {
+	if _, err := io.WriteString(w, msg); err != nil {
+		t.Fatal(err)
+	}
+	return w.Close()
+}
+
+func countInbox(t *testing.T, bkd *backend.Backend, user string) int {
+	_, total, err := bkd.ListMessages(user, &backend.MessagesFilter{Label: backend.InboxLabel})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return total
+}
+
+func TestServer(t *testing.T) {
+	bkd := newBackend(t)
+	s, addr := startServer(t, bkd, false)
+	defer s.Close()
+
+	c := dial(t, addr, false)
+	defer c.Close()
+
+	if err := c.Mail("mallory@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, to := range []string{"alice@example.org", "ALIAS@example.org", "bob@verified.example"} {
+		if err := c.Rcpt(to); err != nil {
+			t.Errorf("Rcpt(%q) = %v", to, err)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeData(t, w, testMessage); err != nil {
+		t.Fatal("Cannot send message:", err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Users with several recipient addresses receive a single copy
+	if n := countInbox(t, bkd, "alice"); n != 1 {
+		t.Errorf("alice received %v messages, want 1", n)
+	}
+	if n := countInbox(t, bkd, "bob"); n != 1 {
+		t.Errorf("bob received %v messages, want 1", n)
+	}
+
+	msgs, _, err := bkd.ListMessages("alice", &backend.MessagesFilter{Label: backend.InboxLabel})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) == 1 && msgs[0].Subject != "Hello" {
+		t.Errorf("Received message subject = %q, want %q", msgs[0].Subject, "Hello")
+	}
+}
+
+func TestServer_invalidRecipients(t *testing.T) {
+	bkd := newBackend(t)
+	s, addr := startServer(t, bkd, false)
+	defer s.Close()
+
+	c := dial(t, addr, false)
+	defer c.Close()
+
+	if err := c.Mail("mallory@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct{
+		to string
+		code int
+	}{
+		{"carol@unverified.example", 550},
+		{"someone@example.com", 550},
+		{"nobody@example.org", 550},
+		{"alice", 553},
+	}
+	for _, test := range tests {
+		err := c.Rcpt(test.to)
+		if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != test.code {
+			t.Errorf("Rcpt(%q) = %v, want code %v", test.to, err, test.code)
+		}
+	}
+}
+
+func TestServer_lmtp(t *testing.T) {
+	bkd := newBackend(t)
+	bkd.Set(&failingMessages{ConversationsBackend: bkd.ConversationsBackend, user: "bob"})
+	s, addr := startServer(t, bkd, true)
+	defer s.Close()
+
+	c := dial(t, addr, true)
+	defer c.Close()
+
+	if err := c.Mail("mallory@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	rcpts := []string{"alice@example.org", "alias@example.org", "bob@verified.example"}
+	for _, to := range rcpts {
+		if err := c.Rcpt(to); err != nil {
+			t.Fatalf("Rcpt(%q) = %v", to, err)
+		}
+	}
+
+	statuses := make(map[string]*smtp.SMTPError)
+	w, err := c.LMTPData(func(rcpt string, status *smtp.SMTPError) {
+		statuses[rcpt] = status
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeData(t, w, testMessage)
+
+	// Each recipient gets its own status
+	for _, to := range rcpts {
+		status, ok := statuses[to]
+		if !ok {
+			t.Errorf("No status for %v", to)
+		} else if ok := status == nil; ok != !strings.HasPrefix(to, "bob") {
+			t.Errorf("Status for %v = %v", to, status)
+		}
+	}
+	if status := statuses["bob@verified.example"]; status != nil && status.Code != 451 {
+		t.Errorf("Status for a failed delivery = %v, want code 451", status)
+	}
+
+	if n := countInbox(t, bkd, "alice"); n != 1 {
+		t.Errorf("alice received %v messages, want 1", n)
+	}
+}
+
+func TestServer_cancelDelivery(t *testing.T) {
+	bkd := newBackend(t)
+	atts := &failingAttachments{AttachmentsBackend: bkd.AttachmentsBackend}
+	bkd.Set(atts)
+	s, addr := startServer(t, bkd, false)
+	defer s.Close()
+
+	c := dial(t, addr, false)
+	defer c.Close()
+
+	if err := c.Mail("mallory@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("alice@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeData(t, w, testMessageAttachments)
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 451 {
+		t.Errorf("Sending a message which cannot be delivered = %v, want code 451", err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The partially delivered message is deleted
+	if n := countInbox(t, bkd, "alice"); n != 0 {
+		t.Errorf("alice received %v messages, want none", n)
+	}
+
+	atts.lock.Lock()
+	defer atts.lock.Unlock()
+	if len(atts.inserted) != 1 || len(atts.deleted) != 1 || atts.deleted[0] != atts.inserted[0] {
+		t.Errorf("Inserted attachments %v, deleted %v, want the inserted attachment to be deleted", atts.inserted, atts.deleted)
+	}
+}
@@ -0,0 +1,200 @@
+package smtp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/emersion/neutron/backend"
+	"github.com/emersion/neutron/backend/util/textproto"
+)
+
+var errMalformedMessage = &smtp.SMTPError{
+	Code: 554,
+	EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+	Message: "Malformed message",
+}
+
+var errDeliveryFailed = &smtp.SMTPError{
+	Code: 451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message: "Cannot deliver message, try again later",
+}
+
+type recipient struct {
+	// The address, as specified by the client
+	to string
+	user string
+	address *backend.Address
+}
+
+// A SMTP transaction.
+type session struct {
+	server *Server
+	from string
+	rcpts []*recipient
+}
+
+func (s *session) Reset() {
+	s.from = ""
+	s.rcpts = nil
+}
+
+func (s *session) Logout() error {
+	return nil
+}
+
+func (s *session) Mail(from string, opts smtp.MailOptions) error {
+	s.from = from
+	return nil
+}
+
+func (s *session) Rcpt(to string) error {
+	rcpt, err := s.server.resolve(to)
+	if err != nil {
+		return err
+	}
+
+	s.rcpts = append(s.rcpts, rcpt)
+	return nil
+}
+
+// Encrypt a message and its attachments with a public key.
+func encryptMessage(msg *backend.Message, atts []*textproto.Attachment, publicKey string) error {
+	body, err := backend.EncryptBody(msg.Body, publicKey)
+	if err != nil {
+		return err
+	}
+
+	msg.Body = body
+	msg.IsEncrypted = backend.StoredEncryptedExternal
+
+	for i, att := range atts {
+		encrypted, data, err := backend.EncryptAttachment(att.Attachment, bytes.NewReader(att.Data), publicKey)
+		if err != nil {
+			return err
+		}
+		encrypted.Headers = att.Headers
+		encrypted.Size = len(data)
+
+		atts[i] = &textproto.Attachment{Attachment: encrypted, Data: data}
+		msg.Attachments[i] = encrypted
+	}
+
+	return nil
+}
+
+// Deliver a message to a recipient's inbox.
+func (s *session) deliver(rcpt *recipient, data []byte) error {
+	msg, atts, err := textproto.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return errMalformedMessage
+	}
+
+	msg.Header = "Return-Path: <" + s.from + ">\r\n" + msg.Header
+	msg.AddressID = rcpt.address.ID
+	msg.LabelIDs = []string{backend.InboxLabel}
+	msg.Size = len(data)
+	if msg.Time == 0 {
+		msg.Time = time.Now().Unix()
+	}
+
+	bkd := s.server.backend
+	if s.server.config.EncryptIncoming && msg.IsEncrypted == backend.Unencrypted && bkd.KeysBackend != nil {
+		publicKey, err := bkd.GetPublicKey(rcpt.address.Email)
+		if err != nil {
+			log.Println("WARN: cannot get public key of", rcpt.address.Email, err)
+			return errDeliveryFailed
+		}
+
+		// If the user has no key, keep the message as is
+		if publicKey != "" {
+			if err := encryptMessage(msg, atts, publicKey); err != nil {
+				log.Println("WARN: cannot encrypt incoming message:", err)
+				return errDeliveryFailed
+			}
+		}
+	}
+
+	inserted, err := bkd.InsertMessage(rcpt.user, msg)
+	if err != nil {
+		log.Println("WARN: cannot insert incoming message:", err)
+		return errDeliveryFailed
+	}
+
+	var insertedAtts []string
+	for _, att := range atts {
+		att.MessageID = inserted.ID
+		insertedAtt, err := bkd.InsertAttachment(rcpt.user, att.Attachment, att.Data)
+		if err != nil {
+			log.Println("WARN: cannot insert incoming message attachment:", err)
+			s.cancelDelivery(rcpt.user, inserted.ID, insertedAtts)
+			return errDeliveryFailed
+		}
+		insertedAtts = append(insertedAtts, insertedAtt.ID)
+	}
+
+	return nil
+}
+
+// Delete a partially delivered message, so that the client can retry without
+// the recipient getting an incomplete copy.
+func (s *session) cancelDelivery(user, msgId string, atts []string) {
+	bkd := s.server.backend
+	for _, id := range atts {
+		if err := bkd.DeleteAttachment(user, id); err != nil {
+			log.Println("WARN: cannot delete attachment of partially delivered message:", err)
+		}
+	}
+	if err := bkd.DeleteMessage(user, msgId); err != nil {
+		log.Println("WARN: cannot delete partially delivered message:", err)
+	}
+}
+
+// Deliver the message to all recipients. If delivery fails for one of them,
+// the whole transaction fails and recipients which already received the
+// message may receive it again when the client retries. Users with several
+// recipient addresses receive a single copy.
+func (s *session) Data(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	delivered := make(map[string]bool)
+	for _, rcpt := range s.rcpts {
+		if delivered[rcpt.user] {
+			continue
+		}
+		if err := s.deliver(rcpt, data); err != nil {
+			return err
+		}
+		delivered[rcpt.user] = true
+	}
+	return nil
+}
+
+// Deliver the message to all recipients, with a status for each of them. Users
+// with several recipient addresses receive a single copy, all addresses get
+// its status.
+func (s *session) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	delivered := make(map[string]error)
+	for _, rcpt := range s.rcpts {
+		err, ok := delivered[rcpt.user]
+		if !ok {
+			err = s.deliver(rcpt, data)
+			delivered[rcpt.user] = err
+		}
+		status.SetStatus(rcpt.to, err)
+	}
+	return nil
+}